@@ -2,7 +2,9 @@ package networkControl
 
 // ACL is a model used mainly for Cisco equipment only
 
-import ()
+import (
+	"sort"
+)
 
 type ACLAction int
 
@@ -17,6 +19,26 @@ const (
 	ACLFL_ESTABLISHED = ACLFlags(0x01)
 )
 
+// ACLDirection is the direction of traffic an ACL is bound to (see "access-group ... in|out interface ...")
+type ACLDirection int
+
+const (
+	ACLDIR_IN  = ACLDirection(1)
+	ACLDIR_OUT = ACLDirection(2)
+)
+
+var ACLDirections = []ACLDirection{ACLDIR_IN, ACLDIR_OUT}
+
+func (direction ACLDirection) String() string {
+	switch direction {
+	case ACLDIR_IN:
+		return "in"
+	case ACLDIR_OUT:
+		return "out"
+	}
+	return "unknown"
+}
+
 type ACLRule struct {
 	Action         ACLAction
 	Protocol       Protocol
@@ -30,9 +52,25 @@ type ACLRule struct {
 type ACLRules []ACLRule
 
 type ACL struct {
-	Name      string
-	Rules     ACLRules
+	Name  string
+	Rules ACLRules
+
+	// VLANNames are interfaces the ACL is applied to for incoming traffic
 	VLANNames []string
+
+	// OutVLANNames are interfaces the ACL is applied to for outgoing traffic
+	OutVLANNames []string
+
+	// Priority defines the order of ACLs applied to the same interface: ACLs are checked in ascending order of Priority (and then of Name).
+	//
+	// The rules of the ACLs bound to an interface in a direction are checked as one list in this
+	// order and the first matching rule decides (outgoing ACLs are checked before incoming ones):
+	// "deny" drops the packet, "allow" of an outgoing ACL skips the rest of the outgoing ACLs and
+	// "allow" of an incoming ACL accepts the packet regardless of security levels. A packet not
+	// matched by any rule is checked by security levels.
+	Priority int
+
+	Ownership Ownership
 }
 
 type ACLs []*ACL
@@ -44,3 +82,46 @@ func (a ACLs) Less(i, j int) bool { return a[i].Name < a[j].Name }
 func (acl ACL) KeyStringValue() string {
 	return acl.Name
 }
+func (acl ACL) GetOwnership() Ownership {
+	return acl.Ownership
+}
+func (acl *ACL) SetOwnership(ownership Ownership) {
+	acl.Ownership = ownership
+}
+
+func (acl ACL) GetVLANNames(direction ACLDirection) []string {
+	switch direction {
+	case ACLDIR_IN:
+		return acl.VLANNames
+	case ACLDIR_OUT:
+		return acl.OutVLANNames
+	}
+	return nil
+}
+func (acl *ACL) AddVLANName(direction ACLDirection, vlanName string) {
+	switch direction {
+	case ACLDIR_IN:
+		acl.VLANNames = append(acl.VLANNames, vlanName)
+	case ACLDIR_OUT:
+		acl.OutVLANNames = append(acl.OutVLANNames, vlanName)
+	}
+}
+
+// GetBoundTo returns ACLs applied to the interface in the direction, in the order they're checked (see ACL.Priority)
+func (acls ACLs) GetBoundTo(vlanName string, direction ACLDirection) (result ACLs) {
+	for _, acl := range acls {
+		for _, curVLANName := range acl.GetVLANNames(direction) {
+			if curVLANName == vlanName {
+				result = append(result, acl)
+				break
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Priority != result[j].Priority {
+			return result[i].Priority < result[j].Priority
+		}
+		return result[i].Name < result[j].Name
+	})
+	return
+}
@@ -0,0 +1,174 @@
+package networkControl
+
+import (
+	"fmt"
+)
+
+type ACLIssueType int
+
+const (
+	// the rule is never matched: an earlier rule with the opposite action matches all its packets
+	ACLISSUE_SHADOWED = ACLIssueType(1)
+
+	// the rule could be removed without any effect: an earlier rule with the same action matches all its packets,
+	// or a later rule with the same action does (and there's no rule with the opposite action between them)
+	ACLISSUE_REDUNDANT = ACLIssueType(2)
+
+	// the rule partially overlaps an earlier rule with the opposite action, so the order of the rules matters
+	ACLISSUE_CONTRADICTORY = ACLIssueType(3)
+
+	// the rule allows any traffic from any source to any destination
+	ACLISSUE_TOO_BROAD = ACLIssueType(4)
+)
+
+func (issueType ACLIssueType) String() string {
+	switch issueType {
+	case ACLISSUE_SHADOWED:
+		return "shadowed"
+	case ACLISSUE_REDUNDANT:
+		return "redundant"
+	case ACLISSUE_CONTRADICTORY:
+		return "contradictory"
+	case ACLISSUE_TOO_BROAD:
+		return "too broad"
+	}
+	return "unknown"
+}
+
+// ACLIssue is a problem found in an ACL by ACL.Analyze()
+type ACLIssue struct {
+	Type ACLIssueType
+
+	// RuleIdx is the index of the problem rule in ACL.Rules
+	RuleIdx int
+
+	// RelatedRuleIdx is the index of the rule that causes the problem (or -1 if there's no such rule)
+	RelatedRuleIdx int
+}
+
+type ACLIssues []ACLIssue
+
+func (issue ACLIssue) String() string {
+	if issue.RelatedRuleIdx < 0 {
+		return fmt.Sprintf("rule #%v is %v", issue.RuleIdx, issue.Type)
+	}
+	return fmt.Sprintf("rule #%v is %v (see rule #%v)", issue.RuleIdx, issue.Type, issue.RelatedRuleIdx)
+}
+
+// ContainsRule returns true if the rule matches all packets matched by "subRule"
+func (rule ACLRule) ContainsRule(subRule ACLRule) bool {
+	if rule.Protocol != PROTO_IP && rule.Protocol != subRule.Protocol {
+		return false
+	}
+	if rule.Flags&^subRule.Flags != 0 {
+		return false
+	}
+	if !rule.FromNet.ContainsIPNet(subRule.FromNet) || !rule.ToNet.ContainsIPNet(subRule.ToNet) {
+		return false
+	}
+	if !rule.FromPortRanges.ContainsPortRanges(subRule.FromPortRanges) || !rule.ToPortRanges.ContainsPortRanges(subRule.ToPortRanges) {
+		return false
+	}
+	return true
+}
+
+// Overlaps returns true if there could be a packet matched by both rules
+func (rule ACLRule) Overlaps(compareTo ACLRule) bool {
+	if rule.Protocol != PROTO_IP && compareTo.Protocol != PROTO_IP && rule.Protocol != compareTo.Protocol {
+		return false
+	}
+	if !rule.FromNet.Overlaps(compareTo.FromNet) || !rule.ToNet.Overlaps(compareTo.ToNet) {
+		return false
+	}
+	if !rule.FromPortRanges.Overlaps(compareTo.FromPortRanges) || !rule.ToPortRanges.Overlaps(compareTo.ToPortRanges) {
+		return false
+	}
+	return true
+}
+
+// IsTooBroad returns true if the rule allows anything from anywhere to anywhere
+func (rule ACLRule) IsTooBroad() bool {
+	return rule.Action == ACL_ALLOW && rule.FromNet.IsAny() && rule.ToNet.IsAny()
+}
+
+// Analyze finds rules that are dead, useless or suspicious. Every rule is compared with other rules one by one,
+// so a rule covered only by a union of several rules is not reported.
+func (acl ACL) Analyze() (issues ACLIssues) {
+	rules := acl.Rules
+	isDead := make([]bool, len(rules)) // the rule never matches anything
+	for idx, rule := range rules {
+		for prevIdx := 0; prevIdx < idx; prevIdx++ {
+			if !isDead[prevIdx] && rules[prevIdx].ContainsRule(rule) {
+				isDead[idx] = true
+				break
+			}
+		}
+	}
+
+	for idx, rule := range rules {
+		if rule.IsTooBroad() {
+			issues = append(issues, ACLIssue{Type: ACLISSUE_TOO_BROAD, RuleIdx: idx, RelatedRuleIdx: -1})
+		}
+
+		// checking earlier rules
+
+		if isDead[idx] {
+			for prevIdx := 0; prevIdx < idx; prevIdx++ {
+				prevRule := rules[prevIdx]
+				if isDead[prevIdx] || !prevRule.ContainsRule(rule) {
+					continue
+				}
+				issueType := ACLISSUE_SHADOWED
+				if prevRule.Action == rule.Action {
+					issueType = ACLISSUE_REDUNDANT
+				}
+				issues = append(issues, ACLIssue{Type: issueType, RuleIdx: idx, RelatedRuleIdx: prevIdx})
+				break
+			}
+			continue
+		}
+
+		for prevIdx := 0; prevIdx < idx; prevIdx++ {
+			prevRule := rules[prevIdx]
+			if isDead[prevIdx] || prevRule.Action == rule.Action || !prevRule.Overlaps(rule) {
+				continue
+			}
+			issues = append(issues, ACLIssue{Type: ACLISSUE_CONTRADICTORY, RuleIdx: idx, RelatedRuleIdx: prevIdx})
+		}
+
+		// checking later rules
+
+		for nextIdx := idx + 1; nextIdx < len(rules); nextIdx++ {
+			nextRule := rules[nextIdx]
+			if isDead[nextIdx] {
+				continue
+			}
+			if nextRule.Action != rule.Action {
+				if nextRule.Overlaps(rule) {
+					break
+				}
+				continue
+			}
+			if !nextRule.ContainsRule(rule) {
+				continue
+			}
+			issues = append(issues, ACLIssue{Type: ACLISSUE_REDUNDANT, RuleIdx: idx, RelatedRuleIdx: nextIdx})
+			break
+		}
+	}
+
+	return
+}
+
+// Analyze runs ACL.Analyze() on every ACL, the result is indexed by ACL names (ACLs without issues are omitted)
+func (acls ACLs) Analyze() map[string]ACLIssues {
+	result := map[string]ACLIssues{}
+	for _, acl := range acls {
+		issues := acl.Analyze()
+		if len(issues) == 0 {
+			continue
+		}
+		result[acl.Name] = issues
+	}
+	return result
+}
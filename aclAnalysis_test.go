@@ -0,0 +1,132 @@
+package networkControl
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func newTestACLRule(t *testing.T, action ACLAction, protocol Protocol, fromNet string, toNet string, toPortRanges ...PortRange) ACLRule {
+	rule := ACLRule{Action: action, Protocol: protocol, ToPortRanges: toPortRanges}
+	for _, netRef := range []struct {
+		s     string
+		ipnet *IPNet
+	}{{fromNet, &rule.FromNet}, {toNet, &rule.ToNet}} {
+		if netRef.s == "any" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(netRef.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*netRef.ipnet = IPNet(*ipnet)
+	}
+	return rule
+}
+
+func TestACLAnalyze(t *testing.T) {
+	r := func(action ACLAction, protocol Protocol, fromNet string, toNet string, toPortRanges ...PortRange) ACLRule {
+		return newTestACLRule(t, action, protocol, fromNet, toNet, toPortRanges...)
+	}
+	established := r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "any")
+	established.Flags = ACLFL_ESTABLISHED
+
+	for _, testCase := range []struct {
+		name   string
+		rules  ACLRules
+		issues ACLIssues
+	}{
+		{
+			name: "independent rules",
+			rules: ACLRules{
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "10.0.1.10/32", PortRange{80, 80}),
+				r(ACL_ALLOW, PROTO_UDP, "10.0.0.0/24", "10.0.1.53/32", PortRange{53, 53}),
+			},
+		},
+		{
+			name: "too broad",
+			rules: ACLRules{
+				r(ACL_ALLOW, PROTO_IP, "any", "any"),
+			},
+			issues: ACLIssues{{Type: ACLISSUE_TOO_BROAD, RuleIdx: 0, RelatedRuleIdx: -1}},
+		},
+		{
+			name: "shadowed",
+			rules: ACLRules{
+				r(ACL_DENY, PROTO_IP, "10.0.0.0/16", "any"),
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "any", PortRange{80, 80}),
+			},
+			issues: ACLIssues{{Type: ACLISSUE_SHADOWED, RuleIdx: 1, RelatedRuleIdx: 0}},
+		},
+		{
+			name: "redundant because of an earlier rule",
+			rules: ACLRules{
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/16", "10.0.1.0/24"),
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "10.0.1.10/32", PortRange{443, 443}),
+			},
+			issues: ACLIssues{{Type: ACLISSUE_REDUNDANT, RuleIdx: 1, RelatedRuleIdx: 0}},
+		},
+		{
+			name: "redundant because of a later rule",
+			rules: ACLRules{
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "10.0.1.10/32", PortRange{443, 443}),
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/16", "10.0.1.0/24"),
+			},
+			issues: ACLIssues{{Type: ACLISSUE_REDUNDANT, RuleIdx: 0, RelatedRuleIdx: 1}},
+		},
+		{
+			name: "not redundant because of a rule with the opposite action between",
+			rules: ACLRules{
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "10.0.1.10/32", PortRange{443, 443}),
+				r(ACL_DENY, PROTO_TCP, "10.0.0.5/32", "any"),
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/16", "10.0.1.0/24"),
+			},
+			issues: ACLIssues{
+				{Type: ACLISSUE_CONTRADICTORY, RuleIdx: 1, RelatedRuleIdx: 0},
+				{Type: ACLISSUE_CONTRADICTORY, RuleIdx: 2, RelatedRuleIdx: 1},
+			},
+		},
+		{
+			name: "established packets are a subset of packets of an earlier rule",
+			rules: ACLRules{
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "any"),
+				established,
+			},
+			issues: ACLIssues{{Type: ACLISSUE_REDUNDANT, RuleIdx: 1, RelatedRuleIdx: 0}},
+		},
+		{
+			name: "established packets are a subset of packets of a later rule",
+			rules: ACLRules{
+				established,
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "any"),
+			},
+			issues: ACLIssues{{Type: ACLISSUE_REDUNDANT, RuleIdx: 0, RelatedRuleIdx: 1}},
+		},
+		{
+			name: "different protocols don't overlap",
+			rules: ACLRules{
+				r(ACL_DENY, PROTO_UDP, "10.0.0.0/24", "any"),
+				r(ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "any"),
+			},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			issues := ACL{Name: "test", Rules: testCase.rules}.Analyze()
+			if !reflect.DeepEqual(issues, testCase.issues) {
+				t.Errorf("issues: %v != %v", issues, testCase.issues)
+			}
+		})
+	}
+}
+
+func TestACLsAnalyze(t *testing.T) {
+	acls := ACLs{
+		{Name: "good", Rules: ACLRules{newTestACLRule(t, ACL_ALLOW, PROTO_TCP, "10.0.0.0/24", "10.0.1.0/24")}},
+		{Name: "bad", Rules: ACLRules{newTestACLRule(t, ACL_ALLOW, PROTO_IP, "any", "any")}},
+	}
+	result := acls.Analyze()
+	expected := map[string]ACLIssues{"bad": {{Type: ACLISSUE_TOO_BROAD, RuleIdx: 0, RelatedRuleIdx: -1}}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("issues: %v != %v", result, expected)
+	}
+}
@@ -10,4 +10,5 @@ var (
 	errInvalidArgs    = errors.New("invalid arguments")
 	errNotFound       = errors.New("not found")
 	errNotImplemented = errors.New("not implemented (yet?)")
+	errNotAdopted     = errors.New("the object is not managed by the library, it should be adopted first (see HostI.Adopt())")
 )
@@ -0,0 +1,1059 @@
+package fwsm
+
+// Parsing of FWSM (and ASA) "show running-config" output into networkControl.State
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/xaionaro-go/iscDhcp/cfg"
+	"github.com/xaionaro-go/networkControl"
+)
+
+var (
+	errUnsupported      = errors.New("unsupported command")
+	errInvalidSyntax    = errors.New("invalid syntax")
+	errUnknownName      = errors.New("unknown name or object-group")
+	errUnknownInterface = errors.New("unknown interface")
+)
+
+// Port names known by FWSM but absent in /etc/services (see networkControl.PortFromString)
+var fwsmPortNames = map[string]uint16{
+	"aol":               5190,
+	"citrix-ica":        1494,
+	"ctiqbe":            2748,
+	"cifs":              3020,
+	"h323":              1720,
+	"lotusnotes":        1352,
+	"lpd":               515,
+	"netbios-dgm":       138,
+	"netbios-ns":        137,
+	"netbios-ssn":       139,
+	"pcanywhere-data":   5631,
+	"pcanywhere-status": 5632,
+	"pop2":              109,
+	"pop3":              110,
+	"rsh":               514,
+	"secureid-udp":      5510,
+	"sqlnet":            1521,
+}
+
+// UnparsedLine is a line of the config that was skipped by ParseConfig
+type UnparsedLine struct {
+	LineNum int
+	Line    string
+	Reason  string
+}
+
+type UnparsedLines []UnparsedLine
+
+func (line UnparsedLine) String() string {
+	return fmt.Sprintf("line %v: \"%v\": %v", line.LineNum, line.Line, line.Reason)
+}
+
+type configLine struct {
+	num   int
+	raw   string
+	words []string
+}
+
+type configCommand struct {
+	configLine
+	children []configLine
+}
+
+type serviceGroup struct {
+	protocols  []networkControl.Protocol
+	portRanges networkControl.PortRanges
+}
+
+type dhcpAddress struct {
+	configLine
+	ifName string
+	subnet *cfg.Subnet
+}
+
+type natSource struct {
+	configLine
+	globalId int
+	source   networkControl.SNATSource
+}
+
+type configParser struct {
+	state    networkControl.State
+	unparsed UnparsedLines
+
+	names          map[string]net.IP
+	networkGroups  map[string]networkControl.IPNets
+	serviceGroups  map[string]serviceGroup
+	protocolGroups map[string][]networkControl.Protocol
+
+	currentLine   configLine
+	acls          map[string]*networkControl.ACL
+	natSources    []natSource
+	dhcpAddresses []dhcpAddress
+}
+
+// ParseConfig parses the output of "show running-config" into a State. Lines which couldn't be
+// represented in the State are skipped and returned as "unparsed".
+func ParseConfig(config string) (state networkControl.State, unparsed UnparsedLines) {
+	parser := configParser{
+		names:          map[string]net.IP{},
+		networkGroups:  map[string]networkControl.IPNets{},
+		serviceGroups:  map[string]serviceGroup{},
+		protocolGroups: map[string][]networkControl.Protocol{},
+		acls:           map[string]*networkControl.ACL{},
+	}
+	parser.state.BridgedVLANs = networkControl.VLANs{}
+	parser.state.DHCP = *networkControl.NewDHCP()
+
+	commands := parser.splitCommands(config)
+
+	// "name"-s and object-groups could be used by any command, so they're collected first
+
+	for _, command := range commands {
+		switch command.words[0] {
+		case "name":
+			parser.try(command.configLine, func() error { return parser.parseName(command.words) })
+		case "object-group":
+			parser.parseObjectGroup(command)
+		}
+	}
+
+	for _, command := range commands {
+		switch command.words[0] {
+		case "name", "object-group":
+		case "FWSM", "ASA", "names", "description", "hostname", "domain-name":
+		case "interface":
+			parser.parseInterface(command)
+		default:
+			parser.try(command.configLine, func() error { return parser.parseCommand(command.words) })
+			for _, child := range command.children {
+				parser.addUnparsed(child, errUnsupported)
+			}
+		}
+	}
+
+	parser.finalize()
+
+	return parser.state, parser.unparsed
+}
+
+func (parser *configParser) splitCommands(config string) (commands []*configCommand) {
+	for idx, raw := range strings.Split(config, "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		words := strings.Fields(raw)
+		if len(words) == 0 || strings.HasPrefix(words[0], "!") || strings.HasPrefix(words[0], ":") {
+			continue
+		}
+		line := configLine{num: idx + 1, raw: raw, words: words}
+		if raw[0] == ' ' {
+			if len(commands) == 0 {
+				parser.addUnparsed(line, errInvalidSyntax)
+				continue
+			}
+			lastCommand := commands[len(commands)-1]
+			lastCommand.children = append(lastCommand.children, line)
+			continue
+		}
+		commands = append(commands, &configCommand{configLine: line})
+	}
+	return
+}
+
+func (parser *configParser) addUnparsed(line configLine, err error) {
+	parser.unparsed = append(parser.unparsed, UnparsedLine{LineNum: line.num, Line: strings.TrimSpace(line.raw), Reason: err.Error()})
+}
+
+// try calls "fn" and records the line as unparsed if "fn" failed (networkControl.PortFromString and others panic on invalid input)
+func (parser *configParser) try(line configLine, fn func() error) {
+	parser.currentLine = line
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		return fn()
+	}()
+	if err != nil {
+		parser.addUnparsed(line, err)
+	}
+}
+
+func (parser *configParser) parseCommand(words []string) error {
+	switch words[0] {
+	case "mtu":
+		return parser.parseMTU(words)
+	case "same-security-traffic":
+		return parser.parseSameSecurityTraffic(words)
+	case "access-list":
+		return parser.parseAccessList(words)
+	case "access-group":
+		return parser.parseAccessGroup(words)
+	case "global":
+		return parser.parseGlobal(words)
+	case "nat":
+		return parser.parseNAT(words)
+	case "static":
+		return parser.parseStatic(words)
+	case "route":
+		return parser.parseRoute(words)
+	case "dhcpd":
+		return parser.parseDHCPd(words)
+	}
+	return errUnsupported
+}
+
+func (parser *configParser) finalize() {
+	// "nat" binds sources to all "global"-s with the same id
+
+	for _, source := range parser.natSources {
+		isFound := false
+		for _, snat := range parser.state.SNATs {
+			if snat.FWSMGlobalId != source.globalId {
+				continue
+			}
+			snat.Sources = append(snat.Sources, source.source)
+			isFound = true
+		}
+		if !isFound {
+			parser.addUnparsed(source.configLine, fmt.Errorf("there's no \"global\" with id %v", source.globalId))
+		}
+	}
+
+	// "dhcpd address" defines a range only, the subnet is the network of the interface
+
+	dhcpRoot := (*cfg.Root)(&parser.state.DHCP)
+	for _, address := range parser.dhcpAddresses {
+		vlan := parser.getVLAN(address.ifName)
+		if vlan == nil || len(vlan.IPs) == 0 {
+			parser.addUnparsed(address.configLine, errUnknownInterface)
+			continue
+		}
+		ip := vlan.IPs[0]
+		address.subnet.Network = net.IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask}
+		dhcpRoot.Subnets[address.subnet.Network.String()] = address.subnet
+	}
+}
+
+func (parser *configParser) getVLAN(ifName string) *networkControl.VLAN {
+	for _, vlan := range parser.state.BridgedVLANs {
+		if vlan.Name == ifName {
+			return vlan
+		}
+	}
+	return nil
+}
+
+func (parser *configParser) getACL(aclName string) *networkControl.ACL {
+	acl := parser.acls[aclName]
+	if acl == nil {
+		acl = &networkControl.ACL{Name: aclName}
+		parser.acls[aclName] = acl
+		parser.state.ACLs = append(parser.state.ACLs, acl)
+	}
+	return acl
+}
+
+// Addresses, ports and protocols
+
+func parseMask(maskStr string) (net.IPMask, error) {
+	mask := net.ParseIP(maskStr).To4()
+	if mask == nil {
+		return nil, fmt.Errorf("invalid mask: %v", maskStr)
+	}
+	return net.IPMask(mask), nil
+}
+
+func (parser *configParser) parseIP(ipStr string) (net.IP, error) {
+	if ip, ok := parser.names[ipStr]; ok {
+		return ip, nil
+	}
+	ip := net.ParseIP(ipStr).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%v: %v", errUnknownName, ipStr)
+	}
+	return ip, nil
+}
+
+func (parser *configParser) parseIPNet(ipStr, maskStr string) (ipnet networkControl.IPNet, err error) {
+	ipnet.IP, err = parser.parseIP(ipStr)
+	if err != nil {
+		return
+	}
+	ipnet.Mask, err = parseMask(maskStr)
+	if err != nil {
+		return
+	}
+	ipnet.IP = ipnet.IP.Mask(ipnet.Mask)
+	return
+}
+
+func hostIPNet(ip net.IP) networkControl.IPNet {
+	return networkControl.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+}
+
+func anyIPNet() networkControl.IPNet {
+	return networkControl.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
+
+// parseAddress parses "any", "host IP", "IP MASK" or "object-group NAME"
+func (parser *configParser) parseAddress(words []string) (ipnets networkControl.IPNets, rest []string, err error) {
+	if len(words) == 0 {
+		return nil, nil, errInvalidSyntax
+	}
+	switch words[0] {
+	case "any", "any4":
+		return networkControl.IPNets{anyIPNet()}, words[1:], nil
+	case "host":
+		if len(words) < 2 {
+			return nil, nil, errInvalidSyntax
+		}
+		ip, err := parser.parseIP(words[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return networkControl.IPNets{hostIPNet(ip)}, words[2:], nil
+	case "object-group":
+		if len(words) < 2 {
+			return nil, nil, errInvalidSyntax
+		}
+		group, ok := parser.networkGroups[words[1]]
+		if !ok {
+			return nil, nil, fmt.Errorf("%v: %v", errUnknownName, words[1])
+		}
+		return group, words[2:], nil
+	case "interface", "object":
+		return nil, nil, fmt.Errorf("%v: %v", errUnsupported, words[0])
+	}
+	if len(words) < 2 {
+		return nil, nil, errInvalidSyntax
+	}
+	ipnet, err := parser.parseIPNet(words[0], words[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return networkControl.IPNets{ipnet}, words[2:], nil
+}
+
+func parsePort(portStr string) uint16 {
+	if port, ok := fwsmPortNames[portStr]; ok {
+		return port
+	}
+	return networkControl.PortFromString(portStr)
+}
+
+// parsePortRanges parses "eq P", "neq P", "lt P", "gt P", "range P P" or "object-group NAME" (of a service group).
+// If there's no port specification then "rest" is just "words".
+func (parser *configParser) parsePortRanges(words []string) (portRanges networkControl.PortRanges, rest []string, err error) {
+	if len(words) == 0 {
+		return nil, words, nil
+	}
+	switch words[0] {
+	case "eq", "neq", "lt", "gt":
+		if len(words) < 2 {
+			return nil, nil, errInvalidSyntax
+		}
+		port := parsePort(words[1])
+		switch words[0] {
+		case "eq":
+			portRanges = networkControl.PortRanges{{Start: port, End: port}}
+		case "neq":
+			if port > 0 {
+				portRanges = append(portRanges, networkControl.PortRange{Start: 0, End: port - 1})
+			}
+			if port < 65535 {
+				portRanges = append(portRanges, networkControl.PortRange{Start: port + 1, End: 65535})
+			}
+		case "lt":
+			if port == 0 {
+				return nil, nil, errInvalidSyntax
+			}
+			portRanges = networkControl.PortRanges{{Start: 0, End: port - 1}}
+		case "gt":
+			if port == 65535 {
+				return nil, nil, errInvalidSyntax
+			}
+			portRanges = networkControl.PortRanges{{Start: port + 1, End: 65535}}
+		}
+		return portRanges, words[2:], nil
+	case "range":
+		if len(words) < 3 {
+			return nil, nil, errInvalidSyntax
+		}
+		return networkControl.PortRanges{{Start: parsePort(words[1]), End: parsePort(words[2])}}, words[3:], nil
+	case "object-group":
+		if len(words) < 2 {
+			return nil, nil, errInvalidSyntax
+		}
+		group, ok := parser.serviceGroups[words[1]]
+		if !ok {
+			// it's not a service group, so it's not a port specification
+			return nil, words, nil
+		}
+		return group.portRanges, words[2:], nil
+	}
+	return nil, words, nil
+}
+
+func parseProtocol(protocolStr string) networkControl.Protocol {
+	if protocolNumber, err := strconv.Atoi(protocolStr); err == nil {
+		return networkControl.Protocol(protocolNumber)
+	}
+	return networkControl.ProtocolFromString(protocolStr)
+}
+
+func (parser *configParser) parseProtocols(protocolStr string, words []string) (protocols []networkControl.Protocol, rest []string, err error) {
+	if protocolStr != "object-group" {
+		return []networkControl.Protocol{parseProtocol(protocolStr)}, words, nil
+	}
+	if len(words) == 0 {
+		return nil, nil, errInvalidSyntax
+	}
+	protocols, ok := parser.protocolGroups[words[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("%v: %v", errUnknownName, words[0])
+	}
+	return protocols, words[1:], nil
+}
+
+// name / object-group
+
+func (parser *configParser) parseName(words []string) error {
+	// name IP NAME [description TEXT]
+	if len(words) < 3 {
+		return errInvalidSyntax
+	}
+	ip := net.ParseIP(words[1]).To4()
+	if ip == nil {
+		return errInvalidSyntax
+	}
+	parser.names[words[2]] = ip
+	return nil
+}
+
+func (parser *configParser) parseObjectGroup(command *configCommand) {
+	// object-group network|service|protocol NAME [tcp|udp|tcp-udp]
+	words := command.words
+	if len(words) < 3 {
+		parser.addUnparsed(command.configLine, errInvalidSyntax)
+		return
+	}
+	groupName := words[2]
+
+	switch words[1] {
+	case "network":
+		group := networkControl.IPNets{}
+		for _, child := range command.children {
+			parser.try(child, func() error {
+				switch child.words[0] {
+				case "description":
+					return nil
+				case "network-object":
+					ipnets, rest, err := parser.parseAddress(child.words[1:])
+					if err != nil {
+						return err
+					}
+					if len(rest) != 0 {
+						return errInvalidSyntax
+					}
+					group = append(group, ipnets...)
+					return nil
+				case "group-object":
+					if len(child.words) != 2 {
+						return errInvalidSyntax
+					}
+					subGroup, ok := parser.networkGroups[child.words[1]]
+					if !ok {
+						return fmt.Errorf("%v: %v", errUnknownName, child.words[1])
+					}
+					group = append(group, subGroup...)
+					return nil
+				}
+				return errUnsupported
+			})
+		}
+		parser.networkGroups[groupName] = group
+
+	case "service":
+		if len(words) < 4 {
+			parser.addUnparsed(command.configLine, fmt.Errorf("%v: a service object-group without a protocol", errUnsupported))
+			return
+		}
+		group := serviceGroup{}
+		switch words[3] {
+		case "tcp":
+			group.protocols = []networkControl.Protocol{networkControl.PROTO_TCP}
+		case "udp":
+			group.protocols = []networkControl.Protocol{networkControl.PROTO_UDP}
+		case "tcp-udp":
+			group.protocols = []networkControl.Protocol{networkControl.PROTO_TCP, networkControl.PROTO_UDP}
+		default:
+			parser.addUnparsed(command.configLine, errInvalidSyntax)
+			return
+		}
+		for _, child := range command.children {
+			parser.try(child, func() error {
+				switch child.words[0] {
+				case "description":
+					return nil
+				case "port-object":
+					portRanges, rest, err := parser.parsePortRanges(child.words[1:])
+					if err != nil {
+						return err
+					}
+					if len(portRanges) == 0 || len(rest) != 0 {
+						return errInvalidSyntax
+					}
+					group.portRanges = append(group.portRanges, portRanges...)
+					return nil
+				case "group-object":
+					if len(child.words) != 2 {
+						return errInvalidSyntax
+					}
+					subGroup, ok := parser.serviceGroups[child.words[1]]
+					if !ok {
+						return fmt.Errorf("%v: %v", errUnknownName, child.words[1])
+					}
+					group.portRanges = append(group.portRanges, subGroup.portRanges...)
+					return nil
+				}
+				return errUnsupported
+			})
+		}
+		parser.serviceGroups[groupName] = group
+
+	case "protocol":
+		var group []networkControl.Protocol
+		for _, child := range command.children {
+			parser.try(child, func() error {
+				switch child.words[0] {
+				case "description":
+					return nil
+				case "protocol-object":
+					if len(child.words) != 2 {
+						return errInvalidSyntax
+					}
+					group = append(group, parseProtocol(child.words[1]))
+					return nil
+				case "group-object":
+					if len(child.words) != 2 {
+						return errInvalidSyntax
+					}
+					subGroup, ok := parser.protocolGroups[child.words[1]]
+					if !ok {
+						return fmt.Errorf("%v: %v", errUnknownName, child.words[1])
+					}
+					group = append(group, subGroup...)
+					return nil
+				}
+				return errUnsupported
+			})
+		}
+		parser.protocolGroups[groupName] = group
+
+	default:
+		parser.addUnparsed(command.configLine, errUnsupported)
+		for _, child := range command.children {
+			parser.addUnparsed(child, errUnsupported)
+		}
+	}
+}
+
+// interface
+
+func (parser *configParser) parseInterface(command *configCommand) {
+	// interface VlanN
+	if len(command.words) != 2 {
+		parser.addUnparsed(command.configLine, errInvalidSyntax)
+		return
+	}
+	vlan := networkControl.VLAN{VlanId: -1}
+	if strings.HasPrefix(command.words[1], "Vlan") {
+		vlanId, err := strconv.Atoi(strings.TrimPrefix(command.words[1], "Vlan"))
+		if err == nil {
+			vlan.VlanId = vlanId
+		}
+	}
+
+	for _, child := range command.children {
+		parser.try(child, func() error {
+			words := child.words
+			switch words[0] {
+			case "description":
+				return nil
+			case "nameif":
+				if len(words) != 2 {
+					return errInvalidSyntax
+				}
+				vlan.Name = words[1]
+				return nil
+			case "vlan":
+				if len(words) != 2 {
+					return errInvalidSyntax
+				}
+				vlanId, err := strconv.Atoi(words[1])
+				if err != nil {
+					return err
+				}
+				vlan.VlanId = vlanId
+				return nil
+			case "security-level":
+				if len(words) != 2 {
+					return errInvalidSyntax
+				}
+				securityLevel, err := strconv.Atoi(words[1])
+				if err != nil {
+					return err
+				}
+				vlan.SecurityLevel = securityLevel
+				return nil
+			case "ip":
+				// ip address IP MASK [standby IP]
+				if len(words) < 4 || words[1] != "address" {
+					return errUnsupported
+				}
+				ip, err := parser.parseIP(words[2])
+				if err != nil {
+					return err
+				}
+				mask, err := parseMask(words[3])
+				if err != nil {
+					return err
+				}
+				vlan.IPs = append(vlan.IPs, networkControl.IPNet{IP: ip, Mask: mask})
+				return nil
+			case "no":
+				// "no nameif", "no security-level", "no ip address" are defaults
+				if len(words) >= 2 && (words[1] == "nameif" || words[1] == "security-level" || words[1] == "ip") {
+					return nil
+				}
+			}
+			return errUnsupported
+		})
+	}
+
+	if vlan.VlanId < 0 {
+		parser.addUnparsed(command.configLine, fmt.Errorf("%v: cannot determine the VLAN ID", errUnsupported))
+		return
+	}
+	parser.state.BridgedVLANs[vlan.VlanId] = &vlan
+}
+
+func (parser *configParser) parseMTU(words []string) error {
+	// mtu IFNAME MTU
+	if len(words) != 3 {
+		return errInvalidSyntax
+	}
+	vlan := parser.getVLAN(words[1])
+	if vlan == nil {
+		return errUnknownInterface
+	}
+	mtu, err := strconv.Atoi(words[2])
+	if err != nil {
+		return err
+	}
+	vlan.MTU = mtu
+	return nil
+}
+
+func (parser *configParser) parseSameSecurityTraffic(words []string) error {
+	// same-security-traffic permit inter-interface|intra-interface
+	if len(words) != 3 || words[1] != "permit" {
+		return errInvalidSyntax
+	}
+	switch words[2] {
+	case "inter-interface":
+		parser.state.PermitInterInterface = true
+	case "intra-interface":
+		parser.state.PermitIntraInterface = true
+	default:
+		return errInvalidSyntax
+	}
+	return nil
+}
+
+// access-list / access-group
+
+func (parser *configParser) parseAccessList(words []string) error {
+	// access-list NAME [line N] [extended] permit|deny PROTOCOL SRC [SRC_PORTS] DST [DST_PORTS] [log ...] [inactive]
+	if len(words) < 3 {
+		return errInvalidSyntax
+	}
+	acl := parser.getACL(words[1])
+	words = words[2:]
+
+	if words[0] == "line" {
+		if len(words) < 3 {
+			return errInvalidSyntax
+		}
+		words = words[2:]
+	}
+	switch words[0] {
+	case "remark":
+		return nil
+	case "extended":
+		words = words[1:]
+	case "permit", "deny":
+	default:
+		return errUnsupported
+	}
+	if len(words) < 4 {
+		return errInvalidSyntax
+	}
+
+	var action networkControl.ACLAction
+	switch words[0] {
+	case "permit":
+		action = networkControl.ACL_ALLOW
+	case "deny":
+		action = networkControl.ACL_DENY
+	default:
+		return errInvalidSyntax
+	}
+
+	protocols, words, err := parser.parseProtocols(words[1], words[2:])
+	if err != nil {
+		return err
+	}
+	fromNets, words, err := parser.parseAddress(words)
+	if err != nil {
+		return err
+	}
+	fromPortRanges, words, err := parser.parsePortRanges(words)
+	if err != nil {
+		return err
+	}
+	toNets, words, err := parser.parseAddress(words)
+	if err != nil {
+		return err
+	}
+	toPortRanges, words, err := parser.parsePortRanges(words)
+	if err != nil {
+		return err
+	}
+
+	isInactive := false
+	for idx := 0; idx < len(words); idx++ {
+		switch words[idx] {
+		case "log":
+			// "log [LEVEL] [interval N]" doesn't change the filtering
+			for idx+1 < len(words) && words[idx+1] != "inactive" {
+				idx++
+			}
+		case "inactive":
+			isInactive = true
+		default:
+			return fmt.Errorf("%v: %v", errUnsupported, words[idx])
+		}
+	}
+	if isInactive {
+		return nil
+	}
+
+	for _, protocol := range protocols {
+		for _, fromNet := range fromNets {
+			for _, toNet := range toNets {
+				acl.Rules = append(acl.Rules, networkControl.ACLRule{
+					Action:         action,
+					Protocol:       protocol,
+					FromNet:        fromNet,
+					FromPortRanges: fromPortRanges,
+					ToNet:          toNet,
+					ToPortRanges:   toPortRanges,
+				})
+			}
+		}
+	}
+	return nil
+}
+
+func (parser *configParser) parseAccessGroup(words []string) error {
+	// access-group NAME in|out interface IFNAME
+	if len(words) < 5 || words[3] != "interface" {
+		return errUnsupported
+	}
+	acl := parser.acls[words[1]]
+	if acl == nil {
+		return fmt.Errorf("%v: %v", errUnknownName, words[1])
+	}
+	if parser.getVLAN(words[4]) == nil {
+		return errUnknownInterface
+	}
+	switch words[2] {
+	case "in":
+		acl.AddVLANName(networkControl.ACLDIR_IN, words[4])
+	case "out":
+		acl.AddVLANName(networkControl.ACLDIR_OUT, words[4])
+	default:
+		return errInvalidSyntax
+	}
+	return nil
+}
+
+// global / nat / static
+
+// parseInterfacesPair parses "(IFNAME)" or "(IFNAME,IFNAME)"
+func parseInterfacesPair(word string) []string {
+	if !strings.HasPrefix(word, "(") || !strings.HasSuffix(word, ")") {
+		return nil
+	}
+	return strings.Split(word[1:len(word)-1], ",")
+}
+
+func (parser *configParser) parseGlobal(words []string) error {
+	// global (IFNAME) ID IP|interface [netmask MASK]
+	if len(words) < 4 {
+		return errInvalidSyntax
+	}
+	ifNames := parseInterfacesPair(words[1])
+	if len(ifNames) != 1 {
+		return errInvalidSyntax
+	}
+	globalId, err := strconv.Atoi(words[2])
+	if err != nil {
+		return err
+	}
+
+	var natTo net.IP
+	switch {
+	case words[3] == "interface":
+		vlan := parser.getVLAN(ifNames[0])
+		if vlan == nil || len(vlan.IPs) == 0 {
+			return errUnknownInterface
+		}
+		natTo = vlan.IPs[0].IP
+	case strings.Contains(words[3], "-"):
+		return fmt.Errorf("%v: address pools", errUnsupported)
+	default:
+		natTo, err = parser.parseIP(words[3])
+		if err != nil {
+			return err
+		}
+	}
+
+	parser.state.SNATs = append(parser.state.SNATs, &networkControl.SNAT{
+		NATTo:        natTo,
+		FWSMGlobalId: globalId,
+	})
+	return nil
+}
+
+func (parser *configParser) parseNAT(words []string) error {
+	// nat (IFNAME) ID IP MASK [options]
+	if len(words) < 5 {
+		return errInvalidSyntax
+	}
+	ifNames := parseInterfacesPair(words[1])
+	if len(ifNames) != 1 {
+		return errInvalidSyntax
+	}
+	globalId, err := strconv.Atoi(words[2])
+	if err != nil {
+		return err
+	}
+	if globalId == 0 {
+		return fmt.Errorf("%v: NAT exemption", errUnsupported)
+	}
+	if words[3] == "access-list" {
+		return fmt.Errorf("%v: policy NAT", errUnsupported)
+	}
+	ipnet, err := parser.parseIPNet(words[3], words[4])
+	if err != nil {
+		return err
+	}
+
+	parser.natSources = append(parser.natSources, natSource{
+		configLine: parser.currentLine,
+		globalId:   globalId,
+		source:     networkControl.SNATSource{IPNet: ipnet, IfName: ifNames[0]},
+	})
+	return nil
+}
+
+func (parser *configParser) parseStatic(words []string) error {
+	// static (REAL_IFNAME,MAPPED_IFNAME) [tcp|udp MAPPED_IP MAPPED_PORT REAL_IP REAL_PORT | MAPPED_IP REAL_IP] [netmask MASK] [options]
+	if len(words) < 4 {
+		return errInvalidSyntax
+	}
+	ifNames := parseInterfacesPair(words[1])
+	if len(ifNames) != 2 {
+		return errInvalidSyntax
+	}
+	words = words[2:]
+
+	var protocol *networkControl.Protocol
+	if words[0] == "tcp" || words[0] == "udp" {
+		protocolValue := networkControl.ProtocolFromString(words[0])
+		protocol = &protocolValue
+		words = words[1:]
+	}
+
+	parseIPPort := func() (ipport networkControl.IPPort, err error) {
+		if len(words) == 0 {
+			return ipport, errInvalidSyntax
+		}
+		ipport.Protocol = protocol
+		if words[0] == "interface" {
+			vlan := parser.getVLAN(ifNames[1])
+			if vlan == nil || len(vlan.IPs) == 0 {
+				return ipport, errUnknownInterface
+			}
+			ipport.IP = vlan.IPs[0].IP
+		} else {
+			ipport.IP, err = parser.parseIP(words[0])
+			if err != nil {
+				return
+			}
+		}
+		words = words[1:]
+		if protocol != nil {
+			if len(words) == 0 {
+				return ipport, errInvalidSyntax
+			}
+			port := parsePort(words[0])
+			ipport.Port = &port
+			words = words[1:]
+		}
+		return
+	}
+
+	mappedIPPort, err := parseIPPort()
+	if err != nil {
+		return err
+	}
+	if len(words) > 0 && words[0] == "access-list" {
+		return fmt.Errorf("%v: policy static", errUnsupported)
+	}
+	realIPPort, err := parseIPPort()
+	if err != nil {
+		return err
+	}
+	if len(words) >= 2 && words[0] == "netmask" {
+		if words[1] != "255.255.255.255" {
+			return fmt.Errorf("%v: network statics", errUnsupported)
+		}
+		words = words[2:]
+	}
+	// the rest are connection limits and similar options, they don't change the translation
+
+	parser.state.DNATs = append(parser.state.DNATs, &networkControl.DNAT{
+		Destinations: networkControl.IPPorts{mappedIPPort},
+		NATTo:        realIPPort,
+		IfName:       ifNames[1],
+	})
+	return nil
+}
+
+// route
+
+func (parser *configParser) parseRoute(words []string) error {
+	// route IFNAME NET MASK GATEWAY [METRIC]
+	if len(words) < 5 {
+		return errInvalidSyntax
+	}
+	destination, err := parser.parseIPNet(words[2], words[3])
+	if err != nil {
+		return err
+	}
+	gateway, err := parser.parseIP(words[4])
+	if err != nil {
+		return err
+	}
+	metric := 1
+	if len(words) > 5 {
+		metric, err = strconv.Atoi(words[5])
+		if err != nil {
+			return err
+		}
+	}
+	if len(words) > 6 {
+		return fmt.Errorf("%v: %v", errUnsupported, words[6])
+	}
+
+	parser.state.Routes = append(parser.state.Routes, &networkControl.Route{
+		Destination: destination,
+		Gateway:     gateway,
+		Metric:      metric,
+		IfName:      words[1],
+	})
+	return nil
+}
+
+// dhcpd
+
+func (parser *configParser) parseDHCPd(words []string) error {
+	if len(words) < 3 {
+		return errInvalidSyntax
+	}
+	dhcpRoot := (*cfg.Root)(&parser.state.DHCP)
+
+	switch words[1] {
+	case "address":
+		// dhcpd address IP-IP IFNAME
+		if len(words) != 4 {
+			return errInvalidSyntax
+		}
+		ipRange := strings.Split(words[2], "-")
+		if len(ipRange) != 2 {
+			return errInvalidSyntax
+		}
+		start, err := parser.parseIP(ipRange[0])
+		if err != nil {
+			return err
+		}
+		end, err := parser.parseIP(ipRange[1])
+		if err != nil {
+			return err
+		}
+		parser.dhcpAddresses = append(parser.dhcpAddresses, dhcpAddress{
+			configLine: parser.currentLine,
+			ifName:     words[3],
+			subnet:     &cfg.Subnet{Range: cfg.Range{Start: start, End: end}},
+		})
+		return nil
+
+	case "dns":
+		// dhcpd dns IP [IP]
+		for _, ipStr := range words[2:] {
+			ip, err := parser.parseIP(ipStr)
+			if err != nil {
+				return err
+			}
+			dhcpRoot.Options.DomainNameServers = append(dhcpRoot.Options.DomainNameServers, net.NS{Host: ip.String()})
+		}
+		return nil
+
+	case "domain":
+		// dhcpd domain DOMAIN
+		if len(words) != 3 {
+			return errInvalidSyntax
+		}
+		dhcpRoot.Options.Domain = words[2]
+		return nil
+
+	case "option":
+		// dhcpd option 3 ip IP [IP]
+		if len(words) < 5 || words[2] != "3" || words[3] != "ip" {
+			return errUnsupported
+		}
+		for _, ipStr := range words[4:] {
+			ip, err := parser.parseIP(ipStr)
+			if err != nil {
+				return err
+			}
+			dhcpRoot.Options.Routers = append(dhcpRoot.Options.Routers, ip)
+		}
+		return nil
+
+	case "enable":
+		// "dhcpd address" is enough to serve the interface
+		return nil
+	}
+
+	return errUnsupported
+}
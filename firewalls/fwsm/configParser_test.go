@@ -0,0 +1,248 @@
+package fwsm
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xaionaro-go/iscDhcp/cfg"
+	"github.com/xaionaro-go/networkControl"
+)
+
+var sampleRunningConfig = []string{
+	": Saved",
+	":",
+	"FWSM Version 4.1(5) <context>",
+	"!",
+	"hostname fw1",
+	"names",
+	"name 10.0.1.10 web description web server",
+	"!",
+	"interface Vlan10",
+	" nameif inside",
+	" security-level 100",
+	" ip address 10.0.0.1 255.255.255.0",
+	"!",
+	"interface Vlan20",
+	" nameif dmz",
+	" security-level 50",
+	" ip address 10.0.1.1 255.255.255.0",
+	"!",
+	"interface Vlan30",
+	" nameif outside",
+	" security-level 0",
+	" ip address 192.0.2.1 255.255.255.0 standby 192.0.2.2",
+	"!",
+	"same-security-traffic permit inter-interface",
+	"object-group network servers",
+	" description public servers",
+	" network-object host web",
+	" network-object 10.0.1.32 255.255.255.224",
+	"object-group service web-ports tcp",
+	" port-object eq www",
+	" port-object range 8080 8081",
+	"object-group protocol dns-protocols",
+	" protocol-object tcp",
+	" protocol-object udp",
+	"access-list outside_in remark public services",
+	"access-list outside_in extended permit tcp any object-group servers object-group web-ports",
+	"access-list outside_in extended permit object-group dns-protocols any host web eq domain",
+	"access-list outside_in extended permit tcp any host web gt 60000 log 6 interval 300",
+	"access-list outside_in extended deny tcp 198.51.100.0 255.255.255.0 lt 1024 any",
+	"access-list outside_in extended permit icmp any any inactive",
+	"access-list outside_in extended deny ip any any",
+	"access-list dmz_out extended permit tcp 10.0.0.0 255.255.255.0 any neq telnet",
+	"access-list dmz_out extended permit tcp any object-group unknown",
+	"access-group outside_in in interface outside",
+	"access-group dmz_out out interface dmz",
+	"mtu inside 1500",
+	"mtu outside 1500",
+	"logging enable",
+	"global (outside) 1 interface",
+	"nat (inside) 0 access-list nonat",
+	"nat (inside) 1 10.0.0.0 255.255.255.0",
+	"static (dmz,outside) tcp interface www web www netmask 255.255.255.255",
+	"static (dmz,outside) 192.0.2.20 10.0.1.20 netmask 255.255.255.255",
+	"route outside 0.0.0.0 0.0.0.0 192.0.2.254 1",
+	"route inside 172.16.0.0 255.240.0.0 10.0.0.254 10",
+	"dhcpd address 10.0.0.100-10.0.0.199 inside",
+	"dhcpd dns 10.0.1.53",
+	"dhcpd domain example.org",
+	"dhcpd option 3 ip 10.0.0.1",
+	"dhcpd enable inside",
+	": end",
+}
+
+// sampleLineNum returns the number of the line of sampleRunningConfig
+func sampleLineNum(t *testing.T, line string) int {
+	for idx, sampleLine := range sampleRunningConfig {
+		if sampleLine == line {
+			return idx + 1
+		}
+	}
+	t.Fatalf("there's no line \"%v\" in the sample config", line)
+	return 0
+}
+
+func ip4(s string) net.IP {
+	return net.ParseIP(s).To4()
+}
+
+func ipnet4(ip string, prefixLen int) networkControl.IPNet {
+	return networkControl.IPNet{IP: ip4(ip), Mask: net.CIDRMask(prefixLen, 32)}
+}
+
+func TestParseConfig(t *testing.T) {
+	state, unparsed := ParseConfig(strings.Join(sampleRunningConfig, "\n"))
+
+	expectedUnparsed := UnparsedLines{
+		{LineNum: sampleLineNum(t, "access-list dmz_out extended permit tcp any object-group unknown"), Line: "access-list dmz_out extended permit tcp any object-group unknown", Reason: "unknown name or object-group: unknown"},
+		{LineNum: sampleLineNum(t, "logging enable"), Line: "logging enable", Reason: "unsupported command"},
+		{LineNum: sampleLineNum(t, "nat (inside) 0 access-list nonat"), Line: "nat (inside) 0 access-list nonat", Reason: "unsupported command: NAT exemption"},
+	}
+	if !reflect.DeepEqual(unparsed, expectedUnparsed) {
+		t.Errorf("unparsed lines:\n%v\n!=\n%v", unparsed, expectedUnparsed)
+	}
+
+	expectedVLANs := networkControl.VLANs{
+		10: {Interface: net.Interface{Name: "inside", MTU: 1500}, VlanId: 10, SecurityLevel: 100, IPs: networkControl.IPNets{ipnet4("10.0.0.1", 24)}},
+		20: {Interface: net.Interface{Name: "dmz"}, VlanId: 20, SecurityLevel: 50, IPs: networkControl.IPNets{ipnet4("10.0.1.1", 24)}},
+		30: {Interface: net.Interface{Name: "outside", MTU: 1500}, VlanId: 30, SecurityLevel: 0, IPs: networkControl.IPNets{ipnet4("192.0.2.1", 24)}},
+	}
+	if !reflect.DeepEqual(state.BridgedVLANs, expectedVLANs) {
+		t.Errorf("VLANs:\n%v\n!=\n%v", state.BridgedVLANs, expectedVLANs)
+	}
+
+	if !state.PermitInterInterface || state.PermitIntraInterface {
+		t.Errorf("same-security-traffic: inter %v, intra %v", state.PermitInterInterface, state.PermitIntraInterface)
+	}
+
+	// name and object-group references are expanded into a rule per combination; inactive lines are skipped
+
+	anyNet := ipnet4("0.0.0.0", 0)
+	web := ipnet4("10.0.1.10", 32)
+	webPorts := networkControl.PortRanges{{Start: 80, End: 80}, {Start: 8080, End: 8081}}
+	expectedACLs := networkControl.ACLs{
+		{
+			Name:      "outside_in",
+			VLANNames: []string{"outside"},
+			Rules: networkControl.ACLRules{
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: anyNet, ToNet: web, ToPortRanges: webPorts},
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: anyNet, ToNet: ipnet4("10.0.1.32", 27), ToPortRanges: webPorts},
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: anyNet, ToNet: web, ToPortRanges: networkControl.PortRanges{{Start: 53, End: 53}}},
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_UDP, FromNet: anyNet, ToNet: web, ToPortRanges: networkControl.PortRanges{{Start: 53, End: 53}}},
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: anyNet, ToNet: web, ToPortRanges: networkControl.PortRanges{{Start: 60001, End: 65535}}},
+				{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_TCP, FromNet: ipnet4("198.51.100.0", 24), FromPortRanges: networkControl.PortRanges{{Start: 0, End: 1023}}, ToNet: anyNet},
+				{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_IP, FromNet: anyNet, ToNet: anyNet},
+			},
+		},
+		{
+			Name:         "dmz_out",
+			OutVLANNames: []string{"dmz"},
+			Rules: networkControl.ACLRules{
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: ipnet4("10.0.0.0", 24), ToNet: anyNet, ToPortRanges: networkControl.PortRanges{{Start: 0, End: 22}, {Start: 24, End: 65535}}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(state.ACLs, expectedACLs) {
+		for idx := range state.ACLs {
+			t.Logf("ACL #%v: %+v", idx, *state.ACLs[idx])
+		}
+		t.Errorf("ACLs are not equal to the expected ones")
+	}
+
+	expectedSNATs := networkControl.SNATs{
+		{NATTo: ip4("192.0.2.1"), FWSMGlobalId: 1, Sources: networkControl.SNATSources{{IPNet: ipnet4("10.0.0.0", 24), IfName: "inside"}}},
+	}
+	if !reflect.DeepEqual(state.SNATs, expectedSNATs) {
+		t.Errorf("SNATs: %v != %v", state.SNATs, expectedSNATs)
+	}
+
+	tcp := networkControl.PROTO_TCP
+	www := uint16(80)
+	expectedDNATs := networkControl.DNATs{
+		{
+			Destinations: networkControl.IPPorts{{Protocol: &tcp, IP: ip4("192.0.2.1"), Port: &www}},
+			NATTo:        networkControl.IPPort{Protocol: &tcp, IP: ip4("10.0.1.10"), Port: &www},
+			IfName:       "outside",
+		},
+		{
+			Destinations: networkControl.IPPorts{{IP: ip4("192.0.2.20")}},
+			NATTo:        networkControl.IPPort{IP: ip4("10.0.1.20")},
+			IfName:       "outside",
+		},
+	}
+	if !reflect.DeepEqual(state.DNATs, expectedDNATs) {
+		t.Errorf("DNATs: %v != %v", state.DNATs, expectedDNATs)
+	}
+
+	expectedRoutes := networkControl.Routes{
+		{Destination: ipnet4("0.0.0.0", 0), Gateway: ip4("192.0.2.254"), Metric: 1, IfName: "outside"},
+		{Destination: ipnet4("172.16.0.0", 12), Gateway: ip4("10.0.0.254"), Metric: 10, IfName: "inside"},
+	}
+	if !reflect.DeepEqual(state.Routes, expectedRoutes) {
+		t.Errorf("routes: %v != %v", state.Routes, expectedRoutes)
+	}
+
+	// "dhcpd address" gets the subnet of the interface
+
+	dhcpRoot := cfg.Root(state.DHCP)
+	subnet := dhcpRoot.Subnets["10.0.0.0/24"]
+	if len(dhcpRoot.Subnets) != 1 || subnet == nil {
+		t.Fatalf("DHCP subnets: %v", dhcpRoot.Subnets)
+	}
+	if !subnet.Range.Start.Equal(ip4("10.0.0.100")) || !subnet.Range.End.Equal(ip4("10.0.0.199")) {
+		t.Errorf("DHCP range: %v", subnet.Range)
+	}
+	if dhcpRoot.Options.Domain != "example.org" || len(dhcpRoot.Options.DomainNameServers) != 1 || dhcpRoot.Options.DomainNameServers[0].Host != "10.0.1.53" {
+		t.Errorf("DHCP options: %v", dhcpRoot.Options)
+	}
+	if len(dhcpRoot.Options.Routers) != 1 || !dhcpRoot.Options.Routers[0].Equal(ip4("10.0.0.1")) {
+		t.Errorf("DHCP routers: %v", dhcpRoot.Options.Routers)
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	parser := configParser{serviceGroups: map[string]serviceGroup{
+		"web-ports": {protocols: []networkControl.Protocol{networkControl.PROTO_TCP}, portRanges: networkControl.PortRanges{{Start: 80, End: 80}}},
+	}}
+
+	for _, testCase := range []struct {
+		words      string
+		portRanges networkControl.PortRanges
+		rest       string
+		isError    bool
+	}{
+		{words: "eq 22 any", portRanges: networkControl.PortRanges{{Start: 22, End: 22}}, rest: "any"},
+		{words: "eq ssh", portRanges: networkControl.PortRanges{{Start: 22, End: 22}}},
+		{words: "eq pop3", portRanges: networkControl.PortRanges{{Start: 110, End: 110}}},
+		{words: "neq 22", portRanges: networkControl.PortRanges{{Start: 0, End: 21}, {Start: 23, End: 65535}}},
+		{words: "neq 0", portRanges: networkControl.PortRanges{{Start: 1, End: 65535}}},
+		{words: "neq 65535", portRanges: networkControl.PortRanges{{Start: 0, End: 65534}}},
+		{words: "lt 1024", portRanges: networkControl.PortRanges{{Start: 0, End: 1023}}},
+		{words: "lt 0", isError: true},
+		{words: "gt 1023", portRanges: networkControl.PortRanges{{Start: 1024, End: 65535}}},
+		{words: "gt 65535", isError: true},
+		{words: "range 8080 8081 log", portRanges: networkControl.PortRanges{{Start: 8080, End: 8081}}, rest: "log"},
+		{words: "range 8080", isError: true},
+		{words: "object-group web-ports", portRanges: networkControl.PortRanges{{Start: 80, End: 80}}},
+		{words: "object-group servers eq 80", rest: "object-group servers eq 80"},
+		{words: "any eq 80", rest: "any eq 80"},
+	} {
+		portRanges, rest, err := parser.parsePortRanges(strings.Fields(testCase.words))
+		if (err != nil) != testCase.isError {
+			t.Errorf("\"%v\": unexpected error value: %v", testCase.words, err)
+			continue
+		}
+		if testCase.isError {
+			continue
+		}
+		if !reflect.DeepEqual(portRanges, testCase.portRanges) {
+			t.Errorf("\"%v\": port ranges: %v != %v", testCase.words, portRanges, testCase.portRanges)
+		}
+		if strings.Join(rest, " ") != testCase.rest {
+			t.Errorf("\"%v\": the rest: \"%v\" != \"%v\"", testCase.words, strings.Join(rest, " "), testCase.rest)
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package fwsm
+
+// Rendering of networkControl.State (and StateDiff) into FWSM CLI commands. The output is deterministic:
+// maps are rendered in the order of keys and slices in their own order.
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xaionaro-go/iscDhcp/cfg"
+	"github.com/xaionaro-go/networkControl"
+)
+
+// Protocols FWSM knows by name, others are rendered as numbers
+var fwsmProtocolNames = map[networkControl.Protocol]string{
+	networkControl.PROTO_IP:    "ip",
+	networkControl.PROTO_ICMP:  "icmp",
+	networkControl.PROTO_IGMP:  "igmp",
+	networkControl.PROTO_TCP:   "tcp",
+	networkControl.PROTO_UDP:   "udp",
+	networkControl.PROTO_GRE:   "gre",
+	networkControl.PROTO_ESP:   "esp",
+	networkControl.PROTO_AH:    "ah",
+	networkControl.PROTO_EIGRP: "eigrp",
+	networkControl.PROTO_OSPF:  "ospf",
+	networkControl.PROTO_PIM:   "pim",
+}
+
+type configRenderer struct {
+	state networkControl.State
+}
+
+// RenderConfig renders the full configuration of the state
+func RenderConfig(state networkControl.State) (commands []string, err error) {
+	renderer := configRenderer{state: state}
+
+	for _, vlan := range renderer.getSortedVLANs() {
+		commands = append(commands, renderer.renderInterface(*vlan)...)
+	}
+
+	for _, renderSection := range []func() ([]string, error){
+		renderer.renderMTUs,
+		renderer.renderSameSecurityTraffic,
+		renderer.renderRoutes,
+		renderer.renderAccessLists,
+		renderer.renderAccessGroups,
+		renderer.renderGlobals,
+		renderer.renderNATs,
+		renderer.renderStatics,
+		renderer.renderDHCPd,
+	} {
+		sectionCommands, err := renderSection()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, sectionCommands...)
+	}
+
+	return
+}
+
+// RenderDiff renders commands to convert the configuration of "curState" by "diff" (see networkControl.State.Diff()).
+// Interfaces are configured first and removed last; other sections are updated by removing obsolete lines first
+// and adding new ones after that. ACLs are edited line by line ("no access-list ..." and "access-list ... line N ...").
+func RenderDiff(curState networkControl.State, diff networkControl.StateDiff) (commands []string, err error) {
+	oldRenderer := configRenderer{state: curState}
+	newRenderer := configRenderer{state: curState.Patch(diff)}
+
+	changedVLANs := diff.Added.BridgedVLANs.ToSlice()
+	changedVLANs = append(changedVLANs, diff.Updated.BridgedVLANs.ToSlice()...)
+	sort.SliceStable(changedVLANs, func(i, j int) bool { return changedVLANs[i].VlanId < changedVLANs[j].VlanId })
+	for _, vlan := range changedVLANs {
+		commands = append(commands, newRenderer.renderInterface(*vlan)...)
+	}
+
+	oldMTUs, err := oldRenderer.renderMTUs()
+	if err != nil {
+		return nil, err
+	}
+	newMTUs, err := newRenderer.renderMTUs()
+	if err != nil {
+		return nil, err
+	}
+	_, addedMTUs := diffLines(oldMTUs, newMTUs)
+	commands = append(commands, addedMTUs...)
+
+	for _, renderSection := range []func(configRenderer) ([]string, error){
+		configRenderer.renderSameSecurityTraffic,
+		configRenderer.renderRoutes,
+	} {
+		sectionCommands, err := diffSection(oldRenderer, newRenderer, renderSection)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, sectionCommands...)
+	}
+
+	aclCommands, err := renderACLsDiff(oldRenderer, newRenderer, diff)
+	if err != nil {
+		return nil, err
+	}
+	commands = append(commands, aclCommands...)
+
+	for _, renderSection := range []func(configRenderer) ([]string, error){
+		configRenderer.renderGlobals,
+		configRenderer.renderNATs,
+		configRenderer.renderStatics,
+		configRenderer.renderDHCPd,
+	} {
+		sectionCommands, err := diffSection(oldRenderer, newRenderer, renderSection)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, sectionCommands...)
+	}
+
+	removedVLANs := diff.Removed.BridgedVLANs.ToSlice()
+	sort.Slice(removedVLANs, func(i, j int) bool { return removedVLANs[i].VlanId < removedVLANs[j].VlanId })
+	for _, vlan := range removedVLANs {
+		commands = append(commands, fmt.Sprintf("clear configure interface Vlan%v", vlan.VlanId))
+	}
+
+	return
+}
+
+// diffLines returns lines of "oldLines" absent in "newLines" and vice versa (preserving the order)
+func diffLines(oldLines, newLines []string) (removed, added []string) {
+	oldSet := map[string]bool{}
+	for _, line := range oldLines {
+		oldSet[line] = true
+	}
+	newSet := map[string]bool{}
+	for _, line := range newLines {
+		newSet[line] = true
+	}
+	for _, line := range oldLines {
+		if !newSet[line] {
+			removed = append(removed, line)
+		}
+	}
+	for _, line := range newLines {
+		if !oldSet[line] {
+			added = append(added, line)
+		}
+	}
+	return
+}
+
+// diffSection renders "no ..." for obsolete lines of the section and then the new lines
+func diffSection(oldRenderer, newRenderer configRenderer, renderSection func(configRenderer) ([]string, error)) (commands []string, err error) {
+	oldLines, err := renderSection(oldRenderer)
+	if err != nil {
+		return nil, err
+	}
+	newLines, err := renderSection(newRenderer)
+	if err != nil {
+		return nil, err
+	}
+	removed, added := diffLines(oldLines, newLines)
+	for idx := len(removed) - 1; idx >= 0; idx-- {
+		commands = append(commands, "no "+removed[idx])
+	}
+	return append(commands, added...), nil
+}
+
+func renderACLsDiff(oldRenderer, newRenderer configRenderer, diff networkControl.StateDiff) (commands []string, err error) {
+	oldAccessGroups, err := oldRenderer.renderAccessGroups()
+	if err != nil {
+		return nil, err
+	}
+	newAccessGroups, err := newRenderer.renderAccessGroups()
+	if err != nil {
+		return nil, err
+	}
+	removedAccessGroups, addedAccessGroups := diffLines(oldAccessGroups, newAccessGroups)
+
+	// an interface could have only one ACL per direction, so a new binding replaces the old one; unbinding is required only if there's no replacement
+
+	isRebound := map[string]bool{}
+	for _, line := range addedAccessGroups {
+		isRebound[accessGroupTarget(line)] = true
+	}
+	for _, line := range removedAccessGroups {
+		if isRebound[accessGroupTarget(line)] {
+			continue
+		}
+		commands = append(commands, "no "+line)
+	}
+
+	changedACLs := append(networkControl.ACLs{}, diff.Updated.ACLs...)
+	changedACLs = append(changedACLs, diff.Added.ACLs...)
+	sort.Sort(changedACLs)
+	for _, acl := range changedACLs {
+		var oldLines []string
+		for _, oldACL := range oldRenderer.state.ACLs {
+			if oldACL.Name != acl.Name {
+				continue
+			}
+			oldLines, err = oldRenderer.renderAccessList(*oldACL)
+			if err != nil {
+				return nil, err
+			}
+		}
+		newLines, err := newRenderer.renderAccessList(*acl)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, renderAccessListEdits(acl.Name, oldLines, newLines)...)
+	}
+
+	commands = append(commands, addedAccessGroups...)
+
+	// removed ACLs are cleared after their bindings are replaced
+
+	removedACLs := append(networkControl.ACLs{}, diff.Removed.ACLs...)
+	sort.Sort(removedACLs)
+	for _, acl := range removedACLs {
+		commands = append(commands, "clear configure access-list "+acl.Name)
+	}
+
+	return
+}
+
+// accessGroupTarget returns "in|out interface IFNAME" of an "access-group" line
+func accessGroupTarget(line string) string {
+	words := strings.Fields(line)
+	return strings.Join(words[2:], " ")
+}
+
+// renderAccessListEdits returns commands converting ACL lines "oldLines" to "newLines": obsolete lines are removed
+// first, then the new lines are inserted at their positions (the rest of lines is the longest common subsequence).
+func renderAccessListEdits(aclName string, oldLines, newLines []string) []string {
+	// lcsLen[i][j] is the length of the longest common subsequence of oldLines[i:] and newLines[j:]
+	lcsLen := make([][]int, len(oldLines)+1)
+	for i := range lcsLen {
+		lcsLen[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			switch {
+			case oldLines[i] == newLines[j]:
+				lcsLen[i][j] = lcsLen[i+1][j+1] + 1
+			case lcsLen[i+1][j] >= lcsLen[i][j+1]:
+				lcsLen[i][j] = lcsLen[i+1][j]
+			default:
+				lcsLen[i][j] = lcsLen[i][j+1]
+			}
+		}
+	}
+
+	var removed []string
+	var inserted []string
+	i, j := 0, 0
+	for i < len(oldLines) || j < len(newLines) {
+		switch {
+		case i < len(oldLines) && j < len(newLines) && oldLines[i] == newLines[j]:
+			i++
+			j++
+		case j < len(newLines) && (i == len(oldLines) || lcsLen[i][j+1] >= lcsLen[i+1][j]):
+			inserted = append(inserted, strings.Replace(newLines[j], "access-list "+aclName+" ", fmt.Sprintf("access-list %v line %v ", aclName, j+1), 1))
+			j++
+		default:
+			removed = append(removed, "no "+oldLines[i])
+			i++
+		}
+	}
+
+	if len(oldLines) > 0 && len(removed) == len(oldLines) {
+		// nothing in common: the removal of the last line removes the ACL (and its bindings), so the new lines are inserted first
+		return append(inserted, removed...)
+	}
+	if len(oldLines) == 0 {
+		return newLines
+	}
+	return append(removed, inserted...)
+}
+
+// Helpers
+
+func (renderer configRenderer) getSortedVLANs() (vlans []*networkControl.VLAN) {
+	vlans = renderer.state.BridgedVLANs.ToSlice()
+	sort.Slice(vlans, func(i, j int) bool { return vlans[i].VlanId < vlans[j].VlanId })
+	return
+}
+
+func (renderer configRenderer) getVLAN(ifName string) *networkControl.VLAN {
+	for _, vlan := range renderer.state.BridgedVLANs {
+		if vlan != nil && vlan.Name == ifName {
+			return vlan
+		}
+	}
+	return nil
+}
+
+// getIfName returns the interface "ip" is reachable through
+func (renderer configRenderer) getIfName(ip net.IP) (string, error) {
+	ifName := renderer.state.GetRouteIfName(ip)
+	if ifName == "" {
+		return "", fmt.Errorf("%v: no route to %v", errUnknownInterface, ip)
+	}
+	return ifName, nil
+}
+
+func renderMask(mask net.IPMask) string {
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	return net.IP(mask).String()
+}
+
+func renderAddress(ipnet networkControl.IPNet) string {
+	switch {
+	case ipnet.IsAny():
+		return "any"
+	case ipnet.PrefixLen() == 32:
+		return "host " + ipnet.IP.String()
+	}
+	return ipnet.IP.String() + " " + renderMask(ipnet.Mask)
+}
+
+func renderProtocol(protocol networkControl.Protocol) string {
+	if name, ok := fwsmProtocolNames[protocol]; ok {
+		return name
+	}
+	return strconv.Itoa(int(protocol))
+}
+
+// renderPortRanges returns a port specification per range ("" for any port)
+func renderPortRanges(portRanges networkControl.PortRanges) (result []string) {
+	if portRanges.IsAny() {
+		return []string{""}
+	}
+	for _, portRange := range portRanges {
+		switch {
+		case portRange.Start == portRange.End:
+			result = append(result, fmt.Sprintf(" eq %v", portRange.Start))
+		case portRange.Start == 0:
+			result = append(result, fmt.Sprintf(" lt %v", portRange.End+1))
+		case portRange.End == 65535:
+			result = append(result, fmt.Sprintf(" gt %v", portRange.Start-1))
+		default:
+			result = append(result, fmt.Sprintf(" range %v %v", portRange.Start, portRange.End))
+		}
+	}
+	return
+}
+
+// Sections
+
+func (renderer configRenderer) renderInterface(vlan networkControl.VLAN) (commands []string) {
+	commands = append(commands, fmt.Sprintf("interface Vlan%v", vlan.VlanId))
+	if vlan.Name == "" {
+		commands = append(commands, " no nameif")
+	} else {
+		commands = append(commands, " nameif "+vlan.Name)
+	}
+	commands = append(commands, fmt.Sprintf(" security-level %v", vlan.SecurityLevel))
+	if len(vlan.IPs) == 0 {
+		commands = append(commands, " no ip address")
+	} else {
+		// FWSM supports only one address per interface
+		commands = append(commands, fmt.Sprintf(" ip address %v %v", vlan.IPs[0].IP, renderMask(vlan.IPs[0].Mask)))
+	}
+	return
+}
+
+func (renderer configRenderer) renderMTUs() (commands []string, err error) {
+	for _, vlan := range renderer.getSortedVLANs() {
+		if vlan.MTU == 0 || vlan.Name == "" {
+			continue
+		}
+		commands = append(commands, fmt.Sprintf("mtu %v %v", vlan.Name, vlan.MTU))
+	}
+	return
+}
+
+func (renderer configRenderer) renderSameSecurityTraffic() (commands []string, err error) {
+	if renderer.state.PermitInterInterface {
+		commands = append(commands, "same-security-traffic permit inter-interface")
+	}
+	if renderer.state.PermitIntraInterface {
+		commands = append(commands, "same-security-traffic permit intra-interface")
+	}
+	return
+}
+
+func (renderer configRenderer) renderRoutes() (commands []string, err error) {
+	for _, route := range renderer.state.Routes {
+		if len(route.Sources) != 0 {
+			return nil, fmt.Errorf("%v: source-based routing (%v)", errUnsupported, route.Sources)
+		}
+		ifName := route.IfName
+		if ifName == "" {
+			ifName, err = renderer.getIfName(route.Gateway)
+			if err != nil {
+				return nil, err
+			}
+		}
+		metric := route.Metric
+		if metric == 0 {
+			metric = 1
+		}
+		destination := route.Destination
+		if len(destination.IP) == 0 {
+			destination = anyIPNet()
+		}
+		commands = append(commands, fmt.Sprintf("route %v %v %v %v %v", ifName, destination.IP, renderMask(destination.Mask), route.Gateway, metric))
+	}
+	return
+}
+
+func (renderer configRenderer) renderAccessList(acl networkControl.ACL) (commands []string, err error) {
+	for _, rule := range acl.Rules {
+		if rule.Flags&networkControl.ACLFL_ESTABLISHED != 0 {
+			return nil, fmt.Errorf("%v: ACL %v: established flag", errUnsupported, acl.Name)
+		}
+		action := "deny"
+		if rule.Action == networkControl.ACL_ALLOW {
+			action = "permit"
+		}
+		hasPorts := rule.Protocol == networkControl.PROTO_TCP || rule.Protocol == networkControl.PROTO_UDP
+		if !hasPorts && (!rule.FromPortRanges.IsAny() || !rule.ToPortRanges.IsAny()) {
+			return nil, fmt.Errorf("%v: ACL %v: ports for protocol %v", errUnsupported, acl.Name, renderProtocol(rule.Protocol))
+		}
+		for _, fromPorts := range renderPortRanges(rule.FromPortRanges) {
+			for _, toPorts := range renderPortRanges(rule.ToPortRanges) {
+				commands = append(commands, fmt.Sprintf("access-list %v extended %v %v %v%v %v%v",
+					acl.Name, action, renderProtocol(rule.Protocol), renderAddress(rule.FromNet), fromPorts, renderAddress(rule.ToNet), toPorts))
+			}
+		}
+	}
+	return
+}
+
+func (renderer configRenderer) renderAccessLists() (commands []string, err error) {
+	for _, acl := range renderer.state.ACLs {
+		aclCommands, err := renderer.renderAccessList(*acl)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, aclCommands...)
+	}
+	return
+}
+
+func (renderer configRenderer) renderAccessGroups() (commands []string, err error) {
+	isBound := map[string]string{}
+	for _, acl := range renderer.state.ACLs {
+		for _, direction := range networkControl.ACLDirections {
+			for _, ifName := range acl.GetVLANNames(direction) {
+				target := fmt.Sprintf("%v interface %v", direction, ifName)
+				if anotherACLName, ok := isBound[target]; ok {
+					return nil, fmt.Errorf("%v: ACLs %v and %v are both bound to \"%v\", FWSM supports only one ACL per interface and direction", errUnsupported, anotherACLName, acl.Name, target)
+				}
+				isBound[target] = acl.Name
+				commands = append(commands, fmt.Sprintf("access-group %v %v", acl.Name, target))
+			}
+		}
+	}
+	return
+}
+
+// getSortedSNATs returns SNATs ordered by FWSMGlobalId
+func (renderer configRenderer) getSortedSNATs() networkControl.SNATs {
+	snats := append(networkControl.SNATs{}, renderer.state.SNATs...)
+	sort.Stable(snats)
+	return snats
+}
+
+func (renderer configRenderer) renderGlobals() (commands []string, err error) {
+	for _, snat := range renderer.getSortedSNATs() {
+		ifName, err := renderer.getIfName(snat.NATTo)
+		if err != nil {
+			return nil, err
+		}
+		natTo := snat.NATTo.String()
+		if vlan := renderer.getVLAN(ifName); vlan != nil {
+			for _, ip := range vlan.IPs {
+				if ip.IP.Equal(snat.NATTo) {
+					natTo = "interface"
+				}
+			}
+		}
+		commands = append(commands, fmt.Sprintf("global (%v) %v %v", ifName, snat.FWSMGlobalId, natTo))
+	}
+	return
+}
+
+func (renderer configRenderer) renderNATs() (commands []string, err error) {
+	isRendered := map[string]bool{}
+	for _, snat := range renderer.getSortedSNATs() {
+		for _, source := range snat.Sources {
+			ifName := source.IfName
+			if ifName == "" {
+				ifName, err = renderer.getIfName(source.IP)
+				if err != nil {
+					return nil, err
+				}
+			}
+			command := fmt.Sprintf("nat (%v) %v %v %v", ifName, snat.FWSMGlobalId, source.IP.Mask(source.Mask), renderMask(source.Mask))
+			// sources are shared by all "global"-s with the same id
+			if isRendered[command] {
+				continue
+			}
+			isRendered[command] = true
+			commands = append(commands, command)
+		}
+	}
+	return
+}
+
+func (renderer configRenderer) renderStatics() (commands []string, err error) {
+	for _, dnat := range renderer.state.DNATs {
+		realIfName, err := renderer.getIfName(dnat.NATTo.IP)
+		if err != nil {
+			return nil, err
+		}
+		for _, destination := range dnat.Destinations {
+			mappedIfName := dnat.IfName
+			if mappedIfName == "" {
+				mappedIfName, err = renderer.getIfName(destination.IP)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			hasPorts := destination.Port != nil || dnat.NATTo.Port != nil
+			if !hasPorts {
+				commands = append(commands, fmt.Sprintf("static (%v,%v) %v %v netmask 255.255.255.255", realIfName, mappedIfName, destination.IP, dnat.NATTo.IP))
+				continue
+			}
+			if destination.Port == nil || dnat.NATTo.Port == nil || destination.Protocol == nil ||
+				(*destination.Protocol != networkControl.PROTO_TCP && *destination.Protocol != networkControl.PROTO_UDP) {
+				return nil, fmt.Errorf("%v: DNAT %v -> %v: port translation requires ports on both sides and TCP or UDP", errUnsupported, destination, dnat.NATTo)
+			}
+			commands = append(commands, fmt.Sprintf("static (%v,%v) %v %v %v %v %v netmask 255.255.255.255",
+				realIfName, mappedIfName, renderProtocol(*destination.Protocol), destination.IP, *destination.Port, dnat.NATTo.IP, *dnat.NATTo.Port))
+		}
+	}
+	return
+}
+
+func (renderer configRenderer) renderDHCPd() (commands []string, err error) {
+	dhcpRoot := cfg.Root(renderer.state.DHCP)
+
+	var subnetKeys []string
+	for key := range dhcpRoot.Subnets {
+		subnetKeys = append(subnetKeys, key)
+	}
+	sort.Strings(subnetKeys)
+
+	for _, key := range subnetKeys {
+		subnet := dhcpRoot.Subnets[key]
+		if subnet == nil || subnet.Range.Start == nil {
+			continue
+		}
+		ifName, err := renderer.getIfName(subnet.Range.Start)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, fmt.Sprintf("dhcpd address %v-%v %v", subnet.Range.Start, subnet.Range.End, ifName))
+	}
+
+	var nsIPs []string
+	for _, ns := range dhcpRoot.Options.DomainNameServers {
+		nsIPs = append(nsIPs, ns.Host)
+	}
+	if len(nsIPs) > 0 {
+		commands = append(commands, "dhcpd dns "+strings.Join(nsIPs, " "))
+	}
+	if dhcpRoot.Options.Domain != "" {
+		commands = append(commands, "dhcpd domain "+dhcpRoot.Options.Domain)
+	}
+	var routers []string
+	for _, router := range dhcpRoot.Options.Routers {
+		routers = append(routers, router.String())
+	}
+	if len(routers) > 0 {
+		commands = append(commands, "dhcpd option 3 ip "+strings.Join(routers, " "))
+	}
+
+	for _, key := range subnetKeys {
+		subnet := dhcpRoot.Subnets[key]
+		if subnet == nil || subnet.Range.Start == nil {
+			continue
+		}
+		ifName, err := renderer.getIfName(subnet.Range.Start)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, "dhcpd enable "+ifName)
+	}
+	return
+}
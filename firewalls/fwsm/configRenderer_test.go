@@ -0,0 +1,156 @@
+package fwsm
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xaionaro-go/networkControl"
+)
+
+func parseSampleConfig(t *testing.T) networkControl.State {
+	state, _ := ParseConfig(strings.Join(sampleRunningConfig, "\n"))
+	return state
+}
+
+func checkCommands(t *testing.T, commands []string, expected []string) {
+	if reflect.DeepEqual(commands, expected) {
+		return
+	}
+	t.Errorf("commands:\n%v\n\nexpected:\n%v", strings.Join(commands, "\n"), strings.Join(expected, "\n"))
+}
+
+func TestRenderConfig(t *testing.T) {
+	commands, err := RenderConfig(parseSampleConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, commands, []string{
+		"interface Vlan10",
+		" nameif inside",
+		" security-level 100",
+		" ip address 10.0.0.1 255.255.255.0",
+		"interface Vlan20",
+		" nameif dmz",
+		" security-level 50",
+		" ip address 10.0.1.1 255.255.255.0",
+		"interface Vlan30",
+		" nameif outside",
+		" security-level 0",
+		" ip address 192.0.2.1 255.255.255.0",
+		"mtu inside 1500",
+		"mtu outside 1500",
+		"same-security-traffic permit inter-interface",
+		"route outside 0.0.0.0 0.0.0.0 192.0.2.254 1",
+		"route inside 172.16.0.0 255.240.0.0 10.0.0.254 10",
+		"access-list outside_in extended permit tcp any host 10.0.1.10 eq 80",
+		"access-list outside_in extended permit tcp any host 10.0.1.10 range 8080 8081",
+		"access-list outside_in extended permit tcp any 10.0.1.32 255.255.255.224 eq 80",
+		"access-list outside_in extended permit tcp any 10.0.1.32 255.255.255.224 range 8080 8081",
+		"access-list outside_in extended permit tcp any host 10.0.1.10 eq 53",
+		"access-list outside_in extended permit udp any host 10.0.1.10 eq 53",
+		"access-list outside_in extended permit tcp any host 10.0.1.10 gt 60000",
+		"access-list outside_in extended deny tcp 198.51.100.0 255.255.255.0 lt 1024 any",
+		"access-list outside_in extended deny ip any any",
+		"access-list dmz_out extended permit tcp 10.0.0.0 255.255.255.0 any lt 23",
+		"access-list dmz_out extended permit tcp 10.0.0.0 255.255.255.0 any gt 23",
+		"access-group outside_in in interface outside",
+		"access-group dmz_out out interface dmz",
+		"global (outside) 1 interface",
+		"nat (inside) 1 10.0.0.0 255.255.255.0",
+		"static (dmz,outside) tcp 192.0.2.1 80 10.0.1.10 80 netmask 255.255.255.255",
+		"static (dmz,outside) 192.0.2.20 10.0.1.20 netmask 255.255.255.255",
+		"dhcpd address 10.0.0.100-10.0.0.199 inside",
+		"dhcpd dns 10.0.1.53",
+		"dhcpd domain example.org",
+		"dhcpd option 3 ip 10.0.0.1",
+		"dhcpd enable inside",
+	})
+}
+
+func TestRenderConfigRoundTrip(t *testing.T) {
+	commands, err := RenderConfig(parseSampleConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, unparsed := ParseConfig(strings.Join(commands, "\n"))
+	if len(unparsed) != 0 {
+		t.Errorf("unparsed lines of the rendered config: %v", unparsed)
+	}
+	reRenderedCommands, err := RenderConfig(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, reRenderedCommands, commands)
+}
+
+func TestRenderDiff(t *testing.T) {
+	curState := parseSampleConfig(t)
+	newState := parseSampleConfig(t)
+
+	newState.PermitIntraInterface = true
+	newState.BridgedVLANs[40] = &networkControl.VLAN{
+		Interface:     net.Interface{Name: "guest"},
+		VlanId:        40,
+		SecurityLevel: 10,
+		IPs:           networkControl.IPNets{ipnet4("10.0.2.1", 24)},
+	}
+	newState.Routes[1].Metric = 20
+
+	// a new rule at the top, the "deny tcp 198.51.100.0 ..." rule is removed
+	outsideIn := newState.ACLs[0]
+	smtpRule := networkControl.ACLRule{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: ipnet4("0.0.0.0", 0), ToNet: ipnet4("10.0.1.25", 32), ToPortRanges: networkControl.PortRanges{{Start: 25, End: 25}}}
+	outsideIn.Rules = append(networkControl.ACLRules{smtpRule}, append(outsideIn.Rules[:5:5], outsideIn.Rules[6:]...)...)
+
+	// "dmz_out" is removed
+	newState.ACLs = newState.ACLs[:1]
+
+	commands, err := RenderDiff(curState, newState.Diff(curState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, commands, []string{
+		"interface Vlan40",
+		" nameif guest",
+		" security-level 10",
+		" ip address 10.0.2.1 255.255.255.0",
+		"same-security-traffic permit intra-interface",
+		"no route inside 172.16.0.0 255.240.0.0 10.0.0.254 10",
+		"route inside 172.16.0.0 255.240.0.0 10.0.0.254 20",
+		"no access-group dmz_out out interface dmz",
+		"no access-list outside_in extended deny tcp 198.51.100.0 255.255.255.0 lt 1024 any",
+		"access-list outside_in line 1 extended permit tcp any host 10.0.1.25 eq 25",
+		"clear configure access-list dmz_out",
+	})
+}
+
+func TestRenderDiffReplacingACL(t *testing.T) {
+	curState := parseSampleConfig(t)
+	newState := parseSampleConfig(t)
+
+	// "outside_in" is replaced by a new ACL; all the lines of "dmz_out" are replaced
+	newState.ACLs[0] = &networkControl.ACL{
+		Name:      "outside_in_v2",
+		VLANNames: []string{"outside"},
+		Rules: networkControl.ACLRules{
+			{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_IP, FromNet: ipnet4("0.0.0.0", 0), ToNet: ipnet4("0.0.0.0", 0)},
+		},
+	}
+	newState.ACLs[1].Rules = networkControl.ACLRules{
+		{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_UDP, FromNet: ipnet4("10.0.0.0", 24), ToNet: ipnet4("0.0.0.0", 0), ToPortRanges: networkControl.PortRanges{{Start: 53, End: 53}}},
+	}
+
+	commands, err := RenderDiff(curState, newState.Diff(curState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCommands(t, commands, []string{
+		"access-list dmz_out line 1 extended permit udp 10.0.0.0 255.255.255.0 any eq 53",
+		"no access-list dmz_out extended permit tcp 10.0.0.0 255.255.255.0 any lt 23",
+		"no access-list dmz_out extended permit tcp 10.0.0.0 255.255.255.0 any gt 23",
+		"access-list outside_in_v2 extended deny ip any any",
+		"access-group outside_in_v2 in interface outside",
+		"clear configure access-list outside_in",
+	})
+}
@@ -1,12 +1,253 @@
 package fwsm
 
 import (
+	"errors"
+
 	"github.com/xaionaro-go/networkControl"
 )
 
+var (
+	errNotFound = errors.New("not found")
+)
+
+// Transport executes a CLI command on the device (in the privileged mode) and returns its output.
+// It should return an error if the device reported one.
+type Transport interface {
+	Run(command string) (output string, err error)
+}
+
 type fwsm struct {
+	networkControl.FirewallBase
+	transport Transport
+}
+
+func NewFirewall(host networkControl.HostI, transport Transport) networkControl.FirewallI {
+	fw := &fwsm{
+		transport: transport,
+	}
+	fw.SetHost(host)
+	return fw
+}
+
+func (fw *fwsm) inquireState() (networkControl.State, error) {
+	config, err := fw.transport.Run("show running-config")
+	if err != nil {
+		fw.LogError(err)
+		return networkControl.State{}, err
+	}
+	state, unparsed := ParseConfig(config)
+	for _, line := range unparsed {
+		fw.Debugf("fwsm: skipped: %v", line)
+	}
+	return state, nil
+}
+
+// mustInquireState is for Inquire*() methods which cannot return an error
+func (fw *fwsm) mustInquireState() networkControl.State {
+	state, err := fw.inquireState()
+	if err != nil {
+		panic(err)
+	}
+	return state
+}
+
+// configure runs the commands in the configuration mode
+func (fw *fwsm) configure(commands []string) (err error) {
+	if len(commands) == 0 {
+		return nil
+	}
+	_, err = fw.transport.Run("configure terminal")
+	if err != nil {
+		fw.LogError(err)
+		return
+	}
+	for _, command := range commands {
+		_, err = fw.transport.Run(command)
+		if err != nil {
+			fw.LogError(err, command)
+			break
+		}
+	}
+	if _, endErr := fw.transport.Run("end"); endErr != nil && err == nil {
+		fw.LogError(endErr)
+		err = endErr
+	}
+	return
+}
+
+// applyDiff renders the diff (prepared by "fillDiff") against the current configuration of the device and runs the commands
+func (fw *fwsm) applyDiff(fillDiff func(curState networkControl.State, diff *networkControl.StateDiff) error) error {
+	curState, err := fw.inquireState()
+	if err != nil {
+		return err
+	}
+
+	diff := networkControl.StateDiff{}
+	diff.Updated.PermitInterInterface = curState.PermitInterInterface
+	diff.Updated.PermitIntraInterface = curState.PermitIntraInterface
+	diff.Updated.DHCP = curState.DHCP
+	err = fillDiff(curState, &diff)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+
+	commands, err := RenderDiff(curState, diff)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	return fw.configure(commands)
+}
+
+func (fw *fwsm) InquireSecurityLevel(ifName string) int {
+	for _, vlan := range fw.mustInquireState().BridgedVLANs {
+		if vlan.Name == ifName {
+			return vlan.SecurityLevel
+		}
+	}
+	fw.Infof("Cannot find security level of iface %v", ifName)
+	return -1
+}
+
+func (fw *fwsm) InquireACLs() networkControl.ACLs {
+	return fw.mustInquireState().ACLs
+}
+
+func (fw *fwsm) InquireSNATs() networkControl.SNATs {
+	return fw.mustInquireState().SNATs
+}
+
+func (fw *fwsm) InquireDNATs() networkControl.DNATs {
+	return fw.mustInquireState().DNATs
+}
+
+func (fw *fwsm) InquirePermitInterInterface() bool {
+	return fw.mustInquireState().PermitInterInterface
+}
+
+func (fw *fwsm) InquirePermitIntraInterface() bool {
+	return fw.mustInquireState().PermitIntraInterface
+}
+
+func (fw *fwsm) AddACL(acl networkControl.ACL) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		for _, curACL := range curState.ACLs {
+			if curACL.Name == acl.Name {
+				diff.Updated.ACLs = networkControl.ACLs{&acl}
+				return nil
+			}
+		}
+		diff.Added.ACLs = networkControl.ACLs{&acl}
+		return nil
+	})
+}
+
+func (fw *fwsm) UpdateACL(acl networkControl.ACL) error {
+	return fw.AddACL(acl)
+}
+
+func (fw *fwsm) RemoveACL(acl networkControl.ACL) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		for _, curACL := range curState.ACLs {
+			if curACL.Name == acl.Name {
+				diff.Removed.ACLs = networkControl.ACLs{curACL}
+			}
+		}
+		return nil
+	})
+}
+
+func (fw *fwsm) AddSNAT(snat networkControl.SNAT) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		for _, curSNAT := range curState.SNATs {
+			if curSNAT.KeyStringValue() == snat.KeyStringValue() {
+				diff.Updated.SNATs = networkControl.SNATs{&snat}
+				return nil
+			}
+		}
+		diff.Added.SNATs = networkControl.SNATs{&snat}
+		return nil
+	})
+}
+
+func (fw *fwsm) UpdateSNAT(snat networkControl.SNAT) error {
+	return fw.AddSNAT(snat)
+}
+
+func (fw *fwsm) RemoveSNAT(snat networkControl.SNAT) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		for _, curSNAT := range curState.SNATs {
+			if curSNAT.KeyStringValue() == snat.KeyStringValue() {
+				diff.Removed.SNATs = networkControl.SNATs{curSNAT}
+			}
+		}
+		return nil
+	})
+}
+
+func (fw *fwsm) AddDNAT(dnat networkControl.DNAT) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		for _, curDNAT := range curState.DNATs {
+			if curDNAT.KeyStringValue() == dnat.KeyStringValue() {
+				diff.Updated.DNATs = networkControl.DNATs{&dnat}
+				return nil
+			}
+		}
+		diff.Added.DNATs = networkControl.DNATs{&dnat}
+		return nil
+	})
+}
+
+func (fw *fwsm) UpdateDNAT(dnat networkControl.DNAT) error {
+	return fw.AddDNAT(dnat)
+}
+
+func (fw *fwsm) RemoveDNAT(dnat networkControl.DNAT) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		for _, curDNAT := range curState.DNATs {
+			if curDNAT.KeyStringValue() == dnat.KeyStringValue() {
+				diff.Removed.DNATs = networkControl.DNATs{curDNAT}
+			}
+		}
+		return nil
+	})
+}
+
+func (fw *fwsm) SetSecurityLevel(ifName string, securityLevel int) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		for _, curVLAN := range curState.BridgedVLANs {
+			if curVLAN.Name != ifName {
+				continue
+			}
+			if curVLAN.SecurityLevel == securityLevel {
+				return nil
+			}
+			vlan := *curVLAN
+			vlan.SecurityLevel = securityLevel
+			diff.Updated.BridgedVLANs = networkControl.VLANs{vlan.VlanId: &vlan}
+			return nil
+		}
+		return errNotFound
+	})
+}
+
+// UnsetSecurityLevel does nothing: a security level is a property of an interface on FWSM, it's
+// removed together with the interface
+func (fw *fwsm) UnsetSecurityLevel(ifName string) error {
+	return nil
+}
+
+func (fw *fwsm) SetEnablePermitInterInterface(enable bool) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		diff.Updated.PermitInterInterface = enable
+		return nil
+	})
 }
 
-func NewFirewall() networkControl.FirewallI {
-	return &fwsm{}
+func (fw *fwsm) SetEnablePermitIntraInterface(enable bool) error {
+	return fw.applyDiff(func(curState networkControl.State, diff *networkControl.StateDiff) error {
+		diff.Updated.PermitIntraInterface = enable
+		return nil
+	})
 }
@@ -0,0 +1,167 @@
+package fwsm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xaionaro-go/networkControl"
+	"github.com/xaionaro-go/networkControl/hosts/fwsm/fakeDevice"
+	"github.com/xaionaro-go/networkControl/hosts/memory"
+)
+
+func newTestFirewall(t *testing.T) (networkControl.FirewallI, *fakeDevice.Device) {
+	dev := fakeDevice.New("", "")
+	dev.SetRunningConfig(strings.Join(sampleRunningConfig, "\n"))
+	return NewFirewall(memoryHost.NewHost(), dev.NewTransport()), dev
+}
+
+// getDeviceState parses the running configuration of the device
+func getDeviceState(t *testing.T, dev *fakeDevice.Device) networkControl.State {
+	state, _ := ParseConfig(dev.GetRunningConfig())
+	return state
+}
+
+func getACL(state networkControl.State, aclName string) *networkControl.ACL {
+	for _, acl := range state.ACLs {
+		if acl.Name == aclName {
+			return acl
+		}
+	}
+	return nil
+}
+
+func TestFirewallInquire(t *testing.T) {
+	fw, _ := newTestFirewall(t)
+
+	if securityLevel := fw.InquireSecurityLevel("dmz"); securityLevel != 50 {
+		t.Errorf("security level of dmz: %v", securityLevel)
+	}
+	if securityLevel := fw.InquireSecurityLevel("unknown"); securityLevel != -1 {
+		t.Errorf("security level of an unknown interface: %v", securityLevel)
+	}
+	if !fw.InquirePermitInterInterface() || fw.InquirePermitIntraInterface() {
+		t.Errorf("same-security-traffic is not inquired")
+	}
+	if acls := fw.InquireACLs(); len(acls) != 2 || acls[0].Name != "outside_in" || acls[1].Name != "dmz_out" {
+		t.Errorf("ACLs: %v", acls)
+	}
+	if len(fw.InquireSNATs()) != 1 || len(fw.InquireDNATs()) != 2 {
+		t.Errorf("NATs: %v %v", fw.InquireSNATs(), fw.InquireDNATs())
+	}
+}
+
+func TestFirewallACLs(t *testing.T) {
+	fw, dev := newTestFirewall(t)
+
+	insideIn := networkControl.ACL{
+		Name:      "inside_in",
+		VLANNames: []string{"inside"},
+		Rules: networkControl.ACLRules{
+			{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_TCP, FromNet: ipnet4("10.0.0.0", 24), ToNet: ipnet4("0.0.0.0", 0), ToPortRanges: networkControl.PortRanges{{Start: 25, End: 25}}},
+			{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_IP, FromNet: ipnet4("10.0.0.0", 24), ToNet: ipnet4("0.0.0.0", 0)},
+		},
+	}
+	err := fw.AddACL(insideIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl := getACL(getDeviceState(t, dev), "inside_in")
+	if acl == nil || !reflect.DeepEqual(acl.Rules, insideIn.Rules) || !reflect.DeepEqual(acl.VLANNames, []string{"inside"}) {
+		t.Fatalf("the added ACL: %v", acl)
+	}
+
+	insideIn.Rules = insideIn.Rules[1:]
+	err = fw.UpdateACL(insideIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl = getACL(getDeviceState(t, dev), "inside_in")
+	if acl == nil || !reflect.DeepEqual(acl.Rules, insideIn.Rules) {
+		t.Fatalf("the updated ACL: %v", acl)
+	}
+
+	err = fw.RemoveACL(networkControl.ACL{Name: "dmz_out"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl := getACL(getDeviceState(t, dev), "dmz_out"); acl != nil {
+		t.Errorf("the ACL is not removed: %v", acl)
+	}
+	if strings.Contains(dev.GetRunningConfig(), "dmz_out") {
+		t.Errorf("lines of the removed ACL are left:\n%v", dev.GetRunningConfig())
+	}
+}
+
+func TestFirewallSecurityLevel(t *testing.T) {
+	fw, dev := newTestFirewall(t)
+
+	err := fw.SetSecurityLevel("dmz", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vlan := getDeviceState(t, dev).BridgedVLANs[20]; vlan == nil || vlan.SecurityLevel != 60 {
+		t.Errorf("VLAN: %v", vlan)
+	}
+
+	err = fw.SetSecurityLevel("unknown", 60)
+	if err == nil {
+		t.Errorf("an error is expected")
+	}
+
+	err = fw.SetEnablePermitIntraInterface(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !getDeviceState(t, dev).PermitIntraInterface {
+		t.Errorf("intra-interface traffic is not permitted")
+	}
+}
+
+func TestFirewallNATs(t *testing.T) {
+	fw, dev := newTestFirewall(t)
+
+	// the fake device finds lines to remove by the text, so the static without names is removed
+	dnats := fw.InquireDNATs()
+	err := fw.RemoveDNAT(*dnats[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dnats := getDeviceState(t, dev).DNATs; len(dnats) != 1 || dnats[0].NATTo.IP.String() != "10.0.1.10" {
+		t.Errorf("DNATs: %v", dnats)
+	}
+
+	snat := networkControl.SNAT{
+		Sources:      networkControl.SNATSources{{IPNet: ipnet4("10.0.1.0", 24), IfName: "dmz"}},
+		NATTo:        ip4("192.0.2.30"),
+		FWSMGlobalId: 2,
+	}
+	err = fw.AddSNAT(snat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snats := getDeviceState(t, dev).SNATs; len(snats) != 2 || !reflect.DeepEqual(*snats[1], snat) {
+		t.Errorf("SNATs: %v", snats)
+	}
+}
+
+func TestFirewallError(t *testing.T) {
+	fw, dev := newTestFirewall(t)
+	dev.SetResponse("access-list", "ERROR: % Invalid input detected at '^' marker.")
+
+	err := fw.AddACL(networkControl.ACL{
+		Name:      "inside_in",
+		VLANNames: []string{"inside"},
+		Rules:     networkControl.ACLRules{{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_IP, FromNet: ipnet4("10.0.0.0", 24), ToNet: ipnet4("0.0.0.0", 0)}},
+	})
+	if err == nil {
+		t.Fatal("an error is expected")
+	}
+	commands := dev.GetCommands()
+	if commands[len(commands)-1] != "end" {
+		t.Errorf("the configuration mode is not left: %v", commands)
+	}
+	if getACL(getDeviceState(t, dev), "inside_in") != nil || strings.Contains(dev.GetRunningConfig(), "access-group inside_in") {
+		t.Errorf("the ACL is bound after the failure:\n%v", dev.GetRunningConfig())
+	}
+}
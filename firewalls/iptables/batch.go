@@ -0,0 +1,462 @@
+package iptables
+
+// A batch collects rule changes in memory and writes them to the kernel by one
+// `iptables-restore --noflush` per table, so each table is changed atomically.
+//
+// The batch keeps a model of each touched table (loaded from `iptables-save`) to answer
+// List/Exists/ListChains the way the kernel would answer them after the changes, a journal of
+// iptables commands which reproduce the changes on the kernel and an inverse journal which undoes
+// them (rules are deleted by their specification, so the rules added meanwhile by other software
+// are kept).
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	ipt "github.com/coreos/go-iptables/iptables"
+)
+
+var (
+	errNoBatch      = errors.New("there's no batch in progress")
+	errBatchStarted = errors.New("a batch is already in progress")
+
+	// batchTablesOrder is the order to commit tables in (the filter table is the last, so the
+	// traffic is not permitted until the rest is in place)
+	batchTablesOrder = []string{"mangle", "nat", "filter"}
+)
+
+// IPTables is the subset of go-iptables methods used by the firewall. It's implemented by
+// *ipt.IPTables (the kernel) and by MemoryIPTables (see NewFirewallWithIPTables()).
+type IPTables interface {
+	Append(table, chain string, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	ClearChain(table, chain string) error
+	Delete(table, chain string, rulespec ...string) error
+	DeleteChain(table, chain string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+	ListChains(table string) ([]string, error)
+	NewChain(table, chain string) error
+	RenameChain(table, oldChain, newChain string) error
+	Replace(table, chain string, pos int, rulespec ...string) error
+}
+
+var _ IPTables = &ipt.IPTables{}
+
+// batchBackend loads tables into a batch and writes the changes of the batch
+type batchBackend interface {
+	// save returns the table in the format of `iptables-save -t TABLE`
+	save(table string) ([]byte, error)
+
+	// restore applies the input in the format of `iptables-restore` ("isNoFlush" is the option "--noflush")
+	restore(input []byte, isNoFlush bool) error
+}
+
+type batchChain struct {
+	policy string // "" for user-defined chains
+	rules  [][]string
+}
+
+type batchTable struct {
+	chains     map[string]*batchChain
+	chainOrder []string // built-in chains in the order of `iptables-save`
+
+	journal []string
+
+	// inverse are the commands which undo the commands of the journal (one group per command)
+	inverse [][]string
+}
+
+type batch struct {
+	tables  map[string]*batchTable
+	backend batchBackend
+}
+
+func newBatch(backend batchBackend) *batch {
+	return &batch{
+		tables:  map[string]*batchTable{},
+		backend: backend,
+	}
+}
+
+// parseBatchTable parses the output of `iptables-save -t TABLE`
+func parseBatchTable(save []byte) *batchTable {
+	t := &batchTable{
+		chains: map[string]*batchChain{},
+	}
+	for _, line := range strings.Split(string(save), "\n") {
+		switch {
+		case strings.HasPrefix(line, ":"):
+			words := strings.Split(line[1:], " ")
+			chain := &batchChain{}
+			if len(words) > 1 && words[1] != "-" {
+				chain.policy = words[1]
+				t.chainOrder = append(t.chainOrder, words[0])
+			}
+			t.chains[words[0]] = chain
+		case strings.HasPrefix(line, "-A "):
+			words := splitRuleString(line)
+			chain := t.chains[words[1]]
+			if chain == nil {
+				continue
+			}
+			chain.rules = append(chain.rules, words[2:])
+		}
+	}
+	return t
+}
+
+func (b *batch) getTable(table string) (*batchTable, error) {
+	t := b.tables[table]
+	if t != nil {
+		return t, nil
+	}
+	save, err := b.backend.save(table)
+	if err != nil {
+		return nil, err
+	}
+	t = parseBatchTable(save)
+	b.tables[table] = t
+	return t, nil
+}
+
+func (b *batch) getChain(table, chainName string) (*batchTable, *batchChain, error) {
+	t, err := b.getTable(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain := t.chains[chainName]
+	if chain == nil {
+		return t, nil, fmt.Errorf("iptables: No chain/target/match by that name. (chain %v in table %v)", chainName, table)
+	}
+	return t, chain, nil
+}
+
+// isReferenced returns true if a rule of the table jumps to the chain
+func (t *batchTable) isReferenced(chainName string) bool {
+	for _, chain := range t.chains {
+		for _, rule := range chain.rules {
+			for idx := 1; idx < len(rule); idx++ {
+				if (rule[idx-1] == "-j" || rule[idx-1] == "-g") && rule[idx] == chainName {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// save returns the table in the format of `iptables-save -t TABLE` (without counters)
+func (t *batchTable) save(table string) []byte {
+	var output bytes.Buffer
+	fmt.Fprintf(&output, "*%v\n", table)
+	userChains := []string{}
+	for chainName, chain := range t.chains {
+		if chain.policy == "" {
+			userChains = append(userChains, chainName)
+		}
+	}
+	sort.Strings(userChains)
+	chainNames := append(append([]string{}, t.chainOrder...), userChains...)
+	for _, chainName := range chainNames {
+		policy := t.chains[chainName].policy
+		if policy == "" {
+			policy = "-"
+		}
+		fmt.Fprintf(&output, ":%v %v [0:0]\n", chainName, policy)
+	}
+	for _, chainName := range chainNames {
+		for _, rule := range t.chains[chainName].rules {
+			fmt.Fprintln(&output, ruleString(append([]string{"-A", chainName}, rule...)))
+		}
+	}
+	fmt.Fprintln(&output, "COMMIT")
+	return output.Bytes()
+}
+
+func (t *batchTable) log(words ...string) {
+	t.journal = append(t.journal, ruleString(words))
+}
+
+// logInverse adds the commands which undo the last command of the journal
+func (t *batchTable) logInverse(commands ...[]string) {
+	var group []string
+	for _, words := range commands {
+		group = append(group, ruleString(words))
+	}
+	t.inverse = append(t.inverse, group)
+}
+
+// inverseInput returns the input of `iptables-restore --noflush` which undoes the journal
+func (t *batchTable) inverseInput(table string) []byte {
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%v\n", table)
+	for idx := len(t.inverse) - 1; idx >= 0; idx-- {
+		for _, line := range t.inverse[idx] {
+			fmt.Fprintln(&input, line)
+		}
+	}
+	fmt.Fprintln(&input, "COMMIT")
+	return input.Bytes()
+}
+
+func (chain *batchChain) find(rule []string) int {
+	ruleStr := ruleString(rule)
+	for idx, curRule := range chain.rules {
+		if ruleString(curRule) == ruleStr {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (chain *batchChain) insert(idx int, rule []string) {
+	chain.rules = append(chain.rules, nil)
+	copy(chain.rules[idx+1:], chain.rules[idx:])
+	chain.rules[idx] = rule
+}
+
+func (b *batch) Append(table, chainName string, rulespec ...string) error {
+	t, chain, err := b.getChain(table, chainName)
+	if err != nil {
+		return err
+	}
+	rule := canonicalRule(rulespec)
+	chain.rules = append(chain.rules, rule)
+	t.log(append([]string{"-A", chainName}, rule...)...)
+	t.logInverse(append([]string{"-D", chainName}, rule...))
+	return nil
+}
+
+func (b *batch) AppendUnique(table, chainName string, rulespec ...string) error {
+	exists, err := b.Exists(table, chainName, rulespec...)
+	if err != nil || exists {
+		return err
+	}
+	return b.Append(table, chainName, rulespec...)
+}
+
+func (b *batch) Insert(table, chainName string, pos int, rulespec ...string) error {
+	t, chain, err := b.getChain(table, chainName)
+	if err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(chain.rules)+1 {
+		return fmt.Errorf("iptables: Index of insertion too big. (%v in chain %v)", pos, chainName)
+	}
+	rule := canonicalRule(rulespec)
+	chain.insert(pos-1, rule)
+	t.log(append([]string{"-I", chainName, strconv.Itoa(pos)}, rule...)...)
+	t.logInverse(append([]string{"-D", chainName}, rule...))
+	return nil
+}
+
+func (b *batch) Replace(table, chainName string, pos int, rulespec ...string) error {
+	t, chain, err := b.getChain(table, chainName)
+	if err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(chain.rules) {
+		return fmt.Errorf("iptables: Index of replacement too big. (%v in chain %v)", pos, chainName)
+	}
+	rule := canonicalRule(rulespec)
+	oldRule := chain.rules[pos-1]
+	chain.rules[pos-1] = rule
+	t.log(append([]string{"-R", chainName, strconv.Itoa(pos)}, rule...)...)
+	t.logInverse(append([]string{"-R", chainName, strconv.Itoa(pos)}, oldRule...))
+	return nil
+}
+
+// Delete deletes a rule by its specification or by its number (if the specification is just a number).
+// The journal deletes it by the specification anyway: the numbers of the rules in the kernel could
+// change until the commit.
+func (b *batch) Delete(table, chainName string, rulespec ...string) error {
+	t, chain, err := b.getChain(table, chainName)
+	if err != nil {
+		return err
+	}
+	var rule []string
+	idx := -1
+	if len(rulespec) == 1 {
+		if pos, err := strconv.Atoi(rulespec[0]); err == nil {
+			if pos < 1 || pos > len(chain.rules) {
+				return fmt.Errorf("iptables: Index of deletion too big. (%v in chain %v)", pos, chainName)
+			}
+			idx = pos - 1
+			rule = chain.rules[idx]
+		}
+	}
+	if idx < 0 {
+		rule = canonicalRule(rulespec)
+		idx = chain.find(rule)
+	}
+	if idx < 0 {
+		return fmt.Errorf("iptables: Bad rule (does a matching rule exist in that chain?). (%v in chain %v)", ruleString(rule), chainName)
+	}
+	chain.rules = append(chain.rules[:idx], chain.rules[idx+1:]...)
+	t.log(append([]string{"-D", chainName}, rule...)...)
+	t.logInverse(append([]string{"-I", chainName, strconv.Itoa(idx + 1)}, rule...))
+	return nil
+}
+
+func (b *batch) Exists(table, chainName string, rulespec ...string) (bool, error) {
+	_, chain, err := b.getChain(table, chainName)
+	if err != nil {
+		return false, err
+	}
+	return chain.find(canonicalRule(rulespec)) >= 0, nil
+}
+
+// List returns the rules of the chain in the format of `iptables -S CHAIN`
+func (b *batch) List(table, chainName string) (result []string, err error) {
+	_, chain, err := b.getChain(table, chainName)
+	if err != nil {
+		return nil, err
+	}
+	if chain.policy != "" {
+		result = append(result, "-P "+chainName+" "+chain.policy)
+	} else {
+		result = append(result, "-N "+chainName)
+	}
+	for _, rule := range chain.rules {
+		result = append(result, ruleString(append([]string{"-A", chainName}, rule...)))
+	}
+	return
+}
+
+// ListChains returns built-in chains and then user-defined chains in alphabetical order (like `iptables -S`)
+func (b *batch) ListChains(table string) ([]string, error) {
+	t, err := b.getTable(table)
+	if err != nil {
+		return nil, err
+	}
+	userChains := []string{}
+	for chainName, chain := range t.chains {
+		if chain.policy == "" {
+			userChains = append(userChains, chainName)
+		}
+	}
+	sort.Strings(userChains)
+	return append(append([]string{}, t.chainOrder...), userChains...), nil
+}
+
+func (b *batch) NewChain(table, chainName string) error {
+	t, err := b.getTable(table)
+	if err != nil {
+		return err
+	}
+	if t.chains[chainName] != nil {
+		return fmt.Errorf("iptables: Chain already exists. (chain %v in table %v)", chainName, table)
+	}
+	t.chains[chainName] = &batchChain{}
+	t.log("-N", chainName)
+	t.logInverse([]string{"-X", chainName})
+	return nil
+}
+
+// ClearChain flushes the chain or creates it if it doesn't exist
+func (b *batch) ClearChain(table, chainName string) error {
+	t, err := b.getTable(table)
+	if err != nil {
+		return err
+	}
+	chain := t.chains[chainName]
+	if chain == nil {
+		return b.NewChain(table, chainName)
+	}
+	var inverse [][]string
+	for _, rule := range chain.rules {
+		inverse = append(inverse, append([]string{"-A", chainName}, rule...))
+	}
+	chain.rules = nil
+	t.log("-F", chainName)
+	t.logInverse(inverse...)
+	return nil
+}
+
+func (b *batch) DeleteChain(table, chainName string) error {
+	t, chain, err := b.getChain(table, chainName)
+	if err != nil {
+		return err
+	}
+	if chain.policy != "" || len(chain.rules) > 0 {
+		return fmt.Errorf("iptables: Directory not empty. (chain %v in table %v)", chainName, table)
+	}
+	if t.isReferenced(chainName) {
+		return fmt.Errorf("iptables: Too many links. (chain %v in table %v)", chainName, table)
+	}
+	delete(t.chains, chainName)
+	t.log("-X", chainName)
+	t.logInverse([]string{"-N", chainName})
+	return nil
+}
+
+func (b *batch) RenameChain(table, oldChainName, newChainName string) error {
+	t, chain, err := b.getChain(table, oldChainName)
+	if err != nil {
+		return err
+	}
+	if t.chains[newChainName] != nil {
+		return fmt.Errorf("iptables: File exists. (chain %v in table %v)", newChainName, table)
+	}
+	delete(t.chains, oldChainName)
+	t.chains[newChainName] = chain
+
+	// the jumps to the chain are renamed by the kernel as well
+	for _, curChain := range t.chains {
+		for _, rule := range curChain.rules {
+			for idx := 1; idx < len(rule); idx++ {
+				if (rule[idx-1] == "-j" || rule[idx-1] == "-g") && rule[idx] == oldChainName {
+					rule[idx] = newChainName
+				}
+			}
+		}
+	}
+	t.log("-E", oldChainName, newChainName)
+	t.logInverse([]string{"-E", newChainName, oldChainName})
+	return nil
+}
+
+// Commit writes the journal to the kernel, one transaction per table. If a table cannot be
+// committed then the changes of the already committed tables are undone by their inverse journals.
+func (b *batch) Commit() error {
+	committed := map[string]*batchTable{}
+	for _, table := range batchTablesOrder {
+		t := b.tables[table]
+		if t == nil || len(t.journal) == 0 {
+			continue
+		}
+		var input bytes.Buffer
+		fmt.Fprintf(&input, "*%v\n", table)
+		for _, line := range t.journal {
+			fmt.Fprintln(&input, line)
+		}
+		fmt.Fprintln(&input, "COMMIT")
+
+		err := b.backend.restore(input.Bytes(), true)
+		if err != nil {
+			rollbackErr := b.rollbackCommitted(committed)
+			if rollbackErr != nil {
+				return fmt.Errorf("%v (and cannot roll back: %v)", err, rollbackErr)
+			}
+			return err
+		}
+		committed[table] = t
+	}
+	return nil
+}
+
+func (b *batch) rollbackCommitted(tables map[string]*batchTable) (err error) {
+	for table, t := range tables {
+		curErr := b.backend.restore(t.inverseInput(table), true)
+		if curErr != nil {
+			err = curErr
+		}
+	}
+	return
+}
@@ -0,0 +1,115 @@
+package iptables
+
+// External commands (iptables-save, iptables-restore, ipset) are run by a CommandRunner, so the
+// firewall could manage iptables of another network namespace (see Config.RunCommand).
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CommandRunner runs an external command with "input" as stdin and returns its stdout (the error contains stderr)
+type CommandRunner func(input []byte, name string, args ...string) ([]byte, error)
+
+// runCommand is the default CommandRunner, it runs the command in the current network namespace
+func runCommand(input []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return stdout.Bytes(), fmt.Errorf("%v %v: %v: %v", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// runCommand runs an external command by Config.RunCommand (or in the current network namespace if it's not set)
+func (fw iptables) runCommand(input []byte, name string, args ...string) ([]byte, error) {
+	if fw.config.RunCommand != nil {
+		return fw.config.RunCommand(input, name, args...)
+	}
+	return runCommand(input, name, args...)
+}
+
+// commandBackend is the batchBackend of the kernel, it uses iptables-save and iptables-restore
+type commandBackend struct {
+	run CommandRunner
+}
+
+func (backend commandBackend) save(table string) ([]byte, error) {
+	return backend.run(nil, "iptables-save", "-t", table)
+}
+
+func (backend commandBackend) restore(input []byte, isNoFlush bool) error {
+	args := []string{}
+	if isNoFlush {
+		args = append(args, "--noflush")
+	}
+	_, err := backend.run(input, "iptables-restore", args...)
+	return err
+}
+
+// commandIPTables is IPTables on top of a CommandRunner (instead of go-iptables which always runs
+// iptables in the current network namespace). Each change is a batch of one command.
+type commandIPTables struct {
+	commandBackend
+}
+
+var _ IPTables = commandIPTables{}
+
+func newCommandIPTables(run CommandRunner) commandIPTables {
+	return commandIPTables{commandBackend{run: run}}
+}
+
+// change applies "fn" to a new batch and commits it
+func (c commandIPTables) change(fn func(b *batch) error) error {
+	b := newBatch(c.commandBackend)
+	err := fn(b)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+func (c commandIPTables) Append(table, chain string, rulespec ...string) error {
+	return c.change(func(b *batch) error { return b.Append(table, chain, rulespec...) })
+}
+func (c commandIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	return c.change(func(b *batch) error { return b.AppendUnique(table, chain, rulespec...) })
+}
+func (c commandIPTables) ClearChain(table, chain string) error {
+	return c.change(func(b *batch) error { return b.ClearChain(table, chain) })
+}
+func (c commandIPTables) Delete(table, chain string, rulespec ...string) error {
+	return c.change(func(b *batch) error { return b.Delete(table, chain, rulespec...) })
+}
+func (c commandIPTables) DeleteChain(table, chain string) error {
+	return c.change(func(b *batch) error { return b.DeleteChain(table, chain) })
+}
+func (c commandIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return newBatch(c.commandBackend).Exists(table, chain, rulespec...)
+}
+func (c commandIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	return c.change(func(b *batch) error { return b.Insert(table, chain, pos, rulespec...) })
+}
+func (c commandIPTables) List(table, chain string) ([]string, error) {
+	return newBatch(c.commandBackend).List(table, chain)
+}
+func (c commandIPTables) ListChains(table string) ([]string, error) {
+	return newBatch(c.commandBackend).ListChains(table)
+}
+func (c commandIPTables) NewChain(table, chain string) error {
+	return c.change(func(b *batch) error { return b.NewChain(table, chain) })
+}
+func (c commandIPTables) RenameChain(table, oldChain, newChain string) error {
+	return c.change(func(b *batch) error { return b.RenameChain(table, oldChain, newChain) })
+}
+func (c commandIPTables) Replace(table, chain string, pos int, rulespec ...string) error {
+	return c.change(func(b *batch) error { return b.Replace(table, chain, pos, rulespec...) })
+}
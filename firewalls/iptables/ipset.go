@@ -0,0 +1,325 @@
+package iptables
+
+// Interfaces of security levels could be matched by ipsets "hash:net,iface" (see Config.UseIPSets):
+// the set of a security level contains "0.0.0.0/0,IFACE" of each interface of the level, so
+// "filter SECURITY_LEVELs" needs one rule per security level instead of the marks set by a rule
+// per interface in "mangle IN_SECURITY_LEVELs"/"mangle OUT_SECURITY_LEVELs".
+//
+// The mode was disabled because of https://bugzilla.kernel.org/show_bug.cgi?id=199107 (entries
+// "0.0.0.0/0,IFACE" were not matched), so the kernel is probed before the mode is used (see probeIPSets).
+//
+// The sets are changed together with the rules: the changes are collected by ipsetModel during a
+// batch and written by `ipset restore` in two steps around the commit of the rules (the sets are
+// created and filled before the rules referencing them appear and destroyed after the rules disappear).
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	errIPSetsUnsafe = errors.New(`the kernel doesn't match "hash:net,iface" entries with "0.0.0.0/0" correctly (see https://bugzilla.kernel.org/show_bug.cgi?id=199107)`)
+)
+
+const (
+	ipsetType   = "hash:net,iface"
+	ipsetParams = "hashsize 4096 maxelem 4096"
+)
+
+func ipsetRestore(run CommandRunner, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	_, err := run([]byte(strings.Join(lines, "\n")+"\n"), "ipset", "restore", "-exist")
+	return err
+}
+
+// ipsetIfaceEntry returns the entry of a set "hash:net,iface" which matches all the traffic of the interface
+func ipsetIfaceEntry(hostIfName string) string {
+	return "0.0.0.0/0," + hostIfName
+}
+
+// parseIPSetIfaceEntry returns the interface of an entry "0.0.0.0/0,IFACE"
+func parseIPSetIfaceEntry(entry string) (string, bool) {
+	if !strings.HasPrefix(entry, "0.0.0.0/0,") {
+		return "", false
+	}
+	return strings.TrimPrefix(entry, "0.0.0.0/0,"), true
+}
+
+// ipsetModel is a model of the sets (loaded from `ipset save`) with the journal of changes
+type ipsetModel struct {
+	run  CommandRunner
+	sets map[string]map[string]bool // the name of a set -> entries
+
+	before []string // creations and additions, they're written before the rules
+	undo   []string // reverts "before" if the rules cannot be written
+	after  []string // deletions and destructions, they're written after the rules
+}
+
+func (fw iptables) loadIPSets() (*ipsetModel, error) {
+	save, err := fw.runCommand(nil, "ipset", "save")
+	if err != nil {
+		return nil, err
+	}
+	m := parseIPSets(save)
+	m.run = fw.runCommand
+	return m, nil
+}
+
+// parseIPSets parses the output of `ipset save`
+func parseIPSets(save []byte) *ipsetModel {
+	m := &ipsetModel{
+		sets: map[string]map[string]bool{},
+	}
+	for _, line := range strings.Split(string(save), "\n") {
+		words := strings.Fields(line)
+		if len(words) < 2 {
+			continue
+		}
+		switch words[0] {
+		case "create":
+			m.sets[words[1]] = map[string]bool{}
+		case "add":
+			if m.sets[words[1]] == nil || len(words) < 3 {
+				continue
+			}
+			m.sets[words[1]][words[2]] = true
+		}
+	}
+	return m
+}
+
+func (m *ipsetModel) Names() (result []string) {
+	for name := range m.sets {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return
+}
+
+func (m *ipsetModel) Entries(name string) (result []string) {
+	for entry := range m.sets[name] {
+		result = append(result, entry)
+	}
+	sort.Strings(result)
+	return
+}
+
+func (m *ipsetModel) Create(name string) {
+	if m.sets[name] != nil {
+		return
+	}
+	m.sets[name] = map[string]bool{}
+	m.before = append(m.before, "create "+name+" "+ipsetType+" "+ipsetParams)
+	m.undo = append(m.undo, "destroy "+name)
+}
+
+func (m *ipsetModel) Add(name, entry string) {
+	if m.sets[name] == nil || m.sets[name][entry] {
+		return
+	}
+	m.sets[name][entry] = true
+	m.before = append(m.before, "add "+name+" "+entry)
+	m.undo = append(m.undo, "del "+name+" "+entry)
+}
+
+func (m *ipsetModel) Del(name, entry string) {
+	if !m.sets[name][entry] {
+		return
+	}
+	delete(m.sets[name], entry)
+	m.after = append(m.after, "del "+name+" "+entry)
+}
+
+func (m *ipsetModel) Destroy(name string) {
+	if m.sets[name] == nil {
+		return
+	}
+	delete(m.sets, name)
+	m.after = append(m.after, "destroy "+name)
+}
+
+func (m *ipsetModel) commitBefore() error {
+	return ipsetRestore(m.run, m.before)
+}
+
+func (m *ipsetModel) rollbackBefore() error {
+	undo := make([]string, 0, len(m.undo))
+	for idx := len(m.undo) - 1; idx >= 0; idx-- {
+		undo = append(undo, m.undo[idx])
+	}
+	return ipsetRestore(m.run, undo)
+}
+
+func (m *ipsetModel) commitAfter() error {
+	return ipsetRestore(m.run, m.after)
+}
+
+// probeIPSets checks if the kernel matches entries "0.0.0.0/0,IFACE" of sets "hash:net,iface"
+// (`ipset test` uses the same lookup as the "set" match of iptables)
+func (fw iptables) probeIPSets() error {
+	name := fw.chain("PROBE.NET_IFACE")
+	err := ipsetRestore(fw.runCommand, []string{
+		"create " + name + " " + ipsetType + " " + ipsetParams,
+		"flush " + name,
+		"add " + name + " " + ipsetIfaceEntry("nc-probe0"),
+	})
+	if err != nil {
+		return err
+	}
+	defer fw.runCommand(nil, "ipset", "destroy", name)
+
+	_, matchErr := fw.runCommand(nil, "ipset", "test", name, "192.0.2.1,nc-probe0")
+	_, otherMatchErr := fw.runCommand(nil, "ipset", "test", name, "192.0.2.1,nc-probe1")
+	isMatched, isOtherMatched := matchErr == nil, otherMatchErr == nil
+	if !isMatched || isOtherMatched {
+		return errIPSetsUnsafe
+	}
+	return nil
+}
+
+// getIPSets returns the model of the sets. The changes are kept only during a batch (if ipsets
+// are used then the model is loaded by BeginBatch(), otherwise it's loaded on the first use).
+func (fw *iptables) getIPSets() (*ipsetModel, error) {
+	if fw.ipsets != nil {
+		return fw.ipsets, nil
+	}
+	ipsets, err := fw.loadIPSets()
+	if err != nil {
+		return nil, err
+	}
+	if fw.batch != nil {
+		fw.ipsets = ipsets
+	}
+	return ipsets, nil
+}
+
+// isOwnIPSet returns true if the set is a set of a security level of the firewall
+func (fw iptables) isOwnIPSet(name string) bool {
+	_, ok := fw.parseSecurityLevelChainName(name)
+	return ok
+}
+
+// ipsetSecurityLevelIfNames returns the interfaces (names in the host) of each security level of the sets
+func (fw *iptables) ipsetSecurityLevelIfNames() (map[int][]string, error) {
+	ipsets, err := fw.getIPSets()
+	if err != nil {
+		return nil, err
+	}
+	result := map[int][]string{}
+	for _, name := range ipsets.Names() {
+		securityLevel, ok := fw.parseSecurityLevelChainName(name)
+		if !ok {
+			continue
+		}
+		result[securityLevel] = []string{}
+		for _, entry := range ipsets.Entries(name) {
+			hostIfName, ok := parseIPSetIfaceEntry(entry)
+			if !ok {
+				continue
+			}
+			result[securityLevel] = append(result[securityLevel], hostIfName)
+		}
+	}
+	return result, nil
+}
+
+// ipsetSetSecurityLevel moves the interface to the set of the security level ("securityLevel" -1 means to remove it from the sets)
+func (fw *iptables) ipsetSetSecurityLevel(hostIfName string, securityLevel int) error {
+	ipsets, err := fw.getIPSets()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	entry := ipsetIfaceEntry(hostIfName)
+	if securityLevel != -1 {
+		name := fw.securityLevelChainName(securityLevel)
+		ipsets.Create(name)
+		ipsets.Add(name, entry)
+	}
+	for _, name := range ipsets.Names() {
+		if !fw.isOwnIPSet(name) || (securityLevel != -1 && name == fw.securityLevelChainName(securityLevel)) {
+			continue
+		}
+		ipsets.Del(name, entry)
+	}
+	return nil
+}
+
+// migrateSecurityLevels moves the interfaces of security levels set in the other mode (marks or
+// ipsets, see Config.UseIPSets) to the current mode. The marks should be recovered already.
+func (fw *iptables) migrateSecurityLevels() error {
+	if fw.isIPSetsUsed {
+		rules, err := fw.listMarkRules("mangle", fw.chain("IN_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelIn)
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		fw.Infof("Moving the security levels of %v interfaces from marks to ipsets", len(rules))
+		for _, rule := range rules {
+			err := fw.ipsetSetSecurityLevel(rule.ifName, rule.securityLevel)
+			if err != nil {
+				return err
+			}
+		}
+		for _, chainName := range []string{fw.chain("IN_SECURITY_LEVELs"), fw.chain("OUT_SECURITY_LEVELs")} {
+			err := fw.iptables.ClearChain("mangle", chainName)
+			if err != nil {
+				fw.LogError(err, chainName)
+				return err
+			}
+		}
+		fw.markToSecurityLevel = map[int]*int{}
+		fw.securityLevelToMark = map[int]int{}
+		return fw.gcSecurityLevels()
+	}
+
+	ipsets, err := fw.getIPSets()
+	if err != nil { // ipset is not installed, there's nothing to migrate
+		fw.Debugf("iptables.migrateSecurityLevels(): %v", err)
+		return nil
+	}
+	isMigrated := false
+	for _, name := range ipsets.Names() {
+		securityLevel, ok := fw.parseSecurityLevelChainName(name)
+		if !ok {
+			continue
+		}
+		for _, entry := range ipsets.Entries(name) {
+			hostIfName, ok := parseIPSetIfaceEntry(entry)
+			if !ok {
+				continue
+			}
+			fw.Infof("Moving the security level %v of interface %v from ipsets to marks", securityLevel, hostIfName)
+			isMigrated = true
+			err := fw.addSecurityLevel(securityLevel)
+			if err != nil {
+				fw.LogError(err)
+				return err
+			}
+			err = fw.addSecurityLevelRules(hostIfName, securityLevel)
+			if err != nil {
+				fw.LogError(err)
+				return err
+			}
+		}
+	}
+	if !isMigrated {
+		return nil
+	}
+	err = fw.gcSecurityLevels()
+	if err != nil {
+		return err
+	}
+	for _, name := range ipsets.Names() { // not referenced by the rules anymore
+		if fw.isOwnIPSet(name) {
+			ipsets.Destroy(name)
+		}
+	}
+	return nil
+}
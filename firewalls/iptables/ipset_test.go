@@ -0,0 +1,302 @@
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/xaionaro-go/networkControl/hosts/memory"
+)
+
+// fakeIPSet is the `ipset` command of a kernel with MemoryIPTables: a set cannot be destroyed while
+// a rule references it and a rule cannot reference a set which doesn't exist
+type fakeIPSet struct {
+	*MemoryIPTables
+	sets       map[string]map[string]bool
+	transcript []string // "ipset ..." and "iptables-restore *TABLE" in the order of execution
+
+	isBuggy     bool   // entries "0.0.0.0/0,IFACE" are not matched (https://bugzilla.kernel.org/show_bug.cgi?id=199107)
+	failedTable string // iptables-restore of the table fails
+}
+
+func newFakeIPSet() *fakeIPSet {
+	return &fakeIPSet{
+		MemoryIPTables: NewMemoryIPTables(),
+		sets:           map[string]map[string]bool{},
+	}
+}
+
+// isReferenced returns true if a rule of the filter table matches the set
+func (f *fakeIPSet) isReferenced(name string) bool {
+	save, _ := f.MemoryIPTables.Save("filter")
+	return strings.Contains(save, "--match-set "+name+" ")
+}
+
+func (f *fakeIPSet) restore(input []byte, isNoFlush bool) error {
+	f.transcript = append(f.transcript, "iptables-restore "+strings.SplitN(string(input), "\n", 2)[0])
+	if strings.HasPrefix(string(input), "*"+f.failedTable+"\n") {
+		return errors.New("injected failure")
+	}
+	words := strings.Fields(string(input))
+	for idx := 0; idx+1 < len(words); idx++ {
+		if words[idx] == "--match-set" && f.sets[words[idx+1]] == nil {
+			return fmt.Errorf("Set %v doesn't exist.", words[idx+1])
+		}
+	}
+	return f.MemoryIPTables.restore(input, isNoFlush)
+}
+
+func (f *fakeIPSet) ipsetCommand(words []string, isExist bool) error {
+	if len(words) < 2 {
+		return fmt.Errorf("unknown command: %v", words)
+	}
+	name, set := words[1], f.sets[words[1]]
+	switch words[0] {
+	case "create":
+		if set != nil && !isExist {
+			return fmt.Errorf("set %v already exists", name)
+		}
+		if set == nil {
+			f.sets[name] = map[string]bool{}
+		}
+		return nil
+	case "destroy":
+		if set == nil {
+			return fmt.Errorf("the set %v does not exist", name)
+		}
+		if f.isReferenced(name) {
+			return fmt.Errorf("set %v cannot be destroyed: it is in use by a kernel component", name)
+		}
+		delete(f.sets, name)
+		return nil
+	}
+	if set == nil {
+		return fmt.Errorf("the set %v does not exist", name)
+	}
+	switch words[0] {
+	case "flush":
+		f.sets[name] = map[string]bool{}
+	case "add", "del":
+		if len(words) < 3 {
+			return fmt.Errorf("unknown command: %v", words)
+		}
+		if set[words[2]] == (words[0] == "add") && !isExist {
+			return fmt.Errorf("element %v: %v", words[0], words[2])
+		}
+		if words[0] == "add" {
+			set[words[2]] = true
+		} else {
+			delete(set, words[2])
+		}
+	case "test":
+		if len(words) < 3 {
+			return fmt.Errorf("unknown command: %v", words)
+		}
+		ifName := words[2][strings.Index(words[2], ",")+1:]
+		if !set[ipsetIfaceEntry(ifName)] || f.isBuggy {
+			return fmt.Errorf("%v is NOT in set %v", words[2], name)
+		}
+	default:
+		return fmt.Errorf("unknown command: %v", words)
+	}
+	return nil
+}
+
+// run is the CommandRunner of the firewall (see Config.RunCommand)
+func (f *fakeIPSet) run(input []byte, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	f.transcript = append(f.transcript, command)
+	switch {
+	case command == "ipset save":
+		var save strings.Builder
+		var names []string
+		for name := range f.sets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&save, "create %v %v family inet %v\n", name, ipsetType, ipsetParams)
+			var entries []string
+			for entry := range f.sets[name] {
+				entries = append(entries, entry)
+			}
+			sort.Strings(entries)
+			for _, entry := range entries {
+				fmt.Fprintf(&save, "add %v %v\n", name, entry)
+			}
+		}
+		return []byte(save.String()), nil
+	case command == "ipset restore -exist":
+		for _, line := range strings.Split(strings.TrimSpace(string(input)), "\n") {
+			f.transcript = append(f.transcript, "  "+line)
+			err := f.ipsetCommand(strings.Fields(line), true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case name == "ipset":
+		return nil, f.ipsetCommand(args, false)
+	}
+	return nil, fmt.Errorf("unexpected command: %v", command)
+}
+
+func newIPSetTestFirewall(t *testing.T, f *fakeIPSet, useIPSets bool) *iptables {
+	config := DefaultConfig()
+	config.UseIPSets = useIPSets
+	config.RunCommand = f.run
+	fw, err := NewFirewallWithIPTables(memoryHost.NewHost(), config, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fw.(*iptables)
+}
+
+// transcriptIndex returns the index of the first line of the transcript with the prefix (starting from "from")
+func transcriptIndex(t *testing.T, transcript []string, from int, prefix string) int {
+	t.Helper()
+	for idx := from; idx < len(transcript); idx++ {
+		if strings.HasPrefix(transcript[idx], prefix) {
+			return idx
+		}
+	}
+	t.Fatalf("%q is not found in the transcript:\n%v", prefix, strings.Join(transcript[from:], "\n"))
+	return -1
+}
+
+func TestProbeIPSets(t *testing.T) {
+	for _, isBuggy := range []bool{false, true} {
+		f := newFakeIPSet()
+		f.isBuggy = isBuggy
+		fw := newIPSetTestFirewall(t, f, true)
+		if fw.IsIPSetsUsed() == isBuggy {
+			t.Errorf("ipsets are used: %v, the kernel is buggy: %v", fw.IsIPSetsUsed(), isBuggy)
+		}
+		if len(f.sets) != 0 {
+			t.Errorf("the probe set is left: %v", f.sets)
+		}
+	}
+}
+
+func TestIPSetsOrder(t *testing.T) {
+	f := newFakeIPSet()
+	fw := newIPSetTestFirewall(t, f, true)
+
+	from := len(f.transcript)
+	err := fw.SetSecurityLevel("inside", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the set is filled before the rules referencing it appear
+	create := transcriptIndex(t, f.transcript, from, "  create IFACES.SECURITY_LEVEL.100 ")
+	add := transcriptIndex(t, f.transcript, from, "  add IFACES.SECURITY_LEVEL.100 0.0.0.0/0,inside")
+	rules := transcriptIndex(t, f.transcript, from, "iptables-restore *filter")
+	if !(create < add && add < rules) {
+		t.Errorf("wrong order:\n%v", strings.Join(f.transcript[from:], "\n"))
+	}
+
+	from = len(f.transcript)
+	err = fw.UnsetSecurityLevel("inside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the set is destroyed after the rules referencing it disappear
+	rules = transcriptIndex(t, f.transcript, from, "iptables-restore *filter")
+	destroy := transcriptIndex(t, f.transcript, from, "  destroy IFACES.SECURITY_LEVEL.100")
+	if rules > destroy {
+		t.Errorf("wrong order:\n%v", strings.Join(f.transcript[from:], "\n"))
+	}
+	if len(f.sets) != 0 {
+		t.Errorf("sets are left: %v", f.sets)
+	}
+}
+
+func TestIPSetsRollbackBefore(t *testing.T) {
+	f := newFakeIPSet()
+	fw := newIPSetTestFirewall(t, f, true)
+	err := fw.SetSecurityLevel("inside", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterBefore, _ := f.Save("filter")
+
+	f.failedTable = "filter"
+	err = fw.SetSecurityLevel("dmz", 50)
+	if err == nil {
+		t.Fatalf("an error is expected")
+	}
+	expectedSets := map[string]map[string]bool{"IFACES.SECURITY_LEVEL.100": {"0.0.0.0/0,inside": true}}
+	if !reflect.DeepEqual(f.sets, expectedSets) {
+		t.Errorf("sets: %v, expected: %v", f.sets, expectedSets)
+	}
+	checkSave(t, f.MemoryIPTables, "filter", filterBefore)
+
+	f.failedTable = ""
+	if securityLevel := fw.InquireSecurityLevel("dmz"); securityLevel != -1 {
+		t.Errorf("security level of dmz: %v", securityLevel)
+	}
+}
+
+// securityLevelsInquiry is the state of the security levels inquired from a firewall
+type securityLevelsInquiry struct {
+	SecurityLevels       []int
+	IfaceSecurityLevels  map[string]int
+	PermitInterInterface bool
+	PermitIntraInterface bool
+}
+
+func inquireSecurityLevels(fw *iptables) (result securityLevelsInquiry) {
+	result.SecurityLevels = fw.GetSecurityLevels()
+	sort.Ints(result.SecurityLevels)
+	result.IfaceSecurityLevels = map[string]int{}
+	for _, ifName := range []string{"inside", "dmz", "outside", "guest"} {
+		result.IfaceSecurityLevels[ifName] = fw.InquireSecurityLevel(ifName)
+	}
+	result.PermitInterInterface = fw.InquirePermitInterInterface()
+	result.PermitIntraInterface = fw.InquirePermitIntraInterface()
+	return
+}
+
+func TestIPSetsModesInquire(t *testing.T) {
+	inquired := map[bool][]securityLevelsInquiry{}
+	for _, useIPSets := range []bool{false, true} {
+		f := newFakeIPSet()
+		fw := newIPSetTestFirewall(t, f, useIPSets)
+		if fw.IsIPSetsUsed() != useIPSets {
+			t.Fatalf("ipsets are used: %v", fw.IsIPSetsUsed())
+		}
+		for _, err := range []error{
+			fw.SetSecurityLevel("inside", 100),
+			fw.SetSecurityLevel("dmz", 50),
+			fw.SetSecurityLevel("outside", 0),
+			fw.SetSecurityLevel("guest", 50),
+			fw.SetEnablePermitInterInterface(true),
+			fw.SetSecurityLevel("dmz", 100),
+			fw.UnsetSecurityLevel("outside"),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		inquired[useIPSets] = append(inquired[useIPSets], inquireSecurityLevels(fw))
+
+		// after a restart
+		inquired[useIPSets] = append(inquired[useIPSets], inquireSecurityLevels(newIPSetTestFirewall(t, f, useIPSets)))
+	}
+
+	expected := securityLevelsInquiry{
+		SecurityLevels:       []int{50, 100},
+		IfaceSecurityLevels:  map[string]int{"inside": 100, "dmz": 100, "outside": -1, "guest": 50},
+		PermitInterInterface: true,
+	}
+	for _, useIPSets := range []bool{false, true} {
+		for idx, result := range inquired[useIPSets] {
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("ipsets: %v, inquiry #%v: %+v, expected: %+v", useIPSets, idx, result, expected)
+			}
+		}
+	}
+}
@@ -7,80 +7,208 @@ import (
 	ipt "github.com/coreos/go-iptables/iptables"
 	"github.com/xaionaro-go/networkControl"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 )
 
 var (
 	errNotImplemented = errors.New("not implemented (yet?)")
+	errNoCommentTag   = errors.New("the comment tag should not be empty")
 	denyCommand       = `DROP`
 	denyToOtherGWs    = true
+
+	// aclIncrementalEditsLimit is the maximal amount of rule-level edits to update an ACL chain in place.
+	// If more edits are required then a new version of the chain is built and switched to.
+	aclIncrementalEditsLimit = 10
 )
 
 type iptables struct {
 	networkControl.FirewallBase
-	iptables              *ipt.IPTables
-	isSameSecurityTraffic bool
+	iptables     IPTables // "baseIPTables" or "batch"
+	baseIPTables IPTables
+	config       Config
+
+	// the "same-security-traffic" settings, see sameSecurityTraffic.go
+	permitInterInterface bool
+	permitIntraInterface bool
+
+	// isIPSetsUsed is true if interfaces of security levels are matched by ipsets instead of marks (see ipset.go)
+	isIPSetsUsed bool
+	ipsets       *ipsetModel // the sets with the changes of the current batch
+
+	markToSecurityLevel map[int]*int
+	securityLevelToMark map[int]int
+
+	// batch collects the changes between BeginBatch() and CommitBatch(); the mark maps and the
+	// "same-security-traffic" settings are backed up to restore them on RollbackBatch()
+	batch                     *batch
+	batchMarkToSecurityLevel  map[int]*int
+	batchSecurityLevelToMark  map[int]int
+	batchPermitInterInterface bool
+	batchPermitIntraInterface bool
+}
+
+// Config is the configuration of the firewall, see NewFirewallWithConfig()
+type Config struct {
+	MarkLayout MarkLayout
+
+	// ChainPrefix is prepended to the names of all the chains of the firewall (to not collide with
+	// chains of other software). Chain names are limited to 28 characters, so it should be short.
+	// It's empty by default, because older versions created the chains without a prefix: with a
+	// default prefix an upgraded host would get a second set of chains next to the old ones.
+	ChainPrefix string
+
+	// CommentTag is the comment of the rules the firewall puts into built-in chains. The firewall
+	// touches only its own chains and the rules of built-in chains with this comment.
+	CommentTag string
+
+	// MigrateLegacyRules enables the removal of rules left by older versions on start: the rules of
+	// built-in chains without the comment tag (see legacyRules), the ACL marks of "mangle ACLs" and,
+	// if there's a ChainPrefix, the chains without the prefix. It's disabled by default, because such
+	// rules could be put by other software or by the administrator.
+	MigrateLegacyRules bool
+
+	Hooks Hooks
 
-	markToSecurityLevel   map[int]*int
-	securityLevelToMark   map[int]int
-	markMax_securityLevel int
+	// UseIPSets enables matching of interfaces of security levels by ipsets "hash:net,iface" instead of
+	// marks (see ipset.go). It's used only if the kernel passes the probe, otherwise marks are used.
+	// ACLs are bound to interfaces by jumps of "filter ACLs" in both modes.
+	UseIPSets bool
 
-	markToACL   map[int]string
-	aclToMark   map[string]int
-	markMax_ACL int
+	// RunCommand runs iptables-save, iptables-restore and ipset (nil means to run them in the current
+	// network namespace). If it's set then go-iptables is not used (see NewFirewallWithConfig()).
+	RunCommand CommandRunner `json:"-"`
+}
+
+// Hooks defines which rules the firewall puts into built-in chains. If a hook is disabled then the
+// administrator is supposed to add the jumps to the chains of the firewall.
+type Hooks struct {
+	// Forward enables jumps from "mangle FORWARD" and "filter FORWARD" (and the accepting of
+	// established connections in "filter FORWARD")
+	Forward bool
+
+	// NAT enables jumps from "nat PREROUTING" and "nat POSTROUTING"
+	NAT bool
+
+	// NoSNATToPrivateNets enables "ACCEPT" of the traffic to RFC1918 networks in "nat POSTROUTING" (before SNATs)
+	NoSNATToPrivateNets bool
+
+	// DenyToOtherGWs enables dropping packets to non-local addresses in "filter INPUT"
+	DenyToOtherGWs bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MarkLayout: DefaultMarkLayout,
+		CommentTag: "networkControl",
+		Hooks: Hooks{
+			Forward:             true,
+			NAT:                 true,
+			NoSNATToPrivateNets: true,
+			DenyToOtherGWs:      denyToOtherGWs,
+		},
+	}
 }
 
 func NewFirewall(host networkControl.HostI) networkControl.FirewallI {
-	newIPT, err := ipt.New()
+	fw, err := NewFirewallWithConfig(host, DefaultConfig())
 	if err != nil {
 		panic(err)
 	}
+	return fw
+}
+
+func NewFirewallWithConfig(host networkControl.HostI, config Config) (networkControl.FirewallI, error) {
+	if config.RunCommand != nil {
+		return NewFirewallWithIPTables(host, config, newCommandIPTables(config.RunCommand))
+	}
+	newIPT, err := ipt.New()
+	if err != nil {
+		return nil, err
+	}
+	return NewFirewallWithIPTables(host, config, newIPT)
+}
+
+// NewFirewallWithIPTables returns a firewall which uses the passed iptables instead of the kernel ones
+// (for example NewMemoryIPTables() to test the rules generated by the firewall)
+func NewFirewallWithIPTables(host networkControl.HostI, config Config, iptablesImpl IPTables) (networkControl.FirewallI, error) {
+	err := config.MarkLayout.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if config.CommentTag == "" {
+		return nil, errNoCommentTag
+	}
 
 	fw := &iptables{
-		iptables:              newIPT,
-		isSameSecurityTraffic: true,
-		markToSecurityLevel:   map[int]*int{},
-		securityLevelToMark:   map[int]int{},
-		markToACL:             map[int]string{},
-		aclToMark:             map[string]int{},
+		iptables:            iptablesImpl,
+		baseIPTables:        iptablesImpl,
+		config:              config,
+		markToSecurityLevel: map[int]*int{},
+		securityLevelToMark: map[int]int{},
 	}
 
 	fw.SetHost(host)
 
-	fw.iptables.NewChain("mangle", "ACLs")
-	fw.iptables.NewChain("mangle", "IN_SECURITY_LEVELs")
-	fw.iptables.NewChain("mangle", "OUT_SECURITY_LEVELs")
-	fw.iptables.NewChain("filter", "ACLs")
-	fw.iptables.NewChain("filter", "ACCEPT_DNATs")
-	fw.iptables.NewChain("filter", "SECURITY_LEVELs")
-	fw.iptables.NewChain("nat", "SNATs")
-	fw.iptables.NewChain("nat", "DNATs")
+	if config.UseIPSets {
+		err := fw.probeIPSets()
+		if err == nil {
+			fw.isIPSetsUsed = true
+		} else {
+			fw.LogWarning(err, "falling back to marks")
+		}
+	}
 
-	fw.iptables.AppendUnique("mangle", "FORWARD", "-j", "ACLs")
-	fw.iptables.AppendUnique("mangle", "FORWARD", "-j", "IN_SECURITY_LEVELs")
-	fw.iptables.AppendUnique("mangle", "FORWARD", "-j", "OUT_SECURITY_LEVELs")
+	fw.iptables.NewChain("mangle", fw.chain("IN_SECURITY_LEVELs"))
+	fw.iptables.NewChain("mangle", fw.chain("OUT_SECURITY_LEVELs"))
+	fw.iptables.NewChain("filter", fw.chain("ACLs"))
+	fw.iptables.NewChain("filter", fw.chain("ACCEPT_DNATs"))
+	fw.iptables.NewChain("filter", fw.chain("SECURITY_LEVELs"))
+	fw.iptables.NewChain("nat", fw.chain("SNATs"))
+	fw.iptables.NewChain("nat", fw.chain("DNATs"))
 
-	ok, _ := fw.iptables.Exists("filter", "FORWARD", "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-	if !ok {
-		err := fw.iptables.Insert("filter", "FORWARD", 1, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	if config.MigrateLegacyRules {
+		err := fw.migrateLegacyRules()
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+	}
+
+	fw.iptables.NewChain("filter", fw.chain(ACL_OUT_DONE_CHAIN))
+	fw.iptables.AppendUnique("filter", fw.chain(ACL_OUT_DONE_CHAIN), fw.aclOutDoneSetRule()...)
+	if ok, _ := fw.iptables.Exists("filter", fw.chain("ACLs"), fw.aclOutDoneResetRule()...); !ok {
+		fw.iptables.Insert("filter", fw.chain("ACLs"), 1, fw.aclOutDoneResetRule()...)
+	}
+	fw.iptables.AppendUnique("filter", fw.chain("ACLs"), "-j", fw.chain("ACCEPT_DNATs"))
+
+	err = fw.setHooks()
+	if err != nil {
+		return nil, err
+	}
+
+	// the mapping between security levels and marks is lost on restart, rebuilding it from the rules
+	err = fw.BeginBatch()
+	if err != nil {
+		return nil, err
+	}
+	if !fw.isIPSetsUsed {
+		err = fw.recoverMarks()
+		if err != nil {
+			fw.RollbackBatch()
+			return nil, err
 		}
 	}
-	fw.iptables.AppendUnique("filter", "FORWARD", "-j", "ACLs")
-	fw.iptables.AppendUnique("filter", "ACLs", "-j", "ACCEPT_DNATs")
-	//fw.iptables.AppendUnique("filter", "FORWARD", "-j", "MARK", "--set-mark", "0x1000000/0x1000000", "-m", "comment", "--comment", "mark that this packet is not mine (a forwarded packet)")
-	//fw.iptables.AppendUnique("filter", "OUTPUT", "-m", "mark", "!", "--mark", "0x1000000/0x1000000", "-j", "ACCEPT", "-m", "comment", "--comment", "it's my traffic, it should not be filtered")
-	fw.iptables.AppendUnique("filter", "FORWARD", "-j", "SECURITY_LEVELs")
-	if denyToOtherGWs {
-		fw.iptables.AppendUnique("filter", "INPUT", "-m", "addrtype", "!", "--dst-type", "LOCAL", "--limit-iface-in", "-j", denyCommand)
+	err = fw.migrateSecurityLevels()
+	if err != nil {
+		fw.RollbackBatch()
+		return nil, err
+	}
+	err = fw.CommitBatch()
+	if err != nil {
+		return nil, err
 	}
-	fw.iptables.AppendUnique("nat", "PREROUTING", "-j", "DNATs")
-	fw.iptables.AppendUnique("nat", "POSTROUTING", "-d", "10.0.0.0/8", "-j", "ACCEPT")
-	fw.iptables.AppendUnique("nat", "POSTROUTING", "-d", "172.16.0.0/12", "-j", "ACCEPT")
-	fw.iptables.AppendUnique("nat", "POSTROUTING", "-d", "192.168.0.0/16", "-j", "ACCEPT")
-	fw.iptables.AppendUnique("nat", "POSTROUTING", "-j", "SNATs")
+	fw.permitInterInterface, fw.permitIntraInterface = fw.inquirePermitFlags()
 
 	// TODO: remove this hack (update "--comment"-s correctly)
 	/*fw.iptables.ClearChain("filter", "ACLs")
@@ -89,89 +217,333 @@ func NewFirewall(host networkControl.HostI) networkControl.FirewallI {
 	fw.iptables.ClearChain("mangle", "IN_SECURITY_LEVELs")
 	fw.iptables.ClearChain("mangle", "OUT_SECURITY_LEVELs")*/
 
-	return fw
+	return fw, nil
 }
 
-func (fw *iptables) SetEnablePermitInterInterface(enable bool) error {
-	//fw.isSameSecurityTraffic = enable
-	return nil
-}
-func (fw *iptables) SetEnablePermitIntraInterface(enable bool) error {
+// BeginBatch starts collecting rule changes, they're written to the kernel by CommitBatch()
+// in one `iptables-restore --noflush` transaction per table
+func (fw *iptables) BeginBatch() error {
+	if fw.batch != nil {
+		return errBatchStarted
+	}
+	if fw.isIPSetsUsed {
+		ipsets, err := fw.loadIPSets()
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+		fw.ipsets = ipsets
+	}
+	backend, ok := fw.baseIPTables.(batchBackend)
+	if !ok {
+		backend = commandBackend{run: fw.runCommand}
+	}
+	fw.batch = newBatch(backend)
+	fw.iptables = fw.batch
+
+	fw.batchMarkToSecurityLevel = map[int]*int{}
+	for mark, securityLevel := range fw.markToSecurityLevel {
+		fw.batchMarkToSecurityLevel[mark] = securityLevel
+	}
+	fw.batchSecurityLevelToMark = map[int]int{}
+	for securityLevel, mark := range fw.securityLevelToMark {
+		fw.batchSecurityLevelToMark[securityLevel] = mark
+	}
+	fw.batchPermitInterInterface = fw.permitInterInterface
+	fw.batchPermitIntraInterface = fw.permitIntraInterface
 	return nil
 }
 
-func (fw iptables) GetSecurityLevels() (securityLevels []int) {
-	/*
-		chainNames := fw.iptables.ListChains("filter")
-		for _, chainName := range chainNames {
-			if strings.Index(chainName, "IFACES.SECURITY_LEVEL.") != 0 {
-				continue
-			}
-			words := strings.Split(chainName, ".")
-			securityLevelString := words[2]
-			securityLevel, err := strconv.Atoi(securityLevelString)
-			if err != nil {
-				fw.LogError(err, securityLevelString)
-				continue
+// CommitBatch writes the collected changes to the kernel. If it fails then the whole batch is rolled back.
+func (fw *iptables) CommitBatch() error {
+	if fw.batch == nil {
+		return errNoBatch
+	}
+	if fw.ipsets != nil {
+		err := fw.ipsets.commitBefore()
+		if err != nil {
+			fw.LogError(err)
+			fw.RollbackBatch()
+			return err
+		}
+	}
+	err := fw.batch.Commit()
+	if err != nil {
+		fw.LogError(err)
+		if fw.ipsets != nil {
+			if rollbackErr := fw.ipsets.rollbackBefore(); rollbackErr != nil {
+				fw.LogError(rollbackErr)
 			}
-			securityLevels = append(securityLevels, securityLevel)
 		}
-
-		return
-	*/
-	for securityLevel, _ := range fw.securityLevelToMark {
-		securityLevels = append(securityLevels, securityLevel)
+		fw.RollbackBatch()
+		return err
+	}
+	if fw.ipsets != nil {
+		err = fw.ipsets.commitAfter()
+		if err != nil { // only unused sets and entries are left
+			fw.LogWarning(err)
+		}
 	}
+	fw.batch = nil
+	fw.iptables = fw.baseIPTables
+	fw.ipsets = nil
+	return nil
+}
 
-	return
+// RollbackBatch drops the collected changes (the kernel is not touched)
+func (fw *iptables) RollbackBatch() error {
+	if fw.batch == nil {
+		return errNoBatch
+	}
+	fw.batch = nil
+	fw.iptables = fw.baseIPTables
+	fw.ipsets = nil
+	fw.markToSecurityLevel = fw.batchMarkToSecurityLevel
+	fw.securityLevelToMark = fw.batchSecurityLevelToMark
+	fw.permitInterInterface = fw.batchPermitInterInterface
+	fw.permitIntraInterface = fw.batchPermitIntraInterface
+	return nil
 }
 
-func (fw iptables) InquireSecurityLevel(ifName string) int {
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	setNames, err := ipset.Names()
+// inBatch runs "fn" in a batch (if there's no batch already), so the changes become active at once
+func (fw *iptables) inBatch(fn func() error) error {
+	if fw.batch != nil {
+		return fn()
+	}
+	err := fw.BeginBatch()
 	if err != nil {
-		panic(err)
+		fw.LogError(err)
+		return err
+	}
+	err = fn()
+	if err != nil {
+		fw.RollbackBatch()
+		return err
 	}
+	return fw.CommitBatch()
+}
 
-	iptIfName := fw.IfNameToIPTIfName(ifName)
+// chain returns the name of the chain of the firewall (with the prefix, see Config.ChainPrefix)
+func (fw iptables) chain(name string) string {
+	return fw.config.ChainPrefix + name
+}
 
-	// TODO: sort setNames numberically before the "for" below
+// hookRule returns the rule with the comment tag of the firewall (see Config.CommentTag)
+func (fw iptables) hookRule(rulespec ...string) []string {
+	return append(rulespec, "-m", "comment", "--comment", fw.config.CommentTag)
+}
+
+// legacyRules are the rules older versions put into built-in chains: without the comment tag and
+// with the chains without the prefix
+var legacyRules = []struct {
+	table, chain string
+	rulespec     []string
+}{
+	{"mangle", "FORWARD", []string{"-j", "ACLs"}},
+	{"mangle", "FORWARD", []string{"-j", "IN_SECURITY_LEVELs"}},
+	{"mangle", "FORWARD", []string{"-j", "OUT_SECURITY_LEVELs"}},
+	{"filter", "FORWARD", []string{"-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"}},
+	{"filter", "FORWARD", []string{"-j", "ACLs"}},
+	{"filter", "FORWARD", []string{"-j", "SECURITY_LEVELs"}},
+	{"filter", "INPUT", []string{"-m", "addrtype", "!", "--dst-type", "LOCAL", "--limit-iface-in", "-j", denyCommand}},
+	{"nat", "PREROUTING", []string{"-j", "DNATs"}},
+	{"nat", "POSTROUTING", []string{"-d", "10.0.0.0/8", "-j", "ACCEPT"}},
+	{"nat", "POSTROUTING", []string{"-d", "172.16.0.0/12", "-j", "ACCEPT"}},
+	{"nat", "POSTROUTING", []string{"-d", "192.168.0.0/16", "-j", "ACCEPT"}},
+	{"nat", "POSTROUTING", []string{"-j", "SNATs"}},
+}
 
-	// Searching for IFACES.SECURITY_LEVEL.###
-	for _, setName := range setNames {
-		if !strings.HasPrefix(setName, "IFACES.SECURITY_LEVEL.") {
+// legacyChains are the chains of older versions (they're the chains of the firewall if there's no prefix)
+var legacyChains = map[string][]string{
+	"mangle": {"IN_SECURITY_LEVELs", "OUT_SECURITY_LEVELs"},
+	"filter": {"ACLs", "ACCEPT_DNATs", "SECURITY_LEVELs"},
+	"nat":    {"SNATs", "DNATs"},
+}
+
+// migrateLegacyRules removes the rules left by older versions (see Config.MigrateLegacyRules)
+func (fw *iptables) migrateLegacyRules() error {
+	for _, rule := range legacyRules {
+		ok, err := fw.iptables.Exists(rule.table, rule.chain, rule.rulespec...)
+		if err != nil || !ok {
 			continue
 		}
+		err = fw.iptables.Delete(rule.table, rule.chain, rule.rulespec...)
+		if err != nil {
+			fw.LogError(err, rule.table, rule.chain, rule.rulespec)
+			return err
+		}
+	}
 
-		chainName := setName
-		iptOk, err := fw.iptables.Exists("filter", "SECURITY_LEVELs", "-m", "set", "--match-set", setName, "src,src", "-j", chainName)
-		if err != nil && strings.Index(err.Error(), "No such file or directory") == -1 {
-			panic(err)
+	// ACLs are bound to interfaces directly in "filter ACLs" now, so ACL marks are not used
+	err := fw.removeLegacyChains("mangle", "ACLs")
+	if err != nil {
+		return err
+	}
+
+	if fw.config.ChainPrefix == "" {
+		return nil
+	}
+	for _, table := range []string{"mangle", "filter", "nat"} {
+		err := fw.removeLegacyChains(table, legacyChains[table]...)
+		if err != nil {
+			return err
 		}
-		if !iptOk {
+	}
+	return nil
+}
+
+// removeLegacyChains removes the chains and the chains they jump to (ACL and security level chains of
+// older versions): all of them are flushed first, so they could be deleted in any order
+func (fw *iptables) removeLegacyChains(table string, chainNames ...string) error {
+	existingChains, err := fw.iptables.ListChains(table)
+	if err != nil {
+		fw.LogError(err, table)
+		return err
+	}
+	isExisting := map[string]bool{}
+	for _, chainName := range existingChains {
+		isExisting[chainName] = true
+	}
+
+	var chains []string
+	isFound := map[string]bool{}
+	for len(chainNames) > 0 {
+		chainName := chainNames[0]
+		chainNames = chainNames[1:]
+		if !isExisting[chainName] || isFound[chainName] {
 			continue
 		}
+		isFound[chainName] = true
+		chains = append(chains, chainName)
+
+		rules, err := fw.iptables.List(table, chainName)
+		if err != nil {
+			fw.LogError(err, table, chainName)
+			return err
+		}
+		for _, rule := range rules {
+			words := splitRuleString(rule)
+			for idx := 0; idx+1 < len(words); idx++ {
+				word := words[idx]
+				if word == "-j" || word == "-g" {
+					chainNames = append(chainNames, words[idx+1])
+				}
+			}
+		}
+	}
 
-		setNameWords := strings.Split(setName, ".")
-		securityLevel, err := strconv.Atoi(setNameWords[2])
+	for _, chainName := range chains {
+		err := fw.iptables.ClearChain(table, chainName)
+		if err != nil {
+			fw.LogError(err, table, chainName)
+			return err
+		}
+	}
+	for _, chainName := range chains {
+		err := fw.iptables.DeleteChain(table, chainName)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid security level value \"%v\" (in ipset name: %v): %v", setNameWords[2], setName, err.Error())
+			fw.LogError(err, table, chainName)
+			return err
+		}
+	}
+	return nil
+}
+
+// setHooks puts the rules of enabled hooks into built-in chains (see Hooks). Only the rules with
+// the comment tag are removed (if a hook is disabled).
+func (fw *iptables) setHooks() error {
+	hooks := fw.config.Hooks
+
+	type hookRuleT struct {
+		isEnabled    bool
+		table, chain string
+		rulespec     []string
+	}
+	rules := []hookRuleT{
+		{hooks.Forward, "mangle", "FORWARD", []string{"-j", fw.chain("IN_SECURITY_LEVELs")}},
+		{hooks.Forward, "mangle", "FORWARD", []string{"-j", fw.chain("OUT_SECURITY_LEVELs")}},
+		{hooks.Forward, "filter", "FORWARD", []string{"-j", fw.chain("ACLs")}},
+		{hooks.Forward, "filter", "FORWARD", []string{"-j", fw.chain("SECURITY_LEVELs")}},
+		{hooks.DenyToOtherGWs, "filter", "INPUT", []string{"-m", "addrtype", "!", "--dst-type", "LOCAL", "--limit-iface-in", "-j", denyCommand}},
+		{hooks.NAT, "nat", "PREROUTING", []string{"-j", fw.chain("DNATs")}},
+	}
+	for _, privateNet := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"} {
+		rules = append(rules, hookRuleT{hooks.NoSNATToPrivateNets, "nat", "POSTROUTING", []string{"-d", privateNet, "-j", "ACCEPT"}})
+	}
+	rules = append(rules, hookRuleT{hooks.NAT, "nat", "POSTROUTING", []string{"-j", fw.chain("SNATs")}})
+
+	for _, rule := range rules {
+		if !rule.isEnabled { // the hook could be enabled before
+			fw.iptables.Delete(rule.table, rule.chain, fw.hookRule(rule.rulespec...)...)
 			continue
 		}
+		err := fw.iptables.AppendUnique(rule.table, rule.chain, fw.hookRule(rule.rulespec...)...)
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+	}
 
-		ok, err := ipset.Test(setName, "0.0.0.0/0,"+iptIfName)
-		if err != nil && strings.Index(err.Error(), "is NOT in set") == -1 {
-			panic(err)
+	// established connections are accepted before anything else
+	established := fw.hookRule("-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT")
+	ok, _ := fw.iptables.Exists("filter", "FORWARD", established...)
+	switch {
+	case hooks.Forward && !ok:
+		err := fw.iptables.Insert("filter", "FORWARD", 1, established...)
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+	case !hooks.Forward && ok:
+		fw.iptables.Delete("filter", "FORWARD", established...)
+	}
+	return nil
+}
+
+// IsIPSetsUsed returns true if interfaces of security levels are matched by ipsets (see Config.UseIPSets)
+func (fw iptables) IsIPSetsUsed() bool {
+	return fw.isIPSetsUsed
+}
+
+func (fw iptables) GetSecurityLevels() (securityLevels []int) {
+	if fw.isIPSetsUsed {
+		ifNames, err := fw.ipsetSecurityLevelIfNames()
+		if err != nil {
+			fw.LogError(err)
+			return
+		}
+		for securityLevel := range ifNames {
+			securityLevels = append(securityLevels, securityLevel)
+		}
+		return
+	}
+
+	for securityLevel, _ := range fw.securityLevelToMark {
+		securityLevels = append(securityLevels, securityLevel)
+	}
+
+	return
+}
+
+func (fw iptables) InquireSecurityLevel(ifName string) int {
+	if fw.isIPSetsUsed {
+		ifNames, err := fw.ipsetSecurityLevelIfNames()
+		if err != nil {
+			fw.LogError(err)
+			return -1
 		}
-		if ok {
-			return securityLevel
+		for securityLevel, hostIfNames := range ifNames {
+			for _, hostIfName := range hostIfNames {
+				if hostIfName == fw.GetHost().IfNameToHostIfName(ifName) {
+					return securityLevel
+				}
+			}
 		}
+		fw.Infof("Cannot find security level of iface %v", ifName)
+		return -1
 	}
 
-	fw.Infof("Cannot find security level of iface %v", ifName)
-	return -1
-	*/
-	ruleStrings, err := fw.iptables.List("mangle", "IN_SECURITY_LEVELs")
+	ruleStrings, err := fw.iptables.List("mangle", fw.chain("IN_SECURITY_LEVELs"))
 	for _, ruleString := range ruleStrings {
 		var ruleIfName string
 		isIfaceRule := false
@@ -182,10 +554,9 @@ func (fw iptables) InquireSecurityLevel(ifName string) int {
 			case "-i":
 				ruleIfName = ruleWords[idx+1]
 			case "--set-xmark":
-				markString := strings.Split(ruleWords[idx+1], "/")[0]
-				mark64, err := strconv.ParseInt(markString, 0, 32)
+				markValue, err := fw.config.MarkLayout.SecurityLevelIn.parseMarkString(ruleWords[idx+1])
 				if err == nil {
-					mark = int(mark64)
+					mark = markValue
 					isIfaceRule = true
 				} else {
 					fw.LogError(err, ruleString)
@@ -213,50 +584,40 @@ func (fw iptables) InquireSecurityLevel(ifName string) int {
 	return -1
 }
 
-func (fw *iptables) createSecurityLevelRules() (err error) {
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	setNames, err := ipset.Names()
-	fw.Infof("iptables.createSecurityLevelRules(): setNames == %v", setNames)
-	if err != nil {
-		fw.LogError(err)
-		return err
-	}
-
-	// Searching for IFACES.SECURITY_LEVEL.###
-	securityLevels := []int{}
-	for _, setName := range setNames {
-		if !strings.HasPrefix(setName, "IFACES.SECURITY_LEVEL.") {
-			continue
+// securityLevelMatch returns the match of the traffic from ("isOut" is false) or to ("isOut" is true) interfaces of the security level
+func (fw iptables) securityLevelMatch(securityLevel int, isOut bool) ([]string, error) {
+	if fw.isIPSetsUsed {
+		direction := "src,src"
+		if isOut {
+			direction = "dst,dst"
 		}
-
-		setNameWords := strings.Split(setName, ".")
-		securityLevel, err := strconv.Atoi(setNameWords[2])
-		if err != nil {
-			fw.Warningf("Invalid security level value \"%v\" (in ipset name: %v): %v", setNameWords[2], setName, err.Error())
-			err := ipset.Destroy(setName)
-			if err != nil {
-				fw.Errorf("Cannot delete the set \"%v\" of the invalid security level: %v", setName, err.Error())
-			}
-			continue
-		}
-
-		securityLevels = append(securityLevels, securityLevel)
+		return []string{"-m", "set", "--match-set", fw.securityLevelChainName(securityLevel), direction}, nil
+	}
+	mask := fw.config.MarkLayout.SecurityLevelIn
+	if isOut {
+		mask = fw.config.MarkLayout.SecurityLevelOut
 	}
-	*/
+	mark, err := fw.SecurityLevelToMark(securityLevel)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-m", "mark", "--mark", mask.markString(mark)}, nil
+}
 
+func (fw *iptables) createSecurityLevelRules() (err error) {
 	securityLevels := fw.GetSecurityLevels()
+	sort.Ints(securityLevels)
 
 	fw.Infof("iptables.createSecurityLevelRules(): %v", securityLevels)
 
-	for _, securityLevelA := range securityLevels {
-		var setName string
+	ifNames, err := fw.securityLevelIfNames()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
 
-		if securityLevelA >= 0 {
-			setName = "IFACES.SECURITY_LEVEL." + strconv.Itoa(securityLevelA)
-		} else {
-			setName = "IFACES.SECURITY_LEVEL.m" + strconv.Itoa(-securityLevelA)
-		}
-		chainName := setName
+	for _, securityLevelA := range securityLevels {
+		chainName := fw.securityLevelChainName(securityLevelA)
 
 		{
 			err := fw.iptables.NewChain("filter", chainName)
@@ -266,106 +627,63 @@ func (fw *iptables) createSecurityLevelRules() (err error) {
 			}
 		}
 
-		var minSecurityLevelB int
-		minSecurityLevelB = 65535
-		for _, securityLevelB := range securityLevels {
-			if securityLevelB >= securityLevelA {
-				continue
-			}
-			if securityLevelB < minSecurityLevelB {
-				minSecurityLevelB = securityLevelB
-			}
-		}
-
-		var setNameB string
-		var chainNameB string
-		if minSecurityLevelB != 65535 {
-			if minSecurityLevelB >= 0 {
-				setNameB = "IFACES.SECURITY_LEVEL." + strconv.Itoa(minSecurityLevelB)
-			} else {
-				setNameB = "IFACES.SECURITY_LEVEL.m" + strconv.Itoa(-minSecurityLevelB)
-			}
-			chainNameB = setNameB
+		fw.Infof("iptables.createSecurityLevelRules(): R: %v %v | %v", securityLevelA, chainName, ifNames[securityLevelA])
 
-			err := fw.iptables.NewChain("filter", chainNameB)
-			if err != nil && strings.Index(err.Error(), "Chain already exists") == -1 {
-				fw.LogError(err)
-				return err
-			}
-		}
+		fw.iptables.ClearChain("filter", chainName)
 
-		fw.Infof("iptables.createSecurityLevelRules(): R: %v %v | %v %v | %v %v", securityLevelA, minSecurityLevelB, chainName, setName, chainNameB, setNameB)
+		// the traffic routed back to its interface (see "same-security-traffic permit intra-interface")
 
-		fw.iptables.ClearChain("filter", chainName)
-		if chainNameB != "" {
-			err := fw.iptables.AppendUnique("filter", chainName, "-j", chainNameB)
+		for _, ifName := range ifNames[securityLevelA] {
+			err := fw.iptables.AppendUnique("filter", chainName, fw.intraInterfaceRule(ifName)...)
 			if err != nil {
 				fw.LogError(err)
 				return err
 			}
 		}
 
-		/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-		{
-			var err error
-			if fw.isSameSecurityTraffic {
-				err = fw.iptables.AppendUnique("filter", chainName, "-m", "set", "--match-set", setName, "dst,dst", "-j", "ACCEPT")
-			} else {
-				if setNameB != "" {
-					err = fw.iptables.AppendUnique("filter", chainName, "-m", "set", "--match-set", setNameB, "dst,dst", "-j", "ACCEPT")
-				}
+		// the traffic to lower security levels (and to the same one, see "same-security-traffic permit inter-interface")
+
+		for _, securityLevelB := range securityLevels {
+			if securityLevelB > securityLevelA || (securityLevelB == securityLevelA && !fw.permitInterInterface) {
+				continue
 			}
+			match, err := fw.securityLevelMatch(securityLevelB, true)
 			if err != nil {
 				fw.LogError(err)
 				return err
 			}
-		}
-
-		{
-			var err error
-			err = fw.iptables.AppendUnique("filter", "SECURITY_LEVELs", "-m", "set", "--match-set", setName, "src,src", "-j", chainName)
+			err = fw.iptables.AppendUnique("filter", chainName, append(match, "-j", "ACCEPT")...)
 			if err != nil {
 				fw.LogError(err)
 				return err
 			}
 		}
-		*/
 
 		{
-			var err error
-			if fw.isSameSecurityTraffic {
-				err = fw.iptables.AppendUnique("filter", chainName, "-m", "mark", "--mark", (strconv.Itoa(fw.SecurityLevelToMark(securityLevelA)<<8))+"/0xff00", "-j", "ACCEPT")
-			} else {
-				if setNameB != "" {
-					err = fw.iptables.AppendUnique("filter", chainName, "-m", "mark", "--mark", (strconv.Itoa(fw.SecurityLevelToMark(minSecurityLevelB)<<8))+"/0xff00", "-j", "ACCEPT")
-				}
-			}
+			match, err := fw.securityLevelMatch(securityLevelA, false)
 			if err != nil {
 				fw.LogError(err)
 				return err
 			}
-		}
-		{
-			var err error
-			err = fw.iptables.AppendUnique("filter", "SECURITY_LEVELs", "-m", "mark", "--mark", strconv.Itoa(fw.SecurityLevelToMark(securityLevelA))+"/0xff", "-j", chainName)
+			err = fw.iptables.AppendUnique("filter", fw.chain("SECURITY_LEVELs"), append(match, "-j", chainName)...)
 			if err != nil {
 				fw.LogError(err)
 				return err
 			}
 		}
 
-		deleteOld, err := fw.iptables.Exists("filter", "SECURITY_LEVELs", "-j", denyCommand)
+		deleteOld, err := fw.iptables.Exists("filter", fw.chain("SECURITY_LEVELs"), "-j", denyCommand)
 		if err != nil {
 			fw.LogError(err)
 			return err
 		}
-		err = fw.iptables.Append("filter", "SECURITY_LEVELs", "-j", denyCommand)
+		err = fw.iptables.Append("filter", fw.chain("SECURITY_LEVELs"), "-j", denyCommand)
 		if err != nil {
 			fw.LogError(err)
 			return err
 		}
 		if deleteOld {
-			err = fw.iptables.Delete("filter", "SECURITY_LEVELs", "-j", denyCommand)
+			err = fw.iptables.Delete("filter", fw.chain("SECURITY_LEVELs"), "-j", denyCommand)
 			if err != nil {
 				fw.LogError(err)
 				return err
@@ -377,29 +695,21 @@ func (fw *iptables) createSecurityLevelRules() (err error) {
 }
 
 func (fw *iptables) addSecurityLevel(securityLevel int) error {
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	var setName string
-	if securityLevel >= 0 {
-		setName = "IFACES.SECURITY_LEVEL." + strconv.Itoa(securityLevel)
-	} else {
-		setName = "IFACES.SECURITY_LEVEL.m" + strconv.Itoa(-securityLevel)
-	}
-	_, err := ipset.New(setName, "hash:net,iface", &ipset.Params{HashSize: 4096, MaxElem: 4096})
-	if err != nil && strings.Index(err.Error(), "set with the same name already exists") == -1 {
-		fw.Errorf("iptables.addSecurityLevel(%v): %v", securityLevel, err)
-		return err
+	if fw.isIPSetsUsed { // the set is created together with the first entry
+		return nil
 	}
 
-	return fw.createSecurityLevelRules()
-	*/
-
 	if fw.securityLevelToMark[securityLevel] == 0 {
-		fw.markMax_securityLevel++
-		fw.securityLevelToMark[securityLevel] = fw.markMax_securityLevel
-		fw.markToSecurityLevel[fw.markMax_securityLevel] = &securityLevel
+		mark, err := fw.allocateSecurityLevelMark()
+		if err != nil {
+			fw.LogError(err, securityLevel)
+			return err
+		}
+		fw.securityLevelToMark[securityLevel] = mark
+		fw.markToSecurityLevel[mark] = &securityLevel
 	}
 
-	return fw.createSecurityLevelRules()
+	return nil
 }
 
 func (fw *iptables) MarkToSecurityLevel(mark int) int {
@@ -412,7 +722,7 @@ func (fw *iptables) MarkToSecurityLevel(mark int) int {
 	// Not found? Ok, scanning :(
 
 	fw.Debugf("securityLevel == nil: %v", mark)
-	ruleStrings, err := fw.iptables.List("filter", "SECURITY_LEVELs")
+	ruleStrings, err := fw.iptables.List("filter", fw.chain("SECURITY_LEVELs"))
 	if err != nil {
 		fw.LogError(err)
 	}
@@ -425,10 +735,9 @@ func (fw *iptables) MarkToSecurityLevel(mark int) int {
 			case "-j":
 				chainName = ruleWords[idx+1]
 			case "--mark":
-				markString := strings.Split(ruleWords[idx+1], "/")[0]
-				mark64, err := strconv.ParseInt(markString, 0, 32)
+				markValue, err := fw.config.MarkLayout.SecurityLevelIn.parseMarkString(ruleWords[idx+1])
 				if err == nil {
-					ruleMark = int(mark64)
+					ruleMark = markValue
 				} else {
 					fw.LogError(err, ruleString)
 				}
@@ -439,10 +748,10 @@ func (fw *iptables) MarkToSecurityLevel(mark int) int {
 		}
 		// -A SECURITY_LEVELs -m mark --mark 0x1/0xff -j IFACES.SECURITY_LEVEL.50
 		// -A SECURITY_LEVELs -m mark --mark 0x2/0xff -j IFACES.SECURITY_LEVEL.0
-		chainNameWords := strings.Split(chainName, ".")
-		securityLevel, err := strconv.Atoi(chainNameWords[2])
-		if err != nil {
-			fw.LogError(err, chainNameWords)
+		securityLevel, ok := fw.parseSecurityLevelChainName(chainName)
+		if !ok {
+			fw.Errorf("Invalid security level chain name: %v", chainName)
+			continue
 		}
 		fw.markToSecurityLevel[mark] = &securityLevel
 		return securityLevel
@@ -454,54 +763,21 @@ func (fw *iptables) MarkToSecurityLevel(mark int) int {
 	return -1
 }
 
-func (fw iptables) SecurityLevelToMark(securityLevel int) int {
+func (fw iptables) SecurityLevelToMark(securityLevel int) (int, error) {
 	mark := fw.securityLevelToMark[securityLevel]
 	if mark == 0 {
-		fw.Panicf("mark == 0", securityLevel)
+		return 0, fmt.Errorf("%v: %v", errNoSecurityLevelMark, securityLevel)
 	}
-	return mark
+	return mark, nil
 }
 
-func (fw *iptables) SetSecurityLevel(ifName string, securityLevel int) (err error) {
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	setName := "IFACES.SECURITY_LEVEL." + strconv.Itoa(securityLevel)
-	fw.Infof("iptables.SetSecurityLevel(%v, %v): %v", ifName, securityLevel, setName)
-
-	if securityLevel < 0 {
-		fw.Warningf("securityLevel < 0: %v", securityLevel)
-	}
-
-	// Remembering the old security level set name
-
-	oldSecurityLevel := fw.InquireSecurityLevel(ifName)
-	oldSetName := "IFACES.SECURITY_LEVEL." + strconv.Itoa(oldSecurityLevel)
-
-	// If nothing to do then return
-	if setName == oldSetName {
-		return nil
-	}
-
-	// Create the security level if not exists
-
-	err = fw.addSecurityLevel(securityLevel)
-	if err != nil {
-		fw.LogError(err)
-		return err
-	}
-
-	// Adding to the new security level
-
-	err = ipset.Add(setName, "0.0.0.0/0,"+fw.IfNameToIPTIfName(ifName), 0)
-	if err != nil {
-		fw.LogError(err, securityLevel, setName, ifName)
-		return err
-	}
-
-	// Removing from the old security level
-
-	ipset.Del(oldSetName, "0.0.0.0/0,"+fw.IfNameToIPTIfName(ifName))
-	*/
+func (fw *iptables) SetSecurityLevel(ifName string, securityLevel int) error {
+	return fw.inBatch(func() error {
+		return fw.setSecurityLevel(ifName, securityLevel)
+	})
+}
 
+func (fw *iptables) setSecurityLevel(ifName string, securityLevel int) (err error) {
 	// Remembering the old security level
 
 	oldSecurityLevel := fw.InquireSecurityLevel(ifName)
@@ -509,6 +785,14 @@ func (fw *iptables) SetSecurityLevel(ifName string, securityLevel int) (err erro
 		return nil
 	}
 
+	if fw.isIPSetsUsed {
+		err = fw.ipsetSetSecurityLevel(fw.GetHost().IfNameToHostIfName(ifName), securityLevel)
+		if err != nil {
+			return err
+		}
+		return fw.gcSecurityLevels()
+	}
+
 	// Create the security level if not exists
 
 	err = fw.addSecurityLevel(securityLevel)
@@ -519,13 +803,7 @@ func (fw *iptables) SetSecurityLevel(ifName string, securityLevel int) (err erro
 
 	// Adding new security level rule
 
-	err = fw.iptables.AppendUnique("mangle", "IN_SECURITY_LEVELs", "-i", fw.GetHost().IfNameToHostIfName(ifName), "-j", "MARK", "--set-mark", strconv.Itoa(fw.SecurityLevelToMark(securityLevel))+"/0xff", "-m", "comment", "--comment", "{security_level:"+strconv.Itoa(securityLevel)+"}")
-	if err != nil {
-		fw.LogError(err)
-		return err
-	}
-
-	err = fw.iptables.AppendUnique("mangle", "OUT_SECURITY_LEVELs", "-o", fw.GetHost().IfNameToHostIfName(ifName), "-j", "MARK", "--set-mark", (strconv.Itoa(fw.SecurityLevelToMark(securityLevel)<<8))+"/0xff00", "-m", "comment", "--comment", "{security_level:"+strconv.Itoa(securityLevel)+"}")
+	err = fw.addSecurityLevelRules(fw.GetHost().IfNameToHostIfName(ifName), securityLevel)
 	if err != nil {
 		fw.LogError(err)
 		return err
@@ -534,21 +812,62 @@ func (fw *iptables) SetSecurityLevel(ifName string, securityLevel int) (err erro
 	// Removing old security level rule
 
 	if oldSecurityLevel != -1 {
-		err = fw.iptables.Delete("mangle", "IN_SECURITY_LEVELs", "-i", fw.GetHost().IfNameToHostIfName(ifName), "-j", "MARK", "--set-mark", strconv.Itoa(fw.SecurityLevelToMark(oldSecurityLevel))+"/0xff", "-m", "comment", "--comment", "{security_level:"+strconv.Itoa(oldSecurityLevel)+"}")
-		if err != nil {
-			fw.LogError(err)
-		}
-		err = fw.iptables.Delete("mangle", "OUT_SECURITY_LEVELs", "-o", fw.GetHost().IfNameToHostIfName(ifName), "-j", "MARK", "--set-mark", (strconv.Itoa(fw.SecurityLevelToMark(oldSecurityLevel)<<8))+"/0xff00", "-m", "comment", "--comment", "{security_level:"+strconv.Itoa(oldSecurityLevel)+"}")
+		err = fw.deleteSecurityLevelRules(fw.GetHost().IfNameToHostIfName(ifName), oldSecurityLevel)
 		if err != nil {
 			fw.LogError(err)
 		}
 	}
 
+	// Rebuilding the security level chains (the rules of the interfaces are there as well), the old
+	// security level could be unused now
+
+	err = fw.gcSecurityLevels()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+
 	// finish
 
 	return err
 }
 
+// UnsetSecurityLevel removes the rules of the interface (for example, the interface is removed); the
+// security levels which are not used anymore are removed as well
+func (fw *iptables) UnsetSecurityLevel(ifName string) error {
+	return fw.inBatch(func() error {
+		hostIfName := fw.GetHost().IfNameToHostIfName(ifName)
+		if fw.isIPSetsUsed {
+			err := fw.ipsetSetSecurityLevel(hostIfName, -1)
+			if err != nil {
+				return err
+			}
+			return fw.gcSecurityLevels()
+		}
+		for _, chain := range []struct {
+			name string
+			mask MarkMask
+		}{{fw.chain("IN_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelIn}, {fw.chain("OUT_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelOut}} {
+			rules, err := fw.listMarkRules("mangle", chain.name, chain.mask)
+			if err != nil {
+				fw.LogError(err)
+				return err
+			}
+			for _, rule := range rules {
+				if rule.ifName != hostIfName {
+					continue
+				}
+				err := fw.iptables.Delete("mangle", chain.name, rule.spec...)
+				if err != nil {
+					fw.LogError(err, chain.name, rule)
+					return err
+				}
+			}
+		}
+		return fw.gcSecurityLevels()
+	})
+}
+
 func (fw iptables) IfNameToIPTIfName(ifName string) string {
 	return fw.GetHost().IfNameToHostIfName(ifName)
 }
@@ -557,152 +876,265 @@ func (fw iptables) IPTIfNameToIfName(ifName string) string {
 }
 
 func (fw iptables) getACLsNames() (result []string) {
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	setNames, err := ipset.Names()
+	chainNames, err := fw.iptables.ListChains("filter")
 	if err != nil {
-		panic(err)
+		fw.LogPanic(err)
 	}
-	// Searching for ACL.IN.###
-	for _, setName := range setNames {
-		if len(setName) == 0 {
-			continue
-		}
-
-		setNameWords := strings.Split(setName, ".")
-		if setNameWords[0] != "ACL" {
+	for _, chainName := range chainNames {
+		if !strings.HasPrefix(chainName, fw.chain("ACL.IN.")) || strings.HasSuffix(chainName, "~") {
 			continue
 		}
-		if len(setNameWords) != 3 {
-			panic(fmt.Errorf("Internal error: %v", setNameWords))
-		}
-		result = append(result, setNameWords[2])
-	}
-	*/
-
-	for acl, _ := range fw.aclToMark {
-		result = append(result, acl)
+		result = append(result, strings.TrimPrefix(chainName, fw.chain("ACL.IN.")))
 	}
 
 	return
 }
 
-func (fw *iptables) MarkToACL(mark int) string {
-	aclName := fw.markToACL[mark]
+// aclChainName returns the name of the chain with rules of the ACL for the direction.
+//
+// "ACL.OUT.*" chains are checked before "ACL.IN.*" chains. They allow a packet by "-g ACLs.OUT.done"
+// instead of "ACCEPT": the chain sets the bit MarkLayout.ACLOutDone, so the rest of outgoing ACLs
+// are skipped, and returns to "filter ACLs", so the packet is still checked by incoming ACLs (see
+// networkControl.ACL.Priority).
+func (fw iptables) aclChainName(aclName string, direction networkControl.ACLDirection) string {
+	if direction == networkControl.ACLDIR_OUT {
+		return fw.chain("ACL.OUT." + aclName)
+	}
+	return fw.chain("ACL.IN." + aclName)
+}
 
-	if aclName != "" { // Found? Ok, returning
-		return aclName
-	}
+const (
+	ACL_OUT_DONE_CHAIN = "ACLs.OUT.done"
+)
 
-	// Not found? Ok, scanning :(
+// aclOutDoneSetRule returns the rule of "filter ACLs.OUT.done" which marks the packet allowed by an outgoing ACL
+func (fw iptables) aclOutDoneSetRule() []string {
+	return []string{"-j", "MARK", "--set-xmark", fw.config.MarkLayout.ACLOutDone.markString(1)}
+}
+
+// aclOutDoneResetRule returns the first rule of "filter ACLs" which clears the mark of aclOutDoneSetRule()
+func (fw iptables) aclOutDoneResetRule() []string {
+	return []string{"-j", "MARK", "--set-xmark", fw.config.MarkLayout.ACLOutDone.markString(0)}
+}
 
-	fw.Debugf(`aclName == "": %v`, mark)
-	ruleStrings, err := fw.iptables.List("filter", "ACLs")
+type aclCommentT struct {
+	Priority int `json:",omitempty"`
+}
+
+func (c aclCommentT) Json() string {
+	b, err := json.Marshal(c)
 	if err != nil {
-		fw.LogError(err)
+		panic(err)
 	}
-	for _, ruleString := range ruleStrings {
-		var chainName string
-		ruleMark := -1
-		ruleWords := strings.Split(ruleString, " ")
-		for idx, ruleWord := range ruleWords {
-			switch ruleWord {
-			case "-j":
-				chainName = ruleWords[idx+1]
-			case "--mark":
-				markString := strings.Split(ruleWords[idx+1], "/")[0]
-				mark64, err := strconv.ParseInt(markString, 0, 32)
-				if err == nil {
-					ruleMark = int(mark64)
-				} else {
-					fw.LogError(err, ruleString)
-				}
-			}
+	return string(b)
+}
+func (c aclCommentT) String() string {
+	return c.Json()
+}
+
+// aclBinding is a jump from "filter ACLs" to a chain of an ACL for traffic of an interface.
+//
+// An interface could be bound to multiple ACLs, they're checked in order defined by aclBindingLess().
+type aclBinding struct {
+	ACLName   string
+	Direction networkControl.ACLDirection
+	IfName    string // the name of the interface in the backend
+	Priority  int
+}
+
+func aclBindingLess(a, b aclBinding) bool {
+	if a.Direction != b.Direction {
+		return a.Direction == networkControl.ACLDIR_OUT
+	}
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	if a.ACLName != b.ACLName {
+		return a.ACLName < b.ACLName
+	}
+	return a.IfName < b.IfName
+}
+
+func (fw iptables) aclBindings(acl networkControl.ACL) (result []aclBinding) {
+	for _, direction := range networkControl.ACLDirections {
+		for _, vlanName := range acl.GetVLANNames(direction) {
+			result = append(result, aclBinding{
+				ACLName:   acl.Name,
+				Direction: direction,
+				IfName:    fw.IfNameToIPTIfName(vlanName),
+				Priority:  acl.Priority,
+			})
 		}
-		if ruleMark != mark {
+	}
+	return
+}
+
+// aclBindingRuleStrings returns the jump to the chain of the binding; outgoing bindings are skipped
+// if an outgoing ACL already allowed the packet (see aclChainName())
+func (fw iptables) aclBindingRuleStrings(binding aclBinding, chainName string) []string {
+	aclComment := aclCommentT{
+		Priority: binding.Priority,
+	}
+	if binding.Direction == networkControl.ACLDIR_OUT {
+		return []string{"-o", binding.IfName, "-m", "mark", "!", "--mark", fw.config.MarkLayout.ACLOutDone.markString(1), "-m", "comment", "--comment", aclComment.Json(), "-j", chainName}
+	}
+	return []string{"-i", binding.IfName, "-m", "comment", "--comment", aclComment.Json(), "-j", chainName}
+}
+
+// parseACLBindingRule parses a rule of "filter ACLs" (without the "-A ACLs " prefix). "ok" is false if it's not a binding rule.
+func (fw iptables) parseACLBindingRule(ruleString string) (binding aclBinding, chainName string, ok bool) {
+	words := strings.Split(ruleString, " ")
+	for len(words) > 1 {
+		switch words[0] { // -i library_inside -m comment --comment "{\"Priority\":10}" -j ACL.IN.library
+		case "!": // -o library_inside -m mark ! --mark 0x10000/0x10000 -m comment ...
+			words = words[1:]
 			continue
+		case "--mark":
+		case "-i":
+			binding.Direction = networkControl.ACLDIR_IN
+			binding.IfName = words[1]
+		case "-o":
+			binding.Direction = networkControl.ACLDIR_OUT
+			binding.IfName = words[1]
+		case "-m":
+		case "--comment":
+			aclComment := aclCommentT{}
+			commentStr, err := strconv.Unquote(words[1])
+			if err != nil {
+				return
+			}
+			err = json.Unmarshal([]byte(commentStr), &aclComment)
+			if err != nil {
+				return
+			}
+			binding.Priority = aclComment.Priority
+		case "-j":
+			chainName = words[1]
+		default:
+			return
 		}
-		chainNameWords := strings.Split(chainName, ".")
-		aclName := chainNameWords[2]
-		if err != nil {
-			fw.LogError(err, chainNameWords)
-		}
-		fw.markToACL[mark] = aclName
-		return aclName
+		words = words[2:]
+	}
+	if len(words) != 0 || binding.IfName == "" {
+		return
 	}
 
-	// Still not found?
-
-	fw.Errorf(`aclName == "": %v`, mark)
-	return ""
+	aclName := strings.TrimSuffix(chainName, "~")
+	switch binding.Direction {
+	case networkControl.ACLDIR_IN:
+		if !strings.HasPrefix(aclName, fw.chain("ACL.IN.")) {
+			return
+		}
+		binding.ACLName = strings.TrimPrefix(aclName, fw.chain("ACL.IN."))
+	case networkControl.ACLDIR_OUT:
+		if !strings.HasPrefix(aclName, fw.chain("ACL.OUT.")) {
+			return
+		}
+		binding.ACLName = strings.TrimPrefix(aclName, fw.chain("ACL.OUT."))
+	}
+	ok = true
+	return
 }
 
-func (fw *iptables) ACLToMark(aclName string) int {
-	mark := fw.aclToMark[aclName]
-	if mark == 0 {
-		fw.Panicf("mark == 0", aclName)
-		return -1
+// listOwnChain returns the rules of an own chain, nothing if the chain doesn't exist (after Teardown())
+func (fw iptables) listOwnChain(table, chainName string) ([]string, error) {
+	ruleStrings, err := fw.iptables.List(table, chainName)
+	if err != nil && strings.Index(err.Error(), "No chain/target/match by that name") != -1 {
+		return nil, nil
 	}
-	return mark
+	return ruleStrings, err
 }
 
-func (fw iptables) inquireACL(aclName string) (result networkControl.ACL) {
-	result.Name = aclName
-
-	// Getting VLANs of the ACL
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	setName := "ACL.IN." + aclName
-	setRows, err := ipset.List(setName)
+// listACLBindingRules returns rules of "filter ACLs" (without the "-A ACLs " prefix)
+func (fw iptables) listACLBindingRules() (result []string, err error) {
+	ruleStrings, err := fw.listOwnChain("filter", fw.chain("ACLs"))
 	if err != nil {
-		panic(err)
+		return
 	}
-
-	for _, setRow := range setRows {
-		if len(setRow) == 0 {
+	for _, ruleString := range ruleStrings {
+		prefix := "-A " + fw.chain("ACLs") + " "
+		if !strings.HasPrefix(ruleString, prefix) {
 			continue
 		}
+		result = append(result, strings.TrimPrefix(ruleString, prefix))
+	}
+	return
+}
 
-		words := strings.Split(setRow, ",")
-		if words[0] != "0.0.0.0/0" {
-			panic("Internal error. words[0] == \"" + words[0] + "\"")
+func (fw iptables) inquireACLBindings() (result []aclBinding) {
+	ruleStrings, err := fw.listACLBindingRules()
+	if err != nil {
+		fw.LogPanic(err)
+	}
+	for _, ruleString := range ruleStrings {
+		binding, _, ok := fw.parseACLBindingRule(ruleString)
+		if !ok {
+			continue
 		}
-		ifName := fw.IPTIfNameToIfName(words[1])
-		result.VLANNames = append(result.VLANNames, ifName)
+		result = append(result, binding)
 	}
-	*/
+	return
+}
 
-	ruleStrings, err := fw.iptables.List("mangle", "ACLs")
+// setACLBindings replaces bindings of the ACL "aclName" by "bindings" keeping the order of jumps in "filter ACLs" (see aclBindingLess())
+func (fw *iptables) setACLBindings(aclName string, bindings []aclBinding) error {
+	ruleStrings, err := fw.listACLBindingRules()
 	if err != nil {
-		fw.LogPanic(err)
+		fw.LogError(err)
+		return err
 	}
 
-	mark := fw.ACLToMark(aclName)
+	oldRules := [][]string{}
+	newBindings := []aclBinding{}
 	for _, ruleString := range ruleStrings {
-		var ifName string
-		ruleMark := -1
-		ruleWords := strings.Split(ruleString, " ")
-		for idx, ruleWord := range ruleWords {
-			switch ruleWord { // -A ACLs -i library_inside -j MARK --set-xmark 0x10000/0xff0000
-			case "-i":
-				ifName = ruleWords[idx+1]
-			case "--set-xmark":
-				markString := strings.Split(ruleWords[idx+1], "/")[0]
-				mark64, err := strconv.ParseInt(markString, 0, 32)
-				if err == nil {
-					ruleMark = int(mark64)
-				} else {
-					fw.LogError(err, ruleString)
-				}
-			}
+		binding, chainName, ok := fw.parseACLBindingRule(ruleString)
+		if !ok {
+			oldRules = append(oldRules, strings.Split(ruleString, " "))
+			continue
 		}
-		if ruleMark != mark {
+		oldRules = append(oldRules, fw.aclBindingRuleStrings(binding, chainName))
+		if binding.ACLName == aclName {
+			continue
+		}
+		newBindings = append(newBindings, binding)
+	}
+	newBindings = append(newBindings, bindings...)
+	sort.Slice(newBindings, func(i, j int) bool { return aclBindingLess(newBindings[i], newBindings[j]) })
+
+	newRules := [][]string{fw.aclOutDoneResetRule()}
+	for _, binding := range newBindings {
+		if binding.Direction != networkControl.ACLDIR_OUT {
+			continue
+		}
+		newRules = append(newRules, fw.aclBindingRuleStrings(binding, fw.aclChainName(binding.ACLName, binding.Direction)))
+	}
+	newRules = append(newRules, []string{"-j", fw.chain("ACCEPT_DNATs")})
+	for _, binding := range newBindings {
+		if binding.Direction != networkControl.ACLDIR_IN {
+			continue
+		}
+		newRules = append(newRules, fw.aclBindingRuleStrings(binding, fw.aclChainName(binding.ACLName, binding.Direction)))
+	}
+
+	return fw.applyRuleEdits("filter", fw.chain("ACLs"), getRuleEdits(oldRules, newRules))
+}
+
+func (fw iptables) inquireACL(aclName string) (result networkControl.ACL) {
+	result.Name = aclName
+
+	// Getting VLANs of the ACL
+
+	for _, binding := range fw.inquireACLBindings() {
+		if binding.ACLName != aclName {
 			continue
 		}
-		result.VLANNames = append(result.VLANNames, ifName)
+		result.AddVLANName(binding.Direction, binding.IfName)
+		result.Priority = binding.Priority
 	}
 
-	// Getting rules of the ACL
+	// Getting rules of the ACL (both chains has the same rules, so the incoming one is enough)
 
-	chainName := "ACL.IN." + aclName
+	chainName := fw.aclChainName(aclName, networkControl.ACLDIR_IN)
 
 	fw.iptables.NewChain("filter", chainName) // creating the chain if not exists (could happened on a dirty work before)
 	rules, err := fw.iptables.List("filter", chainName)
@@ -733,7 +1165,7 @@ func (fw iptables) InquireACLs() (result networkControl.ACLs) {
 	return
 }
 func (fw iptables) InquireSNATs() (result networkControl.SNATs) {
-	ruleStrings, err := fw.iptables.List("nat", "SNATs")
+	ruleStrings, err := fw.listOwnChain("nat", fw.chain("SNATs"))
 	if err != nil {
 		fw.LogPanic(err)
 	}
@@ -747,7 +1179,7 @@ func (fw iptables) InquireSNATs() (result networkControl.SNATs) {
 			panic(fmt.Errorf("%v: %v: %v", errNotImplemented, words, ruleString))
 		}
 		words = words[1:]
-		if words[0] != "SNATs" {
+		if words[0] != fw.chain("SNATs") {
 			continue
 		}
 		words = words[1:]
@@ -809,7 +1241,7 @@ func (fw iptables) InquireSNATs() (result networkControl.SNATs) {
 	return
 }
 func (fw iptables) InquireDNATs() (result networkControl.DNATs) {
-	ruleStrings, err := fw.iptables.List("nat", "DNATs")
+	ruleStrings, err := fw.listOwnChain("nat", fw.chain("DNATs"))
 	if err != nil {
 		panic(err)
 	}
@@ -822,7 +1254,7 @@ func (fw iptables) InquireDNATs() (result networkControl.DNATs) {
 			panic(fmt.Errorf("%v: %v: %v", errNotImplemented, words, ruleString))
 		}
 		words = words[1:]
-		if words[0] != "DNATs" {
+		if words[0] != fw.chain("DNATs") {
 			continue
 		}
 		words = words[1:]
@@ -890,7 +1322,7 @@ func (fw iptables) InquireDNATs() (result networkControl.DNATs) {
 		}
 		dnat.Destinations = append(dnat.Destinations, destination)
 
-		if ok, _ := fw.iptables.Exists("filter", "ACCEPT_DNATs", append(fw.ipportDestinationStrings(dnat.NATTo), "-j", "ACCEPT")...); !ok {
+		if ok, _ := fw.iptables.Exists("filter", fw.chain("ACCEPT_DNATs"), append(fw.ipportDestinationStrings(dnat.NATTo), "-j", "ACCEPT")...); !ok {
 			continue
 		}
 		result = append(result, &dnat)
@@ -900,7 +1332,7 @@ func (fw iptables) InquireDNATs() (result networkControl.DNATs) {
 	return
 }
 
-func ruleToNetfilterRule(rule networkControl.ACLRule) (result []string) {
+func (fw iptables) ruleToNetfilterRule(rule networkControl.ACLRule, direction networkControl.ACLDirection) (result []string) {
 	protocolString := rule.Protocol.String()
 	if protocolString != "ip" {
 		result = append(result, "-p", protocolString)
@@ -913,44 +1345,46 @@ func ruleToNetfilterRule(rule networkControl.ACLRule) (result []string) {
 		result = append(result, "-d", rule.ToNet.String())
 	}
 
-	if len(rule.FromPortRanges) != 1 || len(rule.ToPortRanges) != 1 {
+	if len(rule.FromPortRanges) == 0 || len(rule.ToPortRanges) == 0 {
 		panic(fmt.Errorf("%v: %v, %v: %v", errNotImplemented, rule.FromPortRanges, rule.ToPortRanges, rule))
 	}
 
-	if rule.FromPortRanges[0].Start != 0 || rule.FromPortRanges[0].End != 65535 || rule.ToPortRanges[0].Start != 0 || rule.ToPortRanges[0].End != 65535 {
-		if rule.FromPortRanges[0].Start != rule.FromPortRanges[0].End || rule.ToPortRanges[0].Start != rule.ToPortRanges[0].End {
-			result = append(result, "-m", "multiport")
-		}
-	}
-	if rule.FromPortRanges[0].Start != 0 || rule.FromPortRanges[0].End != 65535 {
-		if rule.FromPortRanges[0].Start != rule.FromPortRanges[0].End {
-			result = append(result, "--sports")
-		} else {
-			result = append(result, "--sport")
+	// a single port range is matched by the match of the protocol ("-m tcp --dport 80") and
+	// a list of port ranges by "-m multiport --dports 80,443"
+	var portOptions, multiportOptions []string
+	for _, side := range []struct {
+		portRanges         networkControl.PortRanges
+		option, listOption string
+	}{
+		{rule.FromPortRanges, "--sport", "--sports"},
+		{rule.ToPortRanges, "--dport", "--dports"},
+	} {
+		switch {
+		case len(side.portRanges) == 1 && side.portRanges[0].Start == 0 && side.portRanges[0].End == 65535:
+		case len(side.portRanges) == 1:
+			portOptions = append(portOptions, side.option, portRangesToNetfilterPorts(side.portRanges))
+		default:
+			multiportOptions = append(multiportOptions, "-m", "multiport", side.listOption, portRangesToNetfilterPorts(side.portRanges))
 		}
-		result = append(result, portRangesToNetfilterPorts(rule.FromPortRanges))
 	}
-	if rule.ToPortRanges[0].Start != 0 || rule.ToPortRanges[0].End != 65535 {
-		if rule.ToPortRanges[0].Start != rule.ToPortRanges[0].End {
-			result = append(result, "--dports")
-		} else {
-			result = append(result, "--dport")
-		}
-		result = append(result, portRangesToNetfilterPorts(rule.ToPortRanges))
+	if len(portOptions) > 0 {
+		result = append(append(result, "-m", protocolString), portOptions...)
 	}
+	result = append(result, multiportOptions...)
 
-	var action string
 	switch rule.Action {
 	case networkControl.ACL_ALLOW:
-		action = "ACCEPT"
+		if direction == networkControl.ACLDIR_OUT {
+			result = append(result, "-g", fw.chain(ACL_OUT_DONE_CHAIN))
+		} else {
+			result = append(result, "-j", "ACCEPT")
+		}
 	case networkControl.ACL_DENY:
-		action = denyCommand
+		result = append(result, "-j", denyCommand)
 	default:
 		panic(fmt.Errorf("Unknown action: %v", rule))
 	}
 
-	result = append(result, "-j", action)
-
 	return result
 }
 
@@ -998,6 +1432,15 @@ func ParseNetfilterPortRanges(portRangesString string) (portRanges networkContro
 }
 
 func parseACLRule(ruleString string) (rule networkControl.ACLRule) {
+	anyNet, err := networkControl.IPNetFromCIDRString("0.0.0.0/0")
+	if err != nil {
+		panic(err)
+	}
+	rule.FromNet = anyNet
+	rule.ToNet = anyNet
+	rule.FromPortRanges = networkControl.PortRanges{{Start: 0, End: 65535}}
+	rule.ToPortRanges = networkControl.PortRanges{{Start: 0, End: 65535}}
+
 	words := strings.Split(ruleString, " ")
 	for len(words) > 0 {
 		switch words[0] {
@@ -1020,20 +1463,23 @@ func parseACLRule(ruleString string) (rule networkControl.ACLRule) {
 		case "-p":
 			rule.Protocol = networkControl.ProtocolFromString(words[1])
 			words = words[2:]
-		case "--sports":
-			rule.ToPortRanges = ParseNetfilterPortRanges(words[1])
-			words = words[2:]
-		case "--dports":
+		case "--sport", "--sports":
 			rule.FromPortRanges = ParseNetfilterPortRanges(words[1])
 			words = words[2:]
+		case "--dport", "--dports":
+			rule.ToPortRanges = ParseNetfilterPortRanges(words[1])
+			words = words[2:]
 		case "-j":
 			switch words[1] {
-			case "ACCEPT":
+			case "ACCEPT", "RETURN":
 				rule.Action = networkControl.ACL_ALLOW
 			case "DROP", "REJECT":
 				rule.Action = networkControl.ACL_DENY
 			}
 			words = words[2:]
+		case "-g": // the allowing rule of an outgoing ACL, see aclChainName()
+			rule.Action = networkControl.ACL_ALLOW
+			words = words[2:]
 		case "--reject-with":
 			words = words[2:]
 		default:
@@ -1044,68 +1490,39 @@ func parseACLRule(ruleString string) (rule networkControl.ACLRule) {
 	return
 }
 
-func (fw *iptables) AddACL(acl networkControl.ACL) (err error) {
-
-	setName := "ACL.IN." + acl.Name
-	chainName := setName
-
-	// adding an ipset
+func (fw *iptables) AddACL(acl networkControl.ACL) error {
+	return fw.inBatch(func() error {
+		return fw.addACL(acl)
+	})
+}
 
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	var set *ipset.IPSet
-	set, err = ipset.New(setName, "hash:net,iface", &ipset.Params{HashSize: 1048576})
-	if err != nil {
-		return
-	}
-	for _, vlanName := range acl.VLANNames {
-		err = set.Add("0.0.0.0/0,"+fw.IfNameToIPTIfName(vlanName), 0)
-		if err != nil {
-			fw.LogError(err)
-			return
-		}
-	}
-	*/
+func (fw *iptables) addACL(acl networkControl.ACL) (err error) {
 
-	if fw.aclToMark[acl.Name] == 0 {
-		fw.markMax_ACL++
-		mark := fw.markMax_ACL << 16
-		fw.markToACL[mark] = acl.Name
-		fw.aclToMark[acl.Name] = mark
-	}
+	// adding chains to iptables
 
-	for _, vlanName := range acl.VLANNames {
-		err = fw.iptables.AppendUnique("mangle", "ACLs", "-i", fw.GetHost().IfNameToHostIfName(vlanName), "-j", "MARK", "--set-mark", strconv.Itoa(fw.ACLToMark(acl.Name))+"/0xff0000", "-m", "comment", "--comment", "{acl:"+acl.Name+"}")
+	for _, direction := range networkControl.ACLDirections {
+		chainName := fw.aclChainName(acl.Name, direction)
+		err = fw.iptables.NewChain("filter", chainName)
 		if err != nil {
-			fw.LogError(err)
-		}
-	}
-
-	// adding a chain to iptables
-
-	err = fw.iptables.NewChain("filter", chainName)
-	if err != nil {
-		if strings.Index(err.Error(), "Chain already exists.") != -1 {
-			fw.LogWarning(err)
-		} else {
-			fw.LogError(err)
-			return err
+			if strings.Index(err.Error(), "Chain already exists.") != -1 {
+				fw.LogWarning(err)
+			} else {
+				fw.LogError(err)
+				return err
+			}
 		}
-	}
-	for _, rule := range acl.Rules {
-		err = fw.iptables.AppendUnique("filter", chainName, ruleToNetfilterRule(rule)...)
-		if err != nil {
-			fw.LogError(err)
-			return
+		for _, rule := range acl.Rules {
+			err = fw.iptables.AppendUnique("filter", chainName, fw.ruleToNetfilterRule(rule, direction)...)
+			if err != nil {
+				fw.LogError(err)
+				return
+			}
 		}
 	}
 
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	// activating the chain
-
-	return fw.iptables.AppendUnique("filter", "ACLs", "-m", "set", "--match-set", setName, "src,src", "-j", chainName)
-	*/
+	// activating the chains
 
-	return fw.iptables.AppendUnique("filter", "ACLs", "-m", "mark", "--mark", strconv.Itoa(fw.ACLToMark(acl.Name))+"/0xff0000", "-j", chainName)
+	return fw.setACLBindings(acl.Name, fw.aclBindings(acl))
 }
 
 type dnatCommentT struct {
@@ -1149,7 +1566,7 @@ func (fw iptables) snatRuleStrings(snat networkControl.SNAT, source networkContr
 
 func (fw *iptables) AddSNAT(snat networkControl.SNAT) error {
 	for _, source := range snat.Sources {
-		err := fw.iptables.AppendUnique("nat", "SNATs", fw.snatRuleStrings(snat, source)...)
+		err := fw.iptables.AppendUnique("nat", fw.chain("SNATs"), fw.snatRuleStrings(snat, source)...)
 		if err != nil {
 			fw.LogError(err)
 			return err
@@ -1234,77 +1651,320 @@ func (fw iptables) ipportDestinationStrings(ipport networkControl.IPPort) (r []s
 
 func (fw *iptables) AddDNAT(dnat networkControl.DNAT) error {
 	for _, destination := range dnat.Destinations {
-		if err := fw.iptables.AppendUnique("nat", "DNATs", fw.dnatRuleStrings(dnat, destination)...); err != nil {
+		if err := fw.iptables.AppendUnique("nat", fw.chain("DNATs"), fw.dnatRuleStrings(dnat, destination)...); err != nil {
 			fw.LogError(err)
 			return err
 		}
 
-		if err := fw.iptables.AppendUnique("filter", "ACCEPT_DNATs", append(fw.ipportDestinationStrings(dnat.NATTo), "-j", "ACCEPT")...); err != nil {
+		if err := fw.iptables.AppendUnique("filter", fw.chain("ACCEPT_DNATs"), append(fw.ipportDestinationStrings(dnat.NATTo), "-j", "ACCEPT")...); err != nil {
 			fw.LogError(err)
 			return err
 		}
 	}
 	return nil
 }
+
+// UpdateACL updates the chains of the ACL in one batch, so the rule-level edits become active at once
 func (fw *iptables) UpdateACL(acl networkControl.ACL) error {
-	fw.RemoveACL(acl)
-	return fw.AddACL(acl)
+	return fw.inBatch(func() error {
+		return fw.updateACL(acl)
+	})
 }
-func (fw *iptables) UpdateSNAT(snat networkControl.SNAT) error {
-	fw.RemoveSNAT(snat)
-	return fw.AddSNAT(snat)
+
+func (fw *iptables) updateACL(acl networkControl.ACL) error {
+	for _, direction := range networkControl.ACLDirections {
+		ok, err := fw.chainExists("filter", fw.aclChainName(acl.Name, direction))
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+		if !ok { // the ACL is incomplete (created by an older version?), just adding everything what is missing
+			return fw.addACL(acl)
+		}
+	}
+
+	for _, direction := range networkControl.ACLDirections {
+		err := fw.updateACLChain(acl, direction)
+		if err != nil {
+			fw.LogError(err, acl.Name, direction)
+			return err
+		}
+	}
+
+	return fw.setACLBindings(acl.Name, fw.aclBindings(acl))
 }
-func (fw *iptables) UpdateDNAT(dnat networkControl.DNAT) error {
-	fw.RemoveDNAT(dnat)
-	return fw.AddDNAT(dnat)
+
+func (fw iptables) chainExists(table, chainName string) (bool, error) {
+	chainNames, err := fw.iptables.ListChains(table)
+	if err != nil {
+		return false, err
+	}
+	for _, curChainName := range chainNames {
+		if curChainName == chainName {
+			return true, nil
+		}
+	}
+	return false, nil
 }
-func (fw *iptables) RemoveACL(acl networkControl.ACL) error {
 
-	setName := "ACL.IN." + acl.Name
-	chainName := setName
+type ruleEditOp int
 
-	// deactivating the chain
-	/* See https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	err := fw.iptables.Delete("filter", "ACLs", "-m", "set", "--match-set", setName, "src,src", "-j", chainName)
-	if err != nil {
-		if err.Error() == "No chain/target/match by that name." {
-			fw.LogError(err)
+const (
+	ruleEditInsert  = ruleEditOp(1)
+	ruleEditDelete  = ruleEditOp(2)
+	ruleEditReplace = ruleEditOp(3)
+)
+
+type ruleEdit struct {
+	Op   ruleEditOp
+	Pos  int // 1-based position in the chain at the moment of applying the edit
+	Rule []string
+}
+
+// getRuleEdits returns edits (in the order they should be applied) to convert a chain with rules "oldRules" into a chain with rules "newRules".
+// The edits keep the longest common subsequence of rules untouched.
+func getRuleEdits(oldRules, newRules [][]string) (edits []ruleEdit) {
+	oldKeys := make([]string, len(oldRules))
+	for idx, rule := range oldRules {
+		oldKeys[idx] = strings.Join(rule, " ")
+	}
+	newKeys := make([]string, len(newRules))
+	for idx, rule := range newRules {
+		newKeys[idx] = strings.Join(rule, " ")
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of oldKeys[i:] and newKeys[j:]
+	lcs := make([][]int, len(oldKeys)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(newKeys)+1)
+	}
+	for i := len(oldKeys) - 1; i >= 0; i-- {
+		for j := len(newKeys) - 1; j >= 0; j-- {
+			switch {
+			case oldKeys[i] == newKeys[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j, pos := 0, 0, 1
+	for i < len(oldKeys) || j < len(newKeys) {
+		switch {
+		case i < len(oldKeys) && j < len(newKeys) && oldKeys[i] == newKeys[j]:
+			i++
+			j++
+			pos++
+		case i < len(oldKeys) && j < len(newKeys) && lcs[i+1][j+1] == lcs[i][j]:
+			edits = append(edits, ruleEdit{Op: ruleEditReplace, Pos: pos, Rule: newRules[j]})
+			i++
+			j++
+			pos++
+		case j >= len(newKeys) || (i < len(oldKeys) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, ruleEdit{Op: ruleEditDelete, Pos: pos})
+			i++
+		default:
+			edits = append(edits, ruleEdit{Op: ruleEditInsert, Pos: pos, Rule: newRules[j]})
+			j++
+			pos++
+		}
+	}
+
+	return
+}
+
+// applyRuleEdits applies the edits to the batch (rule positions are not stable outside of a batch,
+// the kernel could be changed by somebody else between the edits)
+func (fw *iptables) applyRuleEdits(table, chainName string, edits []ruleEdit) error {
+	if fw.batch == nil {
+		return errNoBatch
+	}
+	for _, edit := range edits {
+		var err error
+		switch edit.Op {
+		case ruleEditInsert:
+			err = fw.iptables.Insert(table, chainName, edit.Pos, edit.Rule...)
+		case ruleEditDelete:
+			err = fw.iptables.Delete(table, chainName, strconv.Itoa(edit.Pos))
+		case ruleEditReplace:
+			err = fw.iptables.Replace(table, chainName, edit.Pos, edit.Rule...)
+		default:
+			panic(fmt.Errorf("Unknown edit: %v", edit))
+		}
+		if err != nil {
+			fw.LogError(err, table, chainName, edit)
 			return err
-		} else {
-			fw.LogWarning(err)
 		}
 	}
-	*/
+	return nil
+}
+
+// updateACLChain updates rules of an ACL chain in place if there're just few changes, or
+// replaces the chain by a new one otherwise. The ACL remains active during the update.
+func (fw *iptables) updateACLChain(acl networkControl.ACL, direction networkControl.ACLDirection) error {
+	chainName := fw.aclChainName(acl.Name, direction)
+
+	ruleStrings, err := fw.iptables.List("filter", chainName)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	oldRules := [][]string{}
+	for _, ruleString := range ruleStrings {
+		if !strings.HasPrefix(ruleString, "-A "+chainName+" ") {
+			continue
+		}
+		ruleString = strings.Replace(ruleString, "-A "+chainName+" ", "", 1)
+		oldRules = append(oldRules, fw.ruleToNetfilterRule(parseACLRule(ruleString), direction))
+	}
+	newRules := [][]string{}
+	for _, rule := range acl.Rules {
+		newRules = append(newRules, fw.ruleToNetfilterRule(rule, direction))
+	}
+
+	edits := getRuleEdits(oldRules, newRules)
+	fw.Debugf("iptables.updateACLChain(): %v: %v edits", chainName, len(edits))
+	if len(edits) == 0 {
+		return nil
+	}
+	if len(edits) <= aclIncrementalEditsLimit && fw.batch != nil {
+		return fw.applyRuleEdits("filter", chainName, edits)
+	}
+
+	return fw.replaceACLChain(acl.Name, direction, newRules)
+}
+
+// replaceACLChain builds a new version of the ACL chain, atomically switches jumps in "filter ACLs" to it and then removes the old version
+func (fw *iptables) replaceACLChain(aclName string, direction networkControl.ACLDirection, rules [][]string) error {
+	chainName := fw.aclChainName(aclName, direction)
+	newChainName := chainName + "~"
 
-	// removing the chain
+	// building the new version
 
-	{
-		err := fw.iptables.ClearChain("filter", chainName)
+	err := fw.iptables.NewChain("filter", newChainName)
+	if err != nil {
+		if strings.Index(err.Error(), "Chain already exists.") != -1 { // a leftover of an interrupted update
+			fw.LogWarning(err)
+			err = fw.iptables.ClearChain("filter", newChainName)
+		}
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+	}
+	for _, rule := range rules {
+		err = fw.iptables.Append("filter", newChainName, rule...)
 		if err != nil {
 			fw.LogError(err)
 			return err
 		}
 	}
 
-	{
-		err := fw.iptables.DeleteChain("filter", chainName)
+	// switching the jumps
+
+	ruleStrings, err := fw.listACLBindingRules()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	for idx, ruleString := range ruleStrings {
+		binding, bindingChainName, ok := fw.parseACLBindingRule(ruleString)
+		if !ok || bindingChainName != chainName {
+			continue
+		}
+		err = fw.iptables.Replace("filter", fw.chain("ACLs"), idx+1, fw.aclBindingRuleStrings(binding, newChainName)...)
 		if err != nil {
 			fw.LogError(err)
 			return err
 		}
 	}
 
+	// removing the old version
+
+	err = fw.iptables.ClearChain("filter", chainName)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	err = fw.iptables.DeleteChain("filter", chainName)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+
+	// renaming the new version (the jumps follow the chain)
+
+	err = fw.iptables.RenameChain("filter", newChainName, chainName)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+
 	return nil
+}
+func (fw *iptables) UpdateSNAT(snat networkControl.SNAT) error {
+	fw.RemoveSNAT(snat)
+	return fw.AddSNAT(snat)
+}
+func (fw *iptables) UpdateDNAT(dnat networkControl.DNAT) error {
+	fw.RemoveDNAT(dnat)
+	return fw.AddDNAT(dnat)
+}
+func (fw *iptables) RemoveACL(acl networkControl.ACL) error {
+	return fw.inBatch(func() error {
+		return fw.removeACL(acl)
+	})
+}
+
+func (fw *iptables) removeACL(acl networkControl.ACL) error {
+	// deactivating the chains (the chains can't be deleted while they're referenced)
+
+	err := fw.setACLBindings(acl.Name, nil)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+
+	// removing the chains (including leftovers of an interrupted update, see replaceACLChain()); the
+	// chains could be already removed, so the removal could be repeated safely
+
+	chainNames, err := fw.iptables.ListChains("filter")
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	isExists := map[string]bool{}
+	for _, chainName := range chainNames {
+		isExists[chainName] = true
+	}
+	for _, direction := range networkControl.ACLDirections {
+		for _, chainName := range []string{fw.aclChainName(acl.Name, direction), fw.aclChainName(acl.Name, direction) + "~"} {
+			if !isExists[chainName] {
+				continue
+			}
+
+			err := fw.iptables.ClearChain("filter", chainName)
+			if err != nil {
+				fw.LogError(err)
+				return err
+			}
 
-	// removing the set
+			err = fw.iptables.DeleteChain("filter", chainName)
+			if err != nil {
+				fw.LogError(err)
+				return err
+			}
+		}
+	}
 
-	/* https://bugzilla.kernel.org/show_bug.cgi?id=199107
-	return ipset.Destroy(setName)
-	*/
+	return nil
 }
 func (fw *iptables) RemoveSNAT(snat networkControl.SNAT) error {
 	for _, source := range snat.Sources {
-		err := fw.iptables.Delete("nat", "SNATs", fw.snatRuleStrings(snat, source)...)
+		err := fw.iptables.Delete("nat", fw.chain("SNATs"), fw.snatRuleStrings(snat, source)...)
 		if err != nil {
 			fw.LogError(err)
 			return err
@@ -1314,11 +1974,11 @@ func (fw *iptables) RemoveSNAT(snat networkControl.SNAT) error {
 }
 func (fw *iptables) RemoveDNAT(dnat networkControl.DNAT) error {
 	for _, destination := range dnat.Destinations {
-		if err := fw.iptables.Delete("nat", "DNATs", fw.dnatRuleStrings(dnat, destination)...); err != nil {
+		if err := fw.iptables.Delete("nat", fw.chain("DNATs"), fw.dnatRuleStrings(dnat, destination)...); err != nil {
 			fw.LogError(err)
 			return err
 		}
-		if err := fw.iptables.Delete("filter", "ACCEPT_DNATs", append(fw.ipportDestinationStrings(dnat.NATTo), "-j", "ACCEPT")...); err != nil {
+		if err := fw.iptables.Delete("filter", fw.chain("ACCEPT_DNATs"), append(fw.ipportDestinationStrings(dnat.NATTo), "-j", "ACCEPT")...); err != nil {
 			fw.LogError(err)
 			return nil
 		}
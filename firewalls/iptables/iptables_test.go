@@ -0,0 +1,800 @@
+package iptables
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/xaionaro-go/networkControl"
+	"github.com/xaionaro-go/networkControl/hosts/memory"
+)
+
+func newTestFirewall(t *testing.T) (*iptables, *MemoryIPTables) {
+	ipt := NewMemoryIPTables()
+	fw, err := NewFirewallWithIPTables(memoryHost.NewHost(), DefaultConfig(), ipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fw.(*iptables), ipt
+}
+
+func ipnet(t *testing.T, cidr string) networkControl.IPNet {
+	ipnet, err := networkControl.IPNetFromCIDRString(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipnet
+}
+
+// checkSave compares the output of `iptables-save -t TABLE` with the expected one
+func checkSave(t *testing.T, ipt *MemoryIPTables, table string, expected string) {
+	t.Helper()
+	save, err := ipt.Save(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if save != expected {
+		t.Errorf("table %v:\n%v\nexpected:\n%v", table, save, expected)
+	}
+}
+
+func TestFirewallInit(t *testing.T) {
+	_, ipt := newTestFirewall(t)
+
+	checkSave(t, ipt, "mangle", `*mangle
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:IN_SECURITY_LEVELs - [0:0]
+:OUT_SECURITY_LEVELs - [0:0]
+-A FORWARD -m comment --comment networkControl -j IN_SECURITY_LEVELs
+-A FORWARD -m comment --comment networkControl -j OUT_SECURITY_LEVELs
+COMMIT
+`)
+	checkSave(t, ipt, "filter", `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:ACCEPT_DNATs - [0:0]
+:ACLs - [0:0]
+:ACLs.OUT.done - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A INPUT -m addrtype ! --dst-type LOCAL --limit-iface-in -m comment --comment networkControl -j DROP
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment networkControl -j ACCEPT
+-A FORWARD -m comment --comment networkControl -j ACLs
+-A FORWARD -m comment --comment networkControl -j SECURITY_LEVELs
+-A ACLs -j MARK --set-xmark 0x0/0x10000
+-A ACLs -j ACCEPT_DNATs
+-A ACLs.OUT.done -j MARK --set-xmark 0x10000/0x10000
+COMMIT
+`)
+	checkSave(t, ipt, "nat", `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DNATs - [0:0]
+:SNATs - [0:0]
+-A PREROUTING -m comment --comment networkControl -j DNATs
+-A POSTROUTING -d 10.0.0.0/8 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -d 172.16.0.0/12 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -d 192.168.0.0/16 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -m comment --comment networkControl -j SNATs
+COMMIT
+`)
+}
+
+func TestFirewallSecurityLevel(t *testing.T) {
+	fw, ipt := newTestFirewall(t)
+
+	for _, err := range []error{
+		fw.SetSecurityLevel("inside", 100),
+		fw.SetSecurityLevel("dmz", 50),
+		fw.SetSecurityLevel("outside", 0),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSave(t, ipt, "mangle", `*mangle
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:IN_SECURITY_LEVELs - [0:0]
+:OUT_SECURITY_LEVELs - [0:0]
+-A FORWARD -m comment --comment networkControl -j IN_SECURITY_LEVELs
+-A FORWARD -m comment --comment networkControl -j OUT_SECURITY_LEVELs
+-A IN_SECURITY_LEVELs -i inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x1/0xff
+-A IN_SECURITY_LEVELs -i dmz -m comment --comment "{security_level:50}" -j MARK --set-xmark 0x2/0xff
+-A IN_SECURITY_LEVELs -i outside -m comment --comment "{security_level:0}" -j MARK --set-xmark 0x3/0xff
+-A OUT_SECURITY_LEVELs -o inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x100/0xff00
+-A OUT_SECURITY_LEVELs -o dmz -m comment --comment "{security_level:50}" -j MARK --set-xmark 0x200/0xff00
+-A OUT_SECURITY_LEVELs -o outside -m comment --comment "{security_level:0}" -j MARK --set-xmark 0x300/0xff00
+COMMIT
+`)
+	checkSave(t, ipt, "filter", `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:ACCEPT_DNATs - [0:0]
+:ACLs - [0:0]
+:ACLs.OUT.done - [0:0]
+:IFACES.SECURITY_LEVEL.0 - [0:0]
+:IFACES.SECURITY_LEVEL.100 - [0:0]
+:IFACES.SECURITY_LEVEL.50 - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A INPUT -m addrtype ! --dst-type LOCAL --limit-iface-in -m comment --comment networkControl -j DROP
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment networkControl -j ACCEPT
+-A FORWARD -m comment --comment networkControl -j ACLs
+-A FORWARD -m comment --comment networkControl -j SECURITY_LEVELs
+-A ACLs -j MARK --set-xmark 0x0/0x10000
+-A ACLs -j ACCEPT_DNATs
+-A ACLs.OUT.done -j MARK --set-xmark 0x10000/0x10000
+-A IFACES.SECURITY_LEVEL.0 -i outside -o outside -j DROP
+-A IFACES.SECURITY_LEVEL.100 -i inside -o inside -j DROP
+-A IFACES.SECURITY_LEVEL.100 -m mark --mark 0x300/0xff00 -j ACCEPT
+-A IFACES.SECURITY_LEVEL.100 -m mark --mark 0x200/0xff00 -j ACCEPT
+-A IFACES.SECURITY_LEVEL.50 -i dmz -o dmz -j DROP
+-A IFACES.SECURITY_LEVEL.50 -m mark --mark 0x300/0xff00 -j ACCEPT
+-A SECURITY_LEVELs -m mark --mark 0x3/0xff -j IFACES.SECURITY_LEVEL.0
+-A SECURITY_LEVELs -m mark --mark 0x2/0xff -j IFACES.SECURITY_LEVEL.50
+-A SECURITY_LEVELs -m mark --mark 0x1/0xff -j IFACES.SECURITY_LEVEL.100
+-A SECURITY_LEVELs -j DROP
+COMMIT
+`)
+
+	for ifName, securityLevel := range map[string]int{"inside": 100, "dmz": 50, "outside": 0, "unknown": -1} {
+		if inquired := fw.InquireSecurityLevel(ifName); inquired != securityLevel {
+			t.Errorf("security level of %v: %v != %v", ifName, inquired, securityLevel)
+		}
+	}
+
+	err := fw.UnsetSecurityLevel("dmz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if securityLevel := fw.InquireSecurityLevel("dmz"); securityLevel != -1 {
+		t.Errorf("security level of the unset interface: %v", securityLevel)
+	}
+	checkSave(t, ipt, "mangle", `*mangle
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:IN_SECURITY_LEVELs - [0:0]
+:OUT_SECURITY_LEVELs - [0:0]
+-A FORWARD -m comment --comment networkControl -j IN_SECURITY_LEVELs
+-A FORWARD -m comment --comment networkControl -j OUT_SECURITY_LEVELs
+-A IN_SECURITY_LEVELs -i inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x1/0xff
+-A IN_SECURITY_LEVELs -i outside -m comment --comment "{security_level:0}" -j MARK --set-xmark 0x3/0xff
+-A OUT_SECURITY_LEVELs -o inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x100/0xff00
+-A OUT_SECURITY_LEVELs -o outside -m comment --comment "{security_level:0}" -j MARK --set-xmark 0x300/0xff00
+COMMIT
+`)
+}
+
+func TestFirewallACLs(t *testing.T) {
+	fw, ipt := newTestFirewall(t)
+
+	allPorts := networkControl.PortRanges{{Start: 0, End: 65535}}
+	outsideIn := networkControl.ACL{
+		Name:      "outside_in",
+		VLANNames: []string{"outside"},
+		Rules: networkControl.ACLRules{
+			{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: allPorts, ToNet: ipnet(t, "10.0.1.10/32"), ToPortRanges: networkControl.PortRanges{{Start: 80, End: 80}}},
+			{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_UDP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: allPorts, ToNet: ipnet(t, "10.0.1.10/32"), ToPortRanges: networkControl.PortRanges{{Start: 53, End: 53}}},
+			{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_IP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: allPorts, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: allPorts},
+		},
+	}
+	dmzOut := networkControl.ACL{
+		Name:         "dmz_out",
+		OutVLANNames: []string{"dmz"},
+		Rules: networkControl.ACLRules{
+			{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_TCP, FromNet: ipnet(t, "10.0.0.0/24"), FromPortRanges: allPorts, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: networkControl.PortRanges{{Start: 25, End: 25}}},
+		},
+	}
+	for _, acl := range []networkControl.ACL{outsideIn, dmzOut} {
+		err := fw.AddACL(acl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkSave(t, ipt, "filter", `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:ACCEPT_DNATs - [0:0]
+:ACL.IN.dmz_out - [0:0]
+:ACL.IN.outside_in - [0:0]
+:ACL.OUT.dmz_out - [0:0]
+:ACL.OUT.outside_in - [0:0]
+:ACLs - [0:0]
+:ACLs.OUT.done - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A INPUT -m addrtype ! --dst-type LOCAL --limit-iface-in -m comment --comment networkControl -j DROP
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment networkControl -j ACCEPT
+-A FORWARD -m comment --comment networkControl -j ACLs
+-A FORWARD -m comment --comment networkControl -j SECURITY_LEVELs
+-A ACL.IN.dmz_out -s 10.0.0.0/24 -p tcp -m tcp --dport 25 -j DROP
+-A ACL.IN.outside_in -d 10.0.1.10/32 -p tcp -m tcp --dport 80 -j ACCEPT
+-A ACL.IN.outside_in -d 10.0.1.10/32 -p udp -m udp --dport 53 -j ACCEPT
+-A ACL.IN.outside_in -j DROP
+-A ACL.OUT.dmz_out -s 10.0.0.0/24 -p tcp -m tcp --dport 25 -j DROP
+-A ACL.OUT.outside_in -d 10.0.1.10/32 -p tcp -m tcp --dport 80 -g ACLs.OUT.done
+-A ACL.OUT.outside_in -d 10.0.1.10/32 -p udp -m udp --dport 53 -g ACLs.OUT.done
+-A ACL.OUT.outside_in -j DROP
+-A ACLs -j MARK --set-xmark 0x0/0x10000
+-A ACLs -o dmz -m mark ! --mark 0x10000/0x10000 -m comment --comment "{}" -j ACL.OUT.dmz_out
+-A ACLs -j ACCEPT_DNATs
+-A ACLs -i outside -m comment --comment "{}" -j ACL.IN.outside_in
+-A ACLs.OUT.done -j MARK --set-xmark 0x10000/0x10000
+COMMIT
+`)
+
+	acls := fw.InquireACLs()
+	if len(acls) != 2 {
+		t.Fatalf("ACLs: %v", acls)
+	}
+	for _, acl := range acls {
+		expected := outsideIn
+		if acl.Name == dmzOut.Name {
+			expected = dmzOut
+		}
+		if !reflect.DeepEqual(acl.Rules, expected.Rules) || !reflect.DeepEqual(acl.VLANNames, expected.VLANNames) || !reflect.DeepEqual(acl.OutVLANNames, expected.OutVLANNames) {
+			t.Errorf("inquired ACL:\n%+v\nexpected:\n%+v", *acl, expected)
+		}
+	}
+
+	outsideIn.Rules = outsideIn.Rules[1:]
+	err := fw.UpdateACL(outsideIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fw.RemoveACL(dmzOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSave(t, ipt, "filter", `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:ACCEPT_DNATs - [0:0]
+:ACL.IN.outside_in - [0:0]
+:ACL.OUT.outside_in - [0:0]
+:ACLs - [0:0]
+:ACLs.OUT.done - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A INPUT -m addrtype ! --dst-type LOCAL --limit-iface-in -m comment --comment networkControl -j DROP
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment networkControl -j ACCEPT
+-A FORWARD -m comment --comment networkControl -j ACLs
+-A FORWARD -m comment --comment networkControl -j SECURITY_LEVELs
+-A ACL.IN.outside_in -d 10.0.1.10/32 -p udp -m udp --dport 53 -j ACCEPT
+-A ACL.IN.outside_in -j DROP
+-A ACL.OUT.outside_in -d 10.0.1.10/32 -p udp -m udp --dport 53 -g ACLs.OUT.done
+-A ACL.OUT.outside_in -j DROP
+-A ACLs -j MARK --set-xmark 0x0/0x10000
+-A ACLs -j ACCEPT_DNATs
+-A ACLs -i outside -m comment --comment "{}" -j ACL.IN.outside_in
+-A ACLs.OUT.done -j MARK --set-xmark 0x10000/0x10000
+COMMIT
+`)
+
+	acls = fw.InquireACLs()
+	if len(acls) != 1 || !reflect.DeepEqual(acls[0].Rules, outsideIn.Rules) {
+		t.Errorf("ACLs: %v", acls)
+	}
+}
+
+func TestFirewallACLPorts(t *testing.T) {
+	fw, ipt := newTestFirewall(t)
+
+	acl := networkControl.ACL{
+		Name:      "ports",
+		VLANNames: []string{"outside"},
+		Rules: networkControl.ACLRules{
+			{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: networkControl.PortRanges{{Start: 1024, End: 65535}}, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: networkControl.PortRanges{{Start: 80, End: 80}, {Start: 8000, End: 8080}}},
+			{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_UDP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: networkControl.PortRanges{{Start: 53, End: 53}}, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: networkControl.PortRanges{{Start: 1000, End: 2000}}},
+		},
+	}
+	err := fw.AddACL(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ipt.List("filter", "ACL.IN.ports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRules := []string{
+		"-N ACL.IN.ports",
+		"-A ACL.IN.ports -p tcp -m tcp --sport 1024:65535 -m multiport --dports 80,8000:8080 -j ACCEPT",
+		"-A ACL.IN.ports -p udp -m udp --sport 53 --dport 1000:2000 -j DROP",
+	}
+	if !reflect.DeepEqual(rules, expectedRules) {
+		t.Errorf("rules: %v", rules)
+	}
+
+	acls := fw.InquireACLs()
+	if len(acls) != 1 || !reflect.DeepEqual(acls[0].Rules, acl.Rules) {
+		t.Errorf("ACLs: %v", acls)
+	}
+}
+
+func TestFirewallNATs(t *testing.T) {
+	fw, ipt := newTestFirewall(t)
+
+	snat := networkControl.SNAT{
+		Sources: networkControl.SNATSources{{IPNet: ipnet(t, "10.0.0.0/24"), IfName: "inside"}},
+		NATTo:   net.ParseIP("192.0.2.1"),
+	}
+	port := uint16(80)
+	tcp := networkControl.PROTO_TCP
+	dnat := networkControl.DNAT{
+		Destinations: networkControl.IPPorts{{Protocol: &tcp, IP: net.ParseIP("192.0.2.1"), Port: &port}},
+		NATTo:        networkControl.IPPort{Protocol: &tcp, IP: net.ParseIP("10.0.1.10"), Port: &port},
+		IfName:       "outside",
+	}
+	err := fw.AddSNAT(snat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fw.AddDNAT(dnat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSave(t, ipt, "nat", `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DNATs - [0:0]
+:SNATs - [0:0]
+-A PREROUTING -m comment --comment networkControl -j DNATs
+-A POSTROUTING -d 10.0.0.0/8 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -d 172.16.0.0/12 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -d 192.168.0.0/16 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -m comment --comment networkControl -j SNATs
+-A DNATs -d 192.0.2.1/32 -p tcp -m tcp --dport 80 -m comment --comment "{\"IfName\":\"outside\"}" -j DNAT --to-destination 10.0.1.10:80
+-A SNATs -s 10.0.0.0/24 -m comment --comment "{\"IfName\":\"inside\"}" -j SNAT --to-source 192.0.2.1
+COMMIT
+`)
+	checkSave(t, ipt, "filter", `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:ACCEPT_DNATs - [0:0]
+:ACLs - [0:0]
+:ACLs.OUT.done - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A INPUT -m addrtype ! --dst-type LOCAL --limit-iface-in -m comment --comment networkControl -j DROP
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment networkControl -j ACCEPT
+-A FORWARD -m comment --comment networkControl -j ACLs
+-A FORWARD -m comment --comment networkControl -j SECURITY_LEVELs
+-A ACCEPT_DNATs -d 10.0.1.10/32 -p tcp -m tcp --dport 80 -j ACCEPT
+-A ACLs -j MARK --set-xmark 0x0/0x10000
+-A ACLs -j ACCEPT_DNATs
+-A ACLs.OUT.done -j MARK --set-xmark 0x10000/0x10000
+COMMIT
+`)
+
+	if snats := fw.InquireSNATs(); len(snats) != 1 || !reflect.DeepEqual(*snats[0], snat) {
+		t.Errorf("SNATs: %v", snats)
+	}
+	if dnats := fw.InquireDNATs(); len(dnats) != 1 || !reflect.DeepEqual(*dnats[0], dnat) {
+		t.Errorf("DNATs: %v", dnats)
+	}
+
+	err = fw.RemoveSNAT(snat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fw.RemoveDNAT(dnat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSave(t, ipt, "nat", `*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DNATs - [0:0]
+:SNATs - [0:0]
+-A PREROUTING -m comment --comment networkControl -j DNATs
+-A POSTROUTING -d 10.0.0.0/8 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -d 172.16.0.0/12 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -d 192.168.0.0/16 -m comment --comment networkControl -j ACCEPT
+-A POSTROUTING -m comment --comment networkControl -j SNATs
+COMMIT
+`)
+	checkSave(t, ipt, "filter", `*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:ACCEPT_DNATs - [0:0]
+:ACLs - [0:0]
+:ACLs.OUT.done - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A INPUT -m addrtype ! --dst-type LOCAL --limit-iface-in -m comment --comment networkControl -j DROP
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -m comment --comment networkControl -j ACCEPT
+-A FORWARD -m comment --comment networkControl -j ACLs
+-A FORWARD -m comment --comment networkControl -j SECURITY_LEVELs
+-A ACLs -j MARK --set-xmark 0x0/0x10000
+-A ACLs -j ACCEPT_DNATs
+-A ACLs.OUT.done -j MARK --set-xmark 0x10000/0x10000
+COMMIT
+`)
+}
+
+func TestFirewallMarksExhausted(t *testing.T) {
+	config := DefaultConfig()
+	config.MarkLayout = MarkLayout{SecurityLevelIn: 0x3, SecurityLevelOut: 0xc, ACLOutDone: 0x10}
+	fw, err := NewFirewallWithIPTables(memoryHost.NewHost(), config, NewMemoryIPTables())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, ifName := range []string{"inside", "dmz", "outside"} {
+		err := fw.SetSecurityLevel(ifName, idx*10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used, capacity := fw.(*iptables).GetSecurityLevelMarksUsage(); used != 3 || capacity != 3 {
+		t.Errorf("marks usage: %v/%v", used, capacity)
+	}
+	err = fw.SetSecurityLevel("guest", 30)
+	if err != ErrMarksExhausted {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = fw.SetSecurityLevel("guest", 10)
+	if err != nil {
+		t.Errorf("a security level in use: %v", err)
+	}
+}
+
+// brokenMarksBaseline is a ruleset where the security level 50 has the mark of the security level 100
+// and no dispatching rule
+const brokenMarksBaseline = `*mangle
+:IN_SECURITY_LEVELs - [0:0]
+:OUT_SECURITY_LEVELs - [0:0]
+-A IN_SECURITY_LEVELs -i inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x1/0xff
+-A IN_SECURITY_LEVELs -i dmz -m comment --comment "{security_level:50}" -j MARK --set-xmark 0x1/0xff
+-A OUT_SECURITY_LEVELs -o inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x100/0xff00
+-A OUT_SECURITY_LEVELs -o dmz -m comment --comment "{security_level:50}" -j MARK --set-xmark 0x100/0xff00
+COMMIT
+*filter
+:IFACES.SECURITY_LEVEL.100 - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A SECURITY_LEVELs -m mark --mark 0x1/0xff -j IFACES.SECURITY_LEVEL.100
+-A SECURITY_LEVELs -j DROP
+COMMIT
+`
+
+func TestFirewallRecoverMarks(t *testing.T) {
+	ipt := NewMemoryIPTables()
+	err := ipt.Restore(brokenMarksBaseline, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firewall, err := NewFirewallWithIPTables(memoryHost.NewHost(), DefaultConfig(), ipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw := firewall.(*iptables)
+
+	for securityLevel, expectedMark := range map[int]int{100: 1, 50: 2} {
+		mark, err := fw.SecurityLevelToMark(securityLevel)
+		if err != nil || mark != expectedMark {
+			t.Errorf("the mark of security level %v: %v (%v), expected: %v", securityLevel, mark, err, expectedMark)
+		}
+	}
+	_, err = fw.SecurityLevelToMark(10)
+	if err == nil {
+		t.Errorf("an unknown security level has a mark")
+	}
+
+	for chainName, expectedRules := range map[string][]string{
+		"IN_SECURITY_LEVELs": {
+			"-N IN_SECURITY_LEVELs",
+			`-A IN_SECURITY_LEVELs -i inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x1/0xff`,
+			`-A IN_SECURITY_LEVELs -i dmz -m comment --comment "{security_level:50}" -j MARK --set-xmark 0x2/0xff`,
+		},
+		"OUT_SECURITY_LEVELs": {
+			"-N OUT_SECURITY_LEVELs",
+			`-A OUT_SECURITY_LEVELs -o inside -m comment --comment "{security_level:100}" -j MARK --set-xmark 0x100/0xff00`,
+			`-A OUT_SECURITY_LEVELs -o dmz -m comment --comment "{security_level:50}" -j MARK --set-xmark 0x200/0xff00`,
+		},
+	} {
+		rules, err := ipt.List("mangle", chainName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rules, expectedRules) {
+			t.Errorf("rules of %v:\n%v\nexpected:\n%v", chainName, strings.Join(rules, "\n"), strings.Join(expectedRules, "\n"))
+		}
+	}
+	rules, err := ipt.List("filter", "SECURITY_LEVELs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRules := []string{
+		"-N SECURITY_LEVELs",
+		"-A SECURITY_LEVELs -m mark --mark 0x2/0xff -j IFACES.SECURITY_LEVEL.50",
+		"-A SECURITY_LEVELs -m mark --mark 0x1/0xff -j IFACES.SECURITY_LEVEL.100",
+		"-A SECURITY_LEVELs -j DROP",
+	}
+	if !reflect.DeepEqual(rules, expectedRules) {
+		t.Errorf("rules of SECURITY_LEVELs:\n%v\nexpected:\n%v", strings.Join(rules, "\n"), strings.Join(expectedRules, "\n"))
+	}
+	for ifName, securityLevel := range map[string]int{"inside": 100, "dmz": 50} {
+		if inquired := fw.InquireSecurityLevel(ifName); inquired != securityLevel {
+			t.Errorf("security level of %v: %v != %v", ifName, inquired, securityLevel)
+		}
+	}
+}
+
+func TestFirewallTeardownKeepForeign(t *testing.T) {
+	host := memoryHost.NewHost()
+	ipt := NewMemoryIPTables()
+	fw, err := NewFirewallWithIPTables(host, DefaultConfig(), ipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allPorts := networkControl.PortRanges{{Start: 0, End: 65535}}
+	rules := networkControl.ACLRules{{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_IP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: allPorts, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: allPorts}}
+	managedACL := networkControl.ACL{Name: "managed", VLANNames: []string{"inside"}, Rules: rules}
+	foreignACL := networkControl.ACL{Name: "foreign", VLANNames: []string{"outside"}, Rules: rules, Ownership: networkControl.OWNERSHIP_ADOPTABLE}
+	for _, acl := range []networkControl.ACL{managedACL, foreignACL} {
+		err := fw.AddACL(acl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	host.States.Cur.ACLs = networkControl.ACLs{&managedACL, &foreignACL}
+
+	items, err := fw.(networkControl.TeardownFirewallI).Teardown(networkControl.TeardownOptions{KeepForeign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name != "managed" {
+		t.Errorf("teardown items: %v", items)
+	}
+	if acls := fw.InquireACLs(); len(acls) != 1 || acls[0].Name != "foreign" {
+		t.Errorf("ACLs: %v", acls)
+	}
+
+	host.States.Cur.ACLs = networkControl.ACLs{}
+	_, err = fw.(networkControl.TeardownFirewallI).Teardown(networkControl.TeardownOptions{KeepForeign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chainNames, _ := ipt.ListChains("filter"); len(chainNames) != 3 {
+		t.Errorf("chains are left: %v", chainNames)
+	}
+}
+
+// restoreCountingIPTables counts the transactions of iptables-restore
+type restoreCountingIPTables struct {
+	*MemoryIPTables
+	restoreCount int
+}
+
+func (ipt *restoreCountingIPTables) restore(input []byte, isNoFlush bool) error {
+	ipt.restoreCount++
+	return ipt.MemoryIPTables.restore(input, isNoFlush)
+}
+
+func TestFirewallPermitIntraInterface(t *testing.T) {
+	ipt := &restoreCountingIPTables{MemoryIPTables: NewMemoryIPTables()}
+	fw, err := NewFirewallWithIPTables(memoryHost.NewHost(), DefaultConfig(), ipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{fw.SetSecurityLevel("inside", 100), fw.SetSecurityLevel("dmz", 100)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ipt.restoreCount = 0
+	err = fw.SetEnablePermitIntraInterface(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipt.restoreCount != 1 {
+		t.Errorf("the chains are rebuilt by %v transactions", ipt.restoreCount)
+	}
+	if !fw.InquirePermitIntraInterface() {
+		t.Errorf("intra-interface traffic is not permitted")
+	}
+	rules, err := ipt.List("filter", "IFACES.SECURITY_LEVEL.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRules := []string{
+		"-N IFACES.SECURITY_LEVEL.100",
+		"-A IFACES.SECURITY_LEVEL.100 -i inside -o inside -j ACCEPT",
+		"-A IFACES.SECURITY_LEVEL.100 -i dmz -o dmz -j ACCEPT",
+	}
+	if !reflect.DeepEqual(rules, expectedRules) {
+		t.Errorf("rules: %v", rules)
+	}
+}
+
+// legacyBaseline is the ruleset of an older version (without the comment tag and the chain prefix)
+// next to the rules of other software
+const legacyBaseline = `*mangle
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:ACLs - [0:0]
+:IN_SECURITY_LEVELs - [0:0]
+:OUT_SECURITY_LEVELs - [0:0]
+-A FORWARD -j ACLs
+-A FORWARD -j IN_SECURITY_LEVELs
+-A FORWARD -j OUT_SECURITY_LEVELs
+-A ACLs -i inside -j MARK --set-xmark 0x10000/0xff0000
+COMMIT
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:ACCEPT_DNATs - [0:0]
+:ACLs - [0:0]
+:DOCKER-USER - [0:0]
+:SECURITY_LEVELs - [0:0]
+-A INPUT -m addrtype ! --dst-type LOCAL --limit-iface-in -j DROP
+-A FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A FORWARD -j DOCKER-USER
+-A FORWARD -j ACLs
+-A FORWARD -j SECURITY_LEVELs
+-A ACLs -j ACCEPT_DNATs
+COMMIT
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DNATs - [0:0]
+:SNATs - [0:0]
+-A PREROUTING -j DNATs
+-A POSTROUTING -d 10.0.0.0/8 -j ACCEPT
+-A POSTROUTING -d 172.16.0.0/12 -j ACCEPT
+-A POSTROUTING -d 192.168.0.0/16 -j ACCEPT
+-A POSTROUTING -j SNATs
+COMMIT
+`
+
+// foreignBaseline is legacyBaseline without the rules of the older version
+const foreignBaseline = `*filter
+:DOCKER-USER - [0:0]
+-A FORWARD -j DOCKER-USER
+COMMIT
+`
+
+func TestFirewallMigrateLegacyRules(t *testing.T) {
+	for _, chainPrefix := range []string{"", "NC_"} {
+		config := DefaultConfig()
+		config.ChainPrefix = chainPrefix
+		config.MigrateLegacyRules = true
+
+		newFirewall := func(baseline string) *MemoryIPTables {
+			ipt := NewMemoryIPTables()
+			err := ipt.Restore(baseline, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewFirewallWithIPTables(memoryHost.NewHost(), config, ipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ipt
+		}
+
+		// the upgraded ruleset is the same as a new one
+		migrated := newFirewall(legacyBaseline)
+		expected := newFirewall(foreignBaseline)
+		for _, table := range []string{"mangle", "filter", "nat"} {
+			save, err := expected.Save(table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSave(t, migrated, table, save)
+		}
+	}
+}
+
+// failingBackend is MemoryIPTables which fails to restore the table "failedTable"
+type failingBackend struct {
+	*MemoryIPTables
+	failedTable string
+}
+
+func (backend failingBackend) restore(input []byte, isNoFlush bool) error {
+	if strings.HasPrefix(string(input), "*"+backend.failedTable+"\n") {
+		return errors.New("injected failure")
+	}
+	return backend.MemoryIPTables.restore(input, isNoFlush)
+}
+
+func TestBatchCommitRollback(t *testing.T) {
+	ipt := NewMemoryIPTables()
+	for _, err := range []error{
+		ipt.NewChain("nat", "SNATs"),
+		ipt.Append("nat", "SNATs", "-s", "10.0.0.0/8", "-j", "MASQUERADE"),
+		ipt.Append("nat", "SNATs", "-s", "172.16.0.0/12", "-j", "MASQUERADE"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, _ := ipt.Save("nat")
+
+	b := newBatch(failingBackend{MemoryIPTables: ipt, failedTable: "filter"})
+	for _, err := range []error{
+		b.Append("nat", "SNATs", "-s", "192.168.0.0/16", "-j", "MASQUERADE"),
+		b.Delete("nat", "SNATs", "1"),
+		b.NewChain("nat", "DNATs"),
+		b.ClearChain("nat", "SNATs"),
+		b.Append("filter", "FORWARD", "-j", "ACCEPT"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other software changes the table during the batch: its rules should survive the rollback
+	err := ipt.Append("nat", "POSTROUTING", "-j", "MASQUERADE")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Commit()
+	if err == nil {
+		t.Fatalf("an error is expected")
+	}
+	checkSave(t, ipt, "nat", strings.Replace(before, ":SNATs - [0:0]\n", ":SNATs - [0:0]\n-A POSTROUTING -j MASQUERADE\n", 1))
+}
+
+func TestBatchDeleteByNumber(t *testing.T) {
+	ipt := NewMemoryIPTables()
+	for _, err := range []error{
+		ipt.NewChain("mangle", "IN_SECURITY_LEVELs"),
+		ipt.Append("mangle", "IN_SECURITY_LEVELs", "-i", "inside", "-j", "ACCEPT"),
+		ipt.Append("mangle", "IN_SECURITY_LEVELs", "-i", "outside", "-j", "ACCEPT"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := newBatch(ipt)
+	err := b.Delete("mangle", "IN_SECURITY_LEVELs", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the numbers of the rules in the kernel change until the commit
+	err = ipt.Insert("mangle", "IN_SECURITY_LEVELs", 1, "-i", "dmz", "-j", "ACCEPT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, _ := ipt.List("mangle", "IN_SECURITY_LEVELs")
+	expected := []string{"-N IN_SECURITY_LEVELs", "-A IN_SECURITY_LEVELs -i dmz -j ACCEPT", "-A IN_SECURITY_LEVELs -i inside -j ACCEPT"}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("rules: %v, expected: %v", rules, expected)
+	}
+}
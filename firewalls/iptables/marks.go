@@ -0,0 +1,472 @@
+package iptables
+
+// Security levels are identified in the traffic by fwmarks. The mapping between security levels and
+// marks is kept in memory, so it's rebuilt from the rules in the kernel on start (see recoverMarks).
+//
+// A "mark" here is the number of a security level (1, 2, ...), it's shifted into the bits
+// of MarkMask-s of the MarkLayout to get the value of the fwmark.
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidMarkLayout = errors.New("invalid mark layout: masks should be non-zero, contiguous and should not overlap (and ACLOutDone should be one bit)")
+
+	// ErrMarksExhausted is returned by SetSecurityLevel if all the marks of the mark layout are in use. The
+	// firewall doesn't switch to ipsets on its own: the interfaces of the existing security levels would
+	// have to be moved between the modes on the fly. Set Config.UseIPSets to not depend on the marks.
+	ErrMarksExhausted = errors.New("all the marks of the mark layout are in use")
+
+	errNoSecurityLevelMark = errors.New("the security level has no mark")
+)
+
+// MarkMask is a contiguous set of fwmark bits
+type MarkMask uint32
+
+func (mask MarkMask) shift() uint {
+	return uint(bits.TrailingZeros32(uint32(mask)))
+}
+
+func (mask MarkMask) isValid() bool {
+	value := uint32(mask) >> mask.shift()
+	return mask != 0 && value&(value+1) == 0
+}
+
+// Capacity returns the amount of different marks which fit into the mask (zero means "no mark")
+func (mask MarkMask) Capacity() int {
+	return int(uint32(mask) >> mask.shift())
+}
+
+// markString returns the mark as a "VALUE/MASK" argument of iptables
+func (mask MarkMask) markString(mark int) string {
+	return fmt.Sprintf("0x%x/0x%x", uint32(mark)<<mask.shift(), uint32(mask))
+}
+
+// parseMarkString extracts the mark from a "VALUE[/MASK]" argument of iptables
+func (mask MarkMask) parseMarkString(markString string) (int, error) {
+	value, err := strconv.ParseUint(strings.Split(markString, "/")[0], 0, 32)
+	if err != nil {
+		return -1, err
+	}
+	return int((uint32(value) & uint32(mask)) >> mask.shift()), nil
+}
+
+// MarkLayout defines which fwmark bits are used by the firewall. Other software (wg-quick, Docker,
+// kube-proxy, ...) may use fwmarks as well, so the bits should be chosen to not collide with them.
+// Rules written with another layout are not recognized, so the rules should be flushed on a layout change.
+//
+// There's no mask for ACLs: ACLs are bound to interfaces by jumps of "filter ACLs", so their amount is
+// not limited by the layout. The only bit of ACLs is ACLOutDone: it's set by the chain "ACLs.OUT.done"
+// when an outgoing ACL allowed the packet and it's reset at the beginning of "filter ACLs" (see aclChainName).
+//
+// SecurityLevelsCapacity() security levels fit into the layout, ErrMarksExhausted is returned for the next one
+// (see GetSecurityLevelMarksUsage).
+type MarkLayout struct {
+	SecurityLevelIn  MarkMask // the security level of the input interface
+	SecurityLevelOut MarkMask // the security level of the output interface
+	ACLOutDone       MarkMask // one bit: an outgoing ACL allowed the packet, the rest of outgoing ACLs are skipped
+}
+
+var DefaultMarkLayout = MarkLayout{
+	SecurityLevelIn:  0xff,
+	SecurityLevelOut: 0xff00,
+	ACLOutDone:       0x10000,
+}
+
+func (layout MarkLayout) Validate() error {
+	masks := []MarkMask{layout.SecurityLevelIn, layout.SecurityLevelOut, layout.ACLOutDone}
+	usedBits := MarkMask(0)
+	for _, mask := range masks {
+		if !mask.isValid() || usedBits&mask != 0 {
+			return ErrInvalidMarkLayout
+		}
+		usedBits |= mask
+	}
+	if layout.ACLOutDone.Capacity() != 1 {
+		return ErrInvalidMarkLayout
+	}
+	return nil
+}
+
+// SecurityLevelsCapacity returns the maximal amount of security levels
+func (layout MarkLayout) SecurityLevelsCapacity() int {
+	inCapacity, outCapacity := layout.SecurityLevelIn.Capacity(), layout.SecurityLevelOut.Capacity()
+	if inCapacity < outCapacity {
+		return inCapacity
+	}
+	return outCapacity
+}
+
+// GetSecurityLevelMarksUsage returns the amount of used marks and the capacity of the mark layout
+func (fw iptables) GetSecurityLevelMarksUsage() (used, capacity int) {
+	return len(fw.securityLevelToMark), fw.config.MarkLayout.SecurityLevelsCapacity()
+}
+
+// allocateSecurityLevelMark returns the lowest mark not in use
+func (fw iptables) allocateSecurityLevelMark() (int, error) {
+	capacity := fw.config.MarkLayout.SecurityLevelsCapacity()
+	for mark := 1; mark <= capacity; mark++ {
+		if fw.markToSecurityLevel[mark] == nil {
+			return mark, nil
+		}
+	}
+	return 0, ErrMarksExhausted
+}
+
+const (
+	securityLevelChainPrefix = "IFACES.SECURITY_LEVEL."
+)
+
+func (fw iptables) securityLevelChainName(securityLevel int) string {
+	if securityLevel < 0 {
+		return fw.chain(securityLevelChainPrefix + "m" + strconv.Itoa(-securityLevel))
+	}
+	return fw.chain(securityLevelChainPrefix + strconv.Itoa(securityLevel))
+}
+
+func (fw iptables) parseSecurityLevelChainName(chainName string) (int, bool) {
+	prefix := fw.chain(securityLevelChainPrefix)
+	if !strings.HasPrefix(chainName, prefix) {
+		return 0, false
+	}
+	securityLevelString := chainName[len(prefix):]
+	sign := 1
+	if strings.HasPrefix(securityLevelString, "m") {
+		sign = -1
+		securityLevelString = securityLevelString[1:]
+	}
+	securityLevel, err := strconv.Atoi(securityLevelString)
+	if err != nil {
+		return 0, false
+	}
+	return sign * securityLevel, true
+}
+
+func securityLevelComment(securityLevel int) string {
+	return "{security_level:" + strconv.Itoa(securityLevel) + "}"
+}
+
+func parseSecurityLevelComment(comment string) (int, bool) {
+	comment = strings.Trim(comment, `"`)
+	if !strings.HasPrefix(comment, "{security_level:") || !strings.HasSuffix(comment, "}") {
+		return 0, false
+	}
+	securityLevel, err := strconv.Atoi(comment[len("{security_level:") : len(comment)-1])
+	if err != nil {
+		return 0, false
+	}
+	return securityLevel, true
+}
+
+// inSecurityLevelRule returns the rule of "mangle IN_SECURITY_LEVELs" which marks the traffic from the interface
+func (fw iptables) inSecurityLevelRule(hostIfName string, securityLevel int) ([]string, error) {
+	mark, err := fw.SecurityLevelToMark(securityLevel)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-i", hostIfName, "-j", "MARK", "--set-mark", fw.config.MarkLayout.SecurityLevelIn.markString(mark), "-m", "comment", "--comment", securityLevelComment(securityLevel)}, nil
+}
+
+// outSecurityLevelRule returns the rule of "mangle OUT_SECURITY_LEVELs" which marks the traffic to the interface
+func (fw iptables) outSecurityLevelRule(hostIfName string, securityLevel int) ([]string, error) {
+	mark, err := fw.SecurityLevelToMark(securityLevel)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-o", hostIfName, "-j", "MARK", "--set-mark", fw.config.MarkLayout.SecurityLevelOut.markString(mark), "-m", "comment", "--comment", securityLevelComment(securityLevel)}, nil
+}
+
+// addSecurityLevelRules adds the rules of "mangle IN_SECURITY_LEVELs" and "mangle OUT_SECURITY_LEVELs" of the interface
+func (fw iptables) addSecurityLevelRules(hostIfName string, securityLevel int) error {
+	inRule, err := fw.inSecurityLevelRule(hostIfName, securityLevel)
+	if err != nil {
+		return err
+	}
+	outRule, err := fw.outSecurityLevelRule(hostIfName, securityLevel)
+	if err != nil {
+		return err
+	}
+	err = fw.iptables.AppendUnique("mangle", fw.chain("IN_SECURITY_LEVELs"), inRule...)
+	if err != nil {
+		return err
+	}
+	return fw.iptables.AppendUnique("mangle", fw.chain("OUT_SECURITY_LEVELs"), outRule...)
+}
+
+// deleteSecurityLevelRules deletes the rules of "mangle IN_SECURITY_LEVELs" and "mangle OUT_SECURITY_LEVELs" of the interface
+func (fw iptables) deleteSecurityLevelRules(hostIfName string, securityLevel int) error {
+	inRule, err := fw.inSecurityLevelRule(hostIfName, securityLevel)
+	if err != nil {
+		return err
+	}
+	outRule, err := fw.outSecurityLevelRule(hostIfName, securityLevel)
+	if err != nil {
+		return err
+	}
+	err = fw.iptables.Delete("mangle", fw.chain("IN_SECURITY_LEVELs"), inRule...)
+	outErr := fw.iptables.Delete("mangle", fw.chain("OUT_SECURITY_LEVELs"), outRule...)
+	if err != nil {
+		return err
+	}
+	return outErr
+}
+
+// markRule is a parsed rule of "mangle IN_SECURITY_LEVELs", "mangle OUT_SECURITY_LEVELs" or "filter SECURITY_LEVELs"
+type markRule struct {
+	pos           int      // the rule number (starting with 1)
+	spec          []string // the specification of the rule (to delete it)
+	ifName        string
+	securityLevel int
+	mark          int
+}
+
+// listMarkRules parses the rules of a chain which set or match marks of security levels (other rules are skipped)
+func (fw iptables) listMarkRules(table, chainName string, mask MarkMask) (result []markRule, err error) {
+	ruleStrings, err := fw.iptables.List(table, chainName)
+	if err != nil {
+		return
+	}
+	pos := 0
+	for _, ruleString := range ruleStrings {
+		if !strings.HasPrefix(ruleString, "-A ") {
+			continue
+		}
+		pos++
+		rule := markRule{pos: pos, spec: splitRuleString(ruleString)[2:], mark: -1, securityLevel: -1}
+		isSecurityLevelSet := false
+		ruleWords := strings.Split(ruleString, " ")
+		for idx := 0; idx+1 < len(ruleWords); idx++ {
+			value := ruleWords[idx+1]
+			switch ruleWords[idx] {
+			case "-i", "-o":
+				rule.ifName = value
+			case "--comment":
+				rule.securityLevel, isSecurityLevelSet = parseSecurityLevelComment(value)
+			case "-j":
+				if securityLevel, ok := fw.parseSecurityLevelChainName(value); ok {
+					rule.securityLevel, isSecurityLevelSet = securityLevel, true
+				}
+			case "--set-xmark", "--mark":
+				mark, err := mask.parseMarkString(value)
+				if err != nil {
+					fw.LogError(err, ruleString)
+					continue
+				}
+				rule.mark = mark
+			}
+		}
+		if !isSecurityLevelSet || rule.mark <= 0 {
+			continue
+		}
+		result = append(result, rule)
+	}
+	return
+}
+
+// recoverMarks rebuilds the mapping between security levels and marks from the rules in the kernel
+// (after a restart the mapping is empty). The dispatching rules of "filter SECURITY_LEVELs" are
+// authoritative; interface rules with a mark inconsistent with the mapping are rewritten and the
+// security level chains are rebuilt.
+func (fw *iptables) recoverMarks() error {
+	fw.markToSecurityLevel = map[int]*int{}
+	fw.securityLevelToMark = map[int]int{}
+
+	assign := func(securityLevel, mark int) bool {
+		if fw.securityLevelToMark[securityLevel] != 0 || fw.markToSecurityLevel[mark] != nil {
+			return false
+		}
+		securityLevelCopy := securityLevel
+		fw.securityLevelToMark[securityLevel] = mark
+		fw.markToSecurityLevel[mark] = &securityLevelCopy
+		return true
+	}
+
+	isBroken := false
+
+	dispatchRules, err := fw.listMarkRules("filter", fw.chain("SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelIn)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	for _, rule := range dispatchRules {
+		if !assign(rule.securityLevel, rule.mark) {
+			fw.Warningf("Conflicting security level dispatching rule (security level %v, mark %v)", rule.securityLevel, rule.mark)
+			isBroken = true
+		}
+	}
+
+	type chainMarkRules struct {
+		chainName string
+		rules     []markRule
+	}
+	var ifaceRules []chainMarkRules
+	for _, chain := range []struct {
+		name string
+		mask MarkMask
+	}{{fw.chain("IN_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelIn}, {fw.chain("OUT_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelOut}} {
+		rules, err := fw.listMarkRules("mangle", chain.name, chain.mask)
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+		for _, rule := range rules {
+			assign(rule.securityLevel, rule.mark)
+		}
+		ifaceRules = append(ifaceRules, chainMarkRules{chain.name, rules})
+	}
+
+	isDispatched := map[int]bool{}
+	for _, rule := range dispatchRules {
+		isDispatched[rule.securityLevel] = true
+	}
+	for securityLevel := range fw.securityLevelToMark {
+		if !isDispatched[securityLevel] {
+			fw.Warningf("Security level %v has no dispatching rule", securityLevel)
+			isBroken = true
+		}
+	}
+
+	// repairing interface rules with marks of other security levels
+
+	for _, chain := range ifaceRules {
+		for _, rule := range chain.rules {
+			if fw.securityLevelToMark[rule.securityLevel] == rule.mark {
+				continue
+			}
+			isBroken = true
+			if fw.securityLevelToMark[rule.securityLevel] == 0 {
+				mark, err := fw.allocateSecurityLevelMark()
+				if err != nil {
+					fw.LogError(err, rule.securityLevel)
+					return err
+				}
+				assign(rule.securityLevel, mark)
+			}
+			fw.Warningf("Repairing the mark of interface %v in %v: %v -> %v (security level %v)", rule.ifName, chain.chainName, rule.mark, fw.securityLevelToMark[rule.securityLevel], rule.securityLevel)
+			var ruleSpec []string
+			var err error
+			if chain.chainName == fw.chain("IN_SECURITY_LEVELs") {
+				ruleSpec, err = fw.inSecurityLevelRule(rule.ifName, rule.securityLevel)
+			} else {
+				ruleSpec, err = fw.outSecurityLevelRule(rule.ifName, rule.securityLevel)
+			}
+			if err != nil {
+				fw.LogError(err)
+				return err
+			}
+			err = fw.iptables.Replace("mangle", chain.chainName, rule.pos, ruleSpec...)
+			if err != nil {
+				fw.LogError(err)
+				return err
+			}
+		}
+	}
+
+	if !isBroken {
+		return nil
+	}
+
+	// rebuilding the dispatching rules and the security level chains
+
+	err = fw.iptables.ClearChain("filter", fw.chain("SECURITY_LEVELs"))
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	return fw.createSecurityLevelRules()
+}
+
+// gcSecurityLevels releases the marks (or destroys the ipsets) of the security levels without interfaces,
+// removes their chains and rebuilds the dispatching rules and the security level chains
+func (fw *iptables) gcSecurityLevels() error {
+	if fw.isIPSetsUsed {
+		ipsets, err := fw.getIPSets()
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+		for _, name := range ipsets.Names() {
+			if !fw.isOwnIPSet(name) || len(ipsets.Entries(name)) != 0 {
+				continue
+			}
+			fw.Infof("Destroying the set %v of the unused security level", name)
+			ipsets.Destroy(name) // after the rules referencing it are removed, see CommitBatch()
+		}
+		return fw.rebuildSecurityLevelRules()
+	}
+
+	isUsed := map[int]bool{}
+	for _, chain := range []struct {
+		name string
+		mask MarkMask
+	}{{fw.chain("IN_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelIn}, {fw.chain("OUT_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelOut}} {
+		rules, err := fw.listMarkRules("mangle", chain.name, chain.mask)
+		if err != nil {
+			fw.LogError(err)
+			return err
+		}
+		for _, rule := range rules {
+			isUsed[rule.securityLevel] = true
+		}
+	}
+
+	for securityLevel, mark := range fw.securityLevelToMark {
+		if isUsed[securityLevel] {
+			continue
+		}
+		fw.Infof("Releasing the mark %v of the unused security level %v", mark, securityLevel)
+		delete(fw.securityLevelToMark, securityLevel)
+		delete(fw.markToSecurityLevel, mark)
+	}
+
+	return fw.rebuildSecurityLevelRules()
+}
+
+// rebuildSecurityLevelRules rebuilds the dispatching rules and the security level chains and removes
+// the chains of security levels which don't exist anymore
+func (fw *iptables) rebuildSecurityLevelRules() error {
+	err := fw.iptables.ClearChain("filter", fw.chain("SECURITY_LEVELs"))
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	err = fw.createSecurityLevelRules()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+
+	// the security level chains are not referenced anymore (and don't reference each other)
+
+	isExists := map[int]bool{}
+	for _, securityLevel := range fw.GetSecurityLevels() {
+		isExists[securityLevel] = true
+	}
+	chainNames, err := fw.iptables.ListChains("filter")
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	for _, chainName := range chainNames {
+		securityLevel, ok := fw.parseSecurityLevelChainName(chainName)
+		if !ok || isExists[securityLevel] {
+			continue
+		}
+		err = fw.iptables.ClearChain("filter", chainName)
+		if err != nil {
+			fw.LogError(err, chainName)
+			return err
+		}
+		err = fw.iptables.DeleteChain("filter", chainName)
+		if err != nil {
+			fw.LogError(err, chainName)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1002 @@
+package iptables
+
+// MemoryIPTables is an in-memory implementation of IPTables to test the firewall without the kernel
+// (see NewFirewallWithIPTables()). It checks and lists rules the way the kernel and iptables do it
+// independently of the firewall (see memoryMatches and memoryTargets): for example
+// "-p tcp --dport 80 -j MARK --set-mark 0x10" is listed as "-p tcp -m tcp --dport 80 -j MARK --set-xmark 0x10/0xffffffff"
+// and unknown matches, targets and options are refused.
+//
+// Batches of the firewall are committed to it like to the kernel (see batchBackend), so the
+// same code paths are used with and without batches.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	errUnknownRestoreCommand = errors.New("unknown iptables-restore command")
+)
+
+// memoryBuiltinChains are the built-in chains of each table in the order of `iptables-save`
+var memoryBuiltinChains = map[string][]string{
+	"raw":    {"PREROUTING", "OUTPUT"},
+	"mangle": {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"filter": {"INPUT", "FORWARD", "OUTPUT"},
+}
+
+// memoryOption is an option of a match or a target
+type memoryOption struct {
+	name     string
+	values   int    // the number of values (0 for flags)
+	isQuoted bool   // the value is printed by xtables_save_string()
+	savedAs  string // the option is printed as another one (e.g. "--set-mark" as "--set-xmark")
+
+	// canonical converts the value to the form it's printed in
+	canonical func(value string) (string, error)
+}
+
+// memoryExtension is a match or a target, its options are in the order they're printed in
+type memoryExtension struct {
+	options []memoryOption
+	tables  []string // the tables the target is valid in (nil if any)
+}
+
+var memoryPortOptions = []memoryOption{
+	{name: "--sport", values: 1, canonical: memoryPortRange},
+	{name: "--dport", values: 1, canonical: memoryPortRange},
+}
+
+// memoryMatches are the matches known to MemoryIPTables
+var memoryMatches = map[string]memoryExtension{
+	"tcp": {options: memoryPortOptions},
+	"udp": {options: memoryPortOptions},
+	"multiport": {options: []memoryOption{
+		{name: "--sports", values: 1, canonical: memoryPortList},
+		{name: "--dports", values: 1, canonical: memoryPortList},
+		{name: "--ports", values: 1, canonical: memoryPortList},
+	}},
+	"comment":   {options: []memoryOption{{name: "--comment", values: 1, isQuoted: true}}},
+	"mark":      {options: []memoryOption{{name: "--mark", values: 1, canonical: memoryMark}}},
+	"conntrack": {options: []memoryOption{{name: "--ctstate", values: 1, canonical: memoryCTState}}},
+	"addrtype": {options: []memoryOption{
+		{name: "--src-type", values: 1},
+		{name: "--dst-type", values: 1},
+		{name: "--limit-iface-in"},
+		{name: "--limit-iface-out"},
+	}},
+	"set": {options: []memoryOption{{name: "--match-set", values: 2}}},
+}
+
+// memoryTargets are the targets known to MemoryIPTables (besides user-defined chains)
+var memoryTargets = map[string]memoryExtension{
+	"ACCEPT": {},
+	"DROP":   {},
+	"RETURN": {},
+	"REJECT": {options: []memoryOption{{name: "--reject-with", values: 1}}},
+	"MARK": {options: []memoryOption{
+		{name: "--set-xmark", values: 1, canonical: memoryXMark},
+		{name: "--set-mark", values: 1, savedAs: "--set-xmark", canonical: memorySetMark},
+	}},
+	"SNAT":       {tables: []string{"nat"}, options: []memoryOption{{name: "--to-source", values: 1}}},
+	"DNAT":       {tables: []string{"nat"}, options: []memoryOption{{name: "--to-destination", values: 1}}},
+	"MASQUERADE": {tables: []string{"nat"}, options: []memoryOption{{name: "--to-ports", values: 1}}},
+}
+
+// memoryCTStates are the connection states in the order conntrack prints them
+var memoryCTStates = []string{"INVALID", "NEW", "RELATED", "ESTABLISHED", "UNTRACKED", "SNAT", "DNAT"}
+
+func memoryPortRange(value string) (string, error) {
+	words := strings.Split(value, ":")
+	if len(words) > 2 {
+		return "", fmt.Errorf("invalid port range %q", value)
+	}
+	ports := make([]uint64, 0, 2)
+	for _, word := range words {
+		port, err := strconv.ParseUint(word, 10, 16)
+		if err != nil {
+			return "", fmt.Errorf("invalid port %q", word)
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) == 1 || ports[0] == ports[1] {
+		return strconv.FormatUint(ports[0], 10), nil
+	}
+	if ports[0] > ports[1] {
+		return "", fmt.Errorf("invalid port range %q", value)
+	}
+	return fmt.Sprintf("%v:%v", ports[0], ports[1]), nil
+}
+
+func memoryPortList(value string) (string, error) {
+	words := strings.Split(value, ",")
+	if len(words) > 15 {
+		return "", fmt.Errorf("too many ports specified: %q", value)
+	}
+	for idx, word := range words {
+		portRange, err := memoryPortRange(word)
+		if err != nil {
+			return "", err
+		}
+		words[idx] = portRange
+	}
+	return strings.Join(words, ","), nil
+}
+
+// memoryParseMark parses "VALUE[/MASK]", the mask is 0xffffffff by default
+func memoryParseMark(value string) (mark, mask uint64, err error) {
+	words := strings.SplitN(value, "/", 2)
+	mark, err = strconv.ParseUint(words[0], 0, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad mark value %q", value)
+	}
+	mask = 0xffffffff
+	if len(words) > 1 {
+		mask, err = strconv.ParseUint(words[1], 0, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad mark mask %q", value)
+		}
+	}
+	return
+}
+
+func memoryMark(value string) (string, error) {
+	mark, mask, err := memoryParseMark(value)
+	if err != nil {
+		return "", err
+	}
+	if mask == 0xffffffff {
+		return fmt.Sprintf("0x%x", mark), nil
+	}
+	return fmt.Sprintf("0x%x/0x%x", mark, mask), nil
+}
+
+func memoryXMark(value string) (string, error) {
+	mark, mask, err := memoryParseMark(value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("0x%x/0x%x", mark, mask), nil
+}
+
+// memorySetMark converts "--set-mark VALUE/MASK" to the value of the equivalent "--set-xmark" (like libxt_MARK does)
+func memorySetMark(value string) (string, error) {
+	mark, mask, err := memoryParseMark(value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("0x%x/0x%x", mark, mark|mask), nil
+}
+
+func memoryCTState(value string) (string, error) {
+	states := map[string]bool{}
+	for _, state := range strings.Split(value, ",") {
+		states[state] = true
+	}
+	var result []string
+	for _, state := range memoryCTStates {
+		if states[state] {
+			result = append(result, state)
+			delete(states, state)
+		}
+	}
+	if len(states) > 0 || len(result) == 0 {
+		return "", fmt.Errorf("bad ctstate %q", value)
+	}
+	return strings.Join(result, ","), nil
+}
+
+// memoryAddress converts an address to the form iptables prints it in ("NETWORK/PREFIX")
+func memoryAddress(value string) (string, error) {
+	if !strings.Contains(value, "/") {
+		value += "/32"
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil || ipNet.IP.To4() == nil {
+		return "", fmt.Errorf("host/network `%v' not found", value)
+	}
+	return ipNet.String(), nil
+}
+
+// memorySaveString quotes a value the way xtables_save_string() does it
+func memorySaveString(value string) string {
+	isSafe := value != ""
+	for _, c := range value {
+		if c != '_' && c != '-' && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			isSafe = false
+		}
+	}
+	if isSafe {
+		return value
+	}
+	var result strings.Builder
+	result.WriteByte('"')
+	for _, c := range value {
+		if strings.ContainsRune("\"\\'", c) {
+			result.WriteByte('\\')
+		}
+		result.WriteRune(c)
+	}
+	result.WriteByte('"')
+	return result.String()
+}
+
+// memorySplitLine splits a line of the input of `iptables-restore` into arguments
+func memorySplitLine(line string) (args []string, err error) {
+	var arg strings.Builder
+	isQuoted, hasArg := false, false
+	for idx := 0; idx < len(line); idx++ {
+		c := line[idx]
+		switch {
+		case isQuoted && c == '\\' && idx+1 < len(line):
+			idx++
+			arg.WriteByte(line[idx])
+		case c == '"':
+			isQuoted, hasArg = !isQuoted, true
+		case !isQuoted && (c == ' ' || c == '\t'):
+			if hasArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				hasArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			hasArg = true
+		}
+	}
+	if isQuoted {
+		return nil, fmt.Errorf("unterminated quotes in %q", line)
+	}
+	if hasArg {
+		args = append(args, arg.String())
+	}
+	return
+}
+
+// memoryRule is a rule in the form of `iptables -S` (without "-A CHAIN")
+type memoryRule struct {
+	words  []string
+	quoted map[int]bool // the indexes of the words printed by xtables_save_string()
+	jump   int          // the index of the name of the user-defined chain the rule jumps to (or -1)
+}
+
+func (rule *memoryRule) String() string {
+	words := make([]string, len(rule.words))
+	for idx, word := range rule.words {
+		if rule.quoted[idx] {
+			word = memorySaveString(word)
+		}
+		words[idx] = word
+	}
+	return strings.Join(words, " ")
+}
+
+func (rule *memoryRule) add(isQuoted bool, words ...string) {
+	for _, word := range words {
+		if isQuoted {
+			rule.quoted[len(rule.words)] = true
+		}
+		rule.words = append(rule.words, word)
+	}
+}
+
+type memoryChain struct {
+	policy string // "" for user-defined chains
+	rules  []*memoryRule
+}
+
+func (chain *memoryChain) find(rule *memoryRule) int {
+	ruleStr := rule.String()
+	for idx, curRule := range chain.rules {
+		if curRule.String() == ruleStr {
+			return idx
+		}
+	}
+	return -1
+}
+
+type memoryTable struct {
+	name   string
+	chains map[string]*memoryChain
+}
+
+func newMemoryTable(table string) (*memoryTable, error) {
+	chainNames, ok := memoryBuiltinChains[table]
+	if !ok {
+		return nil, fmt.Errorf("iptables: can't initialize iptables table `%v': Table does not exist", table)
+	}
+	t := &memoryTable{name: table, chains: map[string]*memoryChain{}}
+	for _, chainName := range chainNames {
+		t.chains[chainName] = &memoryChain{policy: "ACCEPT"}
+	}
+	return t, nil
+}
+
+func (t *memoryTable) clone() *memoryTable {
+	result := &memoryTable{name: t.name, chains: map[string]*memoryChain{}}
+	for chainName, chain := range t.chains {
+		chainCopy := &memoryChain{policy: chain.policy}
+		for _, rule := range chain.rules {
+			ruleCopy := *rule
+			ruleCopy.words = append([]string{}, rule.words...)
+			chainCopy.rules = append(chainCopy.rules, &ruleCopy)
+		}
+		result.chains[chainName] = chainCopy
+	}
+	return result
+}
+
+// chainNames returns built-in chains and then user-defined chains in alphabetical order
+func (t *memoryTable) chainNames() []string {
+	userChains := []string{}
+	for chainName, chain := range t.chains {
+		if chain.policy == "" {
+			userChains = append(userChains, chainName)
+		}
+	}
+	sort.Strings(userChains)
+	return append(append([]string{}, memoryBuiltinChains[t.name]...), userChains...)
+}
+
+func (t *memoryTable) chain(chainName string) (*memoryChain, error) {
+	chain := t.chains[chainName]
+	if chain == nil {
+		return nil, fmt.Errorf("iptables: No chain/target/match by that name. (chain %v in table %v)", chainName, t.name)
+	}
+	return chain, nil
+}
+
+// memoryExtensionUse is a match or a target of a rule being parsed
+type memoryExtensionUse struct {
+	flag      string // "-m", "-j" or "-g"
+	name      string
+	extension memoryExtension
+	values    map[string][]string // by the printed option name
+	isChain   bool                // the target is a user-defined chain
+}
+
+func (use *memoryExtensionUse) option(name string) *memoryOption {
+	for idx := range use.extension.options {
+		if use.extension.options[idx].name == name {
+			return &use.extension.options[idx]
+		}
+	}
+	return nil
+}
+
+// parseRule checks the rule specification and converts it to the form of `iptables -S`
+func (t *memoryTable) parseRule(rulespec []string) (*memoryRule, error) {
+	generic := map[string][]string{}
+	var uses []*memoryExtensionUse
+	var target *memoryExtensionUse
+	isNegated := false
+
+	next := func(idx *int) (string, error) {
+		if *idx+1 >= len(rulespec) {
+			return "", fmt.Errorf("option %q requires an argument", rulespec[*idx])
+		}
+		*idx++
+		return rulespec[*idx], nil
+	}
+
+	for idx := 0; idx < len(rulespec); idx++ {
+		word := rulespec[idx]
+		if word == "!" {
+			if isNegated {
+				return nil, errors.New("multiple consecutive ! not allowed")
+			}
+			isNegated = true
+			continue
+		}
+
+		switch word {
+		case "-s", "-d", "-i", "-o", "-p":
+			value, err := next(&idx)
+			if err != nil {
+				return nil, err
+			}
+			if generic[word] != nil {
+				return nil, fmt.Errorf("multiple %v flags not allowed", word)
+			}
+			switch word {
+			case "-s", "-d":
+				value, err = memoryAddress(value)
+				if err != nil {
+					return nil, err
+				}
+			case "-p":
+				value = strings.ToLower(value)
+				if value != "tcp" && value != "udp" && value != "icmp" && value != "all" {
+					return nil, fmt.Errorf("unknown protocol %q specified", value)
+				}
+			}
+			generic[word] = []string{word, value}
+			if isNegated {
+				generic[word] = append([]string{"!"}, generic[word]...)
+			}
+
+		case "-m":
+			if isNegated {
+				return nil, errors.New("unexpected ! flag before -m")
+			}
+			name, err := next(&idx)
+			if err != nil {
+				return nil, err
+			}
+			extension, ok := memoryMatches[name]
+			if !ok {
+				return nil, fmt.Errorf("Couldn't load match `%v':No such file or directory", name)
+			}
+			uses = append(uses, &memoryExtensionUse{flag: word, name: name, extension: extension, values: map[string][]string{}})
+
+		case "-j", "-g":
+			if isNegated {
+				return nil, fmt.Errorf("unexpected ! flag before %v", word)
+			}
+			name, err := next(&idx)
+			if err != nil {
+				return nil, err
+			}
+			if target != nil {
+				return nil, errors.New("multiple -j flags not allowed")
+			}
+			extension, isBuiltin := memoryTargets[name]
+			if isBuiltin && word == "-g" {
+				return nil, fmt.Errorf("goto '%v' is not a chain", name)
+			}
+			if isBuiltin && extension.tables != nil && extension.tables[0] != t.name {
+				return nil, fmt.Errorf("iptables: Invalid argument. (target %v in table %v)", name, t.name)
+			}
+			if !isBuiltin {
+				if chain := t.chains[name]; chain == nil || chain.policy != "" {
+					return nil, fmt.Errorf("Couldn't load target `%v':No such file or directory", name)
+				}
+			}
+			target = &memoryExtensionUse{flag: word, name: name, extension: extension, values: map[string][]string{}, isChain: !isBuiltin}
+
+		default:
+			if !strings.HasPrefix(word, "--") {
+				return nil, fmt.Errorf("Bad argument `%v'", word)
+			}
+
+			// the option belongs to the target or to a loaded match, the match of the protocol is loaded implicitly
+			var use *memoryExtensionUse
+			var option *memoryOption
+			candidates := append(append([]*memoryExtensionUse{}, target), uses...)
+			for _, candidate := range candidates {
+				if candidate != nil {
+					if option = candidate.option(word); option != nil {
+						use = candidate
+						break
+					}
+				}
+			}
+			if use == nil && generic["-p"] != nil {
+				protocol := generic["-p"][len(generic["-p"])-1]
+				if extension, ok := memoryMatches[protocol]; ok {
+					use = &memoryExtensionUse{flag: "-m", name: protocol, extension: extension, values: map[string][]string{}}
+					if option = use.option(word); option != nil {
+						uses = append(uses, use)
+					}
+				}
+			}
+			if option == nil {
+				return nil, fmt.Errorf("unknown option %q", word)
+			}
+
+			values := make([]string, 0, option.values)
+			for len(values) < option.values {
+				value, err := next(&idx)
+				if err != nil {
+					return nil, err
+				}
+				if option.canonical != nil {
+					value, err = option.canonical(value)
+					if err != nil {
+						return nil, err
+					}
+				}
+				values = append(values, value)
+			}
+			name := option.name
+			if option.savedAs != "" {
+				name = option.savedAs
+			}
+			if use.values[name] != nil {
+				return nil, fmt.Errorf("multiple %v flags not allowed", word)
+			}
+			if isNegated {
+				values = append([]string{"!"}, values...)
+			}
+			use.values[name] = values
+		}
+		isNegated = false
+	}
+	if isNegated {
+		return nil, errors.New("unexpected ! at the end")
+	}
+
+	rule := &memoryRule{quoted: map[int]bool{}, jump: -1}
+	for _, option := range []string{"-s", "-d", "-i", "-o", "-p"} {
+		if option == "-p" && len(generic[option]) == 2 && generic[option][1] == "all" {
+			continue
+		}
+		rule.add(false, generic[option]...)
+	}
+	if target != nil {
+		uses = append(uses, target)
+	}
+	for _, use := range uses {
+		rule.add(false, use.flag, use.name)
+		if use.isChain {
+			rule.jump = len(rule.words) - 1
+		}
+		for _, option := range use.extension.options {
+			values := use.values[option.name]
+			if values == nil {
+				continue
+			}
+			if len(values) > 0 && values[0] == "!" {
+				rule.add(false, "!")
+				values = values[1:]
+			}
+			rule.add(false, option.name)
+			rule.add(option.isQuoted, values...)
+		}
+	}
+	return rule, nil
+}
+
+// isReferenced returns true if a rule of the table jumps to the chain
+func (t *memoryTable) isReferenced(chainName string) bool {
+	for _, chain := range t.chains {
+		for _, rule := range chain.rules {
+			if rule.jump >= 0 && rule.words[rule.jump] == chainName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (t *memoryTable) appendRule(chainName string, rulespec []string) error {
+	chain, err := t.chain(chainName)
+	if err != nil {
+		return err
+	}
+	rule, err := t.parseRule(rulespec)
+	if err != nil {
+		return err
+	}
+	chain.rules = append(chain.rules, rule)
+	return nil
+}
+
+func (t *memoryTable) insertRule(chainName string, pos int, rulespec []string) error {
+	chain, err := t.chain(chainName)
+	if err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(chain.rules)+1 {
+		return fmt.Errorf("iptables: Index of insertion too big. (chain %v in table %v)", chainName, t.name)
+	}
+	rule, err := t.parseRule(rulespec)
+	if err != nil {
+		return err
+	}
+	chain.rules = append(chain.rules, nil)
+	copy(chain.rules[pos:], chain.rules[pos-1:])
+	chain.rules[pos-1] = rule
+	return nil
+}
+
+func (t *memoryTable) replaceRule(chainName string, pos int, rulespec []string) error {
+	chain, err := t.chain(chainName)
+	if err != nil {
+		return err
+	}
+	if pos < 1 || pos > len(chain.rules) {
+		return fmt.Errorf("iptables: Index of replacement too big. (chain %v in table %v)", chainName, t.name)
+	}
+	rule, err := t.parseRule(rulespec)
+	if err != nil {
+		return err
+	}
+	chain.rules[pos-1] = rule
+	return nil
+}
+
+// deleteRule deletes the rule by its specification or by its number
+func (t *memoryTable) deleteRule(chainName string, rulespec []string) error {
+	chain, err := t.chain(chainName)
+	if err != nil {
+		return err
+	}
+	idx := -1
+	if len(rulespec) == 1 && !strings.HasPrefix(rulespec[0], "-") {
+		pos, err := strconv.Atoi(rulespec[0])
+		if err != nil {
+			return fmt.Errorf("Bad argument `%v'", rulespec[0])
+		}
+		if pos < 1 || pos > len(chain.rules) {
+			return fmt.Errorf("iptables: Index of deletion too big. (chain %v in table %v)", chainName, t.name)
+		}
+		idx = pos - 1
+	} else {
+		rule, err := t.parseRule(rulespec)
+		if err != nil {
+			return err
+		}
+		idx = chain.find(rule)
+		if idx < 0 {
+			return fmt.Errorf("iptables: Bad rule (does a matching rule exist in that chain?). (chain %v in table %v)", chainName, t.name)
+		}
+	}
+	chain.rules = append(chain.rules[:idx], chain.rules[idx+1:]...)
+	return nil
+}
+
+func (t *memoryTable) exists(chainName string, rulespec []string) (bool, error) {
+	chain, err := t.chain(chainName)
+	if err != nil {
+		return false, err
+	}
+	rule, err := t.parseRule(rulespec)
+	if err != nil {
+		return false, err
+	}
+	return chain.find(rule) >= 0, nil
+}
+
+func (t *memoryTable) newChain(chainName string) error {
+	if t.chains[chainName] != nil {
+		return fmt.Errorf("iptables: Chain already exists. (chain %v in table %v)", chainName, t.name)
+	}
+	if _, isTarget := memoryTargets[chainName]; isTarget || chainName == "" || strings.HasPrefix(chainName, "-") || len(chainName) > 28 {
+		return fmt.Errorf("Invalid chain name `%v'", chainName)
+	}
+	t.chains[chainName] = &memoryChain{}
+	return nil
+}
+
+func (t *memoryTable) deleteChain(chainName string) error {
+	chain, err := t.chain(chainName)
+	if err != nil {
+		return err
+	}
+	if chain.policy != "" || len(chain.rules) > 0 {
+		return fmt.Errorf("iptables: Directory not empty. (chain %v in table %v)", chainName, t.name)
+	}
+	if t.isReferenced(chainName) {
+		return fmt.Errorf("iptables: Too many links. (chain %v in table %v)", chainName, t.name)
+	}
+	delete(t.chains, chainName)
+	return nil
+}
+
+func (t *memoryTable) renameChain(oldChainName, newChainName string) error {
+	chain, err := t.chain(oldChainName)
+	if err != nil {
+		return err
+	}
+	if chain.policy != "" {
+		return fmt.Errorf("iptables: Invalid argument. (chain %v in table %v)", oldChainName, t.name)
+	}
+	err = t.newChain(newChainName)
+	if err != nil {
+		return err
+	}
+	t.chains[newChainName] = chain
+	delete(t.chains, oldChainName)
+	for _, curChain := range t.chains {
+		for _, rule := range curChain.rules {
+			if rule.jump >= 0 && rule.words[rule.jump] == oldChainName {
+				rule.words[rule.jump] = newChainName
+			}
+		}
+	}
+	return nil
+}
+
+func (t *memoryTable) setPolicy(chainName, policy string) error {
+	chain, err := t.chain(chainName)
+	if err != nil {
+		return err
+	}
+	if chain.policy == "" {
+		return fmt.Errorf("iptables: Bad built-in chain name. (chain %v in table %v)", chainName, t.name)
+	}
+	if policy != "ACCEPT" && policy != "DROP" {
+		return fmt.Errorf("iptables: Bad policy name. (%v)", policy)
+	}
+	chain.policy = policy
+	return nil
+}
+
+// save returns the table in the format of `iptables-save -t TABLE` (without counters)
+func (t *memoryTable) save() []byte {
+	var output strings.Builder
+	fmt.Fprintf(&output, "*%v\n", t.name)
+	chainNames := t.chainNames()
+	for _, chainName := range chainNames {
+		policy := t.chains[chainName].policy
+		if policy == "" {
+			policy = "-"
+		}
+		fmt.Fprintf(&output, ":%v %v [0:0]\n", chainName, policy)
+	}
+	for _, chainName := range chainNames {
+		for _, rule := range t.chains[chainName].rules {
+			fmt.Fprintf(&output, "-A %v %v\n", chainName, rule)
+		}
+	}
+	fmt.Fprintln(&output, "COMMIT")
+	return []byte(output.String())
+}
+
+// applyRestoreLine applies a line of the input of `iptables-restore` to the table
+func (t *memoryTable) applyRestoreLine(line string) error {
+	if strings.HasPrefix(line, ":") { // a chain declaration: sets the policy of a built-in chain or creates (flushes) a user-defined one
+		words := strings.Fields(line[1:])
+		if len(words) < 2 {
+			return errUnknownRestoreCommand
+		}
+		chain := t.chains[words[0]]
+		switch {
+		case words[1] != "-":
+			return t.setPolicy(words[0], words[1])
+		case chain == nil:
+			return t.newChain(words[0])
+		case chain.policy != "":
+			return fmt.Errorf("iptables: Bad built-in chain name. (chain %v in table %v)", words[0], t.name)
+		}
+		chain.rules = nil
+		return nil
+	}
+
+	args, err := memorySplitLine(line)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return errUnknownRestoreCommand
+	}
+	command, chainName, args := args[0], args[1], args[2:]
+	switch command {
+	case "-A":
+		return t.appendRule(chainName, args)
+	case "-I", "-R":
+		pos := 1
+		if len(args) > 0 {
+			if argPos, err := strconv.Atoi(args[0]); err == nil {
+				pos, args = argPos, args[1:]
+			} else if command == "-R" {
+				return fmt.Errorf("Bad argument `%v'", args[0])
+			}
+		}
+		if command == "-I" {
+			return t.insertRule(chainName, pos, args)
+		}
+		return t.replaceRule(chainName, pos, args)
+	case "-D":
+		return t.deleteRule(chainName, args)
+	case "-N":
+		return t.newChain(chainName)
+	case "-X":
+		return t.deleteChain(chainName)
+	case "-F":
+		chain, err := t.chain(chainName)
+		if err != nil {
+			return err
+		}
+		chain.rules = nil
+		return nil
+	case "-E":
+		if len(args) != 1 {
+			return errUnknownRestoreCommand
+		}
+		return t.renameChain(chainName, args[0])
+	case "-P":
+		if len(args) != 1 {
+			return errUnknownRestoreCommand
+		}
+		return t.setPolicy(chainName, args[0])
+	}
+	return errUnknownRestoreCommand
+}
+
+type MemoryIPTables struct {
+	locker sync.Mutex
+	tables map[string]*memoryTable
+}
+
+var _ IPTables = &MemoryIPTables{}
+var _ batchBackend = &MemoryIPTables{}
+
+func NewMemoryIPTables() *MemoryIPTables {
+	return &MemoryIPTables{
+		tables: map[string]*memoryTable{},
+	}
+}
+
+func (m *MemoryIPTables) getTable(table string) (*memoryTable, error) {
+	t := m.tables[table]
+	if t != nil {
+		return t, nil
+	}
+	t, err := newMemoryTable(table)
+	if err != nil {
+		return nil, err
+	}
+	m.tables[table] = t
+	return t, nil
+}
+
+// change calls the function for the table with the lock taken
+func (m *MemoryIPTables) change(table string, fn func(t *memoryTable) error) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	t, err := m.getTable(table)
+	if err != nil {
+		return err
+	}
+	return fn(t)
+}
+
+// Save returns the table in the format of `iptables-save -t TABLE` (without counters)
+func (m *MemoryIPTables) Save(table string) (string, error) {
+	save, err := m.save(table)
+	return string(save), err
+}
+
+func (m *MemoryIPTables) save(table string) (save []byte, err error) {
+	err = m.change(table, func(t *memoryTable) error {
+		save = t.save()
+		return nil
+	})
+	return
+}
+
+// Restore applies the input the way `iptables-restore [--noflush]` does (the counterpart of Save())
+func (m *MemoryIPTables) Restore(input string, isNoFlush bool) error {
+	return m.restore([]byte(input), isNoFlush)
+}
+
+// restore applies the input the way `iptables-restore` does: each table is changed atomically
+func (m *MemoryIPTables) restore(input []byte, isNoFlush bool) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	var table *memoryTable
+	for lineNum, line := range strings.Split(string(input), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			if table != nil {
+				return fmt.Errorf("iptables-restore: line %v failed: COMMIT expected (table %v)", lineNum+1, table.name)
+			}
+			cur, err := m.getTable(line[1:])
+			if err != nil {
+				return err
+			}
+			if isNoFlush {
+				table = cur.clone()
+			} else {
+				table, _ = newMemoryTable(cur.name)
+			}
+		case table == nil:
+			return fmt.Errorf("iptables-restore: line %v failed (%v): no table", lineNum+1, line)
+		case line == "COMMIT":
+			m.tables[table.name] = table
+			table = nil
+		default:
+			err := table.applyRestoreLine(line)
+			if err != nil {
+				return fmt.Errorf("iptables-restore: line %v failed (%v): %v", lineNum+1, line, err)
+			}
+		}
+	}
+	if table != nil {
+		return fmt.Errorf("iptables-restore: COMMIT expected (table %v)", table.name)
+	}
+	return nil
+}
+
+func (m *MemoryIPTables) Append(table, chain string, rulespec ...string) error {
+	return m.change(table, func(t *memoryTable) error {
+		return t.appendRule(chain, rulespec)
+	})
+}
+func (m *MemoryIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	return m.change(table, func(t *memoryTable) error {
+		exists, err := t.exists(chain, rulespec)
+		if err != nil || exists {
+			return err
+		}
+		return t.appendRule(chain, rulespec)
+	})
+}
+
+// ClearChain flushes the chain or creates it if it doesn't exist (like go-iptables does)
+func (m *MemoryIPTables) ClearChain(table, chain string) error {
+	return m.change(table, func(t *memoryTable) error {
+		if t.chains[chain] == nil {
+			return t.newChain(chain)
+		}
+		t.chains[chain].rules = nil
+		return nil
+	})
+}
+func (m *MemoryIPTables) Delete(table, chain string, rulespec ...string) error {
+	return m.change(table, func(t *memoryTable) error {
+		return t.deleteRule(chain, rulespec)
+	})
+}
+func (m *MemoryIPTables) DeleteChain(table, chain string) error {
+	return m.change(table, func(t *memoryTable) error {
+		return t.deleteChain(chain)
+	})
+}
+func (m *MemoryIPTables) Exists(table, chain string, rulespec ...string) (exists bool, err error) {
+	err = m.change(table, func(t *memoryTable) error {
+		exists, err = t.exists(chain, rulespec)
+		return err
+	})
+	return
+}
+func (m *MemoryIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	return m.change(table, func(t *memoryTable) error {
+		return t.insertRule(chain, pos, rulespec)
+	})
+}
+
+// List returns the rules of the chain in the format of `iptables -S CHAIN`
+func (m *MemoryIPTables) List(table, chainName string) (result []string, err error) {
+	err = m.change(table, func(t *memoryTable) error {
+		chain, err := t.chain(chainName)
+		if err != nil {
+			return err
+		}
+		if chain.policy != "" {
+			result = append(result, "-P "+chainName+" "+chain.policy)
+		} else {
+			result = append(result, "-N "+chainName)
+		}
+		for _, rule := range chain.rules {
+			result = append(result, "-A "+chainName+" "+rule.String())
+		}
+		return nil
+	})
+	return
+}
+
+// ListChains returns built-in chains and then user-defined chains in alphabetical order (like `iptables -S`)
+func (m *MemoryIPTables) ListChains(table string) (result []string, err error) {
+	err = m.change(table, func(t *memoryTable) error {
+		result = t.chainNames()
+		return nil
+	})
+	return
+}
+func (m *MemoryIPTables) NewChain(table, chain string) error {
+	return m.change(table, func(t *memoryTable) error {
+		return t.newChain(chain)
+	})
+}
+func (m *MemoryIPTables) RenameChain(table, oldChain, newChain string) error {
+	return m.change(table, func(t *memoryTable) error {
+		return t.renameChain(oldChain, newChain)
+	})
+}
+func (m *MemoryIPTables) Replace(table, chain string, pos int, rulespec ...string) error {
+	return m.change(table, func(t *memoryTable) error {
+		return t.replaceRule(chain, pos, rulespec)
+	})
+}
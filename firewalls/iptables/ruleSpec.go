@@ -0,0 +1,206 @@
+package iptables
+
+// Rule specifications in the form `iptables -S` prints them. It's required to work with rules
+// without the kernel (see batch): a rule added as "-p tcp --dport 80 -j ACCEPT -m comment --comment X"
+// is listed back as "-p tcp -m tcp --dport 80 -m comment --comment X -j ACCEPT".
+//
+// Only the syntax used by this package is canonicalized, other rules are kept as is.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// genericOptions are options which are printed before matches (in this order)
+var genericOptions = []string{"-s", "-d", "-i", "-o", "-p"}
+
+func isGenericOption(word string) bool {
+	for _, option := range genericOptions {
+		if word == option {
+			return true
+		}
+	}
+	return false
+}
+
+func isOption(word string) bool {
+	return word == "!" || strings.HasPrefix(word, "-")
+}
+
+// canonicalMark converts "VALUE[/MASK]" to the form of `iptables -S` ("0xVALUE[/0xMASK]", a full mask is omitted unless "isXMark")
+func canonicalMark(markString string, isXMark bool) string {
+	words := strings.SplitN(markString, "/", 2)
+	value, err := strconv.ParseUint(words[0], 0, 32)
+	if err != nil {
+		return markString
+	}
+	mask := uint64(0xffffffff)
+	if len(words) > 1 {
+		mask, err = strconv.ParseUint(words[1], 0, 32)
+		if err != nil {
+			return markString
+		}
+	}
+	if mask == 0xffffffff && !isXMark {
+		return fmt.Sprintf("0x%x", value)
+	}
+	return fmt.Sprintf("0x%x/0x%x", value, mask)
+}
+
+// canonicalRule converts a rule specification to the form of `iptables -S` (without "-A CHAIN")
+func canonicalRule(rulespec []string) []string {
+	generic := map[string][]string{}
+	var groups [][]string // matches and then the target, each one starts with "-m NAME" or "-j NAME"
+	var target []string
+	var protocol string
+	current := -1 // the index of the current group; "len(groups)" means the target
+	isNegated := false
+
+	for idx := 0; idx < len(rulespec); idx++ {
+		word := rulespec[idx]
+		switch {
+		case word == "!":
+			isNegated = true
+			continue
+
+		case isGenericOption(word) && idx+1 < len(rulespec):
+			value := rulespec[idx+1]
+			idx++
+			if (word == "-s" || word == "-d") && !strings.Contains(value, "/") {
+				value += "/32"
+			}
+			if word == "-p" {
+				protocol = value
+			}
+			generic[word] = []string{word, value}
+			if isNegated {
+				generic[word] = append([]string{"!"}, generic[word]...)
+			}
+
+		case (word == "-m" || word == "-j" || word == "-g") && idx+1 < len(rulespec):
+			idx++
+			if word == "-j" || word == "-g" {
+				target = []string{word, rulespec[idx]}
+				current = len(groups)
+				break
+			}
+			groups = append(groups, []string{word, rulespec[idx]})
+			current = len(groups) - 1
+
+		default:
+			if current == -1 { // e.g. "--dport" after "-p tcp" loads the match of the protocol implicitly
+				groups = append(groups, []string{"-m", protocol})
+				current = len(groups) - 1
+			}
+			words := []string{word}
+			for idx+1 < len(rulespec) && !isOption(rulespec[idx+1]) {
+				idx++
+				words = append(words, rulespec[idx])
+			}
+			if isNegated {
+				words = append([]string{"!"}, words...)
+			}
+			if current == len(groups) {
+				target = append(target, words...)
+			} else {
+				groups[current] = append(groups[current], words...)
+			}
+		}
+		isNegated = false
+	}
+
+	// values
+
+	for _, group := range append(groups, target) {
+		if len(group) < 2 {
+			continue
+		}
+		for idx := 2; idx+1 < len(group); idx++ {
+			switch {
+			case group[0] == "-m" && group[1] == "mark" && group[idx] == "--mark":
+				group[idx+1] = canonicalMark(group[idx+1], false)
+			case group[0] == "-j" && group[1] == "MARK" && (group[idx] == "--set-mark" || group[idx] == "--set-xmark"):
+				group[idx] = "--set-xmark"
+				group[idx+1] = canonicalMark(group[idx+1], true)
+			}
+		}
+	}
+
+	// the order
+
+	result := []string{}
+	for _, option := range genericOptions {
+		result = append(result, generic[option]...)
+	}
+	for _, group := range groups {
+		result = append(result, group...)
+	}
+	return append(result, target...)
+}
+
+// quoteRuleWord quotes a word the way iptables does it (see xtables_save_string())
+func quoteRuleWord(word string) string {
+	isSafe := word != ""
+	for _, c := range word {
+		if !(c == '_' || c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+			isSafe = false
+			break
+		}
+	}
+	if isSafe {
+		return word
+	}
+	var result strings.Builder
+	result.WriteByte('"')
+	for _, c := range word {
+		if c == '"' || c == '\\' || c == '\'' {
+			result.WriteByte('\\')
+		}
+		result.WriteRune(c)
+	}
+	result.WriteByte('"')
+	return result.String()
+}
+
+// ruleString joins the words of a rule, values of "--comment" and words with spaces or quotes are quoted
+func ruleString(words []string) string {
+	quoted := make([]string, 0, len(words))
+	for idx, word := range words {
+		if (idx > 0 && words[idx-1] == "--comment") || strings.ContainsAny(word, " \"'\\") {
+			word = quoteRuleWord(word)
+		}
+		quoted = append(quoted, word)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// splitRuleString splits an output line of `iptables -S` or `iptables-save` into words (quoted words are unquoted)
+func splitRuleString(line string) (words []string) {
+	var word strings.Builder
+	isQuoted, isWord := false, false
+	for idx := 0; idx < len(line); idx++ {
+		c := line[idx]
+		switch {
+		case c == '\\' && isQuoted && idx+1 < len(line):
+			idx++
+			word.WriteByte(line[idx])
+		case c == '"':
+			isQuoted = !isQuoted
+			isWord = true
+		case c == ' ' && !isQuoted:
+			if isWord {
+				words = append(words, word.String())
+				word.Reset()
+				isWord = false
+			}
+		default:
+			word.WriteByte(c)
+			isWord = true
+		}
+	}
+	if isWord {
+		words = append(words, word.String())
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package iptables
+
+// The "same-security-traffic" settings of FWSM are implemented in the security level chains
+// (see createSecurityLevelRules):
+// * "permit inter-interface": the chain of a security level accepts the traffic to interfaces of the same level;
+// * "permit intra-interface": the rules "-i X -o X" of the chain accept (or deny) the traffic routed back to its interface.
+
+import (
+	"strings"
+)
+
+// intraInterfaceRule returns the rule of a security level chain for the traffic routed back to the interface
+func (fw iptables) intraInterfaceRule(hostIfName string) []string {
+	verdict := denyCommand
+	if fw.permitIntraInterface {
+		verdict = "ACCEPT"
+	}
+	return []string{"-i", hostIfName, "-o", hostIfName, "-j", verdict}
+}
+
+// securityLevelIfNames returns the interfaces (names in the host) of each security level
+func (fw iptables) securityLevelIfNames() (result map[int][]string, err error) {
+	if fw.isIPSetsUsed {
+		return fw.ipsetSecurityLevelIfNames()
+	}
+	rules, err := fw.listMarkRules("mangle", fw.chain("IN_SECURITY_LEVELs"), fw.config.MarkLayout.SecurityLevelIn)
+	if err != nil {
+		return
+	}
+	result = map[int][]string{}
+	for _, rule := range rules {
+		result[rule.securityLevel] = append(result[rule.securityLevel], rule.ifName)
+	}
+	return
+}
+
+// inquirePermitFlags returns the "same-security-traffic" settings found in the security level chains. If
+// the chains don't define them (for example there're no security levels yet) then the current settings are returned.
+func (fw iptables) inquirePermitFlags() (permitInterInterface, permitIntraInterface bool) {
+	permitInterInterface, permitIntraInterface = fw.permitInterInterface, fw.permitIntraInterface
+	isInterFound, isIntraFound := false, false
+	for _, securityLevel := range fw.GetSecurityLevels() {
+		match, err := fw.securityLevelMatch(securityLevel, true)
+		if err != nil {
+			fw.LogError(err, securityLevel)
+			continue
+		}
+		sameLevelRule := ruleString(canonicalRule(append(match, "-j", "ACCEPT")))
+		chainName := fw.securityLevelChainName(securityLevel)
+		ruleStrings, err := fw.iptables.List("filter", chainName)
+		if err != nil {
+			fw.LogError(err, chainName)
+			continue
+		}
+		isSameLevelAccepted := false
+		for _, ruleString := range ruleStrings {
+			if !strings.HasPrefix(ruleString, "-A ") {
+				continue
+			}
+			if strings.TrimPrefix(ruleString, "-A "+chainName+" ") == sameLevelRule {
+				isSameLevelAccepted = true
+				continue
+			}
+			var inIfName, outIfName, target string
+			ruleWords := strings.Split(ruleString, " ")
+			for idx := 0; idx+1 < len(ruleWords); idx++ {
+				value := ruleWords[idx+1]
+				switch ruleWords[idx] {
+				case "-i":
+					inIfName = value
+				case "-o":
+					outIfName = value
+				case "-j":
+					target = value
+				}
+			}
+			if inIfName != "" && inIfName == outIfName && !isIntraFound {
+				permitIntraInterface, isIntraFound = target == "ACCEPT", true
+			}
+		}
+		if !isInterFound {
+			permitInterInterface, isInterFound = isSameLevelAccepted, true
+		}
+	}
+	return
+}
+
+// SetEnablePermitInterInterface rebuilds the security level chains in one batch, so the traffic
+// doesn't see the chains half-built
+func (fw *iptables) SetEnablePermitInterInterface(enable bool) error {
+	if fw.permitInterInterface == enable {
+		return nil
+	}
+	return fw.inBatch(func() error {
+		fw.permitInterInterface = enable
+		return fw.createSecurityLevelRules()
+	})
+}
+
+// SetEnablePermitIntraInterface rebuilds the security level chains in one batch (see SetEnablePermitInterInterface)
+func (fw *iptables) SetEnablePermitIntraInterface(enable bool) error {
+	if fw.permitIntraInterface == enable {
+		return nil
+	}
+	return fw.inBatch(func() error {
+		fw.permitIntraInterface = enable
+		return fw.createSecurityLevelRules()
+	})
+}
+
+func (fw iptables) InquirePermitInterInterface() bool {
+	permitInterInterface, _ := fw.inquirePermitFlags()
+	return permitInterInterface
+}
+func (fw iptables) InquirePermitIntraInterface() bool {
+	_, permitIntraInterface := fw.inquirePermitFlags()
+	return permitIntraInterface
+}
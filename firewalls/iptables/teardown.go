@@ -0,0 +1,150 @@
+package iptables
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/xaionaro-go/networkControl"
+)
+
+// isOwnChain returns true if the chain is created by the firewall
+func (fw iptables) isOwnChain(chainName string) bool {
+	for _, name := range []string{"IN_SECURITY_LEVELs", "OUT_SECURITY_LEVELs", "ACLs", ACL_OUT_DONE_CHAIN, "ACCEPT_DNATs", "SECURITY_LEVELs", "SNATs", "DNATs"} {
+		if chainName == fw.chain(name) {
+			return true
+		}
+	}
+	for _, prefix := range []string{"ACL.IN.", "ACL.OUT.", securityLevelChainPrefix} {
+		if strings.HasPrefix(chainName, fw.chain(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnHookRule returns true if the rule of a built-in chain (in the format of `iptables -S`) is put by
+// the firewall: it has the comment tag or it jumps to a chain of the firewall
+func (fw iptables) isOwnHookRule(ruleString string) bool {
+	words := splitRuleString(ruleString)
+	for idx := 0; idx+1 < len(words); idx++ {
+		switch words[idx] {
+		case "--comment":
+			if words[idx+1] == fw.config.CommentTag {
+				return true
+			}
+		case "-j", "-g":
+			if fw.isOwnChain(words[idx+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Teardown removes the chains of the firewall and its rules from built-in chains (rules of other
+// software are not touched). Each table is changed in one transaction. With KeepForeign the chains
+// are kept if there're ACLs or NATs the library doesn't manage: only the managed ones are removed.
+func (fw *iptables) Teardown(options networkControl.TeardownOptions) (result networkControl.TeardownItems, err error) {
+	if options.KeepForeign {
+		var isForeignFound bool
+		result, isForeignFound, err = networkControl.TeardownManagedFirewallObjects(fw, fw.GetHost().GetCurState(), options.DryRun)
+		if err != nil || isForeignFound {
+			return
+		}
+	}
+
+	err = fw.BeginBatch()
+	if err != nil {
+		fw.LogError(err)
+		return
+	}
+	defer func() {
+		if options.DryRun || err != nil {
+			fw.RollbackBatch()
+			return
+		}
+		err = fw.CommitBatch()
+		if err != nil {
+			return
+		}
+		fw.markToSecurityLevel = map[int]*int{}
+		fw.securityLevelToMark = map[int]int{}
+	}()
+
+	for _, table := range batchTablesOrder {
+		var chainNames []string
+		chainNames, err = fw.iptables.ListChains(table)
+		if err != nil {
+			fw.LogError(err, table)
+			return
+		}
+
+		// rules of built-in chains (at first, so own chains are not referenced anymore)
+
+		ownChainNames := []string{}
+		for _, chainName := range chainNames {
+			if fw.isOwnChain(chainName) {
+				ownChainNames = append(ownChainNames, chainName)
+				continue
+			}
+			var ruleStrings []string
+			ruleStrings, err = fw.iptables.List(table, chainName)
+			if err != nil {
+				fw.LogError(err, table, chainName)
+				return
+			}
+			pos := 0
+			for _, ruleString := range ruleStrings {
+				if !strings.HasPrefix(ruleString, "-A ") {
+					continue
+				}
+				pos++
+				if !fw.isOwnHookRule(ruleString) {
+					continue
+				}
+				result = append(result, networkControl.TeardownItem{Kind: "iptables rule", Name: "-t " + table + " " + ruleString})
+				err = fw.iptables.Delete(table, chainName, strconv.Itoa(pos))
+				if err != nil {
+					fw.LogError(err, table, ruleString)
+					return
+				}
+				pos--
+			}
+		}
+
+		// own chains (flushing all of them at first, because they reference each other)
+
+		for _, chainName := range ownChainNames {
+			err = fw.iptables.ClearChain(table, chainName)
+			if err != nil {
+				fw.LogError(err, table, chainName)
+				return
+			}
+		}
+		for _, chainName := range ownChainNames {
+			result = append(result, networkControl.TeardownItem{Kind: "iptables chain", Name: table + " " + chainName})
+			err = fw.iptables.DeleteChain(table, chainName)
+			if err != nil {
+				fw.LogError(err, table, chainName)
+				return
+			}
+		}
+	}
+
+	// ipsets (left by the ipsets mode even if marks are used now), they're not referenced by the rules anymore
+
+	ipsets, ipsetErr := fw.getIPSets()
+	if ipsetErr != nil { // ipset is not installed
+		fw.Debugf("iptables.Teardown(): %v", ipsetErr)
+		return
+	}
+	for _, name := range ipsets.Names() {
+		if !fw.isOwnIPSet(name) {
+			continue
+		}
+		result = append(result, networkControl.TeardownItem{Kind: "ipset", Name: name})
+		ipsets.Destroy(name)
+	}
+
+	return
+}
@@ -0,0 +1,423 @@
+package nftables
+
+// A firewall on top of nf_tables. Everything is kept in one table (see TABLE_NAME) and the table
+// is replaced as a whole in one netlink transaction, so the traffic never sees an intermediate state.
+//
+// The table looks like:
+//
+//	chain forward (hook forward): ct state established,related accept; jump acls; iifname vmap @security_levels; drop
+//	chain acls: oifname @acl.out.NAME jump acl.out.NAME; ...; ct status dnat accept; iifname @acl.in.NAME jump acl.in.NAME; ...
+//	chain acl.in.NAME, acl.out.NAME: the rules of the ACL
+//	chain security_level.N: oifname @security_level.M accept (for each M < N, and M == N if permitted)
+//	chain prerouting (hook prerouting, nat): DNATs
+//	chain postrouting (hook postrouting, nat): SNATs
+
+import (
+	"errors"
+	"sort"
+
+	nft "github.com/google/nftables"
+	"github.com/xaionaro-go/networkControl"
+)
+
+const (
+	TABLE_NAME = "networkControl"
+)
+
+var (
+	errNotImplemented  = errors.New("not implemented (yet?)")
+	errUnexpectedRule  = errors.New("unexpected rule (was the table modified by somebody else?)")
+	errNoBatch         = errors.New("there's no batch in progress")
+	errBatchInProgress = errors.New("a batch is in progress")
+	denyToOtherGWs     = true
+)
+
+// ruleset is the model of the table
+type ruleset struct {
+	securityLevels       map[string]int // the name of interface in the backend -> security level
+	acls                 networkControl.ACLs
+	snats                networkControl.SNATs
+	dnats                networkControl.DNATs
+	permitInterInterface bool
+	permitIntraInterface bool
+}
+
+func newRuleset() ruleset {
+	return ruleset{
+		securityLevels:       map[string]int{},
+		permitInterInterface: true,
+		permitIntraInterface: true,
+	}
+}
+
+func (rs ruleset) Copy() ruleset {
+	result := rs
+	result.securityLevels = map[string]int{}
+	for ifName, securityLevel := range rs.securityLevels {
+		result.securityLevels[ifName] = securityLevel
+	}
+	result.acls = append(networkControl.ACLs{}, rs.acls...)
+	result.snats = append(networkControl.SNATs{}, rs.snats...)
+	result.dnats = append(networkControl.DNATs{}, rs.dnats...)
+	return result
+}
+
+// getSecurityLevels returns all used security levels in ascending order
+func (rs ruleset) getSecurityLevels() (result []int) {
+	isSet := map[int]bool{}
+	for _, securityLevel := range rs.securityLevels {
+		if isSet[securityLevel] {
+			continue
+		}
+		isSet[securityLevel] = true
+		result = append(result, securityLevel)
+	}
+	sort.Ints(result)
+	return
+}
+
+type nftables struct {
+	networkControl.FirewallBase
+
+	// batch is the pending ruleset between BeginBatch() and CommitBatch()
+	batch *ruleset
+
+	// lastRuleset is the last ruleset read from or written to the kernel (flags cannot always be
+	// inquired from the kernel, so they're taken from here in this case)
+	lastRuleset ruleset
+
+	// netNSFd is the network namespace of the table (-1 means the namespace of the process)
+	netNSFd int
+
+	// connOptions are passed to every connection (the tests use it to replace the kernel)
+	connOptions []nft.ConnOption
+}
+
+func NewFirewall(host networkControl.HostI) (networkControl.FirewallI, error) {
+	return NewFirewallInNetNS(host, -1)
+}
+
+// NewFirewallInNetNS returns a firewall of the network namespace referenced by the file descriptor.
+// An error is returned if the table of the firewall cannot be read (for example if it has foreign rules).
+func NewFirewallInNetNS(host networkControl.HostI, netNSFd int) (networkControl.FirewallI, error) {
+	fw, err := newFirewall(host, netNSFd)
+	if err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+func newFirewall(host networkControl.HostI, netNSFd int, connOptions ...nft.ConnOption) (*nftables, error) {
+	fw := &nftables{
+		lastRuleset: newRuleset(),
+		netNSFd:     netNSFd,
+		connOptions: connOptions,
+	}
+	fw.SetHost(host)
+
+	_, err := fw.inquireRuleset()
+	if err != nil {
+		return nil, err
+	}
+
+	return fw, nil
+}
+
+// getRuleset returns the pending ruleset if there's a batch in progress or the ruleset of the kernel otherwise
+func (fw *nftables) getRuleset() (ruleset, error) {
+	if fw.batch != nil {
+		return *fw.batch, nil
+	}
+	return fw.inquireRuleset()
+}
+
+// inquiredRuleset is getRuleset() for the Inquire* methods: they cannot return an error, so the last
+// known ruleset is returned if the table cannot be read (the error itself is returned by Rescan())
+func (fw *nftables) inquiredRuleset() ruleset {
+	rs, err := fw.getRuleset()
+	if err != nil {
+		fw.LogError(err)
+		return fw.lastRuleset
+	}
+	return rs
+}
+
+// Rescan reads the table from the kernel and returns an error if it cannot be read or parsed
+// (nothing is read while a batch is in progress: the pending ruleset is inquired then)
+func (fw *nftables) Rescan() error {
+	if fw.batch != nil {
+		return nil
+	}
+	_, err := fw.inquireRuleset()
+	return err
+}
+
+// modify changes the ruleset by "fn" and writes the result to the kernel (or just remembers it if there's a batch in progress)
+func (fw *nftables) modify(fn func(rs *ruleset) error) error {
+	rs, err := fw.getRuleset()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	rs = rs.Copy()
+	err = fn(&rs)
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	if fw.batch != nil {
+		fw.batch = &rs
+		return nil
+	}
+	return fw.commit(rs)
+}
+
+// BeginBatch starts collecting changes, they're written to the kernel in one transaction by CommitBatch()
+func (fw *nftables) BeginBatch() error {
+	rs, err := fw.inquireRuleset()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	fw.batch = &rs
+	return nil
+}
+
+func (fw *nftables) CommitBatch() error {
+	if fw.batch == nil {
+		return errNoBatch
+	}
+	rs := *fw.batch
+	fw.batch = nil
+	return fw.commit(rs)
+}
+
+// RollbackBatch drops the changes collected since BeginBatch(), the kernel is not touched
+func (fw *nftables) RollbackBatch() error {
+	if fw.batch == nil {
+		return errNoBatch
+	}
+	fw.batch = nil
+	return nil
+}
+
+func (fw *nftables) IfNameToNFTIfName(ifName string) string {
+	return fw.GetHost().IfNameToHostIfName(ifName)
+}
+func (fw *nftables) NFTIfNameToIfName(ifName string) string {
+	return fw.GetHost().HostIfNameToIfName(ifName)
+}
+
+func (fw *nftables) SetEnablePermitInterInterface(enable bool) error {
+	return fw.modify(func(rs *ruleset) error {
+		rs.permitInterInterface = enable
+		return nil
+	})
+}
+func (fw *nftables) SetEnablePermitIntraInterface(enable bool) error {
+	return fw.modify(func(rs *ruleset) error {
+		rs.permitIntraInterface = enable
+		return nil
+	})
+}
+
+func (fw *nftables) GetSecurityLevels() []int {
+	return fw.inquiredRuleset().getSecurityLevels()
+}
+
+func (fw *nftables) InquireSecurityLevel(ifName string) int {
+	securityLevel, ok := fw.inquiredRuleset().securityLevels[fw.IfNameToNFTIfName(ifName)]
+	if !ok {
+		fw.Infof("Cannot find security level of iface %v", ifName)
+		return -1
+	}
+	return securityLevel
+}
+
+func (fw *nftables) SetSecurityLevel(ifName string, securityLevel int) error {
+	return fw.modify(func(rs *ruleset) error {
+		rs.securityLevels[fw.IfNameToNFTIfName(ifName)] = securityLevel
+		return nil
+	})
+}
+
+func (fw *nftables) UnsetSecurityLevel(ifName string) error {
+	return fw.modify(func(rs *ruleset) error {
+		delete(rs.securityLevels, fw.IfNameToNFTIfName(ifName))
+		return nil
+	})
+}
+
+func (fw *nftables) InquireACLs() networkControl.ACLs {
+	return fw.inquiredRuleset().acls
+}
+func (fw *nftables) InquireSNATs() networkControl.SNATs {
+	return fw.inquiredRuleset().snats
+}
+func (fw *nftables) InquireDNATs() networkControl.DNATs {
+	return fw.inquiredRuleset().dnats
+}
+func (fw *nftables) InquirePermitInterInterface() bool {
+	return fw.inquiredRuleset().permitInterInterface
+}
+func (fw *nftables) InquirePermitIntraInterface() bool {
+	return fw.inquiredRuleset().permitIntraInterface
+}
+
+func (fw *nftables) AddACL(acl networkControl.ACL) error {
+	return fw.modify(func(rs *ruleset) error {
+		for idx, curACL := range rs.acls {
+			if curACL.Name == acl.Name {
+				rs.acls[idx] = &acl
+				return nil
+			}
+		}
+		rs.acls = append(rs.acls, &acl)
+		return nil
+	})
+}
+func (fw *nftables) UpdateACL(acl networkControl.ACL) error {
+	return fw.AddACL(acl)
+}
+func (fw *nftables) RemoveACL(acl networkControl.ACL) error {
+	return fw.modify(func(rs *ruleset) error {
+		acls := networkControl.ACLs{}
+		for _, curACL := range rs.acls {
+			if curACL.Name == acl.Name {
+				continue
+			}
+			acls = append(acls, curACL)
+		}
+		rs.acls = acls
+		return nil
+	})
+}
+
+func (fw *nftables) AddSNAT(snat networkControl.SNAT) error {
+	return fw.modify(func(rs *ruleset) error {
+		for idx, curSNAT := range rs.snats {
+			if curSNAT.KeyStringValue() == snat.KeyStringValue() {
+				rs.snats[idx] = &snat
+				return nil
+			}
+		}
+		rs.snats = append(rs.snats, &snat)
+		return nil
+	})
+}
+func (fw *nftables) UpdateSNAT(snat networkControl.SNAT) error {
+	return fw.AddSNAT(snat)
+}
+func (fw *nftables) RemoveSNAT(snat networkControl.SNAT) error {
+	return fw.modify(func(rs *ruleset) error {
+		snats := networkControl.SNATs{}
+		for _, curSNAT := range rs.snats {
+			if curSNAT.KeyStringValue() == snat.KeyStringValue() {
+				continue
+			}
+			snats = append(snats, curSNAT)
+		}
+		rs.snats = snats
+		return nil
+	})
+}
+
+func (fw *nftables) AddDNAT(dnat networkControl.DNAT) error {
+	return fw.modify(func(rs *ruleset) error {
+		for idx, curDNAT := range rs.dnats {
+			if curDNAT.KeyStringValue() == dnat.KeyStringValue() {
+				rs.dnats[idx] = &dnat
+				return nil
+			}
+		}
+		rs.dnats = append(rs.dnats, &dnat)
+		return nil
+	})
+}
+func (fw *nftables) UpdateDNAT(dnat networkControl.DNAT) error {
+	return fw.AddDNAT(dnat)
+}
+func (fw *nftables) RemoveDNAT(dnat networkControl.DNAT) error {
+	return fw.modify(func(rs *ruleset) error {
+		dnats := networkControl.DNATs{}
+		for _, curDNAT := range rs.dnats {
+			if curDNAT.KeyStringValue() == dnat.KeyStringValue() {
+				continue
+			}
+			dnats = append(dnats, curDNAT)
+		}
+		rs.dnats = dnats
+		return nil
+	})
+}
+
+func (fw *nftables) newConn() (*nft.Conn, error) {
+	options := append([]nft.ConnOption{}, fw.connOptions...)
+	if fw.netNSFd >= 0 {
+		options = append(options, nft.WithNetNSFd(fw.netNSFd))
+	}
+	return nft.New(options...)
+}
+
+// commit replaces the table in the kernel by the ruleset in one transaction
+func (fw *nftables) commit(rs ruleset) error {
+	conn, err := fw.newConn()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	err = fw.renderRuleset(conn, rs)
+	if err != nil { // the messages are not sent, the connection is just dropped
+		fw.LogError(err)
+		return err
+	}
+	err = conn.Flush()
+	if err != nil {
+		fw.LogError(err)
+		return err
+	}
+	fw.lastRuleset = rs
+	return nil
+}
+
+// Teardown deletes the table of the firewall. With KeepForeign the table is kept if there're
+// ACLs or NATs the library doesn't manage: only the managed ones are removed.
+func (fw *nftables) Teardown(options networkControl.TeardownOptions) (networkControl.TeardownItems, error) {
+	if fw.batch != nil {
+		return nil, errBatchInProgress
+	}
+	if options.KeepForeign {
+		result, isForeignFound, err := networkControl.TeardownManagedFirewallObjects(fw, fw.GetHost().GetCurState(), options.DryRun)
+		if err != nil || isForeignFound {
+			return result, err
+		}
+	}
+	conn, err := fw.newConn()
+	if err != nil {
+		fw.LogError(err)
+		return nil, err
+	}
+	tables, err := conn.ListTablesOfFamily(nft.TableFamilyIPv4)
+	if err != nil {
+		fw.LogError(err)
+		return nil, err
+	}
+	var result networkControl.TeardownItems
+	for _, table := range tables {
+		if table.Name != TABLE_NAME {
+			continue
+		}
+		result = append(result, networkControl.TeardownItem{Kind: "nftables table", Name: "ip " + TABLE_NAME})
+		if options.DryRun {
+			return result, nil
+		}
+		conn.DelTable(table)
+		err = conn.Flush()
+		if err != nil {
+			fw.LogError(err)
+			return nil, err
+		}
+	}
+	fw.lastRuleset = newRuleset()
+	return result, nil
+}
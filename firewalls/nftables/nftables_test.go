@@ -0,0 +1,351 @@
+package nftables
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	nft "github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/xaionaro-go/networkControl"
+	"github.com/xaionaro-go/networkControl/hosts/memory"
+	"golang.org/x/sys/unix"
+)
+
+// fakeKernel is nf_tables without a kernel: the NEW* messages are stored and they're the replies
+// to GET* requests (DELTABLE removes the messages of the table). Like the kernel, it names
+// the anonymous sets ("__set%d") by their IDs.
+type fakeKernel struct {
+	messages []netlink.Message
+}
+
+const attrTypeMask = ^uint16(netlink.Nested | netlink.NetByteOrder)
+
+// rewriteAttributes calls fn for the attributes of the message data and returns the data with the changed attributes
+func rewriteAttributes(data []byte, fn func(attrs []netlink.Attribute) error) ([]byte, error) {
+	attrs, err := netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return nil, err
+	}
+	err = fn(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return netlink.MarshalAttributes(attrs)
+}
+
+func messageAttribute(msg netlink.Message, attrType uint16) string {
+	decoder, err := netlink.NewAttributeDecoder(msg.Data[4:])
+	if err != nil {
+		return ""
+	}
+	for decoder.Next() {
+		if decoder.Type() == attrType {
+			return strings.TrimRight(string(decoder.Bytes()), "\x00")
+		}
+	}
+	return ""
+}
+
+// rewriteNested returns a function which rewrites the nested attributes of the type by fn
+func rewriteNested(attrType uint16, fn func(attrs []netlink.Attribute) error) func(attrs []netlink.Attribute) error {
+	return func(attrs []netlink.Attribute) error {
+		for idx, attr := range attrs {
+			if attr.Type&attrTypeMask != attrType {
+				continue
+			}
+			data, err := rewriteAttributes(attr.Data, fn)
+			if err != nil {
+				return err
+			}
+			attrs[idx].Data = data
+		}
+		return nil
+	}
+}
+
+// nameSetByID returns a function which replaces "%d" in the name of an anonymous set by its ID
+func nameSetByID(nameAttrType, idAttrType uint16) func(attrs []netlink.Attribute) error {
+	return func(attrs []netlink.Attribute) error {
+		for idx, attr := range attrs {
+			name := strings.TrimRight(string(attr.Data), "\x00")
+			if attr.Type&attrTypeMask != nameAttrType || !strings.Contains(name, "%d") {
+				continue
+			}
+			for _, idAttr := range attrs {
+				if idAttr.Type&attrTypeMask == idAttrType {
+					attrs[idx].Data = []byte(fmt.Sprintf(name, binary.BigEndian.Uint32(idAttr.Data)) + "\x00")
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// nameAnonymousSets converts a request to the message the kernel would reply: the anonymous sets are
+// named in NEWSET, NEWSETELEM and in the lookups of NEWRULE
+func nameAnonymousSets(msg netlink.Message) (netlink.Message, error) {
+	var rewrite func(attrs []netlink.Attribute) error
+	switch msg.Header.Type & 0xff {
+	case unix.NFT_MSG_NEWSET:
+		rewrite = nameSetByID(unix.NFTA_SET_NAME, unix.NFTA_SET_ID)
+	case unix.NFT_MSG_NEWSETELEM:
+		// the elements are numbered in the request, but they're NFTA_LIST_ELEM in the replies of the kernel
+		listElements := rewriteNested(unix.NFTA_SET_ELEM_LIST_ELEMENTS, func(attrs []netlink.Attribute) error {
+			for idx := range attrs {
+				attrs[idx].Type = unix.NFTA_LIST_ELEM | netlink.Nested
+			}
+			return nil
+		})
+		nameSet := nameSetByID(unix.NFTA_SET_ELEM_LIST_SET, unix.NFTA_SET_ELEM_LIST_SET_ID)
+		rewrite = func(attrs []netlink.Attribute) error {
+			err := listElements(attrs)
+			if err != nil {
+				return err
+			}
+			return nameSet(attrs)
+		}
+	case unix.NFT_MSG_NEWRULE:
+		lookupData := rewriteNested(unix.NFTA_EXPR_DATA, nameSetByID(unix.NFTA_LOOKUP_SET, unix.NFTA_LOOKUP_SET_ID))
+		lookup := func(attrs []netlink.Attribute) error {
+			for _, attr := range attrs {
+				if attr.Type&attrTypeMask == unix.NFTA_EXPR_NAME && strings.TrimRight(string(attr.Data), "\x00") == "lookup" {
+					return lookupData(attrs)
+				}
+			}
+			return nil
+		}
+		rewrite = rewriteNested(unix.NFTA_RULE_EXPRESSIONS, rewriteNested(unix.NFTA_LIST_ELEM, lookup))
+	default:
+		return msg, nil
+	}
+	data, err := rewriteAttributes(msg.Data[4:], rewrite)
+	if err != nil {
+		return msg, err
+	}
+	msg.Data = append(append([]byte{}, msg.Data[:4]...), data...)
+	return msg, nil
+}
+
+func (kernel *fakeKernel) dial(req []netlink.Message) ([]netlink.Message, error) {
+	var replies []netlink.Message
+	for _, msg := range req {
+		if msg.Header.Type>>8 != unix.NFNL_SUBSYS_NFTABLES { // the beginning and the end of a batch
+			continue
+		}
+		// the table is the first attribute in all the messages; the set of an element or the chain of a rule is the second one
+		table := messageAttribute(msg, 1)
+		msgType := msg.Header.Type & 0xff
+		switch msgType {
+		case unix.NFT_MSG_NEWTABLE, unix.NFT_MSG_NEWCHAIN, unix.NFT_MSG_NEWSET, unix.NFT_MSG_NEWSETELEM, unix.NFT_MSG_NEWRULE:
+			msg, err := nameAnonymousSets(msg)
+			if err != nil {
+				return nil, err
+			}
+			kernel.messages = append(kernel.messages, msg)
+		case unix.NFT_MSG_DELTABLE:
+			var messages []netlink.Message
+			for _, stored := range kernel.messages {
+				if messageAttribute(stored, 1) != table {
+					messages = append(messages, stored)
+				}
+			}
+			kernel.messages = messages
+		case unix.NFT_MSG_GETTABLE, unix.NFT_MSG_GETCHAIN, unix.NFT_MSG_GETSET, unix.NFT_MSG_GETSETELEM, unix.NFT_MSG_GETRULE:
+			replyType := map[netlink.HeaderType]netlink.HeaderType{
+				unix.NFT_MSG_GETTABLE:   unix.NFT_MSG_NEWTABLE,
+				unix.NFT_MSG_GETCHAIN:   unix.NFT_MSG_NEWCHAIN,
+				unix.NFT_MSG_GETSET:     unix.NFT_MSG_NEWSET,
+				unix.NFT_MSG_GETSETELEM: unix.NFT_MSG_NEWSETELEM,
+				unix.NFT_MSG_GETRULE:    unix.NFT_MSG_NEWRULE,
+			}[msgType]
+			for _, stored := range kernel.messages {
+				if stored.Header.Type&0xff != replyType {
+					continue
+				}
+				if table != "" && msgType != unix.NFT_MSG_GETTABLE && messageAttribute(stored, 1) != table {
+					continue
+				}
+				if name := messageAttribute(msg, 2); name != "" && (msgType == unix.NFT_MSG_GETSETELEM || msgType == unix.NFT_MSG_GETRULE) && messageAttribute(stored, 2) != name {
+					continue
+				}
+				reply := stored
+				reply.Header.Flags = netlink.Multi
+				reply.Header.Sequence = msg.Header.Sequence
+				reply.Header.PID = msg.Header.PID
+				replies = append(replies, reply)
+			}
+			replies = append(replies, netlink.Message{Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: msg.Header.Sequence, PID: msg.Header.PID}})
+			continue
+		default:
+			return nil, fmt.Errorf("the fake kernel cannot handle message type %v", msgType)
+		}
+		replies = append(replies, netlink.Message{
+			Header: netlink.Header{Type: netlink.Error, Sequence: msg.Header.Sequence, PID: msg.Header.PID},
+			Data:   make([]byte, 4), // errno 0: the acknowledgement
+		})
+	}
+	return replies, nil
+}
+
+func newTestFirewall(t *testing.T) *nftables {
+	kernel := &fakeKernel{}
+	fw, err := newFirewall(memoryHost.NewHost(), -1, nft.WithTestDial(kernel.dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fw
+}
+
+func ipnet(t *testing.T, cidr string) networkControl.IPNet {
+	ipnet, err := networkControl.IPNetFromCIDRString(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipnet
+}
+
+// sprintObjects prints the objects of a slice of pointers (ACLs, SNATs, DNATs)
+func sprintObjects(objects interface{}) string {
+	var result []string
+	value := reflect.ValueOf(objects)
+	for idx := 0; idx < value.Len(); idx++ {
+		result = append(result, fmt.Sprintf("%+v", value.Index(idx).Elem().Interface()))
+	}
+	return strings.Join(result, "\n")
+}
+
+func TestRenderParseRoundTrip(t *testing.T) {
+	tcp := networkControl.PROTO_TCP
+	port80 := uint16(80)
+	port8080 := uint16(8080)
+	allPorts := networkControl.PortRanges{{Start: 0, End: 65535}}
+
+	rs := newRuleset()
+	rs.securityLevels = map[string]int{"inside": 100, "dmz": 50, "guests": 50, "outside": 0}
+	rs.permitInterInterface = false
+	rs.permitIntraInterface = true
+	rs.acls = networkControl.ACLs{ // in the order of the priorities, as they're parsed
+		{
+			Name:      "outside_in",
+			VLANNames: []string{"outside"},
+			Rules: networkControl.ACLRules{
+				{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_TCP, FromNet: ipnet(t, "192.0.2.0/24"), FromPortRanges: allPorts, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: networkControl.PortRanges{{Start: 25, End: 25}}},
+			},
+		},
+		{
+			Name:         "dmz_in",
+			VLANNames:    []string{"dmz"},
+			OutVLANNames: []string{"guests"},
+			Priority:     10,
+			Rules: networkControl.ACLRules{
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_TCP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: allPorts, ToNet: ipnet(t, "10.0.1.10/32"), ToPortRanges: networkControl.PortRanges{{Start: 80, End: 80}, {Start: 8000, End: 8080}}},
+				{Action: networkControl.ACL_ALLOW, Protocol: networkControl.PROTO_UDP, FromNet: ipnet(t, "10.0.2.0/24"), FromPortRanges: networkControl.PortRanges{{Start: 1024, End: 65535}}, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: networkControl.PortRanges{{Start: 53, End: 53}}},
+				{Action: networkControl.ACL_DENY, Protocol: networkControl.PROTO_IP, FromNet: ipnet(t, "0.0.0.0/0"), FromPortRanges: allPorts, ToNet: ipnet(t, "0.0.0.0/0"), ToPortRanges: allPorts},
+			},
+		},
+	}
+	rs.snats = networkControl.SNATs{
+		{
+			Sources:      networkControl.SNATSources{{IPNet: ipnet(t, "10.0.1.0/24"), IfName: "inside"}, {IPNet: ipnet(t, "10.0.2.0/24")}},
+			NATTo:        net.ParseIP("198.51.100.1").To4(),
+			FWSMGlobalId: 1,
+		},
+	}
+	rs.dnats = networkControl.DNATs{
+		{
+			Destinations: networkControl.IPPorts{{Protocol: &tcp, IP: net.ParseIP("198.51.100.2").To4(), Port: &port80}},
+			NATTo:        networkControl.IPPort{Protocol: &tcp, IP: net.ParseIP("10.0.1.10").To4(), Port: &port8080},
+			IfName:       "outside",
+		},
+		{
+			Destinations: networkControl.IPPorts{{IP: net.ParseIP("198.51.100.3").To4()}},
+			NATTo:        networkControl.IPPort{IP: net.ParseIP("10.0.1.11").To4()},
+		},
+	}
+
+	for _, flags := range []struct{ permitInterInterface, permitIntraInterface bool }{{false, true}, {true, false}} {
+		rs.permitInterInterface = flags.permitInterInterface
+		rs.permitIntraInterface = flags.permitIntraInterface
+
+		fw := newTestFirewall(t)
+		err := fw.commit(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.lastRuleset = newRuleset() // the flags should be recognized by the rules
+
+		parsed, err := fw.inquireRuleset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed.securityLevels, rs.securityLevels) {
+			t.Errorf("security levels: %v != %v", parsed.securityLevels, rs.securityLevels)
+		}
+		if parsed.permitInterInterface != rs.permitInterInterface || parsed.permitIntraInterface != rs.permitIntraInterface {
+			t.Errorf("flags: %v %v != %v %v", parsed.permitInterInterface, parsed.permitIntraInterface, rs.permitInterInterface, rs.permitIntraInterface)
+		}
+		for _, check := range []struct {
+			name             string
+			parsed, expected interface{}
+		}{
+			{"ACLs", parsed.acls, rs.acls},
+			{"SNATs", parsed.snats, rs.snats},
+			{"DNATs", parsed.dnats, rs.dnats},
+		} {
+			if got, expected := sprintObjects(check.parsed), sprintObjects(check.expected); got != expected {
+				t.Errorf("%v:\n%v\nexpected:\n%v", check.name, got, expected)
+			}
+		}
+	}
+}
+
+func TestForeignRule(t *testing.T) {
+	fw := newTestFirewall(t)
+	err := fw.AddSNAT(networkControl.SNAT{
+		Sources: networkControl.SNATSources{{IPNet: ipnet(t, "10.0.1.0/24")}},
+		NATTo:   net.ParseIP("198.51.100.1").To4(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nft add rule ip networkControl postrouting counter log
+
+	conn, err := fw.newConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.AddRule(&nft.Rule{
+		Table: &nft.Table{Name: TABLE_NAME, Family: nft.TableFamilyIPv4},
+		Chain: &nft.Chain{Name: "postrouting"},
+		Exprs: []expr.Any{&expr.Counter{}, &expr.Log{}},
+	})
+	err = conn.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fw.Rescan()
+	if err == nil || !strings.Contains(err.Error(), errUnexpectedRule.Error()) {
+		t.Errorf("an error of the unexpected rule is expected, got: %v", err)
+	}
+	if snats := fw.InquireSNATs(); len(snats) != 1 {
+		t.Errorf("the last known SNATs are expected: %v", snats)
+	}
+	if err := fw.AddSNAT(networkControl.SNAT{NATTo: net.ParseIP("198.51.100.2").To4()}); err == nil {
+		t.Errorf("the table with a foreign rule is replaced")
+	}
+
+	_, err = newFirewall(memoryHost.NewHost(), -1, fw.connOptions...)
+	if err == nil {
+		t.Errorf("the constructor returned no error")
+	}
+}
@@ -0,0 +1,525 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	nft "github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/xaionaro-go/networkControl"
+)
+
+// loadedValue is what was loaded to the register by the last expression of a rule
+type loadedValue int
+
+const (
+	loadedNothing = loadedValue(iota)
+	loadedProtocol
+	loadedSAddr
+	loadedDAddr
+	loadedSPort
+	loadedDPort
+	loadedIIfName
+	loadedOIfName
+	loadedCtState
+	loadedCtStatus
+	loadedFib
+)
+
+// parsedRule is a rule of the table in terms of the model. Only the expressions generated by renderer are supported.
+type parsedRule struct {
+	Protocol       *networkControl.Protocol
+	FromNet        *networkControl.IPNet
+	ToNet          *networkControl.IPNet
+	FromPortRanges networkControl.PortRanges
+	ToPortRanges   networkControl.PortRanges
+	IIfName        string
+	OIfName        string
+	IIfNameSet     string
+	OIfNameSet     string
+	VerdictMap     string
+	CtState        uint32
+	CtStatus       uint32
+	Verdict        *expr.Verdict
+	NAT            *expr.NAT
+	NATToIP        net.IP
+	NATToPort      *uint16
+	Metadata       ruleMetadata
+}
+
+func ifNameFromBytes(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// ruleParser converts the table from the kernel to a ruleset
+type ruleParser struct {
+	fw    *nftables
+	conn  *nft.Conn
+	table *nft.Table
+	sets  map[string]*nft.Set
+}
+
+func (p *ruleParser) getSetElements(setName string) ([]nft.SetElement, error) {
+	set := p.sets[setName]
+	if set == nil {
+		return nil, fmt.Errorf("%v: there's no set %v", errUnexpectedRule, setName)
+	}
+	return p.conn.GetSetElements(set)
+}
+
+func (p *ruleParser) getIfNameSet(setName string) (result []string, err error) {
+	elements, err := p.getSetElements(setName)
+	if err != nil {
+		return
+	}
+	for _, element := range elements {
+		result = append(result, ifNameFromBytes(element.Key))
+	}
+	sort.Strings(result)
+	return
+}
+
+// getPortRangesSet converts an interval set back to port ranges (see renderer.portRangesExprs())
+func (p *ruleParser) getPortRangesSet(setName string) (result networkControl.PortRanges, err error) {
+	elements, err := p.getSetElements(setName)
+	if err != nil {
+		return
+	}
+	sort.Slice(elements, func(i, j int) bool {
+		a, b := binaryutil.BigEndian.Uint16(elements[i].Key), binaryutil.BigEndian.Uint16(elements[j].Key)
+		if a != b {
+			return a < b
+		}
+		return elements[i].IntervalEnd && !elements[j].IntervalEnd
+	})
+	for _, element := range elements {
+		port := binaryutil.BigEndian.Uint16(element.Key)
+		if element.IntervalEnd {
+			if len(result) == 0 { // the "0" interval end which could be added by the kernel/tools
+				continue
+			}
+			result[len(result)-1].End = port - 1
+			continue
+		}
+		result = append(result, networkControl.PortRange{Start: port, End: 65535})
+	}
+	return
+}
+
+func ipNetFromBytes(ip, mask []byte) *networkControl.IPNet {
+	if mask == nil {
+		mask = []byte{255, 255, 255, 255}
+	}
+	return &networkControl.IPNet{IP: net.IP(append([]byte{}, ip...)), Mask: net.IPMask(append([]byte{}, mask...))}
+}
+
+func (p *ruleParser) parseRule(rule *nft.Rule) (result parsedRule, err error) {
+	loaded := loadedNothing
+	var mask []byte
+	immediates := map[uint32][]byte{}
+	for _, e := range rule.Exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			switch e.Key {
+			case expr.MetaKeyL4PROTO:
+				loaded = loadedProtocol
+			case expr.MetaKeyIIFNAME:
+				loaded = loadedIIfName
+			case expr.MetaKeyOIFNAME:
+				loaded = loadedOIfName
+			default:
+				return result, fmt.Errorf("%v: meta key %v", errUnexpectedRule, e.Key)
+			}
+		case *expr.Payload:
+			switch {
+			case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 12 && e.Len == 4:
+				loaded = loadedSAddr
+			case e.Base == expr.PayloadBaseNetworkHeader && e.Offset == 16 && e.Len == 4:
+				loaded = loadedDAddr
+			case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 0 && e.Len == 2:
+				loaded = loadedSPort
+			case e.Base == expr.PayloadBaseTransportHeader && e.Offset == 2 && e.Len == 2:
+				loaded = loadedDPort
+			default:
+				return result, fmt.Errorf("%v: payload %v/%v/%v", errUnexpectedRule, e.Base, e.Offset, e.Len)
+			}
+			mask = nil
+		case *expr.Ct:
+			switch e.Key {
+			case expr.CtKeySTATE:
+				loaded = loadedCtState
+			case expr.CtKeySTATUS:
+				loaded = loadedCtStatus
+			default:
+				return result, fmt.Errorf("%v: ct key %v", errUnexpectedRule, e.Key)
+			}
+		case *expr.Fib:
+			loaded = loadedFib
+		case *expr.Bitwise:
+			mask = e.Mask
+		case *expr.Cmp:
+			switch loaded {
+			case loadedProtocol:
+				protocol := networkControl.Protocol(e.Data[0])
+				result.Protocol = &protocol
+			case loadedSAddr:
+				result.FromNet = ipNetFromBytes(e.Data, mask)
+			case loadedDAddr:
+				result.ToNet = ipNetFromBytes(e.Data, mask)
+			case loadedSPort:
+				port := binaryutil.BigEndian.Uint16(e.Data)
+				result.FromPortRanges = networkControl.PortRanges{{Start: port, End: port}}
+			case loadedDPort:
+				port := binaryutil.BigEndian.Uint16(e.Data)
+				result.ToPortRanges = networkControl.PortRanges{{Start: port, End: port}}
+			case loadedIIfName:
+				result.IIfName = ifNameFromBytes(e.Data)
+			case loadedOIfName:
+				result.OIfName = ifNameFromBytes(e.Data)
+			case loadedCtState, loadedCtStatus:
+				if len(mask) != 4 {
+					return result, fmt.Errorf("%v: ct without a mask", errUnexpectedRule)
+				}
+				if loaded == loadedCtState {
+					result.CtState = binaryutil.NativeEndian.Uint32(mask)
+				} else {
+					result.CtStatus = binaryutil.NativeEndian.Uint32(mask)
+				}
+			case loadedFib:
+			default:
+				return result, fmt.Errorf("%v: cmp without a load", errUnexpectedRule)
+			}
+		case *expr.Range:
+			portRanges := networkControl.PortRanges{{Start: binaryutil.BigEndian.Uint16(e.FromData), End: binaryutil.BigEndian.Uint16(e.ToData)}}
+			switch loaded {
+			case loadedSPort:
+				result.FromPortRanges = portRanges
+			case loadedDPort:
+				result.ToPortRanges = portRanges
+			default:
+				return result, fmt.Errorf("%v: range without a port load", errUnexpectedRule)
+			}
+		case *expr.Lookup:
+			switch loaded {
+			case loadedIIfName:
+				if e.IsDestRegSet {
+					result.VerdictMap = e.SetName
+				} else {
+					result.IIfNameSet = e.SetName
+				}
+			case loadedOIfName:
+				result.OIfNameSet = e.SetName
+			case loadedSPort:
+				result.FromPortRanges, err = p.getPortRangesSet(e.SetName)
+			case loadedDPort:
+				result.ToPortRanges, err = p.getPortRangesSet(e.SetName)
+			default:
+				return result, fmt.Errorf("%v: lookup without a load", errUnexpectedRule)
+			}
+			if err != nil {
+				return
+			}
+		case *expr.Immediate:
+			immediates[e.Register] = e.Data
+		case *expr.NAT:
+			result.NAT = e
+			result.NATToIP = net.IP(immediates[e.RegAddrMin])
+			if e.RegProtoMin != 0 {
+				port := binaryutil.BigEndian.Uint16(immediates[e.RegProtoMin])
+				result.NATToPort = &port
+			}
+		case *expr.Verdict:
+			result.Verdict = e
+		case *expr.Counter:
+		default:
+			return result, fmt.Errorf("%v: expression %T", errUnexpectedRule, e)
+		}
+	}
+	result.Metadata = parseRuleMetadata(rule.UserData)
+	return
+}
+
+func (p *ruleParser) getRules(chainName string) (result []parsedRule, err error) {
+	rules, err := p.conn.GetRules(p.table, &nft.Chain{Name: chainName, Table: p.table})
+	if err != nil {
+		return
+	}
+	for _, rule := range rules {
+		parsed, err := p.parseRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("chain %v: %v", chainName, err)
+		}
+		result = append(result, parsed)
+	}
+	return
+}
+
+func (parsed parsedRule) ToACLRule() (rule networkControl.ACLRule, err error) {
+	anyNet, err := networkControl.IPNetFromCIDRString("0.0.0.0/0")
+	if err != nil {
+		return
+	}
+	rule.FromNet = anyNet
+	rule.ToNet = anyNet
+	rule.FromPortRanges = networkControl.PortRanges{{Start: 0, End: 65535}}
+	rule.ToPortRanges = networkControl.PortRanges{{Start: 0, End: 65535}}
+
+	if parsed.CtState != 0 {
+		rule.Flags |= networkControl.ACLFL_ESTABLISHED
+	}
+	if parsed.Protocol != nil {
+		rule.Protocol = *parsed.Protocol
+	}
+	if parsed.FromNet != nil {
+		rule.FromNet = *parsed.FromNet
+	}
+	if parsed.ToNet != nil {
+		rule.ToNet = *parsed.ToNet
+	}
+	if parsed.FromPortRanges != nil {
+		rule.FromPortRanges = parsed.FromPortRanges
+	}
+	if parsed.ToPortRanges != nil {
+		rule.ToPortRanges = parsed.ToPortRanges
+	}
+	if parsed.Verdict == nil {
+		return rule, fmt.Errorf("%v: no verdict", errUnexpectedRule)
+	}
+	switch parsed.Verdict.Kind {
+	case expr.VerdictAccept, expr.VerdictGoto:
+		rule.Action = networkControl.ACL_ALLOW
+	case expr.VerdictDrop:
+		rule.Action = networkControl.ACL_DENY
+	default:
+		return rule, fmt.Errorf("%v: verdict %v", errUnexpectedRule, parsed.Verdict.Kind)
+	}
+	return
+}
+
+func (p *ruleParser) parse(chains []*nft.Chain) (rs ruleset, err error) {
+	rs = newRuleset()
+	rs.permitInterInterface = p.fw.lastRuleset.permitInterInterface
+	rs.permitIntraInterface = p.fw.lastRuleset.permitIntraInterface
+
+	// security levels (the verdict map "security_levels" is built from the sets "security_level.N", so the sets are enough)
+
+	for setName := range p.sets {
+		securityLevel, ok := parseSecurityLevelName(setName)
+		if !ok {
+			continue
+		}
+		ifNames, err := p.getIfNameSet(setName)
+		if err != nil {
+			return rs, err
+		}
+		for _, ifName := range ifNames {
+			rs.securityLevels[ifName] = securityLevel
+		}
+	}
+
+	// the flags are not stored explicitly, they're recognized by the rules of security levels (if there're any)
+
+	for _, chain := range chains {
+		securityLevel, ok := parseSecurityLevelName(chain.Name)
+		if !ok {
+			continue
+		}
+		rules, err := p.getRules(chain.Name)
+		if err != nil {
+			return rs, err
+		}
+		isSameLevelPermitted := false
+		for _, rule := range rules {
+			if rule.IIfName != "" && rule.IIfName == rule.OIfName && rule.Verdict != nil {
+				rs.permitIntraInterface = rule.Verdict.Kind == expr.VerdictAccept
+			}
+			if rule.OIfNameSet == securityLevelName(securityLevel) {
+				isSameLevelPermitted = true
+			}
+		}
+		rs.permitInterInterface = isSameLevelPermitted
+	}
+
+	// ACLs (incoming bindings are in chain "acls.in", the order of the rules there is defined by priorities)
+
+	aclRules, err := p.getRules("acls.in")
+	if err != nil {
+		return
+	}
+	for _, aclRule := range aclRules {
+		if aclRule.Verdict == nil || aclRule.Verdict.Kind != expr.VerdictJump || !strings.HasPrefix(aclRule.Verdict.Chain, "acl.in.") {
+			continue
+		}
+		acl := networkControl.ACL{
+			Name: strings.TrimPrefix(aclRule.Verdict.Chain, "acl.in."),
+		}
+		if priorityString, ok := aclRule.Metadata["priority"]; ok {
+			acl.Priority, err = strconv.Atoi(priorityString)
+			if err != nil {
+				return
+			}
+		}
+		for _, direction := range networkControl.ACLDirections {
+			ifNames, err := p.getIfNameSet(aclChainName(acl.Name, direction))
+			if err != nil {
+				return rs, err
+			}
+			for _, ifName := range ifNames {
+				acl.AddVLANName(direction, p.fw.NFTIfNameToIfName(ifName))
+			}
+		}
+
+		// both chains have the same rules, so the incoming one is enough
+		rules, err := p.getRules(aclChainName(acl.Name, networkControl.ACLDIR_IN))
+		if err != nil {
+			return rs, err
+		}
+		for _, parsed := range rules {
+			rule, err := parsed.ToACLRule()
+			if err != nil {
+				return rs, fmt.Errorf("ACL %v: %v", acl.Name, err)
+			}
+			acl.Rules = append(acl.Rules, rule)
+		}
+		rs.acls = append(rs.acls, &acl)
+	}
+
+	// DNATs (consecutive rules with the same target are destinations of the same DNAT)
+
+	dnatRules, err := p.getRules("prerouting")
+	if err != nil {
+		return
+	}
+	var lastDNAT *networkControl.DNAT
+	for _, parsed := range dnatRules {
+		if parsed.NAT == nil || parsed.NAT.Type != expr.NATTypeDestNAT || parsed.ToNet == nil {
+			return rs, fmt.Errorf("%v: prerouting: not a DNAT", errUnexpectedRule)
+		}
+		natTo := networkControl.IPPort{IP: parsed.NATToIP, Port: parsed.NATToPort}
+		destination := networkControl.IPPort{IP: parsed.ToNet.IP, Protocol: parsed.Protocol}
+		if parsed.ToPortRanges != nil {
+			port := parsed.ToPortRanges[0].Start
+			destination.Port = &port
+			natTo.Protocol = parsed.Protocol
+		}
+		ifName := parsed.Metadata["ifname"]
+		if lastDNAT != nil && lastDNAT.NATTo.String() == natTo.String() && lastDNAT.IfName == ifName {
+			lastDNAT.Destinations = append(lastDNAT.Destinations, destination)
+			continue
+		}
+		lastDNAT = &networkControl.DNAT{
+			Destinations: networkControl.IPPorts{destination},
+			NATTo:        natTo,
+			IfName:       ifName,
+		}
+		rs.dnats = append(rs.dnats, lastDNAT)
+	}
+	for _, dnat := range rs.dnats {
+		dnat.Destinations = dnat.Destinations.Sort()
+	}
+
+	// SNATs (grouped by the target)
+
+	snatRules, err := p.getRules("postrouting")
+	if err != nil {
+		return
+	}
+	snatMap := map[string]*networkControl.SNAT{}
+	for _, parsed := range snatRules {
+		if parsed.NAT == nil { // the rules to skip SNAT for private networks
+			continue
+		}
+		if parsed.NAT.Type != expr.NATTypeSourceNAT || parsed.FromNet == nil {
+			return rs, fmt.Errorf("%v: postrouting: not a SNAT", errUnexpectedRule)
+		}
+		source := networkControl.SNATSource{IPNet: *parsed.FromNet, IfName: parsed.Metadata["ifname"]}
+		snatKey := parsed.NATToIP.String()
+		if snatMap[snatKey] != nil {
+			snatMap[snatKey].Sources = append(snatMap[snatKey].Sources, source)
+			continue
+		}
+		snat := &networkControl.SNAT{
+			Sources: networkControl.SNATSources{source},
+			NATTo:   parsed.NATToIP,
+		}
+		if globalIdString, ok := parsed.Metadata["global"]; ok {
+			snat.FWSMGlobalId, err = strconv.Atoi(globalIdString)
+			if err != nil {
+				return
+			}
+		}
+		snatMap[snatKey] = snat
+		rs.snats = append(rs.snats, snat)
+	}
+	for _, snat := range rs.snats {
+		snat.Sources = snat.Sources.Sort()
+	}
+
+	return
+}
+
+// inquireRuleset reads the table from the kernel (an empty ruleset is returned if there's no table)
+func (fw *nftables) inquireRuleset() (rs ruleset, err error) {
+	conn, err := fw.newConn()
+	if err != nil {
+		fw.LogError(err)
+		return
+	}
+
+	tables, err := conn.ListTablesOfFamily(nft.TableFamilyIPv4)
+	if err != nil {
+		fw.LogError(err)
+		return
+	}
+	var table *nft.Table
+	for _, curTable := range tables {
+		if curTable.Name == TABLE_NAME {
+			table = curTable
+		}
+	}
+	if table == nil {
+		rs = newRuleset()
+		rs.permitInterInterface = fw.lastRuleset.permitInterInterface
+		rs.permitIntraInterface = fw.lastRuleset.permitIntraInterface
+		fw.lastRuleset = rs
+		return
+	}
+
+	p := &ruleParser{
+		fw:    fw,
+		conn:  conn,
+		table: table,
+		sets:  map[string]*nft.Set{},
+	}
+	sets, err := conn.GetSets(table)
+	if err != nil {
+		fw.LogError(err)
+		return
+	}
+	for _, set := range sets {
+		p.sets[set.Name] = set
+	}
+	allChains, err := conn.ListChainsOfTableFamily(nft.TableFamilyIPv4)
+	if err != nil {
+		fw.LogError(err)
+		return
+	}
+	chains := []*nft.Chain{}
+	for _, chain := range allChains {
+		if chain.Table.Name == TABLE_NAME {
+			chains = append(chains, chain)
+		}
+	}
+
+	rs, err = p.parse(chains)
+	if err != nil {
+		fw.LogError(err)
+		return
+	}
+	fw.lastRuleset = rs
+	return
+}
@@ -0,0 +1,568 @@
+package nftables
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	nft "github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/xaionaro-go/networkControl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ifNameSize = 16
+
+	// IPS_DST_NAT of "enum ip_conntrack_status"
+	ctStatusDstNAT = 0x20
+)
+
+var (
+	privateNets = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}
+)
+
+func securityLevelName(securityLevel int) string {
+	if securityLevel < 0 {
+		return "security_level.m" + strconv.Itoa(-securityLevel)
+	}
+	return "security_level." + strconv.Itoa(securityLevel)
+}
+
+func parseSecurityLevelName(name string) (int, bool) {
+	if !strings.HasPrefix(name, "security_level.") {
+		return 0, false
+	}
+	securityLevelString := strings.TrimPrefix(name, "security_level.")
+	sign := 1
+	if strings.HasPrefix(securityLevelString, "m") {
+		sign = -1
+		securityLevelString = securityLevelString[1:]
+	}
+	securityLevel, err := strconv.Atoi(securityLevelString)
+	if err != nil {
+		return 0, false
+	}
+	return sign * securityLevel, true
+}
+
+// aclChainName returns the name of the chain with rules of the ACL for the direction. The set of
+// interfaces the ACL is bound to has the same name.
+//
+// "acl.out.*" chains are checked before "acl.in.*" chains (see networkControl.ACL.Priority). They
+// allow a packet by "goto acls.in" instead of "accept": the rest of outgoing ACLs is skipped and the
+// packet is still checked by incoming ACLs. "acls.in" always ends with a verdict, so the goto never
+// returns to chain "acls".
+func aclChainName(aclName string, direction networkControl.ACLDirection) string {
+	return "acl." + direction.String() + "." + aclName
+}
+
+// ruleMetadata is the values which do not affect the traffic but are required to restore the model
+// (like the FWSM global id of a SNAT). It's kept in the comment of the rule.
+type ruleMetadata map[string]string
+
+func (m ruleMetadata) UserData() []byte {
+	if len(m) == 0 {
+		return nil
+	}
+	words := []string{}
+	for key, value := range m {
+		words = append(words, key+"="+value)
+	}
+	sort.Strings(words)
+	return userdata.AppendString(nil, userdata.TypeComment, strings.Join(words, " "))
+}
+
+func parseRuleMetadata(udata []byte) ruleMetadata {
+	m := ruleMetadata{}
+	comment, ok := userdata.GetString(udata, userdata.TypeComment)
+	if !ok {
+		return m
+	}
+	for _, word := range strings.Fields(comment) {
+		keyValue := strings.SplitN(word, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		m[keyValue[0]] = keyValue[1]
+	}
+	return m
+}
+
+func ifNameBytes(ifName string) []byte {
+	b := make([]byte, ifNameSize)
+	copy(b, ifName)
+	return b
+}
+
+func port16Bytes(port uint16) []byte {
+	return binaryutil.BigEndian.PutUint16(port)
+}
+
+// renderer converts a ruleset to netlink messages of nf_tables
+type renderer struct {
+	fw    *nftables
+	conn  *nft.Conn
+	table *nft.Table
+	sets  map[string]*nft.Set
+}
+
+// renderRuleset queues messages to replace the table by the ruleset (they're sent by conn.Flush())
+func (fw *nftables) renderRuleset(conn *nft.Conn, rs ruleset) error {
+	r := &renderer{
+		fw:   fw,
+		conn: conn,
+		sets: map[string]*nft.Set{},
+	}
+	return r.render(rs)
+}
+
+func (r *renderer) addChain(name string, chainType nft.ChainType, hook *nft.ChainHook, priority *nft.ChainPriority) *nft.Chain {
+	return r.conn.AddChain(&nft.Chain{
+		Name:     name,
+		Table:    r.table,
+		Type:     chainType,
+		Hooknum:  hook,
+		Priority: priority,
+	})
+}
+
+func (r *renderer) addRule(chain *nft.Chain, metadata ruleMetadata, exprs ...expr.Any) {
+	r.conn.AddRule(&nft.Rule{
+		Table:    r.table,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: metadata.UserData(),
+	})
+}
+
+func (r *renderer) addIfNameSet(name string, ifNames []string) error {
+	elements := []nft.SetElement{}
+	for _, ifName := range ifNames {
+		elements = append(elements, nft.SetElement{Key: ifNameBytes(ifName)})
+	}
+	set := &nft.Set{
+		Table:   r.table,
+		Name:    name,
+		KeyType: nft.TypeIFName,
+	}
+	err := r.conn.AddSet(set, elements)
+	if err != nil {
+		return err
+	}
+	r.sets[name] = set
+	return nil
+}
+
+// lookupExprs returns expressions of "NAME @SET" (NAME is "iifname" or "oifname")
+func (r *renderer) lookupExprs(metaKey expr.MetaKey, setName string) []expr.Any {
+	set := r.sets[setName]
+	return []expr.Any{
+		&expr.Meta{Key: metaKey, Register: 1},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+func ifNameExprs(metaKey expr.MetaKey, ifName string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: metaKey, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifNameBytes(ifName)},
+	}
+}
+
+func verdictExprs(kind expr.VerdictKind, chainName string) []expr.Any {
+	return []expr.Any{&expr.Verdict{Kind: kind, Chain: chainName}}
+}
+
+// ipNetExprs returns expressions of "ip saddr NET" (or "ip daddr NET")
+func ipNetExprs(ipNet networkControl.IPNet, isDst bool) ([]expr.Any, error) {
+	offset := uint32(12)
+	if isDst {
+		offset = 16
+	}
+	ip := ipNet.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%v: not IPv4: %v", errNotImplemented, ipNet)
+	}
+	ones, bits := net.IPMask(ipNet.Mask).Size()
+	if bits == 0 {
+		return nil, fmt.Errorf("%v: non-canonical mask: %v", errNotImplemented, ipNet)
+	}
+	mask := net.CIDRMask(ones-(bits-32), 32)
+	result := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 4},
+	}
+	if ones-(bits-32) != 32 {
+		result = append(result, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte(mask), Xor: []byte{0, 0, 0, 0}})
+	}
+	result = append(result, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(ip.Mask(mask))})
+	return result, nil
+}
+
+func protocolExprs(protocol networkControl.Protocol) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(protocol)}},
+	}
+}
+
+// portRangesExprs returns expressions of "th sport PORTS" (or "th dport PORTS"); an anonymous set is used for multiple ranges
+func (r *renderer) portRangesExprs(portRanges networkControl.PortRanges, isDst bool) ([]expr.Any, error) {
+	offset := uint32(0)
+	if isDst {
+		offset = 2
+	}
+	result := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2},
+	}
+
+	if len(portRanges) == 1 {
+		portRange := portRanges[0]
+		if portRange.Start == portRange.End {
+			return append(result, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: port16Bytes(portRange.Start)}), nil
+		}
+		return append(result, &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: port16Bytes(portRange.Start), ToData: port16Bytes(portRange.End)}), nil
+	}
+
+	sortedPortRanges := append(networkControl.PortRanges{}, portRanges...)
+	sort.Slice(sortedPortRanges, func(i, j int) bool { return sortedPortRanges[i].Start < sortedPortRanges[j].Start })
+	elements := []nft.SetElement{}
+	for _, portRange := range sortedPortRanges {
+		elements = append(elements, nft.SetElement{Key: port16Bytes(portRange.Start)})
+		if portRange.End != 65535 {
+			elements = append(elements, nft.SetElement{Key: port16Bytes(portRange.End + 1), IntervalEnd: true})
+		}
+	}
+	set := &nft.Set{
+		Table:     r.table,
+		Anonymous: true,
+		Constant:  true,
+		Interval:  true,
+		KeyType:   nft.TypeInetService,
+	}
+	err := r.conn.AddSet(set, elements)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID}), nil
+}
+
+func ctBitsExprs(key expr.CtKey, bits uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: key, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(bits), Xor: binaryutil.NativeEndian.PutUint32(0)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+func (r *renderer) aclRuleExprs(rule networkControl.ACLRule, direction networkControl.ACLDirection) (result []expr.Any, err error) {
+	if rule.Flags&networkControl.ACLFL_ESTABLISHED != 0 {
+		result = append(result, ctBitsExprs(expr.CtKeySTATE, expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)...)
+	}
+	if rule.Protocol != networkControl.PROTO_IP {
+		result = append(result, protocolExprs(rule.Protocol)...)
+	}
+	if !rule.FromNet.IsAny() {
+		exprs, err := ipNetExprs(rule.FromNet, false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, exprs...)
+	}
+	if !rule.ToNet.IsAny() {
+		exprs, err := ipNetExprs(rule.ToNet, true)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, exprs...)
+	}
+	if len(rule.FromPortRanges) != 0 && !rule.FromPortRanges.IsAny() {
+		exprs, err := r.portRangesExprs(rule.FromPortRanges, false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, exprs...)
+	}
+	if len(rule.ToPortRanges) != 0 && !rule.ToPortRanges.IsAny() {
+		exprs, err := r.portRangesExprs(rule.ToPortRanges, true)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, exprs...)
+	}
+
+	switch rule.Action {
+	case networkControl.ACL_ALLOW:
+		if direction == networkControl.ACLDIR_OUT {
+			result = append(result, verdictExprs(expr.VerdictGoto, "acls.in")...)
+		} else {
+			result = append(result, verdictExprs(expr.VerdictAccept, "")...)
+		}
+	case networkControl.ACL_DENY:
+		result = append(result, verdictExprs(expr.VerdictDrop, "")...)
+	default:
+		return nil, fmt.Errorf("Unknown action: %v", rule)
+	}
+	return
+}
+
+// ipPortExprs returns expressions of "ip daddr IP [meta l4proto PROTO th dport PORT]"
+func ipPortExprs(ipport networkControl.IPPort) ([]expr.Any, error) {
+	ip := ipport.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%v: not IPv4: %v", errNotImplemented, ipport)
+	}
+	result := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(ip)},
+	}
+	protocol := ipport.Protocol
+	if protocol != nil && *protocol == networkControl.PROTO_IP {
+		protocol = nil
+	}
+	if protocol == nil && ipport.Port == nil {
+		return result, nil
+	}
+	if protocol == nil || ipport.Port == nil {
+		return nil, fmt.Errorf("This case is not implemented: %v %v: %v", ipport.Port, ipport.Protocol, ipport)
+	}
+	result = append(result, protocolExprs(*protocol)...)
+	result = append(result,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: port16Bytes(*ipport.Port)},
+	)
+	return result, nil
+}
+
+// natToExprs returns expressions of "snat to IP" or "dnat to IP[:PORT]"
+func natToExprs(natType expr.NATType, ip net.IP, port *uint16) ([]expr.Any, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("%v: not IPv4: %v", errNotImplemented, ip)
+	}
+	result := []expr.Any{
+		&expr.Immediate{Register: 1, Data: []byte(ip4)},
+	}
+	nat := &expr.NAT{Type: natType, Family: unix.NFPROTO_IPV4, RegAddrMin: 1}
+	if port != nil {
+		result = append(result, &expr.Immediate{Register: 2, Data: port16Bytes(*port)})
+		nat.RegProtoMin = 2
+		nat.Specified = true
+	}
+	return append(result, nat), nil
+}
+
+func (r *renderer) render(rs ruleset) error {
+	// replacing the table: "add" (in case it doesn't exist), "delete", "add"
+
+	table := &nft.Table{Name: TABLE_NAME, Family: nft.TableFamilyIPv4}
+	r.conn.AddTable(table)
+	r.conn.DelTable(table)
+	r.table = r.conn.AddTable(table)
+
+	// chains (they should exist before the verdict map refers them)
+
+	forward := r.addChain("forward", nft.ChainTypeFilter, nft.ChainHookForward, nft.ChainPriorityFilter)
+	var input *nft.Chain
+	if denyToOtherGWs {
+		input = r.addChain("input", nft.ChainTypeFilter, nft.ChainHookInput, nft.ChainPriorityFilter)
+	}
+	acls := r.addChain("acls", "", nil, nil)
+	aclsIn := r.addChain("acls.in", "", nil, nil)
+	prerouting := r.addChain("prerouting", nft.ChainTypeNAT, nft.ChainHookPrerouting, nft.ChainPriorityNATDest)
+	postrouting := r.addChain("postrouting", nft.ChainTypeNAT, nft.ChainHookPostrouting, nft.ChainPriorityNATSource)
+
+	securityLevels := rs.getSecurityLevels()
+	securityLevelChains := map[int]*nft.Chain{}
+	for _, securityLevel := range securityLevels {
+		securityLevelChains[securityLevel] = r.addChain(securityLevelName(securityLevel), "", nil, nil)
+	}
+
+	sortedACLs := append(networkControl.ACLs{}, rs.acls...)
+	sort.SliceStable(sortedACLs, func(i, j int) bool {
+		if sortedACLs[i].Priority != sortedACLs[j].Priority {
+			return sortedACLs[i].Priority < sortedACLs[j].Priority
+		}
+		return sortedACLs[i].Name < sortedACLs[j].Name
+	})
+	aclChains := map[string]*nft.Chain{}
+	for _, acl := range sortedACLs {
+		for _, direction := range networkControl.ACLDirections {
+			chainName := aclChainName(acl.Name, direction)
+			aclChains[chainName] = r.addChain(chainName, "", nil, nil)
+		}
+	}
+
+	// sets
+
+	ifNamesOfSecurityLevel := map[int][]string{}
+	vmapElements := []nft.SetElement{}
+	for ifName, securityLevel := range rs.securityLevels {
+		ifNamesOfSecurityLevel[securityLevel] = append(ifNamesOfSecurityLevel[securityLevel], ifName)
+		vmapElements = append(vmapElements, nft.SetElement{
+			Key:         ifNameBytes(ifName),
+			VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: securityLevelName(securityLevel)},
+		})
+	}
+	for _, securityLevel := range securityLevels {
+		sort.Strings(ifNamesOfSecurityLevel[securityLevel])
+		err := r.addIfNameSet(securityLevelName(securityLevel), ifNamesOfSecurityLevel[securityLevel])
+		if err != nil {
+			return err
+		}
+	}
+	vmap := &nft.Set{
+		Table:    r.table,
+		Name:     "security_levels",
+		IsMap:    true,
+		KeyType:  nft.TypeIFName,
+		DataType: nft.TypeVerdict,
+	}
+	err := r.conn.AddSet(vmap, vmapElements)
+	if err != nil {
+		return err
+	}
+	r.sets[vmap.Name] = vmap
+
+	for _, acl := range sortedACLs {
+		for _, direction := range networkControl.ACLDirections {
+			ifNames := []string{}
+			for _, vlanName := range acl.GetVLANNames(direction) {
+				ifNames = append(ifNames, r.fw.IfNameToNFTIfName(vlanName))
+			}
+			err := r.addIfNameSet(aclChainName(acl.Name, direction), ifNames)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// "forward" and "input"
+
+	r.addRule(forward, nil, append(ctBitsExprs(expr.CtKeySTATE, expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED), verdictExprs(expr.VerdictAccept, "")...)...)
+	r.addRule(forward, nil, verdictExprs(expr.VerdictJump, acls.Name)...)
+	if input != nil { // fib daddr . iif type != local drop
+		r.addRule(input, nil,
+			&expr.Fib{Register: 1, ResultADDRTYPE: true, FlagDADDR: true, FlagIIF: true},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		)
+	}
+
+	// ACLs
+
+	// "acls": outgoing bindings; "acls.in": accepted DNATs, incoming bindings and then security levels
+
+	for _, acl := range sortedACLs {
+		chainName := aclChainName(acl.Name, networkControl.ACLDIR_OUT)
+		r.addRule(acls, ruleMetadata{"priority": strconv.Itoa(acl.Priority)}, append(r.lookupExprs(expr.MetaKeyOIFNAME, chainName), verdictExprs(expr.VerdictJump, chainName)...)...)
+	}
+	r.addRule(acls, nil, verdictExprs(expr.VerdictGoto, aclsIn.Name)...)
+
+	r.addRule(aclsIn, nil, append(ctBitsExprs(expr.CtKeySTATUS, ctStatusDstNAT), verdictExprs(expr.VerdictAccept, "")...)...)
+	for _, acl := range sortedACLs {
+		chainName := aclChainName(acl.Name, networkControl.ACLDIR_IN)
+		r.addRule(aclsIn, ruleMetadata{"priority": strconv.Itoa(acl.Priority)}, append(r.lookupExprs(expr.MetaKeyIIFNAME, chainName), verdictExprs(expr.VerdictJump, chainName)...)...)
+	}
+	if len(securityLevels) > 0 {
+		r.addRule(aclsIn, nil,
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Lookup{SourceRegister: 1, DestRegister: 0, IsDestRegSet: true, SetName: vmap.Name, SetID: vmap.ID},
+		)
+		r.addRule(aclsIn, nil, verdictExprs(expr.VerdictDrop, "")...)
+	} else {
+		r.addRule(aclsIn, nil, verdictExprs(expr.VerdictAccept, "")...)
+	}
+	for _, acl := range sortedACLs {
+		for _, direction := range networkControl.ACLDirections {
+			chain := aclChains[aclChainName(acl.Name, direction)]
+			for _, rule := range acl.Rules {
+				exprs, err := r.aclRuleExprs(rule, direction)
+				if err != nil {
+					return fmt.Errorf("ACL %v: %v", acl.Name, err)
+				}
+				r.addRule(chain, nil, exprs...)
+			}
+		}
+	}
+
+	// security levels
+
+	for _, securityLevel := range securityLevels {
+		chain := securityLevelChains[securityLevel]
+		verdict := expr.VerdictDrop
+		if rs.permitIntraInterface {
+			verdict = expr.VerdictAccept
+		}
+		for _, ifName := range ifNamesOfSecurityLevel[securityLevel] {
+			exprs := append(ifNameExprs(expr.MetaKeyIIFNAME, ifName), ifNameExprs(expr.MetaKeyOIFNAME, ifName)...)
+			r.addRule(chain, nil, append(exprs, verdictExprs(verdict, "")...)...)
+		}
+		for _, lowerSecurityLevel := range securityLevels {
+			if lowerSecurityLevel > securityLevel || (lowerSecurityLevel == securityLevel && !rs.permitInterInterface) {
+				continue
+			}
+			r.addRule(chain, nil, append(r.lookupExprs(expr.MetaKeyOIFNAME, securityLevelName(lowerSecurityLevel)), verdictExprs(expr.VerdictAccept, "")...)...)
+		}
+	}
+
+	// DNATs
+
+	for _, dnat := range rs.dnats {
+		metadata := ruleMetadata{}
+		if dnat.IfName != "" {
+			metadata["ifname"] = dnat.IfName
+		}
+		natToExprs, err := natToExprs(expr.NATTypeDestNAT, dnat.NATTo.IP, dnat.NATTo.Port)
+		if err != nil {
+			return fmt.Errorf("DNAT %v: %v", dnat.NATTo, err)
+		}
+		for _, destination := range dnat.Destinations {
+			exprs, err := ipPortExprs(destination)
+			if err != nil {
+				return fmt.Errorf("DNAT %v: %v", dnat.NATTo, err)
+			}
+			r.addRule(prerouting, metadata, append(exprs, natToExprs...)...)
+		}
+	}
+
+	// SNATs
+
+	for _, privateNet := range privateNets {
+		ipNet, err := networkControl.IPNetFromCIDRString(privateNet)
+		if err != nil {
+			return err
+		}
+		exprs, err := ipNetExprs(ipNet, true)
+		if err != nil {
+			return err
+		}
+		r.addRule(postrouting, nil, append(exprs, verdictExprs(expr.VerdictAccept, "")...)...)
+	}
+	for _, snat := range rs.snats {
+		natToExprs, err := natToExprs(expr.NATTypeSourceNAT, snat.NATTo, nil)
+		if err != nil {
+			return fmt.Errorf("SNAT %v: %v", snat.NATTo, err)
+		}
+		for _, source := range snat.Sources {
+			metadata := ruleMetadata{}
+			if snat.FWSMGlobalId != 0 {
+				metadata["global"] = strconv.Itoa(snat.FWSMGlobalId)
+			}
+			if source.IfName != "" {
+				metadata["ifname"] = source.IfName
+			}
+			exprs, err := ipNetExprs(source.IPNet, false)
+			if err != nil {
+				return fmt.Errorf("SNAT %v: %v", snat.NATTo, err)
+			}
+			r.addRule(postrouting, metadata, append(exprs, natToExprs...)...)
+		}
+	}
+
+	return nil
+}
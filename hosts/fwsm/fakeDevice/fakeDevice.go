@@ -0,0 +1,541 @@
+package fakeDevice
+
+// A fake Catalyst switch with an FWSM module to test fwsmHost without hardware. It's accessible via telnet
+// (without any option negotiation), emulates the login sequence of the switch and of the module and keeps the
+// running configuration as a list of lines, which are edited by configuration commands. Any command could be
+// scripted by SetResponse() (for example to simulate errors).
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_SWITCH_HOSTNAME = "switch"
+	DEFAULT_HOSTNAME        = "FWSM"
+)
+
+type mode int
+
+const (
+	mode_SWITCH_USER = mode(1)
+	mode_SWITCH_PRIV = mode(2)
+	mode_USER        = mode(3)
+	mode_PRIV        = mode(4)
+	mode_CONFIG      = mode(5)
+	mode_CONFIG_IF   = mode(6)
+)
+
+type response struct {
+	commandPrefix string
+	output        string
+}
+
+type Device struct {
+	SwitchHostname string
+	Hostname       string
+	EntryPassword  string
+	FWSMPassword   string
+	EnablePassword string // FWSMPassword is used if it's empty
+
+	locker        sync.Mutex
+	runningConfig []string
+	startupConfig []string
+	commands      []string
+	responses     []response
+	listener      net.Listener
+	waitGroup     sync.WaitGroup
+}
+
+func New(entryPassword, fwsmPassword string) *Device {
+	return &Device{
+		SwitchHostname: DEFAULT_SWITCH_HOSTNAME,
+		Hostname:       DEFAULT_HOSTNAME,
+		EntryPassword:  entryPassword,
+		FWSMPassword:   fwsmPassword,
+	}
+}
+
+func splitConfig(config string) (lines []string) {
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine == "" || strings.HasPrefix(trimmedLine, "!") || strings.HasPrefix(trimmedLine, ":") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return
+}
+
+func joinConfig(lines []string) string {
+	return ": Saved\n" + strings.Join(lines, "\n") + "\n"
+}
+
+func (dev *Device) SetRunningConfig(config string) {
+	dev.locker.Lock()
+	defer dev.locker.Unlock()
+	dev.runningConfig = splitConfig(config)
+}
+func (dev *Device) GetRunningConfig() string {
+	dev.locker.Lock()
+	defer dev.locker.Unlock()
+	return joinConfig(dev.runningConfig)
+}
+func (dev *Device) SetStartupConfig(config string) {
+	dev.locker.Lock()
+	defer dev.locker.Unlock()
+	dev.startupConfig = splitConfig(config)
+}
+func (dev *Device) GetStartupConfig() string {
+	dev.locker.Lock()
+	defer dev.locker.Unlock()
+	return joinConfig(dev.startupConfig)
+}
+
+// GetCommands returns all commands received by the module (after entering the privileged mode)
+func (dev *Device) GetCommands() []string {
+	dev.locker.Lock()
+	defer dev.locker.Unlock()
+	return append([]string{}, dev.commands...)
+}
+
+// SetResponse makes the module to reply "output" to commands beginning with "commandPrefix" instead of executing them
+func (dev *Device) SetResponse(commandPrefix, output string) {
+	dev.locker.Lock()
+	defer dev.locker.Unlock()
+	dev.responses = append([]response{{commandPrefix: commandPrefix, output: output}}, dev.responses...)
+}
+
+// Listen starts accepting connections on "addr" (for example "127.0.0.1:0")
+func (dev *Device) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	dev.listener = listener
+	dev.waitGroup.Add(1)
+	go func() {
+		defer dev.waitGroup.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dev.waitGroup.Add(1)
+			go func() {
+				defer dev.waitGroup.Done()
+				defer conn.Close()
+				dev.serve(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// GetAddr returns the address the device listens on
+func (dev *Device) GetAddr() string {
+	return dev.listener.Addr().String()
+}
+
+func (dev *Device) Close() error {
+	err := dev.listener.Close()
+	dev.waitGroup.Wait()
+	return err
+}
+
+// Transport executes commands on the module directly (without a network connection), it satisfies fwsm.Transport
+type Transport struct {
+	conn   *connection
+	output bytes.Buffer
+}
+
+// NewTransport returns a Transport in the privileged mode of the module
+func (dev *Device) NewTransport() *Transport {
+	transport := &Transport{}
+	transport.conn = &connection{dev: dev, writer: &transport.output, mode: mode_PRIV}
+	return transport
+}
+
+func (transport *Transport) Run(command string) (string, error) {
+	transport.output.Reset()
+	if !transport.conn.handle(strings.TrimSpace(command)) {
+		return "", errors.New("the session is closed")
+	}
+	output := strings.Replace(transport.output.String(), "\r\n", "\n", -1)
+	if strings.HasPrefix(output, "ERROR: ") || strings.Contains(output, "\nERROR: ") {
+		return output, errors.New(strings.TrimSpace(output))
+	}
+	return output, nil
+}
+
+type connection struct {
+	dev    *Device
+	reader *bufio.Reader
+	writer io.Writer
+	mode   mode
+	ifName string
+}
+
+func (conn *connection) write(format string, args ...interface{}) {
+	fmt.Fprintf(conn.writer, format, args...)
+}
+
+func (conn *connection) readLine() (string, error) {
+	line, err := conn.reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (conn *connection) askPassword(password string) (bool, error) {
+	conn.write("Password: ")
+	line, err := conn.readLine()
+	if err != nil {
+		return false, err
+	}
+	conn.write("\r\n")
+	if line != password {
+		conn.write("Invalid password\r\n")
+		return false, nil
+	}
+	return true, nil
+}
+
+func (conn *connection) prompt() string {
+	switch conn.mode {
+	case mode_SWITCH_USER:
+		return conn.dev.SwitchHostname + ">"
+	case mode_SWITCH_PRIV:
+		return conn.dev.SwitchHostname + "#"
+	case mode_USER:
+		return conn.dev.Hostname + ">"
+	case mode_PRIV:
+		return conn.dev.Hostname + "#"
+	case mode_CONFIG:
+		return conn.dev.Hostname + "(config)#"
+	case mode_CONFIG_IF:
+		return conn.dev.Hostname + "(config-if)#"
+	}
+	return "?"
+}
+
+func (dev *Device) serve(rawConn net.Conn) {
+	conn := &connection{dev: dev, reader: bufio.NewReader(rawConn), writer: rawConn, mode: mode_SWITCH_USER}
+
+	conn.write("\r\n\r\nUser Access Verification\r\n\r\n")
+	if ok, err := conn.askPassword(dev.EntryPassword); !ok || err != nil {
+		return
+	}
+
+	for {
+		conn.write("%v ", conn.prompt())
+		line, err := conn.readLine()
+		if err != nil {
+			return
+		}
+		conn.write("%v\r\n", line)
+		if !conn.handle(strings.TrimSpace(line)) {
+			return
+		}
+	}
+}
+
+// handle executes the command and returns false if the connection should be closed
+func (conn *connection) handle(command string) bool {
+	dev := conn.dev
+	words := strings.Fields(command)
+	if len(words) == 0 {
+		return true
+	}
+
+	switch conn.mode {
+	case mode_SWITCH_USER, mode_SWITCH_PRIV:
+		switch {
+		case words[0] == "enable" && conn.mode == mode_SWITCH_USER:
+			ok, err := conn.askPassword(dev.EntryPassword)
+			if err != nil {
+				return false
+			}
+			if ok {
+				conn.mode = mode_SWITCH_PRIV
+			}
+		case words[0] == "session" && conn.mode == mode_SWITCH_PRIV:
+			conn.write("The default escape character is Ctrl-^, then x.\r\nYou can also type 'exit' at the remote prompt to end the session\r\nTrying 127.0.0.41 ... Open\r\n\r\n\r\nUser Access Verification\r\n\r\n")
+			ok, err := conn.askPassword(dev.FWSMPassword)
+			if err != nil || !ok {
+				return false
+			}
+			conn.mode = mode_USER
+		case words[0] == "exit":
+			return false
+		default:
+			conn.write("%% Invalid input detected at '^' marker.\r\n\r\n")
+		}
+		return true
+	case mode_USER:
+		switch words[0] {
+		case "enable":
+			enablePassword := dev.EnablePassword
+			if enablePassword == "" {
+				enablePassword = dev.FWSMPassword
+			}
+			ok, err := conn.askPassword(enablePassword)
+			if err != nil {
+				return false
+			}
+			if ok {
+				conn.mode = mode_PRIV
+			}
+		case "exit":
+			return false
+		default:
+			conn.write("ERROR: %% Invalid input detected at '^' marker.\r\n")
+		}
+		return true
+	}
+
+	dev.locker.Lock()
+	defer dev.locker.Unlock()
+
+	dev.commands = append(dev.commands, command)
+
+	for _, response := range dev.responses {
+		if strings.HasPrefix(command, response.commandPrefix) {
+			if response.output != "" {
+				conn.write("%v\r\n", strings.Replace(response.output, "\n", "\r\n", -1))
+			}
+			return true
+		}
+	}
+
+	if conn.mode == mode_PRIV {
+		switch {
+		case command == "exit":
+			return false
+		case command == "terminal pager 0":
+		case command == "configure terminal":
+			conn.mode = mode_CONFIG
+		case command == "show running-config" || command == "show run":
+			conn.write("%v", strings.Replace(joinConfig(dev.runningConfig), "\n", "\r\n", -1))
+		case command == "show startup-config":
+			conn.write("%v", strings.Replace(joinConfig(dev.startupConfig), "\n", "\r\n", -1))
+		case command == "write memory":
+			dev.startupConfig = append([]string{}, dev.runningConfig...)
+			conn.write("Building configuration...\r\n[OK]\r\n")
+		default:
+			conn.write("ERROR: %% Invalid input detected at '^' marker.\r\n")
+		}
+		return true
+	}
+
+	if err := conn.configure(words); err != nil {
+		conn.write("ERROR: %v\r\n", err)
+	}
+	return true
+}
+
+func normalize(line string) string {
+	return strings.Join(strings.Fields(line), " ")
+}
+
+func (dev *Device) findLine(line string) int {
+	line = normalize(line)
+	for idx, configLine := range dev.runningConfig {
+		if !strings.HasPrefix(configLine, " ") && normalize(configLine) == line {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (dev *Device) removeLinesByPrefix(prefix string) {
+	var result []string
+	for _, line := range dev.runningConfig {
+		if strings.HasPrefix(line, prefix) {
+			continue
+		}
+		result = append(result, line)
+	}
+	dev.runningConfig = result
+}
+
+// findInterface returns the position of the "interface" line and the position after its block
+func (dev *Device) findInterface(ifName string) (int, int) {
+	start := dev.findLine("interface " + ifName)
+	if start < 0 {
+		return -1, -1
+	}
+	end := start + 1
+	for end < len(dev.runningConfig) && strings.HasPrefix(dev.runningConfig[end], " ") {
+		end++
+	}
+	return start, end
+}
+
+func (dev *Device) insertLine(idx int, line string) {
+	dev.runningConfig = append(dev.runningConfig, "")
+	copy(dev.runningConfig[idx+1:], dev.runningConfig[idx:])
+	dev.runningConfig[idx] = line
+}
+
+func (dev *Device) removeLine(idx int) {
+	dev.runningConfig = append(dev.runningConfig[:idx], dev.runningConfig[idx+1:]...)
+}
+
+// configureInterface handles a subcommand of "interface"; it returns false if it's not an interface subcommand
+func (conn *connection) configureInterface(words []string) bool {
+	dev := conn.dev
+	isNo := words[0] == "no"
+	keyWords := words
+	if isNo {
+		keyWords = words[1:]
+	}
+	if len(keyWords) == 0 {
+		return false
+	}
+	key := keyWords[0]
+	switch key {
+	case "nameif", "security-level", "description", "vlan", "shutdown":
+	case "ip":
+		key = "ip address"
+	default:
+		return false
+	}
+
+	start, end := dev.findInterface(conn.ifName)
+	for idx := start + 1; idx < end; idx++ {
+		if strings.HasPrefix(strings.TrimSpace(dev.runningConfig[idx]), key) {
+			dev.removeLine(idx)
+			end--
+			break
+		}
+	}
+	if !isNo {
+		dev.insertLine(end, " "+strings.Join(words, " "))
+	}
+	return true
+}
+
+func (conn *connection) configure(words []string) error {
+	dev := conn.dev
+
+	if conn.mode == mode_CONFIG_IF {
+		if conn.configureInterface(words) {
+			return nil
+		}
+		conn.mode = mode_CONFIG
+	}
+
+	command := strings.Join(words, " ")
+	switch {
+	case command == "end":
+		conn.mode = mode_PRIV
+		return nil
+	case command == "exit":
+		return nil
+
+	case words[0] == "interface" && len(words) == 2:
+		if start, _ := dev.findInterface(words[1]); start < 0 {
+			dev.runningConfig = append(dev.runningConfig, command)
+		}
+		conn.mode = mode_CONFIG_IF
+		conn.ifName = words[1]
+		return nil
+
+	case len(words) == 4 && words[0] == "clear" && words[1] == "configure" && words[2] == "access-list":
+		dev.removeLinesByPrefix("access-list " + words[3] + " ")
+		dev.removeLinesByPrefix("access-group " + words[3] + " ")
+		return nil
+
+	case len(words) == 4 && words[0] == "clear" && words[1] == "configure" && words[2] == "interface":
+		start, end := dev.findInterface(words[3])
+		if start >= 0 {
+			dev.runningConfig = append(dev.runningConfig[:start], dev.runningConfig[end:]...)
+		}
+		return nil
+
+	case words[0] == "no" && len(words) > 1:
+		idx := dev.findLine(strings.Join(words[1:], " "))
+		if idx < 0 {
+			return fmt.Errorf("entry not found: %v", strings.Join(words[1:], " "))
+		}
+		dev.removeLine(idx)
+		if words[1] == "access-list" && len(words) > 2 {
+			// an ACL without lines doesn't exist
+			isEmpty := true
+			for _, line := range dev.runningConfig {
+				if strings.HasPrefix(line, "access-list "+words[2]+" ") {
+					isEmpty = false
+				}
+			}
+			if isEmpty {
+				dev.removeLinesByPrefix("access-group " + words[2] + " ")
+			}
+		}
+		return nil
+
+	case words[0] == "access-list" && len(words) > 4 && words[2] == "line":
+		position, err := strconv.Atoi(words[3])
+		if err != nil || position < 1 {
+			return fmt.Errorf("invalid line number: %v", words[3])
+		}
+		line := strings.Join(append([]string{"access-list", words[1]}, words[4:]...), " ")
+		if dev.findLine(line) >= 0 {
+			return fmt.Errorf("duplicate of existing entry")
+		}
+		count := 0
+		insertIdx := -1
+		lastIdx := -1
+		for idx, configLine := range dev.runningConfig {
+			if !strings.HasPrefix(configLine, "access-list "+words[1]+" ") {
+				continue
+			}
+			count++
+			lastIdx = idx
+			if count == position {
+				insertIdx = idx
+			}
+		}
+		switch {
+		case insertIdx >= 0:
+			dev.insertLine(insertIdx, line)
+		case lastIdx >= 0:
+			dev.insertLine(lastIdx+1, line)
+		default:
+			dev.runningConfig = append(dev.runningConfig, line)
+		}
+		return nil
+
+	case words[0] == "access-group" && len(words) == 5:
+		// an interface could have only one ACL per direction
+		for idx, line := range dev.runningConfig {
+			lineWords := strings.Fields(line)
+			if len(lineWords) == 5 && lineWords[0] == "access-group" && strings.Join(lineWords[2:], " ") == strings.Join(words[2:], " ") {
+				dev.removeLine(idx)
+				break
+			}
+		}
+		dev.runningConfig = append(dev.runningConfig, command)
+		return nil
+
+	case words[0] == "mtu" && len(words) == 3:
+		dev.removeLinesByPrefix("mtu " + words[1] + " ")
+		dev.runningConfig = append(dev.runningConfig, command)
+		return nil
+	}
+
+	if dev.findLine(command) >= 0 {
+		if words[0] == "access-list" {
+			return fmt.Errorf("duplicate of existing entry")
+		}
+		return nil
+	}
+	dev.runningConfig = append(dev.runningConfig, command)
+	return nil
+}
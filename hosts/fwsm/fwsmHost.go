@@ -1,41 +1,263 @@
 package fwsmHost
 
 import (
+	"errors"
+	"strings"
+	"time"
+
 	"github.com/xaionaro-go/networkControl"
 	"github.com/xaionaro-go/networkControl/firewalls/fwsm"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errNotImplemented = errors.New("not implemented, yet")
 )
 
 const (
-	errNotImplemented = error("not implemented, yet")
+	DEFAULT_TIMEOUT = 30 * time.Second
 )
 
+type AccessProtocol int
+
+const (
+	ACCESSPROTO_TELNET = AccessProtocol(0)
+	ACCESSPROTO_SSH    = AccessProtocol(1)
+)
+
+func (protocol AccessProtocol) String() string {
+	switch protocol {
+	case ACCESSPROTO_TELNET:
+		return "telnet"
+	case ACCESSPROTO_SSH:
+		return "ssh"
+	}
+	return "unknown"
+}
+
 type AccessDetails struct {
-	Host          string
+	Host          string // "host" or "host:port" of the switch
 	Slot          int
 	Processor     int
 	EntryPassword string
 	FWSMPassword  string
+
+	// Protocol is the protocol to access the switch (telnet by default)
+	Protocol AccessProtocol
+
+	// Username is required for SSH and for telnet if the switch asks it
+	Username string
+
+	// EnablePassword is the password of the privileged mode of FWSM (FWSMPassword is used if it's empty)
+	EnablePassword string
+
+	// HostKeyCallback verifies the SSH host key of the switch (the key is not verified if it's nil)
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Timeout is the timeout of connecting and of waiting for the output of a command (DEFAULT_TIMEOUT if zero)
+	Timeout time.Duration
 }
 
 type fwsmHost struct {
 	networkControl.HostBase
 	accessDetails *AccessDetails
+	session       *session
 }
 
 func NewHost(accessDetails *AccessDetails) networkControl.HostI {
 	host := fwsmHost{}
-	host.HostBase.parent = &host
+	err := host.HostBase.SetParent(&host)
+	if err != nil {
+		panic(err)
+	}
 	if accessDetails != nil {
 		accessDetailsCopy := *accessDetails
 		host.accessDetails = &accessDetailsCopy
 	} else {
 		panic(errNotImplemented)
 	}
-	host.HostBase.SetFirewall(fwsm.NewFirewall())
+	host.HostBase.SetFirewall(fwsm.NewFirewall(&host, &host))
 	return &host
 }
 
-func (fwsmHost *fwsmHost) SetFirewall() error {
+func (host *fwsmHost) SetFirewall(newFirewall networkControl.FirewallI) error {
 	panic(errNotImplemented)
 	return errNotImplemented
 }
+
+// IfNameToHostIfName returns the name as is: FWSM interfaces are referred by "nameif"
+func (host *fwsmHost) IfNameToHostIfName(ifName string) string {
+	return ifName
+}
+func (host *fwsmHost) HostIfNameToIfName(hostIfName string) string {
+	return hostIfName
+}
+
+// getSession returns the opened session (and opens it if required)
+func (host *fwsmHost) getSession() (*session, error) {
+	if host.session != nil {
+		return host.session, nil
+	}
+	session := newSession(*host.accessDetails, host.Debugf)
+	err := session.Open()
+	if err != nil {
+		host.LogError(err, host.accessDetails.Host)
+		return nil, err
+	}
+	host.session = session
+	return session, nil
+}
+
+// run executes the commands and stops on the first failed one. The session is reopened on the next call if it's broken.
+func (host *fwsmHost) run(commands ...string) (output string, err error) {
+	session, err := host.getSession()
+	if err != nil {
+		return
+	}
+	for _, command := range commands {
+		output, err = session.Run(command)
+		if err != nil {
+			host.LogError(err, command)
+			if err == errTimeout || err == errSessionClosed {
+				session.Close()
+				host.session = nil
+			}
+			return
+		}
+	}
+	return
+}
+
+// Run executes the command on FWSM (in the privileged mode), it's the fwsm.Transport of the firewall of the host
+func (host *fwsmHost) Run(command string) (string, error) {
+	return host.run(command)
+}
+
+// Close closes the session to the device
+func (host *fwsmHost) Close() error {
+	if host.session == nil {
+		return nil
+	}
+	err := host.session.Close()
+	host.session = nil
+	return err
+}
+
+func (host *fwsmHost) inquireState(command string) (networkControl.State, error) {
+	config, err := host.run(command)
+	if err != nil {
+		return networkControl.State{}, err
+	}
+	state, unparsed := fwsm.ParseConfig(config)
+	for _, line := range unparsed {
+		host.Debugf("fwsmHost: skipped: %v", line)
+	}
+	return state, nil
+}
+
+func (host *fwsmHost) RescanState() error {
+	oldIgnoredState := networkControl.State{}
+	oldIgnoredState.CopyIgnoredFrom(host.States.Cur)
+
+	host.Debugf("rescanning the state")
+	state, err := host.inquireState("show running-config")
+	if err != nil {
+		return err
+	}
+	host.States.Cur = state
+
+	host.States.Cur.CopyIgnoredFrom(oldIgnoredState)
+	host.TagOwnership()
+	return nil
+}
+
+func (host *fwsmHost) ApplyDiff(stateDiff networkControl.StateDiff) error {
+	commands, err := fwsm.RenderDiff(host.States.Cur, stateDiff)
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	host.Infof("fwsmHost.ApplyDiff(): %v commands", len(commands))
+	_, err = host.run("configure terminal")
+	if err != nil {
+		return err
+	}
+	_, err = host.run(commands...)
+	if _, endErr := host.run("end"); endErr != nil && err == nil {
+		err = endErr
+	}
+	return err
+}
+
+func (host *fwsmHost) SaveToDisk() error {
+	host.Infof("fwsmHost.SaveToDisk()")
+	output, err := host.run("write memory")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(output, "[OK]") {
+		host.Warningf("fwsmHost.SaveToDisk(): unexpected output: %v", output)
+	}
+	return nil
+}
+
+// SaveManagedObjects does nothing: the device has no place for the registry of managed objects, so
+// it's created from the current state on every start (see HostBase.TagOwnership())
+func (host *fwsmHost) SaveManagedObjects() error {
+	return nil
+}
+
+// RestoreFromDisk applies the startup configuration
+func (host *fwsmHost) RestoreFromDisk() error {
+	err := host.RescanState()
+	if err != nil {
+		return err
+	}
+	state, err := host.inquireState("show startup-config")
+	if err != nil {
+		return err
+	}
+	host.States.New = state
+	return host.Apply()
+}
+
+// Teardown removes the configuration managed by the library (VLAN interfaces, ACLs, NATs, routes, ...)
+// from FWSM. The items are the configuration commands.
+func (host *fwsmHost) Teardown(options networkControl.TeardownOptions) (networkControl.TeardownItems, error) {
+	err := host.RescanState()
+	if err != nil {
+		return nil, err
+	}
+
+	emptyState := networkControl.State{}
+	if options.KeepForeign {
+		emptyState.CopyUnmanagedFrom(host.States.Cur)
+	}
+	stateDiff := emptyState.Diff(host.States.Cur)
+	commands, err := fwsm.RenderDiff(host.States.Cur, stateDiff)
+	if err != nil {
+		host.LogError(err)
+		return nil, err
+	}
+	var result networkControl.TeardownItems
+	for _, command := range commands {
+		result = append(result, networkControl.TeardownItem{Kind: "fwsm command", Name: command})
+	}
+	if options.DryRun || len(commands) == 0 {
+		return result, nil
+	}
+
+	// not by Apply(): it would keep ignored VLANs
+	err = host.ApplyDiff(stateDiff)
+	if err != nil {
+		return result, err
+	}
+	if !options.KeepForeign {
+		host.States.Cur = networkControl.State{}
+	}
+	return result, host.RescanState()
+}
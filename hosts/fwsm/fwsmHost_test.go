@@ -0,0 +1,180 @@
+package fwsmHost
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xaionaro-go/networkControl"
+	"github.com/xaionaro-go/networkControl/firewalls/fwsm"
+	"github.com/xaionaro-go/networkControl/hosts/fwsm/fakeDevice"
+)
+
+const testRunningConfig = `: Saved
+FWSM Version 4.1(5) <context>
+hostname FWSM
+interface Vlan10
+ nameif inside
+ security-level 100
+ ip address 10.0.0.1 255.255.255.0
+interface Vlan30
+ nameif outside
+ security-level 0
+ ip address 192.0.2.1 255.255.255.0
+access-list outside_in extended permit tcp any host 10.0.0.10 eq 80
+access-list outside_in extended deny ip any any
+access-group outside_in in interface outside
+route outside 0.0.0.0 0.0.0.0 192.0.2.254 1
+`
+
+func newTestHost(t *testing.T) (*fwsmHost, *fakeDevice.Device) {
+	dev := fakeDevice.New("entry-password", "fwsm-password")
+	dev.SetRunningConfig(testRunningConfig)
+	err := dev.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := NewHost(&AccessDetails{
+		Host:          dev.GetAddr(),
+		Slot:          3,
+		Processor:     1,
+		EntryPassword: "entry-password",
+		FWSMPassword:  "fwsm-password",
+		Timeout:       5 * time.Second,
+	}).(*fwsmHost)
+	t.Cleanup(func() {
+		host.Close()
+		dev.Close()
+	})
+	return host, dev
+}
+
+// renderDeviceConfig renders the running configuration of the device the same way for any order of lines
+func renderDeviceConfig(t *testing.T, dev *fakeDevice.Device) string {
+	state, _ := fwsm.ParseConfig(dev.GetRunningConfig())
+	commands, err := fwsm.RenderConfig(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(commands, "\n")
+}
+
+func TestRescanState(t *testing.T) {
+	host, dev := newTestHost(t)
+
+	err := host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := host.States.Cur
+	if len(state.BridgedVLANs) != 2 || state.BridgedVLANs[30] == nil || state.BridgedVLANs[30].Name != "outside" {
+		t.Errorf("VLANs: %v", state.BridgedVLANs)
+	}
+	if len(state.ACLs) != 1 || state.ACLs[0].Name != "outside_in" || len(state.ACLs[0].Rules) != 2 {
+		t.Errorf("ACLs: %v", state.ACLs)
+	}
+	if len(state.Routes) != 1 {
+		t.Errorf("routes: %v", state.Routes)
+	}
+
+	commands := dev.GetCommands()
+	if len(commands) != 2 || commands[0] != "terminal pager 0" || commands[1] != "show running-config" {
+		t.Errorf("commands: %v", commands)
+	}
+}
+
+func TestApplyDiff(t *testing.T) {
+	host, dev := newTestHost(t)
+
+	err := host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newState, _ := fwsm.ParseConfig(testRunningConfig)
+	newState.PermitInterInterface = true
+	newState.BridgedVLANs[10].SecurityLevel = 90
+	newState.ACLs[0].Rules = append(networkControl.ACLRules{{
+		Action:       networkControl.ACL_ALLOW,
+		Protocol:     networkControl.PROTO_TCP,
+		FromNet:      newState.ACLs[0].Rules[0].FromNet,
+		ToNet:        newState.ACLs[0].Rules[0].ToNet,
+		ToPortRanges: networkControl.PortRanges{{Start: 443, End: 443}},
+	}}, newState.ACLs[0].Rules...)
+
+	err = host.ApplyDiff(newState.Diff(host.States.Cur))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedCommands, err := fwsm.RenderConfig(newState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := renderDeviceConfig(t, dev); config != strings.Join(expectedCommands, "\n") {
+		t.Errorf("the running config:\n%v\n\nexpected:\n%v", config, strings.Join(expectedCommands, "\n"))
+	}
+
+	commands := dev.GetCommands()
+	if commands[2] != "configure terminal" || commands[len(commands)-1] != "end" {
+		t.Errorf("the commands are not run in the configuration mode: %v", commands)
+	}
+
+	err = host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(host.States.Cur.ACLs) != 1 || !reflect.DeepEqual(host.States.Cur.ACLs[0].Rules, newState.ACLs[0].Rules) {
+		t.Errorf("ACLs are not applied: %v", host.States.Cur.ACLs)
+	}
+}
+
+func TestApplyDiffError(t *testing.T) {
+	host, dev := newTestHost(t)
+	dev.SetResponse("same-security-traffic", "ERROR: % Invalid input detected at '^' marker.")
+
+	err := host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newState, _ := fwsm.ParseConfig(testRunningConfig)
+	newState.PermitInterInterface = true
+
+	err = host.ApplyDiff(newState.Diff(host.States.Cur))
+	if err == nil {
+		t.Fatal("an error is expected")
+	}
+	commands := dev.GetCommands()
+	if commands[len(commands)-1] != "end" {
+		t.Errorf("the configuration mode is not left: %v", commands)
+	}
+
+	// the session is still usable
+
+	err = host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveToDisk(t *testing.T) {
+	host, dev := newTestHost(t)
+
+	err := host.SaveToDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.GetStartupConfig() != dev.GetRunningConfig() {
+		t.Errorf("the startup config:\n%v\n\n!= the running config:\n%v", dev.GetStartupConfig(), dev.GetRunningConfig())
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	host, _ := newTestHost(t)
+	host.accessDetails.FWSMPassword = "wrong"
+
+	err := host.RescanState()
+	if err == nil {
+		t.Fatal("an error is expected")
+	}
+}
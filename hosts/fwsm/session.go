@@ -0,0 +1,388 @@
+package fwsmHost
+
+// An interactive CLI session to FWSM: the module is accessed through the supervisor of the switch
+// ("session slot X processor Y"), the switch could be accessed via telnet or SSH.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	errTimeout         = errors.New("timeout")
+	errSessionClosed   = errors.New("the session is closed")
+	errCommandFailed   = errors.New("the command failed")
+	errUnexpectedLogin = errors.New("unexpected login prompt")
+)
+
+var (
+	promptRe   = regexp.MustCompile(`(?m)^[A-Za-z0-9_.\-/]+(\([a-z\-]+\))?[>#] ?\z`)
+	passwordRe = regexp.MustCompile(`(?i)password: ?\z`)
+	usernameRe = regexp.MustCompile(`(?i)(username|login): ?\z`)
+	moreRe     = regexp.MustCompile(`<--- More --->\s*\z`)
+	errorRe    = regexp.MustCompile(`(?m)^(ERROR: |% Invalid|% Incomplete|% Ambiguous)`)
+)
+
+const (
+	telnetIAC  = 255
+	telnetDONT = 254
+	telnetDO   = 253
+	telnetWONT = 252
+	telnetWILL = 251
+	telnetSB   = 250
+	telnetSE   = 240
+)
+
+type session struct {
+	accessDetails AccessDetails
+	debugf        func(fmt string, args ...interface{})
+
+	conn     io.ReadWriter
+	closers  []io.Closer
+	isTelnet bool
+
+	writeLocker sync.Mutex
+	output      chan []byte
+	buffer      bytes.Buffer
+	prompt      string
+}
+
+func newSession(accessDetails AccessDetails, debugf func(fmt string, args ...interface{})) *session {
+	if accessDetails.Timeout == 0 {
+		accessDetails.Timeout = DEFAULT_TIMEOUT
+	}
+	return &session{
+		accessDetails: accessDetails,
+		debugf:        debugf,
+	}
+}
+
+func hostWithDefaultPort(host string, defaultPort int) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, fmt.Sprintf("%v", defaultPort))
+}
+
+// Open connects to the switch, opens a session to the FWSM module and enters the privileged mode
+func (s *session) Open() (err error) {
+	switch s.accessDetails.Protocol {
+	case ACCESSPROTO_TELNET:
+		err = s.dialTelnet()
+	case ACCESSPROTO_SSH:
+		err = s.dialSSH()
+	default:
+		err = fmt.Errorf("unknown protocol: %v", s.accessDetails.Protocol)
+	}
+	if err != nil {
+		return
+	}
+
+	s.output = make(chan []byte, 16)
+	go s.readLoop()
+
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	// the switch
+
+	if err = s.login(s.accessDetails.Username, s.accessDetails.EntryPassword); err != nil {
+		return
+	}
+	if strings.HasSuffix(s.prompt, ">") {
+		if err = s.enable(s.accessDetails.EntryPassword); err != nil {
+			return
+		}
+	}
+
+	// the module
+
+	if err = s.write(fmt.Sprintf("session slot %v processor %v", s.accessDetails.Slot, s.accessDetails.Processor)); err != nil {
+		return
+	}
+	if err = s.login("", s.accessDetails.FWSMPassword); err != nil {
+		return
+	}
+	if strings.HasSuffix(s.prompt, ">") {
+		enablePassword := s.accessDetails.EnablePassword
+		if enablePassword == "" {
+			enablePassword = s.accessDetails.FWSMPassword
+		}
+		if err = s.enable(enablePassword); err != nil {
+			return
+		}
+	}
+
+	_, err = s.Run("terminal pager 0")
+	return
+}
+
+func (s *session) dialTelnet() error {
+	conn, err := net.DialTimeout("tcp", hostWithDefaultPort(s.accessDetails.Host, 23), s.accessDetails.Timeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.closers = []io.Closer{conn}
+	s.isTelnet = true
+	return nil
+}
+
+func (s *session) dialSSH() error {
+	hostKeyCallback := s.accessDetails.HostKeyCallback
+	if hostKeyCallback == nil {
+		s.debugf("fwsmHost: AccessDetails.HostKeyCallback is not set, the host key of %v is not verified", s.accessDetails.Host)
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	password := s.accessDetails.EntryPassword
+	config := &ssh.ClientConfig{
+		User: s.accessDetails.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for idx := range answers {
+					answers[idx] = password
+				}
+				return answers, nil
+			}),
+		},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         s.accessDetails.Timeout,
+	}
+	client, err := ssh.Dial("tcp", hostWithDefaultPort(s.accessDetails.Host, 22), config)
+	if err != nil {
+		return err
+	}
+	sshSession, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return err
+	}
+	if err := sshSession.RequestPty("vt100", 0, 200, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+		sshSession.Close()
+		client.Close()
+		return err
+	}
+	stdin, err := sshSession.StdinPipe()
+	if err != nil {
+		sshSession.Close()
+		client.Close()
+		return err
+	}
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		sshSession.Close()
+		client.Close()
+		return err
+	}
+	if err := sshSession.Shell(); err != nil {
+		sshSession.Close()
+		client.Close()
+		return err
+	}
+	s.conn = struct {
+		io.Reader
+		io.Writer
+	}{stdout, stdin}
+	s.closers = []io.Closer{sshSession, client}
+	return nil
+}
+
+func (s *session) Close() error {
+	var err error
+	for _, closer := range s.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.closers = nil
+	return err
+}
+
+func (s *session) readLoop() {
+	defer close(s.output)
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.conn.Read(buf)
+		if n > 0 {
+			data := append([]byte{}, buf[:n]...)
+			if s.isTelnet {
+				data = s.handleTelnetCommands(data)
+			}
+			s.output <- data
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleTelnetCommands removes telnet commands from the data and refuses all options the server offers or asks
+// for (the CLI works fine without any of them). A command split between reads is not supported.
+func (s *session) handleTelnetCommands(data []byte) (result []byte) {
+	for idx := 0; idx < len(data); idx++ {
+		if data[idx] != telnetIAC {
+			result = append(result, data[idx])
+			continue
+		}
+		if idx+1 >= len(data) {
+			break
+		}
+		idx++
+		switch data[idx] {
+		case telnetIAC:
+			result = append(result, telnetIAC)
+		case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+			if idx+1 >= len(data) {
+				break
+			}
+			command, option := data[idx], data[idx+1]
+			idx++
+			switch command {
+			case telnetDO:
+				s.writeRaw([]byte{telnetIAC, telnetWONT, option})
+			case telnetWILL:
+				s.writeRaw([]byte{telnetIAC, telnetDONT, option})
+			}
+		case telnetSB:
+			for idx+1 < len(data) && !(data[idx] == telnetIAC && data[idx+1] == telnetSE) {
+				idx++
+			}
+			idx++
+		}
+	}
+	return
+}
+
+func (s *session) writeRaw(data []byte) error {
+	s.writeLocker.Lock()
+	defer s.writeLocker.Unlock()
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *session) write(line string) error {
+	s.debugf("fwsmHost: > %v", line)
+	return s.writeRaw([]byte(line + "\n"))
+}
+
+// readUntil reads the output until it matches one of the regexps. It returns the output and the index of the matched regexp.
+func (s *session) readUntil(regexps ...*regexp.Regexp) (string, int, error) {
+	timer := time.NewTimer(s.accessDetails.Timeout)
+	defer timer.Stop()
+	for {
+		for idx, re := range regexps {
+			if re.Match(s.buffer.Bytes()) {
+				output := s.buffer.String()
+				s.buffer.Reset()
+				return output, idx, nil
+			}
+		}
+		select {
+		case data, ok := <-s.output:
+			if !ok {
+				return s.buffer.String(), -1, errSessionClosed
+			}
+			s.buffer.Write(bytes.Replace(data, []byte("\r"), nil, -1))
+		case <-timer.C:
+			return s.buffer.String(), -1, errTimeout
+		}
+	}
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(output, "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// login answers username/password requests until a prompt
+func (s *session) login(username, password string) error {
+	isPasswordSent := false
+	for {
+		output, idx, err := s.readUntil(promptRe, passwordRe, usernameRe)
+		if err != nil {
+			return fmt.Errorf("%v: %v", err, output)
+		}
+		switch idx {
+		case 0:
+			s.prompt = lastLine(output)
+			return nil
+		case 1:
+			if isPasswordSent {
+				return fmt.Errorf("%v: wrong password?", errUnexpectedLogin)
+			}
+			isPasswordSent = true
+			if err := s.writeRaw([]byte(password + "\n")); err != nil {
+				return err
+			}
+		case 2:
+			if username == "" {
+				return errUnexpectedLogin
+			}
+			if err := s.write(username); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *session) enable(password string) error {
+	if err := s.write("enable"); err != nil {
+		return err
+	}
+	if err := s.login("", password); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(s.prompt, "#") {
+		return fmt.Errorf("cannot enter the privileged mode: %v", s.prompt)
+	}
+	return nil
+}
+
+// Run executes the command and returns its output (without the echoed command and the prompt)
+func (s *session) Run(command string) (string, error) {
+	if err := s.write(command); err != nil {
+		return "", err
+	}
+	var output bytes.Buffer
+	for {
+		part, idx, err := s.readUntil(promptRe, moreRe)
+		if err != nil {
+			return output.String() + part, err
+		}
+		if idx == 1 {
+			output.WriteString(moreRe.ReplaceAllString(part, ""))
+			if err := s.writeRaw([]byte(" ")); err != nil {
+				return output.String(), err
+			}
+			continue
+		}
+		s.prompt = lastLine(part)
+		output.WriteString(part[:len(part)-len(promptRe.FindString(part))])
+		break
+	}
+
+	result := output.String()
+	if lines := strings.SplitN(result, "\n", 2); len(lines) == 2 && strings.TrimSpace(lines[0]) == strings.TrimSpace(command) {
+		result = lines[1]
+	} else if strings.TrimSpace(result) == strings.TrimSpace(command) {
+		result = ""
+	}
+	if errorRe.MatchString(result) {
+		return result, fmt.Errorf("%v: %v: %v", errCommandFailed, command, strings.TrimSpace(result))
+	}
+	return result, nil
+}
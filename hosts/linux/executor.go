@@ -0,0 +1,373 @@
+package linuxHost
+
+// The changes of a host are made by an Executor: external commands (ip, iptables-restore, ipset, the
+// scripts) and netlink requests which change links and addresses. If the executor is set by
+// Options.Executor then the state is inquired by it as well ("ip -json", iptables-save, ...). dhcpd is
+// managed by iscDhcp, so it's not covered by the Executor; the nftables firewall talks to the kernel by
+// itself, so it cannot be used with an executor.
+//
+// NewRealExecutor() makes the changes, NewRecordingExecutor() writes a transcript of the changes
+// made by another executor, NewReplayExecutor() plays a transcript back (to test the exact sequence
+// of commands without root) and NewDryRunExecutor() only writes down the changes.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+var (
+	errUnexpectedCall     = errors.New("unexpected call of the executor")
+	errUnknownNetlinkOp   = errors.New("unknown netlink operation")
+	errTranscriptUnplayed = errors.New("the transcript is not played to the end")
+)
+
+// Executor makes the changes of a host (see Options.Executor)
+type Executor interface {
+	// Run runs an external command with "input" as stdin and returns its stdout (the error contains stderr)
+	Run(input []byte, name string, args ...string) ([]byte, error)
+
+	// Netlink sends a netlink request
+	Netlink(request NetlinkRequest) error
+}
+
+type NetlinkOperation int
+
+const (
+	NETLINK_LINK_ADD_BRIDGE = NetlinkOperation(1)
+	NETLINK_LINK_ADD_VLAN   = NetlinkOperation(2)
+	NETLINK_LINK_SET_UP     = NetlinkOperation(3)
+	NETLINK_LINK_SET_DOWN   = NetlinkOperation(4)
+	NETLINK_LINK_SET_MASTER = NetlinkOperation(5)
+	NETLINK_LINK_DEL        = NetlinkOperation(6)
+	NETLINK_ADDR_ADD        = NetlinkOperation(7)
+	NETLINK_ADDR_DEL        = NetlinkOperation(8)
+)
+
+// NetlinkRequest is a change of a link or of an address of a link
+type NetlinkRequest struct {
+	Operation NetlinkOperation
+	LinkName  string
+
+	// ParentName is the parent link of NETLINK_LINK_ADD_VLAN or the master of NETLINK_LINK_SET_MASTER
+	ParentName string
+
+	VlanId int    // NETLINK_LINK_ADD_VLAN only
+	Addr   string // the address in CIDR notation (NETLINK_ADDR_ADD and NETLINK_ADDR_DEL only)
+}
+
+// IPArgs returns the arguments of the equivalent "ip" command
+func (request NetlinkRequest) IPArgs() []string {
+	switch request.Operation {
+	case NETLINK_LINK_ADD_BRIDGE:
+		return []string{"link", "add", request.LinkName, "type", "bridge"}
+	case NETLINK_LINK_ADD_VLAN:
+		return []string{"link", "add", "link", request.ParentName, "name", request.LinkName, "type", "vlan", "id", strconv.Itoa(request.VlanId)}
+	case NETLINK_LINK_SET_UP:
+		return []string{"link", "set", request.LinkName, "up"}
+	case NETLINK_LINK_SET_DOWN:
+		return []string{"link", "set", request.LinkName, "down"}
+	case NETLINK_LINK_SET_MASTER:
+		return []string{"link", "set", request.LinkName, "master", request.ParentName}
+	case NETLINK_LINK_DEL:
+		return []string{"link", "del", request.LinkName}
+	case NETLINK_ADDR_ADD:
+		return []string{"addr", "add", request.Addr, "dev", request.LinkName}
+	case NETLINK_ADDR_DEL:
+		return []string{"addr", "del", request.Addr, "dev", request.LinkName}
+	}
+	return []string{"unknown", strconv.Itoa(int(request.Operation))}
+}
+
+func (request NetlinkRequest) String() string {
+	return "ip " + strings.Join(request.IPArgs(), " ")
+}
+
+// realExecutor runs the commands and sends the netlink requests in the network namespace
+type realExecutor struct {
+	netNS   netns.NsHandle
+	netlink *netlink.Handle
+}
+
+// NewRealExecutor returns the executor which makes the changes in the network namespace (netns.None()
+// means the namespace of the process). It's the default executor of a host.
+func NewRealExecutor(netNS netns.NsHandle) (Executor, error) {
+	var handle *netlink.Handle
+	var err error
+	if netNS.IsOpen() {
+		handle, err = netlink.NewHandleAt(netNS)
+	} else {
+		handle, err = netlink.NewHandle()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &realExecutor{netNS: netNS, netlink: handle}, nil
+}
+
+// Run runs the command; in another network namespace it's run by nsenter (the namespace is passed
+// to nsenter as the file descriptor 3)
+func (executor *realExecutor) Run(input []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if executor.netNS.IsOpen() {
+		netNSFd, err := syscall.Dup(int(executor.netNS))
+		if err != nil {
+			return nil, err
+		}
+		netNSFile := os.NewFile(uintptr(netNSFd), "netns")
+		defer netNSFile.Close()
+		cmd = exec.Command("nsenter", append([]string{"--net=/proc/self/fd/3", "--", name}, args...)...)
+		cmd.ExtraFiles = []*os.File{netNSFile}
+	}
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return stdout.Bytes(), fmt.Errorf("%v %v: %v: %v", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (executor *realExecutor) Netlink(request NetlinkRequest) error {
+	switch request.Operation {
+	case NETLINK_LINK_ADD_BRIDGE:
+		return executor.netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: request.LinkName}})
+	case NETLINK_LINK_ADD_VLAN:
+		parent, err := executor.netlink.LinkByName(request.ParentName)
+		if err != nil {
+			return err
+		}
+		return executor.netlink.LinkAdd(&netlink.Vlan{
+			LinkAttrs: netlink.LinkAttrs{Name: request.LinkName, ParentIndex: parent.Attrs().Index},
+			VlanId:    request.VlanId,
+		})
+	}
+
+	link, err := executor.netlink.LinkByName(request.LinkName)
+	if err != nil {
+		return err
+	}
+	switch request.Operation {
+	case NETLINK_LINK_SET_UP:
+		return executor.netlink.LinkSetUp(link)
+	case NETLINK_LINK_SET_DOWN:
+		return executor.netlink.LinkSetDown(link)
+	case NETLINK_LINK_SET_MASTER:
+		master, err := executor.netlink.LinkByName(request.ParentName)
+		if err != nil {
+			return err
+		}
+		return executor.netlink.LinkSetMaster(link, master)
+	case NETLINK_LINK_DEL:
+		return executor.netlink.LinkDel(link)
+	case NETLINK_ADDR_ADD, NETLINK_ADDR_DEL:
+		addr, err := netlink.ParseAddr(request.Addr)
+		if err != nil {
+			return err
+		}
+		if request.Operation == NETLINK_ADDR_ADD {
+			return executor.netlink.AddrAdd(link, addr)
+		}
+		return executor.netlink.AddrDel(link, addr)
+	}
+	return errUnknownNetlinkOp
+}
+
+// TranscriptEntry is a call of an executor
+type TranscriptEntry struct {
+	// Command is the command with its arguments (the equivalent "ip" command for a netlink request)
+	Command   []string
+	IsNetlink bool   `json:",omitempty"`
+	Input     string `json:",omitempty"`
+	Output    string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+func newCommandEntry(input []byte, name string, args ...string) TranscriptEntry {
+	return TranscriptEntry{Command: append([]string{name}, args...), Input: string(input)}
+}
+
+func newNetlinkEntry(request NetlinkRequest) TranscriptEntry {
+	return TranscriptEntry{Command: append([]string{"ip"}, request.IPArgs()...), IsNetlink: true}
+}
+
+func (entry *TranscriptEntry) setResult(output []byte, err error) {
+	entry.Output = string(output)
+	if err != nil {
+		entry.Error = err.Error()
+	}
+}
+
+func (entry TranscriptEntry) result() ([]byte, error) {
+	var output []byte
+	if entry.Output != "" {
+		output = []byte(entry.Output)
+	}
+	if entry.Error != "" {
+		return output, errors.New(entry.Error)
+	}
+	return output, nil
+}
+
+func (entry TranscriptEntry) isSameCall(other TranscriptEntry) bool {
+	return entry.IsNetlink == other.IsNetlink && entry.Input == other.Input &&
+		strings.Join(entry.Command, "\x00") == strings.Join(other.Command, "\x00")
+}
+
+func (entry TranscriptEntry) String() string {
+	result := strings.Join(entry.Command, " ")
+	if entry.IsNetlink {
+		result = "netlink: " + result
+	}
+	return result
+}
+
+type Transcript []TranscriptEntry
+
+// String returns the calls one per line (to compare with a golden file)
+func (transcript Transcript) String() string {
+	var lines []string
+	for _, entry := range transcript {
+		lines = append(lines, entry.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RecordingExecutor writes down the calls of another executor with their results
+type RecordingExecutor struct {
+	locker     sync.Mutex
+	executor   Executor
+	transcript Transcript
+}
+
+func NewRecordingExecutor(executor Executor) *RecordingExecutor {
+	return &RecordingExecutor{executor: executor}
+}
+
+func (executor *RecordingExecutor) Run(input []byte, name string, args ...string) ([]byte, error) {
+	entry := newCommandEntry(input, name, args...)
+	output, err := executor.executor.Run(input, name, args...)
+	entry.setResult(output, err)
+	executor.record(entry)
+	return output, err
+}
+
+func (executor *RecordingExecutor) Netlink(request NetlinkRequest) error {
+	entry := newNetlinkEntry(request)
+	err := executor.executor.Netlink(request)
+	entry.setResult(nil, err)
+	executor.record(entry)
+	return err
+}
+
+func (executor *RecordingExecutor) record(entry TranscriptEntry) {
+	executor.locker.Lock()
+	defer executor.locker.Unlock()
+	executor.transcript = append(executor.transcript, entry)
+}
+
+// Transcript returns the calls recorded so far
+func (executor *RecordingExecutor) Transcript() Transcript {
+	executor.locker.Lock()
+	defer executor.locker.Unlock()
+	return append(Transcript{}, executor.transcript...)
+}
+
+// ReplayExecutor plays a transcript back: every call should be the next call of the transcript, its
+// recorded result is returned. Nothing is run.
+type ReplayExecutor struct {
+	locker     sync.Mutex
+	transcript Transcript
+	position   int
+}
+
+func NewReplayExecutor(transcript Transcript) *ReplayExecutor {
+	return &ReplayExecutor{transcript: transcript}
+}
+
+func (executor *ReplayExecutor) Run(input []byte, name string, args ...string) ([]byte, error) {
+	return executor.replay(newCommandEntry(input, name, args...))
+}
+
+func (executor *ReplayExecutor) Netlink(request NetlinkRequest) error {
+	_, err := executor.replay(newNetlinkEntry(request))
+	return err
+}
+
+func (executor *ReplayExecutor) replay(call TranscriptEntry) ([]byte, error) {
+	executor.locker.Lock()
+	defer executor.locker.Unlock()
+	if executor.position >= len(executor.transcript) {
+		return nil, fmt.Errorf("%v: %v (the transcript is over)", errUnexpectedCall, call)
+	}
+	entry := executor.transcript[executor.position]
+	if !entry.isSameCall(call) {
+		return nil, fmt.Errorf("%v: %v (expected: %v)", errUnexpectedCall, call, entry)
+	}
+	executor.position++
+	return entry.result()
+}
+
+// Done returns an error if not all the calls of the transcript were made
+func (executor *ReplayExecutor) Done() error {
+	executor.locker.Lock()
+	defer executor.locker.Unlock()
+	if executor.position < len(executor.transcript) {
+		return fmt.Errorf("%v: %v calls left, the next one: %v", errTranscriptUnplayed, len(executor.transcript)-executor.position, executor.transcript[executor.position])
+	}
+	return nil
+}
+
+// DryRunExecutor passes the commands which only read the state to another executor and writes down
+// the other calls without making them (they succeed with an empty output)
+type DryRunExecutor struct {
+	RecordingExecutor
+}
+
+func NewDryRunExecutor(executor Executor) *DryRunExecutor {
+	return &DryRunExecutor{RecordingExecutor{executor: executor}}
+}
+
+func (executor *DryRunExecutor) Run(input []byte, name string, args ...string) ([]byte, error) {
+	if isReadOnlyCommand(name, args...) {
+		return executor.executor.Run(input, name, args...)
+	}
+	executor.record(newCommandEntry(input, name, args...))
+	return nil, nil
+}
+
+func (executor *DryRunExecutor) Netlink(request NetlinkRequest) error {
+	executor.record(newNetlinkEntry(request))
+	return nil
+}
+
+// isReadOnlyCommand returns true if the command doesn't change anything
+func isReadOnlyCommand(name string, args ...string) bool {
+	switch name {
+	case "iptables-save":
+		return true
+	case "ip":
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") { // "-json", "-details", "-4", ...
+			args = args[1:]
+		}
+		return len(args) >= 2 && (args[1] == "show" || args[1] == "list" || args[1] == "save")
+	case "ipset":
+		return len(args) >= 1 && (args[0] == "list" || args[0] == "save" || args[0] == "test")
+	case "nft":
+		return len(args) >= 1 && args[0] == "list"
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package linuxHost
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netns"
+	"github.com/xaionaro-go/networkControl"
+	"github.com/xaionaro-go/networkControl/firewalls/iptables"
+)
+
+// stubExecutor is a host without a kernel: iptables is in memory, the interfaces are "lo" and "trunk"
+// (or linksJSON if set)
+type stubExecutor struct {
+	ipt           *iptables.MemoryIPTables
+	linksJSON     string
+	failedCommand string
+}
+
+const stubLinksJSON = `[{"ifindex":1,"ifname":"lo","mtu":65536,"address":"00:00:00:00:00:00","linkinfo":{}},` +
+	`{"ifindex":2,"ifname":"trunk","mtu":1500,"address":"02:00:00:00:00:01","linkinfo":{}}]`
+
+func (executor *stubExecutor) Run(input []byte, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	if command == executor.failedCommand {
+		return nil, fmt.Errorf("injected failure: %v", command)
+	}
+	switch {
+	case command == "iptables-save -t filter" || command == "iptables-save -t nat" || command == "iptables-save -t mangle":
+		save, err := executor.ipt.Save(args[1])
+		return []byte(save), err
+	case name == "iptables-restore":
+		return nil, executor.ipt.Restore(string(input), command == "iptables-restore --noflush")
+	case command == "ip -json -details link show" && executor.linksJSON != "":
+		return []byte(executor.linksJSON), nil
+	case command == "ip -json -details link show":
+		return []byte(stubLinksJSON), nil
+	case strings.HasPrefix(command, "ip -json -4 addr show dev "):
+		return []byte("[]"), nil
+	case strings.HasPrefix(command, "ip rule ") || command == "ip route show table fwsm" || command == "ip route flush table fwsm":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("the stub cannot run: %v", command)
+}
+
+func (executor *stubExecutor) Netlink(request NetlinkRequest) error {
+	return nil
+}
+
+func newExecutorTestHost(t *testing.T, executor Executor) *linuxHost {
+	options := DefaultOptions()
+	options.Executor = executor
+	options.NetNS = netns.None()
+	options.RootPath = t.TempDir()
+	options.DisableDHCP = true
+	host, err := NewHostWithOptions(nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host.(*linuxHost)
+}
+
+func TestRecordingReplayExecutor(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.0.10.1/24")
+	ipNet.IP = net.ParseIP("10.0.10.1").To4()
+	vlan := networkControl.VLAN{
+		Interface:     net.Interface{Name: "inside"},
+		VlanId:        10,
+		SecurityLevel: 100,
+		IPs:           networkControl.IPNets{networkControl.IPNet(*ipNet)},
+	}
+	run := func(host *linuxHost) {
+		err := host.RescanState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = host.ApplyDiff(networkControl.StateDiff{Added: networkControl.State{BridgedVLANs: networkControl.VLANs{10: &vlan}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := NewRecordingExecutor(&stubExecutor{ipt: iptables.NewMemoryIPTables()})
+	host := newExecutorTestHost(t, recorder)
+	if host.netlink != nil {
+		t.Errorf("a netlink handle is opened for a host with an executor")
+	}
+	constructionLen := len(recorder.Transcript())
+	run(host)
+
+	transcript := recorder.Transcript()
+	expected := strings.TrimSpace(`
+ip -json -details link show
+ip route show table fwsm
+iptables-save -t filter
+iptables-save -t nat
+iptables-save -t nat
+netlink: ip link add inside type bridge
+netlink: ip link set inside up
+netlink: ip link add link trunk name trunk.10 type vlan id 10
+netlink: ip link set trunk.10 up
+netlink: ip link set trunk.10 master inside
+iptables-save -t mangle
+iptables-save -t filter
+netlink: ip addr add 10.0.10.1/24 dev inside
+iptables-restore --noflush
+iptables-restore --noflush
+`)
+	if got := transcript[constructionLen:].String(); got != expected {
+		t.Errorf("unexpected transcript:\n%v\nexpected:\n%v", got, expected)
+	}
+
+	// the replay serves both the reads and the changes: nothing is run
+
+	replayer := NewReplayExecutor(transcript)
+	run(newExecutorTestHost(t, replayer))
+	if err := replayer.Done(); err != nil {
+		t.Error(err)
+	}
+
+	replayer = NewReplayExecutor(transcript[:constructionLen])
+	host = newExecutorTestHost(t, replayer)
+	if err := host.RescanState(); err == nil {
+		t.Errorf("an error is expected: the transcript is over")
+	}
+
+	options := DefaultOptions()
+	options.FirewallBackend = FIREWALL_NFTABLES
+	options.Executor = NewReplayExecutor(nil)
+	_, err := NewHostWithOptions(nil, options)
+	if err != errExecutorNFTables {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
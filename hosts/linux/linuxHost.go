@@ -1,41 +1,107 @@
 package linuxHost
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"github.com/xaionaro-go/iscDhcp"
 	"github.com/xaionaro-go/iscDhcp/cfg"
 	"github.com/xaionaro-go/netTree"
 	"github.com/xaionaro-go/networkControl"
 	"github.com/xaionaro-go/networkControl/firewalls/iptables"
+	"github.com/xaionaro-go/networkControl/firewalls/nftables"
+	"golang.org/x/crypto/ssh"
 	"hash/crc32"
-	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	errNotImplemented  = errors.New("not implemented (yet?)")
 	errIfNameCollision = errors.New("Got a collision of backend interface names. It's an internal error caused by a limit in 15 characters for linux network interface names. You can change crc32q value in linuxHost.go to bypass the problem.")
 	errUnknownIfName   = errors.New("Unknown interface in the backend. Cannot convert back to the real interface name")
+	errVLANNotFound    = errors.New("the VLAN is not found on the host")
+	errSecurityLevel   = errors.New("the security level is not set")
 )
 
 const (
 	DHCP_CONFIG_PATH      = "/etc/dhcp/dhcpd.conf"
 	SCRIPTS_PATH          = "/root/fwsm-config/linux"
 	NETCONTOL_CONFIG_PATH = "/etc/networkControl.json"
+	IPTABLES_RULES_PATH   = "/etc/iptables/fwsm.rules"
+	NFTABLES_RULES_PATH   = "/etc/nftables/fwsm.nft"
 )
 
+// FirewallBackend selects the implementation of the firewall of the host
+type FirewallBackend int
+
+const (
+	FIREWALL_IPTABLES = FirewallBackend(0)
+	FIREWALL_NFTABLES = FirewallBackend(1)
+)
+
+func (backend FirewallBackend) String() string {
+	switch backend {
+	case FIREWALL_IPTABLES:
+		return "iptables"
+	case FIREWALL_NFTABLES:
+		return "nftables"
+	}
+	return "unknown"
+}
+
+// AccessDetails of a remote host, it's managed over SSH (see NewSSHExecutor())
 type AccessDetails struct {
 	Host string
-	Post int
-	// ...
+	Post int // the SSH port (22 if zero)
+
+	// Username is "root" if empty (the commands are run without sudo)
+	Username string
+	Password string
+	Signers  []ssh.Signer
+
+	// HostKeyCallback verifies the SSH host key (nil means ~/.ssh/known_hosts of the user, connecting
+	// fails if the file cannot be read)
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Timeout is the timeout of connecting (no timeout if zero)
+	Timeout time.Duration
+}
+
+// Options of a linux host (see NewHostWithOptions())
+type Options struct {
+	FirewallBackend FirewallBackend
+
+	// NetNS is the network namespace to manage (netns.None() means the namespace of the process). The
+	// external commands are run in it by nsenter.
+	NetNS netns.NsHandle
+
+	// RootPath is prepended to the paths of the files read and written by the host ("" means "/")
+	RootPath string
+
+	// DisableDHCP disables the management of dhcpd (it's a system service, so it cannot be isolated in a namespace)
+	DisableDHCP bool
+
+	// Executor makes the changes (nil means NewRealExecutor(NetNS)). If it's set then the iptables
+	// firewall runs its commands by the executor as well and the links and addresses are inquired by
+	// "ip -json" (like on a remote host), so a ReplayExecutor serves the reads without the kernel. The
+	// nftables firewall cannot be used with an executor: it sends netlink requests by itself.
+	Executor Executor
+
+	// MigrateLegacyFirewallRules removes the iptables rules left by older versions (see iptables.Config.MigrateLegacyRules)
+	MigrateLegacyFirewallRules bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		FirewallBackend: FIREWALL_IPTABLES,
+		NetNS:           netns.None(),
+	}
 }
 
 type linuxHost struct {
@@ -45,6 +111,12 @@ type linuxHost struct {
 	netlink       *netlink.Handle
 	crc32q        *crc32.Table
 	ifNameMap     map[string]string
+	executor      Executor
+
+	firewallBackend FirewallBackend
+	netNS           netns.NsHandle
+	rootPath        string
+	isDHCPDisabled  bool
 }
 
 func (host *linuxHost) IfNameToLinuxIfName(ifName string) string {
@@ -79,33 +151,114 @@ func (host linuxHost) HostIfNameToIfName(hostIfName string) string {
 	return host.LinuxIfNameToIfName(hostIfName)
 }
 
+// NewHost is NewHostE which panics on errors
 func NewHost(accessDetails *AccessDetails) networkControl.HostI {
-	host := linuxHost{}
-	err := host.HostBase.SetParent(&host)
+	return NewHostWithFirewall(accessDetails, FIREWALL_IPTABLES)
+}
+
+// NewHostWithFirewall is NewHostWithOptions with the default options which panics on errors
+func NewHostWithFirewall(accessDetails *AccessDetails, firewallBackend FirewallBackend) networkControl.HostI {
+	options := DefaultOptions()
+	options.FirewallBackend = firewallBackend
+	host, err := NewHostWithOptions(accessDetails, options)
 	if err != nil {
 		panic(err)
 	}
+	return host
+}
+
+// NewHostE returns the host with the default options (see NewHostWithOptions())
+func NewHostE(accessDetails *AccessDetails) (networkControl.HostI, error) {
+	return NewHostWithOptions(accessDetails, DefaultOptions())
+}
+
+// NewHostWithOptions returns the host; an error is returned if it cannot be accessed (for example
+// the remote host is unreachable) or the firewall cannot be initialized
+func NewHostWithOptions(accessDetails *AccessDetails, options Options) (_ networkControl.HostI, err error) {
+	host := linuxHost{
+		firewallBackend: options.FirewallBackend,
+		netNS:           options.NetNS,
+		rootPath:        options.RootPath,
+		isDHCPDisabled:  options.DisableDHCP,
+	}
+	err = host.HostBase.SetParent(&host)
+	if err != nil {
+		return nil, err
+	}
 	if accessDetails != nil {
-		panic(errNotImplemented)
 		accessDetailsCopy := *accessDetails
 		host.accessDetails = &accessDetailsCopy
 	}
 	host.crc32q = crc32.MakeTable(0xD5828281)
 	host.ifNameMap = map[string]string{}
-	host.HostBase.SetFirewall(iptables.NewFirewall(&host))
+	host.executor = options.Executor
+	defer func() { // releasing the connections if the host is not returned
+		if err == nil {
+			return
+		}
+		if executor, ok := host.executor.(*sshExecutor); ok && options.Executor == nil {
+			executor.Close()
+		}
+		if host.netlink != nil {
+			host.netlink.Delete()
+		}
+	}()
+	if host.isRemote() {
+		if host.executor == nil {
+			host.executor = newSSHExecutor(*host.accessDetails, host.Debugf)
+		}
+	} else if host.executor == nil {
+		host.netlink, err = host.newNetlinkHandle()
+		if err != nil {
+			host.LogError(err)
+			return nil, err
+		}
+		host.executor = &realExecutor{netNS: host.netNS, netlink: host.netlink}
+	}
+	switch host.firewallBackend {
+	case FIREWALL_IPTABLES:
+		config := iptables.DefaultConfig()
+		config.MigrateLegacyRules = options.MigrateLegacyFirewallRules
+		if host.isInNetNS() || host.isRemote() || options.Executor != nil {
+			config.RunCommand = host.runCommand
+		}
+		firewall, err := iptables.NewFirewallWithConfig(&host, config)
+		if err != nil {
+			host.LogError(err)
+			return nil, err
+		}
+		host.HostBase.SetFirewall(firewall)
+	case FIREWALL_NFTABLES:
+		if host.isRemote() {
+			return nil, errRemoteNFTables
+		}
+		if options.Executor != nil {
+			return nil, errExecutorNFTables
+		}
+		firewall, err := nftables.NewFirewallInNetNS(&host, int(host.netNS))
+		if err != nil {
+			host.LogError(err)
+			return nil, err
+		}
+		host.HostBase.SetFirewall(firewall)
+	default:
+		return nil, fmt.Errorf("unknown firewall backend: %v", host.firewallBackend)
+	}
 	host.dhcpd = iscDhcp.NewDHCP()
-	host.netlink, err = netlink.NewHandle()
+
+	err = host.loadManagedObjects()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	host.exec("ip", "rule", "del", "from", "any", "lookup", "fwsm")
 	err = host.exec("ip", "rule", "add", "from", "any", "lookup", "fwsm")
 	if err != nil {
-		panic(err)
+		host.LogError(err)
+		return nil, err
 	}
 
-	return &host
+	return &host, nil
 }
 
 func (host *linuxHost) SetFirewall(newFirewall networkControl.FirewallI) error {
@@ -113,28 +266,16 @@ func (host *linuxHost) SetFirewall(newFirewall networkControl.FirewallI) error {
 	return errNotImplemented
 }
 
-func (host *linuxHost) getTrunkLink() (netlink.Link, error) {
-	return host.netlink.LinkByName("trunk")
-}
-
 func (host *linuxHost) AddVLAN(vlan networkControl.VLAN) error {
 	if vlan.IsIgnored {
 		return nil
 	}
 
-	if host.accessDetails != nil {
-		panic(errNotImplemented)
-	}
 	host.Debugf("AddVLAN: %v", vlan)
 
-	trunk, err := host.getTrunkLink()
-	if err != nil {
-		host.LogError(err)
-		return err
-	}
-
-	bridgeLink := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: host.IfNameToHostIfName(vlan.Name)}}
-	if err := host.netlink.LinkAdd(bridgeLink); err != nil {
+	bridgeName := host.IfNameToHostIfName(vlan.Name)
+	bridgeLink := NetlinkRequest{Operation: NETLINK_LINK_ADD_BRIDGE, LinkName: bridgeName}
+	if err := host.executor.Netlink(bridgeLink); err != nil {
 		if err.Error() == "file exists" {
 			host.LogWarning(err, vlan, bridgeLink)
 		} else {
@@ -143,13 +284,14 @@ func (host *linuxHost) AddVLAN(vlan networkControl.VLAN) error {
 		}
 	}
 
-	if err := host.netlink.LinkSetUp(bridgeLink); err != nil {
+	if err := host.executor.Netlink(NetlinkRequest{Operation: NETLINK_LINK_SET_UP, LinkName: bridgeName}); err != nil {
 		host.LogError(err)
 		return err
 	}
 
-	vlanLink := &netlink.Vlan{netlink.LinkAttrs{Name: "trunk." + strconv.Itoa(vlan.VlanId), ParentIndex: trunk.Attrs().Index}, vlan.VlanId}
-	if err := host.netlink.LinkAdd(vlanLink); err != nil {
+	vlanName := "trunk." + strconv.Itoa(vlan.VlanId)
+	vlanLink := NetlinkRequest{Operation: NETLINK_LINK_ADD_VLAN, LinkName: vlanName, ParentName: "trunk", VlanId: vlan.VlanId}
+	if err := host.executor.Netlink(vlanLink); err != nil {
 		if err.Error() == "file exists" {
 			host.LogWarning(err, vlan, vlanLink)
 		} else {
@@ -158,32 +300,27 @@ func (host *linuxHost) AddVLAN(vlan networkControl.VLAN) error {
 		}
 	}
 
-	if err := host.netlink.LinkSetUp(vlanLink); err != nil {
+	if err := host.executor.Netlink(NetlinkRequest{Operation: NETLINK_LINK_SET_UP, LinkName: vlanName}); err != nil {
 		host.LogError(err)
 		return err
 	}
 
-	if err := host.netlink.LinkSetMaster(vlanLink, bridgeLink); err != nil {
+	if err := host.executor.Netlink(NetlinkRequest{Operation: NETLINK_LINK_SET_MASTER, LinkName: vlanName, ParentName: bridgeName}); err != nil {
 		host.LogError(err)
 		return err
 	}
 
-	err = host.GetFirewall().SetSecurityLevel(host.IfNameToHostIfName(vlan.Name), vlan.SecurityLevel)
+	err := host.GetFirewall().SetSecurityLevel(bridgeName, vlan.SecurityLevel)
 	if err != nil {
 		host.LogError(err)
 		return err
 	}
 
 	for _, ip := range vlan.IPs {
-		addr, err := netlink.ParseAddr(ip.String())
-		if err != nil {
-			host.LogError(err)
-			return err
-		}
-		err = host.netlink.AddrAdd(bridgeLink, addr)
+		err = host.executor.Netlink(NetlinkRequest{Operation: NETLINK_ADDR_ADD, LinkName: bridgeName, Addr: ip.String()})
 		if err != nil {
 			if err.Error() == "file exists" {
-				host.LogWarning(err, ip, addr)
+				host.LogWarning(err, ip)
 			} else {
 				host.LogError(err)
 				return err
@@ -214,14 +351,9 @@ func (host *linuxHost) exec(command ...interface{}) error {
 		commandStr = append(commandStr, fmt.Sprintf("%v", word))
 	}
 
-	cmd := exec.Command(commandStr[0], commandStr[1:]...)
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	out, err := host.runCommand(nil, commandStr[0], commandStr[1:]...)
 	if err != nil {
-		err = fmt.Errorf("Got an error while execution of %v: %v\nstdout: %v\nstderr: %v", commandStr, err, out.String(), stderr.String())
+		err = fmt.Errorf("Got an error while execution of %v: %v\nstdout: %v", commandStr, err, string(out))
 		host.Errorf("%v", err.Error())
 		return err
 	}
@@ -260,7 +392,8 @@ func (host *linuxHost) UpdateVLAN(vlan networkControl.VLAN) error {
 
 	oldVlan := host.InquireBridgedVLAN(vlan.VlanId)
 	if oldVlan == nil {
-		panic(fmt.Errorf("oldVlan == nil: %v", vlan))
+		host.LogError(errVLANNotFound, vlan)
+		return errVLANNotFound
 	}
 
 	host.Infof("linuxHost.UpdateVLAN(): %v != %v", vlan, *oldVlan)
@@ -289,7 +422,8 @@ func (host *linuxHost) UpdateVLAN(vlan networkControl.VLAN) error {
 		// recheck just in case
 		newSecurityLevelCheck := host.GetFirewall().InquireSecurityLevel(vlan.Name)
 		if newSecurityLevelCheck != vlan.SecurityLevel {
-			panic(fmt.Errorf("cannot set new security level: %v", vlan))
+			host.LogError(errSecurityLevel, vlan, newSecurityLevelCheck)
+			return errSecurityLevel
 		}
 	}
 
@@ -319,33 +453,12 @@ func (host *linuxHost) UpdateVLAN(vlan networkControl.VLAN) error {
 		remIPs = append(remIPs, ip)
 	}
 
-	// Getting netlink pointers
-
-	bridgeLink, err := host.netlink.LinkByName(host.IfNameToLinuxIfName(vlan.Name))
-	if err != nil {
-		host.LogError(err)
-		return err
-	}
-	curAddrs, err := host.netlink.AddrList(bridgeLink, netlink.FAMILY_V4)
-	if err != nil {
-		host.LogError(err)
-		return err
-	}
-	curAddrMap := map[string]*netlink.Addr{}
-	for idx, addr := range curAddrs {
-		addrString := strings.Split(addr.String(), " ")[0]
-		curAddrMap[addrString] = &curAddrs[idx]
-	}
-
 	// Adding and removing IP addresses
 
-	for _, ip := range remIPs {
-		addr := curAddrMap[ip.String()]
-		if addr == nil {
-			panic(fmt.Errorf("This shouldn't happened: %v", ip))
-		}
+	bridgeName := host.IfNameToLinuxIfName(vlan.Name)
 
-		err := host.netlink.AddrDel(bridgeLink, addr)
+	for _, ip := range remIPs {
+		err := host.executor.Netlink(NetlinkRequest{Operation: NETLINK_ADDR_DEL, LinkName: bridgeName, Addr: ip.String()})
 		if err != nil {
 			host.LogError(err)
 			return err
@@ -353,13 +466,7 @@ func (host *linuxHost) UpdateVLAN(vlan networkControl.VLAN) error {
 	}
 
 	for _, ip := range addIPs {
-		addr, err := netlink.ParseAddr(ip.String())
-		if err != nil {
-			host.LogError(err)
-			return err
-		}
-
-		err = host.netlink.AddrAdd(bridgeLink, addr)
+		err := host.executor.Netlink(NetlinkRequest{Operation: NETLINK_ADDR_ADD, LinkName: bridgeName, Addr: ip.String()})
 		if err != nil {
 			host.LogError(err)
 			return err
@@ -391,38 +498,26 @@ func (host *linuxHost) RemoveVLAN(vlan networkControl.VLAN) error {
 		return nil
 	}
 
-	if host.accessDetails != nil {
-		panic(errNotImplemented)
-	}
-
-	vlanLink, err := host.netlink.LinkByName("trunk." + strconv.Itoa(vlan.VlanId))
+	err := host.executor.Netlink(NetlinkRequest{Operation: NETLINK_LINK_DEL, LinkName: "trunk." + strconv.Itoa(vlan.VlanId)})
 	if err != nil {
 		host.LogError(err)
 		return err
 	}
 
-	bridgeLink, err := host.netlink.LinkByName(vlan.Name)
+	bridgeName := host.IfNameToLinuxIfName(vlan.Name)
+	host.executor.Netlink(NetlinkRequest{Operation: NETLINK_LINK_SET_DOWN, LinkName: bridgeName})
+	err = host.executor.Netlink(NetlinkRequest{Operation: NETLINK_LINK_DEL, LinkName: bridgeName})
 	if err != nil {
 		host.LogError(err)
 		return err
 	}
 
-	err = host.netlink.LinkDel(vlanLink)
+	err = host.GetFirewall().UnsetSecurityLevel(vlan.Name)
 	if err != nil {
-		host.LogError(err)
+		host.LogError(err, vlan.Name)
 		return err
 	}
 
-	host.netlink.LinkSetDown(bridgeLink)
-	err = host.netlink.LinkDel(bridgeLink)
-	if err != nil {
-		host.LogError(err)
-		return err
-	}
-
-	//panic(errNotImplemented) // TODO: clean up security levels chain in iptables
-	host.Warningf("cleaning up of security levels after removing a VLAN is not implemented, yet. VLAN %v: %v", vlan.VlanId, vlan)
-
 	return nil
 }
 
@@ -456,7 +551,31 @@ func (host *linuxHost) RemoveRoute(route networkControl.Route) error {
 	return nil
 }
 
+// ApplyDiff applies the diff; if the firewall supports batches then all firewall changes become active at once
 func (host *linuxHost) ApplyDiff(stateDiff networkControl.StateDiff) error {
+	batchFirewall, ok := host.GetFirewall().(networkControl.BatchFirewallI)
+	if !ok {
+		return host.applyDiff(stateDiff)
+	}
+
+	if err := batchFirewall.BeginBatch(); err != nil {
+		host.LogError(err)
+		return err
+	}
+	if err := host.applyDiff(stateDiff); err != nil {
+		if rollbackErr := batchFirewall.RollbackBatch(); rollbackErr != nil {
+			host.LogError(rollbackErr)
+		}
+		return err
+	}
+	if err := batchFirewall.CommitBatch(); err != nil {
+		host.LogError(err)
+		return err
+	}
+	return nil
+}
+
+func (host *linuxHost) applyDiff(stateDiff networkControl.StateDiff) error {
 	// Setting global flags
 
 	if err := host.GetFirewall().SetEnablePermitInterInterface(stateDiff.Updated.PermitInterInterface); err != nil {
@@ -569,14 +688,17 @@ func (host *linuxHost) ApplyDiff(stateDiff networkControl.StateDiff) error {
 
 	host.SetDHCPState(stateDiff.Updated.DHCP)
 	go func() {
+		if host.isDHCPDisabled {
+			return
+		}
 		// Running the new state on DHCP
 		//oldDHCPState := networkControl.DHCP(host.dhcpd.Config.Root)
 
-		if err := host.dhcpd.SaveConfig(); err != nil {
+		if err := host.saveDHCPConfig(); err != nil {
 			host.LogWarning(err)
 			return
 		}
-		if err := host.dhcpd.Restart(); err != nil {
+		if err := host.restartDHCP(); err != nil {
 			host.LogWarning(err)
 			return
 		}
@@ -651,9 +773,9 @@ func (host *linuxHost) ApplyDiff(stateDiff networkControl.StateDiff) error {
 
 func (host *linuxHost) runScript(scriptName string) (err error) {
 	host.Debugf("runScript(\"%v\")", scriptName)
-	scriptPath := SCRIPTS_PATH + "/" + scriptName
+	scriptPath := host.path(SCRIPTS_PATH + "/" + scriptName)
 
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+	if !host.isFileExist(SCRIPTS_PATH + "/" + scriptName) {
 		return nil
 	}
 
@@ -665,28 +787,48 @@ func (host *linuxHost) runScript(scriptName string) (err error) {
 	return nil
 }
 
-func (host *linuxHost) InquireDHCP() (dhcp networkControl.DHCP) {
-	// Scanning on the local machine only, so "accessDetails" is not supported, yet
-	if host.accessDetails != nil {
-		panic(errNotImplemented)
+func (host *linuxHost) InquireDHCP() networkControl.DHCP {
+	dhcp, err := host.getDHCP()
+	if err != nil {
+		host.LogError(err)
+	}
+	return dhcp
+}
+func (host *linuxHost) getDHCP() (networkControl.DHCP, error) {
+	if host.isDHCPDisabled {
+		return networkControl.DHCP(host.dhcpd.Config.Root), nil
+	}
+	if host.isRemote() {
+		return host.getRemoteDHCP()
 	}
 
 	err := host.dhcpd.ReloadConfig()
 	if err != nil && strings.Index(err.Error(), "no such file or directory") == -1 {
-		panic(err)
+		return networkControl.DHCP{}, err
 	}
-	return networkControl.DHCP(host.dhcpd.Config.Root)
+	return networkControl.DHCP(host.dhcpd.Config.Root), nil
 }
 func (host *linuxHost) InquireBridgedVLANs() networkControl.VLANs {
-	// Scanning on the local machine only, so "accessDetails" is not supported, yet
-	if host.accessDetails != nil {
-		panic(errNotImplemented)
+	vlans, err := host.getBridgedVLANs()
+	if err != nil {
+		host.LogError(err)
 	}
-
-	return host.inquireBridgedVLANs(netTree.GetTree().ToSlice())
+	return vlans
+}
+func (host *linuxHost) getBridgedVLANs() (networkControl.VLANs, error) {
+	ifaces, err := host.getLinkTree()
+	if err != nil {
+		return nil, err
+	}
+	return host.inquireBridgedVLANs(ifaces), nil
 }
 func (host *linuxHost) InquireBridgedVLAN(vlanId int) *networkControl.VLAN {
-	vlans := host.inquireBridgedVLANs(netTree.GetTree().ToSlice(), vlanId)
+	ifaces, err := host.getLinkTree()
+	if err != nil {
+		host.LogError(err)
+		return nil
+	}
+	vlans := host.inquireBridgedVLANs(ifaces, vlanId)
 
 	for _, vlan := range vlans {
 		if vlan.VlanId != vlanId {
@@ -741,14 +883,13 @@ func (host *linuxHost) inquireBridgedVLANs(ifaces netTree.Nodes, filterVlanIds .
 		}
 
 		// IP-addresses
-		ips := networkControl.IPNets{}
-		addrs, err := host.netlink.AddrList(childLink, netlink.FAMILY_V4)
+		ips, err := host.getAddrs(childLink)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Got an error from netlink.AddrList(link<%v>, netlink.FAMILY_V4): %v", childLink.LinkAttrs.Name, err.Error())
+			fmt.Fprintf(os.Stderr, "Got an error from getAddrs(link<%v>): %v", childLink.LinkAttrs.Name, err.Error())
 			//panic(err)
 		}
-		for _, addr := range addrs {
-			ips = append(ips, networkControl.IPNet(*addr.Peer))
+		if ips == nil {
+			ips = networkControl.IPNets{}
 		}
 
 		ifName := host.LinuxIfNameToIfName(childLink.Name)
@@ -801,10 +942,20 @@ func parseIP(words []string) (ip net.IP, newWords []string) {
 	return
 }
 
-func (host *linuxHost) InquireRoutes() (result networkControl.Routes) {
-	outB, err := exec.Command("ip", "route", "show", "table", "fwsm").Output()
+func (host *linuxHost) InquireRoutes() networkControl.Routes {
+	routes, err := host.getRoutes()
 	if err != nil {
-		panic(err)
+		host.LogError(err)
+	}
+	return routes
+}
+func (host *linuxHost) getRoutes() (result networkControl.Routes, err error) {
+	outB, err := host.runCommand(nil, "ip", "route", "show", "table", "fwsm")
+	if err != nil {
+		if strings.Contains(err.Error(), "FIB table does not exist") { // there were no routes in the table yet
+			return nil, nil
+		}
+		return nil, err
 	}
 	out := string(outB)
 	lines := strings.Split(out, "\n")
@@ -836,9 +987,12 @@ func (host *linuxHost) InquireRoutes() (result networkControl.Routes) {
 				words = words[2:]
 			case "metric":
 				route.Metric, err = strconv.Atoi(words[1])
+				if err != nil {
+					return nil, err
+				}
 				words = words[2:]
 			default:
-				panic("unknown word: \"" + words[0] + "\"")
+				return nil, fmt.Errorf("unknown word in the output of \"ip route\": \"%v\"", words[0])
 			}
 		}
 		if len(route.Sources) == 0 {
@@ -852,7 +1006,7 @@ func (host *linuxHost) InquireRoutes() (result networkControl.Routes) {
 		host.Infof("host.InquireRoutes() route: %v", *route)
 	}
 
-	return
+	return result, nil
 }
 
 func (host *linuxHost) RescanState() error {
@@ -860,20 +1014,47 @@ func (host *linuxHost) RescanState() error {
 	oldIgnoredState.CopyIgnoredFrom(host.States.Cur)
 
 	host.Debugf("rescanning the state: vlans")
-	host.States.Cur.BridgedVLANs = host.InquireBridgedVLANs()
+	vlans, err := host.getBridgedVLANs()
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
 	host.Debugf("rescanning the state: dhcp")
-	host.States.Cur.DHCP = host.InquireDHCP()
+	dhcp, err := host.getDHCP()
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
+	host.Debugf("rescanning the state: routes")
+	routes, err := host.getRoutes()
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
+	if firewall, ok := host.GetFirewall().(networkControl.RescanFirewallI); ok {
+		host.Debugf("rescanning the state: firewall")
+		err = firewall.Rescan()
+		if err != nil {
+			host.LogError(err)
+			return err
+		}
+	}
+	host.States.Cur.BridgedVLANs = vlans
+	host.States.Cur.DHCP = dhcp
+	host.States.Cur.Routes = routes
 	host.Debugf("rescanning the state: acls")
 	host.States.Cur.ACLs = host.InquireACLs()
 	host.Debugf("rescanning the state: snats")
 	host.States.Cur.SNATs = host.InquireSNATs()
 	host.Debugf("rescanning the state: dnats")
 	host.States.Cur.DNATs = host.InquireDNATs()
-	host.Debugf("rescanning the state: routes")
-	host.States.Cur.Routes = host.InquireRoutes()
+	host.Debugf("rescanning the state: same-security-traffic")
+	host.States.Cur.PermitInterInterface = host.GetFirewall().InquirePermitInterInterface()
+	host.States.Cur.PermitIntraInterface = host.GetFirewall().InquirePermitIntraInterface()
 	host.Debugf("end of rescanning the state")
 
 	host.States.Cur.CopyIgnoredFrom(oldIgnoredState)
+	host.TagOwnership()
 	return nil
 }
 func (host *linuxHost) SetDHCPState(state networkControl.DHCP) error {
@@ -882,7 +1063,53 @@ func (host *linuxHost) SetDHCPState(state networkControl.DHCP) error {
 }
 
 type netConfigT struct {
-	VLANs networkControl.VLANs
+	VLANs   networkControl.VLANs
+	Managed networkControl.ManagedObjects // nil if the config was saved by an older version
+}
+
+// loadManagedObjects loads the registry of managed objects saved by SaveToDisk() (if any)
+func (host *linuxHost) loadManagedObjects() error {
+	if !host.isFileExist(NETCONTOL_CONFIG_PATH) {
+		return nil
+	}
+	plan, err := host.readFile(NETCONTOL_CONFIG_PATH)
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
+	netConfig := netConfigT{}
+	err = json.Unmarshal(plan, &netConfig)
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
+	host.Managed = netConfig.Managed
+	return nil
+}
+
+// SaveManagedObjects writes the registry of managed objects to the config of SaveToDisk() (the saved VLANs are kept)
+func (host *linuxHost) SaveManagedObjects() error {
+	netConfig := netConfigT{}
+	if host.isFileExist(NETCONTOL_CONFIG_PATH) {
+		plan, err := host.readFile(NETCONTOL_CONFIG_PATH)
+		if err != nil {
+			host.LogError(err)
+			return err
+		}
+		err = json.Unmarshal(plan, &netConfig)
+		if err != nil {
+			host.LogError(err)
+			return err
+		}
+	}
+	netConfig.Managed = host.Managed
+	netConfigJson, _ := json.MarshalIndent(netConfig, "", " ")
+	err := host.writeFile(NETCONTOL_CONFIG_PATH, netConfigJson)
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
+	return nil
 }
 
 func (host *linuxHost) SaveToDisk() (err error) { // ATM, works only with Debian with preinstalled packages: "iproute2", "iptables" and "ipset"!
@@ -893,8 +1120,9 @@ func (host *linuxHost) SaveToDisk() (err error) { // ATM, works only with Debian
 	{
 		netConfig := netConfigT{}
 		netConfig.VLANs = host.States.Cur.BridgedVLANs
+		netConfig.Managed = host.Managed
 		netConfigJson, _ := json.MarshalIndent(netConfig, "", " ")
-		err = ioutil.WriteFile(NETCONTOL_CONFIG_PATH, netConfigJson, 0644)
+		err = host.writeFile(NETCONTOL_CONFIG_PATH, netConfigJson)
 		if err != nil {
 			host.LogError(err)
 			return err
@@ -903,28 +1131,41 @@ func (host *linuxHost) SaveToDisk() (err error) { // ATM, works only with Debian
 
 	// routes
 
-	_, err = exec.Command("sh", "-c", "ip rule save > /etc/iproute.rules").Output()
+	err = host.saveCommandOutput("/etc/iproute.rules", "ip", "rule", "save")
 	if err != nil {
 		host.LogWarning(err)
 	}
-	_, err = exec.Command("sh", "-c", "ip route save > /etc/iproute.routes").Output()
+	err = host.saveCommandOutput("/etc/iproute.routes", "ip", "route", "save")
 	if err != nil {
 		host.LogWarning(err)
 	}
 
 	// dhcp
 
-	host.Debugf("linuxHost.SaveToDisk(): DHCP == %v (new: %v; old: %v)", host.States.Cur.DHCP, host.States.New.DHCP, host.States.Old.DHCP)
-	host.SetDHCPState(host.States.Cur.DHCP)
-	err = host.dhcpd.SaveConfig()
-	if err != nil {
-		host.LogError(err)
-		return err
+	if !host.isDHCPDisabled {
+		host.Debugf("linuxHost.SaveToDisk(): DHCP == %v (new: %v; old: %v)", host.States.Cur.DHCP, host.States.New.DHCP, host.States.Old.DHCP)
+		host.SetDHCPState(host.States.Cur.DHCP)
+		err = host.saveDHCPConfig()
+		if err != nil {
+			host.LogError(err)
+			return err
+		}
 	}
 
-	// iptables
+	// iptables/nftables
 
-	_, err = exec.Command("sh", "-c", "iptables-save > /etc/iptables/fwsm.rules").Output()
+	switch host.firewallBackend {
+	case FIREWALL_IPTABLES:
+		err = host.saveCommandOutput(IPTABLES_RULES_PATH, "iptables-save")
+	case FIREWALL_NFTABLES:
+		// "table" + "delete table" makes the file replace the table atomically on "nft -f" (whether it exists or not)
+		table := "table ip " + nftables.TABLE_NAME
+		var out []byte
+		out, err = host.runCommand(nil, "nft", "list", "table", "ip", nftables.TABLE_NAME)
+		if err == nil {
+			err = host.writeFile(NFTABLES_RULES_PATH, append([]byte(table+"\ndelete "+table+"\n"), out...))
+		}
+	}
 	if err != nil {
 		host.LogError(err)
 		return err
@@ -932,7 +1173,7 @@ func (host *linuxHost) SaveToDisk() (err error) { // ATM, works only with Debian
 
 	// ipset
 
-	_, err = exec.Command("ipset", "save", "-file", "/etc/ipset-fwsm.dump").Output()
+	err = host.saveCommandOutput("/etc/ipset-fwsm.dump", "ipset", "save")
 	if err != nil {
 		host.LogError(err)
 		return err
@@ -942,34 +1183,55 @@ func (host *linuxHost) SaveToDisk() (err error) { // ATM, works only with Debian
 
 	return nil
 }
+
+// saveCommandOutput writes the output of the command to the file of the host
+func (host *linuxHost) saveCommandOutput(path string, name string, args ...string) error {
+	out, err := host.runCommand(nil, name, args...)
+	if err != nil {
+		return err
+	}
+	return host.writeFile(path, out)
+}
+
 func (host *linuxHost) RestoreFromDisk() error { // ATM, works only with Debian with preinstalled packages: "iproute2", "iptables" and "ipset"!
 	host.RescanState()
 
 	// ipset
 
-	if _, err := os.Stat("/etc/ipset-fwsm.dump"); err == nil {
+	if input, err := host.readFile("/etc/ipset-fwsm.dump"); err == nil {
 		host.Debugf("restoring from disk: ipset")
-		_, err := exec.Command("ipset", "restore", "-file", "/etc/ipset-fwsm.dump").Output()
+		_, err := host.runCommand(input, "ipset", "restore")
 		if err != nil {
-			host.LogWarning(err, "ipset", "restore", "-file", "/etc/ipset-fwsm.dump")
+			host.LogWarning(err, "ipset", "restore", "/etc/ipset-fwsm.dump")
 		}
 	}
 
-	// iptables
+	// iptables/nftables
 
-	if _, err := os.Stat("/etc/iptables/fwsm.rules"); err == nil {
-		host.Debugf("restoring from disk: iptables")
-		_, err := exec.Command("iptables-restore", "/etc/iptables/fwsm.rules").Output()
-		if err != nil {
-			host.LogWarning(err, "iptables-restore", "/etc/iptables/fwsm.rules")
+	switch host.firewallBackend {
+	case FIREWALL_IPTABLES:
+		if input, err := host.readFile(IPTABLES_RULES_PATH); err == nil {
+			host.Debugf("restoring from disk: iptables")
+			_, err := host.runCommand(input, "iptables-restore")
+			if err != nil {
+				host.LogWarning(err, "iptables-restore", IPTABLES_RULES_PATH)
+			}
+		}
+	case FIREWALL_NFTABLES:
+		if input, err := host.readFile(NFTABLES_RULES_PATH); err == nil {
+			host.Debugf("restoring from disk: nftables")
+			_, err := host.runCommand(input, "nft", "-f", "-")
+			if err != nil {
+				host.LogWarning(err, "nft", "-f", NFTABLES_RULES_PATH)
+			}
 		}
 	}
 
 	// vlans
 
-	if _, err := os.Stat(NETCONTOL_CONFIG_PATH); err == nil {
+	if host.isFileExist(NETCONTOL_CONFIG_PATH) {
 		host.Debugf("restoring from disk: vlans")
-		plan, err := ioutil.ReadFile(NETCONTOL_CONFIG_PATH)
+		plan, err := host.readFile(NETCONTOL_CONFIG_PATH)
 		if err != nil {
 			host.LogError(err)
 			return err
@@ -980,6 +1242,9 @@ func (host *linuxHost) RestoreFromDisk() error { // ATM, works only with Debian
 			host.LogError(err)
 			return err
 		}
+		if netConfig.Managed != nil {
+			host.Managed = netConfig.Managed
+		}
 		host.States.New = host.States.Cur
 		host.States.New.BridgedVLANs = netConfig.VLANs
 		err = host.Apply()
@@ -991,26 +1256,26 @@ func (host *linuxHost) RestoreFromDisk() error { // ATM, works only with Debian
 
 	// routes
 
-	if _, err := os.Stat("/etc/iproute.rules"); err == nil {
+	if input, err := host.readFile("/etc/iproute.rules"); err == nil {
 		host.Debugf("restoring from disk: routes rules")
-		exec.Command("ip", "rule", "flush").Output()
-		exec.Command("ip", "rule", "del", "0").Output()
-		exec.Command("ip", "rule", "del", "0").Output()
-		exec.Command("ip", "rule", "del", "32766").Output()
-		exec.Command("ip", "rule", "del", "32766").Output()
-		exec.Command("ip", "rule", "del", "32767").Output()
-		exec.Command("ip", "rule", "del", "32767").Output()
-		_, err := exec.Command("sh", "-c", "ip rule restore < /etc/iproute.rules").Output()
+		host.runCommand(nil, "ip", "rule", "flush")
+		host.runCommand(nil, "ip", "rule", "del", "0")
+		host.runCommand(nil, "ip", "rule", "del", "0")
+		host.runCommand(nil, "ip", "rule", "del", "32766")
+		host.runCommand(nil, "ip", "rule", "del", "32766")
+		host.runCommand(nil, "ip", "rule", "del", "32767")
+		host.runCommand(nil, "ip", "rule", "del", "32767")
+		_, err := host.runCommand(input, "ip", "rule", "restore")
 		if err != nil {
 			host.LogWarning(err)
 		}
-		exec.Command("ip", "rule", "add", "from", "all", "lookup", "local", "priority", "0").Output()
-		exec.Command("ip", "rule", "add", "from", "all", "lookup", "main", "priority", "32766").Output()
-		exec.Command("ip", "rule", "add", "from", "all", "lookup", "default", "priority", "32767").Output()
+		host.runCommand(nil, "ip", "rule", "add", "from", "all", "lookup", "local", "priority", "0")
+		host.runCommand(nil, "ip", "rule", "add", "from", "all", "lookup", "main", "priority", "32766")
+		host.runCommand(nil, "ip", "rule", "add", "from", "all", "lookup", "default", "priority", "32767")
 	}
-	if _, err := os.Stat("/etc/iproute.routes"); err == nil {
+	if input, err := host.readFile("/etc/iproute.routes"); err == nil {
 		host.Debugf("restoring from disk: routes")
-		_, err := exec.Command("sh", "-c", "ip route restore < /etc/iproute.routes").Output()
+		_, err := host.runCommand(input, "ip", "route", "restore")
 		if err != nil {
 			host.LogWarning(err, "ip route restore < /etc/iproute.routes")
 		}
@@ -0,0 +1,67 @@
+package linuxHost
+
+// A host could manage another network namespace (see Options.NetNS): netlink requests are sent
+// by a handle of the namespace and the external commands are run in it by nsenter (see
+// NewRealExecutor()).
+
+import (
+	"path/filepath"
+
+	"github.com/vishvananda/netlink"
+	"github.com/xaionaro-go/netTree"
+)
+
+func (host *linuxHost) isInNetNS() bool {
+	return host.netNS.IsOpen()
+}
+
+func (host *linuxHost) newNetlinkHandle() (*netlink.Handle, error) {
+	if !host.isInNetNS() {
+		return netlink.NewHandle()
+	}
+	return netlink.NewHandleAt(host.netNS)
+}
+
+// path returns the path of a file of the host (see Options.RootPath)
+func (host *linuxHost) path(path string) string {
+	if host.rootPath == "" {
+		return path
+	}
+	return filepath.Join(host.rootPath, path)
+}
+
+// runCommand runs an external command by the executor of the host with "input" as stdin and returns its stdout
+func (host *linuxHost) runCommand(input []byte, name string, args ...string) ([]byte, error) {
+	return host.executor.Run(input, name, args...)
+}
+
+// getLinkTree returns the interfaces of the host: a VLAN interface has its bridge as the child
+// (netTree.GetTree() reads the interfaces of the namespace of the process only)
+func (host *linuxHost) getLinkTree() (netTree.Nodes, error) {
+	if host.isInquiredByExecutor() {
+		return host.getRemoteLinkTree()
+	}
+	if !host.isInNetNS() {
+		return netTree.GetTree().ToSlice(), nil
+	}
+	links, err := host.netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	nodes := map[int]*netTree.Node{}
+	result := netTree.Nodes{}
+	for _, link := range links {
+		node := &netTree.Node{Link: link}
+		nodes[link.Attrs().Index] = node
+		result = append(result, node)
+	}
+	for _, link := range links {
+		master := nodes[link.Attrs().MasterIndex]
+		if master == nil {
+			continue
+		}
+		node := nodes[link.Attrs().Index]
+		node.Children = append(node.Children, master)
+	}
+	return result, nil
+}
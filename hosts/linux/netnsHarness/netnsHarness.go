@@ -0,0 +1,339 @@
+package netnsHarness
+
+// An end-to-end test harness of linuxHost which doesn't touch the real machine: the host manages a
+// throwaway network namespace with a dummy "trunk" interface, the files of the host are written to a
+// temporary directory and dhcpd is not managed.
+//
+// The harness is the reference test suite of the linux backend, it should be run as root:
+//
+//	harness, err := netnsHarness.New(linuxHost.FIREWALL_IPTABLES)
+//	...
+//	defer harness.Close()
+//	err = harness.Run()
+//
+// NewOverSSH() creates the harness of a remote host: the host manages the namespace over SSH (by the
+// server of sshStandIn), only the iptables backend is supported.
+//
+// Requirements: the routing table "fwsm" in /etc/iproute2/rt_tables (see README.md), nsenter and
+// the tools of the firewall backend (iptables or nftables).
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"github.com/xaionaro-go/networkControl"
+	"github.com/xaionaro-go/networkControl/hosts/linux"
+	"github.com/xaionaro-go/networkControl/hosts/linux/sshStandIn"
+)
+
+const (
+	TRUNK_NAME = "trunk"
+)
+
+var (
+	errNoFWSMTable = errors.New(`there's no routing table "fwsm" in /etc/iproute2/rt_tables (see README.md)`)
+)
+
+type Harness struct {
+	FirewallBackend linuxHost.FirewallBackend
+	NetNS           netns.NsHandle
+	RootPath        string
+	Host            networkControl.HostI
+
+	// SSHServer is the server the host is connected to (nil if the host is not remote, see NewOverSSH())
+	SSHServer *sshStandIn.Server
+
+	netlink *netlink.Handle
+}
+
+// New creates a network namespace with the dummy interface "trunk" and a linux host managing it
+func New(firewallBackend linuxHost.FirewallBackend) (harness *Harness, err error) {
+	return newHarness(firewallBackend, false)
+}
+
+// NewOverSSH is New() with the host managing the namespace as a remote host
+func NewOverSSH(firewallBackend linuxHost.FirewallBackend) (harness *Harness, err error) {
+	return newHarness(firewallBackend, true)
+}
+
+func newHarness(firewallBackend linuxHost.FirewallBackend, isOverSSH bool) (harness *Harness, err error) {
+	rtTables, err := ioutil.ReadFile("/etc/iproute2/rt_tables")
+	if err != nil || !strings.Contains(string(rtTables), "fwsm") {
+		return nil, errNoFWSMTable
+	}
+
+	harness = &Harness{FirewallBackend: firewallBackend, NetNS: netns.None()}
+	defer func() {
+		if err != nil {
+			harness.Close()
+			harness = nil
+		}
+	}()
+
+	harness.NetNS, err = newNetNS()
+	if err != nil {
+		return
+	}
+	harness.netlink, err = netlink.NewHandleAt(harness.NetNS)
+	if err != nil {
+		return
+	}
+	trunk := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: TRUNK_NAME}}
+	err = harness.netlink.LinkAdd(trunk)
+	if err != nil {
+		return
+	}
+	err = harness.netlink.LinkSetUp(trunk)
+	if err != nil {
+		return
+	}
+
+	harness.RootPath, err = ioutil.TempDir("", "networkControl-netnsHarness")
+	if err != nil {
+		return
+	}
+	for _, dir := range []string{linuxHost.SCRIPTS_PATH, "/etc/dhcp", "/etc/iptables", "/etc/nftables"} {
+		err = os.MkdirAll(filepath.Join(harness.RootPath, dir), 0755)
+		if err != nil {
+			return
+		}
+	}
+
+	options := linuxHost.Options{
+		FirewallBackend: firewallBackend,
+		NetNS:           harness.NetNS,
+		RootPath:        harness.RootPath,
+		DisableDHCP:     true,
+	}
+	if !isOverSSH {
+		harness.Host, err = linuxHost.NewHostWithOptions(nil, options)
+		return
+	}
+	harness.SSHServer, err = sshStandIn.New(harness.NetNS)
+	if err != nil {
+		return
+	}
+	accessDetails := harness.SSHServer.AccessDetails()
+	options.NetNS = netns.None()
+	harness.Host, err = linuxHost.NewHostWithOptions(&accessDetails, options)
+	return
+}
+
+// newNetNS creates a network namespace without entering it
+func newNetNS() (netns.NsHandle, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNetNS, err := netns.Get()
+	if err != nil {
+		return netns.None(), err
+	}
+	defer origNetNS.Close()
+
+	newNetNS, err := netns.New() // it switches the thread to the new namespace
+	if err != nil {
+		return netns.None(), err
+	}
+	err = netns.Set(origNetNS)
+	if err != nil {
+		newNetNS.Close()
+		return netns.None(), err
+	}
+	return newNetNS, nil
+}
+
+// Close removes the network namespace (with everything in it) and the temporary directory
+func (harness *Harness) Close() error {
+	if harness.SSHServer != nil {
+		harness.SSHServer.Close()
+		harness.SSHServer = nil
+	}
+	if harness.netlink != nil {
+		harness.netlink.Delete()
+		harness.netlink = nil
+	}
+	if harness.NetNS.IsOpen() {
+		harness.NetNS.Close()
+		harness.NetNS = netns.None()
+	}
+	if harness.RootPath != "" {
+		err := os.RemoveAll(harness.RootPath)
+		if err != nil {
+			return err
+		}
+		harness.RootPath = ""
+	}
+	return nil
+}
+
+// SampleState returns a state which uses every kind of objects supported by the linux backend
+func SampleState() networkControl.State {
+	mustIPNet := func(cidr string) networkControl.IPNet {
+		ipnet, err := networkControl.IPNetFromCIDRString(cidr)
+		if err != nil {
+			panic(err)
+		}
+		return ipnet
+	}
+	mustIPNetWithIP := func(cidr string) networkControl.IPNet {
+		ipnet := mustIPNet(cidr)
+		ipnet.IP = net.ParseIP(strings.Split(cidr, "/")[0]).To4()
+		return ipnet
+	}
+
+	return networkControl.State{
+		PermitInterInterface: true,
+		PermitIntraInterface: false,
+		BridgedVLANs: networkControl.VLANs{
+			10: &networkControl.VLAN{
+				Interface:     net.Interface{Name: "inside"},
+				VlanId:        10,
+				IPs:           networkControl.IPNets{mustIPNetWithIP("192.0.2.1/25")},
+				SecurityLevel: 100,
+			},
+			20: &networkControl.VLAN{
+				Interface:     net.Interface{Name: "outside"},
+				VlanId:        20,
+				IPs:           networkControl.IPNets{mustIPNetWithIP("192.0.2.129/25")},
+				SecurityLevel: 0,
+			},
+		},
+		ACLs: networkControl.ACLs{
+			&networkControl.ACL{
+				Name: "outside_in",
+				Rules: networkControl.ACLRules{
+					{
+						Action:   networkControl.ACL_ALLOW,
+						Protocol: networkControl.PROTO_TCP,
+						FromNet:  mustIPNet("0.0.0.0/0"),
+						ToNet:    mustIPNet("192.0.2.0/25"),
+					},
+				},
+				VLANNames: []string{"outside"},
+			},
+		},
+		Routes: networkControl.Routes{
+			&networkControl.Route{
+				Sources:     networkControl.IPNets{mustIPNet("0.0.0.0/0")},
+				Destination: mustIPNet("198.51.100.0/24"),
+				Gateway:     net.ParseIP("192.0.2.130").To4(),
+				Metric:      10,
+				IfName:      "outside",
+			},
+		},
+	}
+}
+
+// CheckRoundTrip applies the state, rescans it from the namespace and returns an error if they differ
+func (harness *Harness) CheckRoundTrip(state networkControl.State) error {
+	err := harness.Host.SetNewState(state)
+	if err != nil {
+		return err
+	}
+	err = harness.Host.Apply()
+	if err != nil {
+		return fmt.Errorf("cannot apply the state: %v", err)
+	}
+	err = harness.Host.RescanState()
+	if err != nil {
+		return fmt.Errorf("cannot rescan the state: %v", err)
+	}
+	differences := describeDiff(state.Diff(harness.Host.GetCurState()))
+	if len(differences) > 0 {
+		return fmt.Errorf("the rescanned state differs from the applied one: %v", strings.Join(differences, "; "))
+	}
+	return nil
+}
+
+// describeDiff returns the differences of the states (DHCP is not compared, it's not managed by the harness)
+func describeDiff(diff networkControl.StateDiff) (result []string) {
+	for _, part := range []struct {
+		name  string
+		state networkControl.State
+	}{{"added", diff.Added}, {"updated", diff.Updated}, {"removed", diff.Removed}} {
+		for _, vlan := range part.state.BridgedVLANs {
+			result = append(result, fmt.Sprintf("%v VLAN %v", part.name, *vlan))
+		}
+		for _, acl := range part.state.ACLs {
+			result = append(result, fmt.Sprintf("%v ACL %v", part.name, *acl))
+		}
+		for _, snat := range part.state.SNATs {
+			result = append(result, fmt.Sprintf("%v SNAT %v", part.name, *snat))
+		}
+		for _, dnat := range part.state.DNATs {
+			result = append(result, fmt.Sprintf("%v DNAT %v", part.name, *dnat))
+		}
+		for _, route := range part.state.Routes {
+			result = append(result, fmt.Sprintf("%v route %v", part.name, *route))
+		}
+	}
+	return
+}
+
+// Run runs the suite: the sample state is applied, changed, saved and restored and finally everything is removed
+func (harness *Harness) Run() (err error) {
+	defer func() { // the host panics on some errors
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	state := SampleState()
+	err = harness.CheckRoundTrip(state)
+	if err != nil {
+		return fmt.Errorf("apply: %v", err)
+	}
+	if harness.Host.GetCurState().PermitInterInterface != state.PermitInterInterface || harness.Host.GetCurState().PermitIntraInterface != state.PermitIntraInterface {
+		return fmt.Errorf("apply: same-security-traffic settings differ: %+v", harness.Host.GetCurState())
+	}
+
+	updatedState := SampleState()
+	updatedState.BridgedVLANs[20].SecurityLevel = 50
+	updatedState.ACLs = nil
+	updatedState.PermitIntraInterface = true
+	err = harness.CheckRoundTrip(updatedState)
+	if err != nil {
+		return fmt.Errorf("update: %v", err)
+	}
+
+	err = harness.Host.Save()
+	if err != nil {
+		return fmt.Errorf("save: %v", err)
+	}
+	err = harness.Host.RestoreFromDisk()
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+	differences := describeDiff(updatedState.Diff(harness.Host.GetCurState()))
+	if len(differences) > 0 {
+		return fmt.Errorf("restore: the restored state differs from the saved one: %v", strings.Join(differences, "; "))
+	}
+
+	err = harness.CheckRoundTrip(networkControl.State{})
+	if err != nil {
+		return fmt.Errorf("removal: %v", err)
+	}
+
+	_, err = harness.Host.Teardown(networkControl.TeardownOptions{})
+	if err != nil {
+		return fmt.Errorf("teardown: %v", err)
+	}
+	links, err := harness.netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if link.Attrs().Name != TRUNK_NAME && link.Attrs().Name != "lo" {
+			return fmt.Errorf("teardown: link %v is left", link.Attrs().Name)
+		}
+	}
+	return nil
+}
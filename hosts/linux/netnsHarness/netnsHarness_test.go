@@ -0,0 +1,47 @@
+package netnsHarness
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/xaionaro-go/networkControl/hosts/linux"
+)
+
+func TestHarness(t *testing.T) {
+	for _, testCase := range []struct {
+		name            string
+		firewallBackend linuxHost.FirewallBackend
+		isOverSSH       bool
+		tools           []string
+	}{
+		{"iptables", linuxHost.FIREWALL_IPTABLES, false, []string{"iptables-save", "iptables-restore"}},
+		{"nftables", linuxHost.FIREWALL_NFTABLES, false, []string{"nft"}},
+		{"iptables over SSH", linuxHost.FIREWALL_IPTABLES, true, []string{"iptables-save", "iptables-restore"}},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			if os.Geteuid() != 0 {
+				t.Skip("the harness creates network namespaces, it should be run as root")
+			}
+			for _, tool := range append([]string{"ip", "nsenter"}, testCase.tools...) {
+				if _, err := exec.LookPath(tool); err != nil {
+					t.Skipf("%v is not installed", tool)
+				}
+			}
+
+			harness, err := newHarness(testCase.firewallBackend, testCase.isOverSSH)
+			if err == errNoFWSMTable {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer harness.Close()
+
+			err = harness.Run()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package linuxHost
+
+// The state of a remote host is inquired by "ip -json" (iproute2 >= 4.14) instead of netlink and its
+// files are read and written by the executor. The links and addresses of a local host with an
+// executor (see Options.Executor) are inquired the same way.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/xaionaro-go/iscDhcp/cfg"
+	"github.com/xaionaro-go/netTree"
+	"github.com/xaionaro-go/networkControl"
+)
+
+const (
+	DHCP_RESTART_COMMAND = "service isc-dhcp-server restart"
+	DHCP_STOP_COMMAND    = "service isc-dhcp-server stop"
+)
+
+var (
+	errRemoteNFTables   = errors.New("the nftables firewall cannot manage a remote host (it needs netlink)")
+	errExecutorNFTables = errors.New("the nftables firewall cannot be used with an executor (it sends netlink requests by itself)")
+)
+
+func (host *linuxHost) isRemote() bool {
+	return host.accessDetails != nil
+}
+
+// isInquiredByExecutor returns true if the links and addresses are inquired by "ip -json" run by the
+// executor instead of netlink (the host has no netlink handle)
+func (host *linuxHost) isInquiredByExecutor() bool {
+	return host.netlink == nil
+}
+
+type ipLinkJSON struct {
+	IfIndex  int    `json:"ifindex"`
+	IfName   string `json:"ifname"`
+	MTU      int    `json:"mtu"`
+	Address  string `json:"address"`
+	Master   string `json:"master"`
+	LinkInfo struct {
+		InfoKind string          `json:"info_kind"`
+		InfoData json.RawMessage `json:"info_data"` // the format depends on the kind
+	} `json:"linkinfo"`
+}
+
+type ipVLANInfoJSON struct {
+	Id int `json:"id"`
+}
+
+type ipAddrJSON struct {
+	AddrInfo []struct {
+		Family    string `json:"family"`
+		Local     string `json:"local"`
+		PrefixLen int    `json:"prefixlen"`
+	} `json:"addr_info"`
+}
+
+// getRemoteLinkTree is getLinkTree() of a remote host (or of a host with an executor)
+func (host *linuxHost) getRemoteLinkTree() (netTree.Nodes, error) {
+	out, err := host.runCommand(nil, "ip", "-json", "-details", "link", "show")
+	if err != nil {
+		return nil, err
+	}
+	var ipLinks []ipLinkJSON
+	err = json.Unmarshal(out, &ipLinks)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := map[string]*netTree.Node{}
+	result := netTree.Nodes{}
+	for _, ipLink := range ipLinks {
+		attrs := netlink.LinkAttrs{Index: ipLink.IfIndex, Name: ipLink.IfName, MTU: ipLink.MTU}
+		attrs.HardwareAddr, _ = net.ParseMAC(ipLink.Address)
+		var link netlink.Link
+		switch ipLink.LinkInfo.InfoKind {
+		case "vlan":
+			var vlanInfo ipVLANInfoJSON
+			err = json.Unmarshal(ipLink.LinkInfo.InfoData, &vlanInfo)
+			if err != nil {
+				return nil, err
+			}
+			link = &netlink.Vlan{LinkAttrs: attrs, VlanId: vlanInfo.Id}
+		case "bridge":
+			link = &netlink.Bridge{LinkAttrs: attrs}
+		default:
+			link = &netlink.Device{LinkAttrs: attrs}
+		}
+		node := &netTree.Node{Link: link}
+		nodes[ipLink.IfName] = node
+		result = append(result, node)
+	}
+	for _, ipLink := range ipLinks {
+		master := nodes[ipLink.Master]
+		if master == nil {
+			continue
+		}
+		node := nodes[ipLink.IfName]
+		node.Link.Attrs().MasterIndex = master.Link.Attrs().Index
+		node.Children = append(node.Children, master)
+	}
+	return result, nil
+}
+
+// getAddrs returns the IPv4 addresses of the link
+func (host *linuxHost) getAddrs(link netlink.Link) (result networkControl.IPNets, err error) {
+	if !host.isInquiredByExecutor() {
+		addrs, err := host.netlink.AddrList(link, netlink.FAMILY_V4)
+		for _, addr := range addrs {
+			result = append(result, networkControl.IPNet(*addr.Peer))
+		}
+		return result, err
+	}
+
+	out, err := host.runCommand(nil, "ip", "-json", "-4", "addr", "show", "dev", link.Attrs().Name)
+	if err != nil {
+		return nil, err
+	}
+	var ipAddrs []ipAddrJSON
+	err = json.Unmarshal(out, &ipAddrs)
+	if err != nil {
+		return nil, err
+	}
+	for _, ipAddr := range ipAddrs {
+		for _, addrInfo := range ipAddr.AddrInfo {
+			if addrInfo.Family != "inet" {
+				continue
+			}
+			result = append(result, networkControl.IPNet{IP: net.ParseIP(addrInfo.Local).To4(), Mask: net.CIDRMask(addrInfo.PrefixLen, 32)})
+		}
+	}
+	return result, nil
+}
+
+// readFile reads a file of the host (see Options.RootPath)
+func (host *linuxHost) readFile(path string) ([]byte, error) {
+	if !host.isRemote() {
+		return ioutil.ReadFile(host.path(path))
+	}
+	return host.runCommand(nil, "cat", host.path(path))
+}
+
+// writeFile writes a file of the host (see Options.RootPath)
+func (host *linuxHost) writeFile(path string, data []byte) error {
+	if !host.isRemote() {
+		return ioutil.WriteFile(host.path(path), data, 0644)
+	}
+	_, err := host.runCommand(data, "sh", "-c", "cat > "+shellQuote(host.path(path)))
+	return err
+}
+
+// isFileExist returns true if the file of the host exists (see Options.RootPath)
+func (host *linuxHost) isFileExist(path string) bool {
+	if !host.isRemote() {
+		_, err := os.Stat(host.path(path))
+		return err == nil
+	}
+	_, err := host.runCommand(nil, "test", "-e", host.path(path))
+	return err == nil
+}
+
+// removeFile removes a file of the host (see Options.RootPath)
+func (host *linuxHost) removeFile(path string) error {
+	if !host.isRemote() {
+		return os.Remove(host.path(path))
+	}
+	_, err := host.runCommand(nil, "rm", host.path(path))
+	return err
+}
+
+// getRemoteDHCP reads dhcpd.conf of the remote host (iscDhcp reads the config on the local machine only)
+func (host *linuxHost) getRemoteDHCP() (networkControl.DHCP, error) {
+	root := cfg.NewRoot()
+	if host.isFileExist(DHCP_CONFIG_PATH) {
+		config, err := host.readFile(DHCP_CONFIG_PATH)
+		if err != nil {
+			return networkControl.DHCP{}, err
+		}
+		err = root.LoadFrom(bytes.NewReader(config))
+		if err != nil {
+			return networkControl.DHCP{}, err
+		}
+	}
+	host.dhcpd.Config.Root = *root
+	return networkControl.DHCP(*root), nil
+}
+
+// saveDHCPConfig writes the config of dhcpd (iscDhcp writes it on the local machine only, so the config
+// of a remote host is rendered by iscDhcp and written by the executor)
+func (host *linuxHost) saveDHCPConfig() error {
+	if !host.isRemote() {
+		return host.dhcpd.SaveConfig()
+	}
+	var config bytes.Buffer
+	err := host.dhcpd.Config.Root.ConfigWrite(&config)
+	if err != nil {
+		return err
+	}
+	return host.writeFile(DHCP_CONFIG_PATH, config.Bytes())
+}
+
+// stopDHCP stops dhcpd by the service command (iscDhcp cannot stop it)
+func (host *linuxHost) stopDHCP() error {
+	_, err := host.runCommand(nil, "sh", "-c", DHCP_STOP_COMMAND)
+	return err
+}
+
+func (host *linuxHost) restartDHCP() error {
+	if !host.isRemote() {
+		return host.dhcpd.Restart()
+	}
+	_, err := host.runCommand(nil, "sh", "-c", DHCP_RESTART_COMMAND)
+	return err
+}
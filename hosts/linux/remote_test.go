@@ -0,0 +1,28 @@
+package linuxHost
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewHostUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close() // nothing listens on the port
+
+	host, err := NewHostE(&AccessDetails{Host: "127.0.0.1", Post: port, Password: "password", Timeout: time.Second})
+	if err == nil {
+		t.Fatalf("an error is expected, got the host: %v", host)
+	}
+
+	options := DefaultOptions()
+	options.FirewallBackend = FIREWALL_NFTABLES
+	_, err = NewHostWithOptions(&AccessDetails{Host: "127.0.0.1", Post: port}, options)
+	if err != errRemoteNFTables {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
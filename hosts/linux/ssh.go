@@ -0,0 +1,156 @@
+package linuxHost
+
+// A remote host (see AccessDetails) is managed over SSH: the commands are run by the shell of the
+// remote user (it should be root) and netlink requests are replaced by the equivalent "ip" commands.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	errNoHostKeyCallback = errors.New("AccessDetails.HostKeyCallback is not set and the known hosts cannot be read")
+)
+
+// sshExecutor is the executor of a remote host, it connects on the first call
+type sshExecutor struct {
+	accessDetails AccessDetails
+	debugf        func(fmt string, args ...interface{})
+
+	locker sync.Mutex
+	client *ssh.Client
+}
+
+// NewSSHExecutor returns the executor which makes the changes on the remote host over SSH. It's the
+// default executor of a host with AccessDetails.
+func NewSSHExecutor(accessDetails AccessDetails) Executor {
+	return newSSHExecutor(accessDetails, func(string, ...interface{}) {})
+}
+
+func newSSHExecutor(accessDetails AccessDetails, debugf func(fmt string, args ...interface{})) *sshExecutor {
+	if accessDetails.Post == 0 {
+		accessDetails.Post = 22
+	}
+	if accessDetails.Username == "" {
+		accessDetails.Username = "root"
+	}
+	return &sshExecutor{accessDetails: accessDetails, debugf: debugf}
+}
+
+// knownHostsCallback verifies the host keys by ~/.ssh/known_hosts of the user
+func knownHostsCallback() (ssh.HostKeyCallback, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return knownhosts.New(filepath.Join(homeDir, ".ssh", "known_hosts"))
+}
+
+func (executor *sshExecutor) dial() (*ssh.Client, error) {
+	accessDetails := executor.accessDetails
+	hostKeyCallback := accessDetails.HostKeyCallback
+	if hostKeyCallback == nil {
+		var err error
+		hostKeyCallback, err = knownHostsCallback()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", errNoHostKeyCallback, err)
+		}
+	}
+	auth := []ssh.AuthMethod{}
+	if len(accessDetails.Signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(accessDetails.Signers...))
+	}
+	if accessDetails.Password != "" {
+		auth = append(auth, ssh.Password(accessDetails.Password))
+	}
+	config := &ssh.ClientConfig{
+		User:            accessDetails.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         accessDetails.Timeout,
+	}
+	return ssh.Dial("tcp", net.JoinHostPort(accessDetails.Host, strconv.Itoa(accessDetails.Post)), config)
+}
+
+// newSession opens a session; the connection is reestablished if it's broken
+func (executor *sshExecutor) newSession() (*ssh.Session, error) {
+	executor.locker.Lock()
+	defer executor.locker.Unlock()
+
+	if executor.client != nil {
+		session, err := executor.client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		executor.debugf("linuxHost: reconnecting to %v: %v", executor.accessDetails.Host, err)
+		executor.client.Close()
+		executor.client = nil
+	}
+
+	client, err := executor.dial()
+	if err != nil {
+		return nil, err
+	}
+	executor.client = client
+	return client.NewSession()
+}
+
+func (executor *sshExecutor) Run(input []byte, name string, args ...string) ([]byte, error) {
+	session, err := executor.newSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	if input != nil {
+		session.Stdin = bytes.NewReader(input)
+	}
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(shellQuote(append([]string{name}, args...)...))
+	if err != nil {
+		return stdout.Bytes(), fmt.Errorf("%v %v: %v: %v", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (executor *sshExecutor) Netlink(request NetlinkRequest) error {
+	_, err := executor.Run(nil, "ip", request.IPArgs()...)
+	if err != nil && strings.Contains(err.Error(), "File exists") {
+		return syscall.EEXIST // the same error as of netlink (the callers check it)
+	}
+	return err
+}
+
+// Close closes the connection (the next call reconnects)
+func (executor *sshExecutor) Close() error {
+	executor.locker.Lock()
+	defer executor.locker.Unlock()
+	if executor.client == nil {
+		return nil
+	}
+	err := executor.client.Close()
+	executor.client = nil
+	return err
+}
+
+// shellQuote returns the command line for a POSIX shell
+func shellQuote(words ...string) string {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		quoted = append(quoted, "'"+strings.Replace(word, "'", `'\''`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,203 @@
+package sshStandIn
+
+// A minimal SSH server to test the management of a remote linux host without a container: it
+// listens on 127.0.0.1, accepts the password of AccessDetails() and runs the commands by "sh -c"
+// (in the network namespace, if it's set):
+//
+//	server, err := sshStandIn.New(netNS)
+//	...
+//	defer server.Close()
+//	accessDetails := server.AccessDetails()
+//	host, err := linuxHost.NewHostWithOptions(&accessDetails, options)
+//
+// Only "exec" requests are supported (no shells, no port forwarding).
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netns"
+	"github.com/xaionaro-go/networkControl/hosts/linux"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	USERNAME = "root"
+)
+
+var (
+	errWrongPassword = errors.New("wrong password")
+)
+
+type Server struct {
+	NetNS netns.NsHandle
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+	password string
+
+	waitGroup sync.WaitGroup
+}
+
+// New starts the server; the commands are run in the network namespace (netns.None() means the
+// namespace of the process)
+func New(netNS netns.NsHandle) (*Server, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	passwordBytes := make([]byte, 16)
+	_, err = rand.Read(passwordBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		NetNS:    netNS,
+		hostKey:  signer.PublicKey(),
+		password: hex.EncodeToString(passwordBytes),
+	}
+	server.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() != USERNAME || string(password) != server.password {
+				return nil, errWrongPassword
+			}
+			return nil, nil
+		},
+	}
+	server.config.AddHostKey(signer)
+
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server.waitGroup.Add(1)
+	go server.serve()
+	return server, nil
+}
+
+// AccessDetails returns the details to connect to the server (with the host key verification)
+func (server *Server) AccessDetails() linuxHost.AccessDetails {
+	addr := server.listener.Addr().(*net.TCPAddr)
+	return linuxHost.AccessDetails{
+		Host:            addr.IP.String(),
+		Post:            addr.Port,
+		Username:        USERNAME,
+		Password:        server.password,
+		HostKeyCallback: ssh.FixedHostKey(server.hostKey),
+	}
+}
+
+// Close stops accepting new connections
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	server.waitGroup.Wait()
+	return err
+}
+
+func (server *Server) serve() {
+	defer server.waitGroup.Done()
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handleConn(conn)
+	}
+}
+
+func (server *Server) handleConn(conn net.Conn) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, server.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go server.handleSession(channel, channelRequests)
+	}
+}
+
+func (server *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		err := ssh.Unmarshal(request.Payload, &payload)
+		if err != nil {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+
+		exitStatus := server.run(channel, payload.Command)
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, exitStatus)
+		channel.SendRequest("exit-status", false, status)
+		return
+	}
+}
+
+// run runs the command with the stdin, stdout and stderr of the channel and returns its exit status
+func (server *Server) run(channel ssh.Channel, command string) uint32 {
+	cmd := exec.Command("sh", "-c", command)
+	if server.NetNS.IsOpen() {
+		netNSFd, err := syscall.Dup(int(server.NetNS))
+		if err != nil {
+			fmt.Fprintf(channel.Stderr(), "%v\n", err)
+			return 255
+		}
+		netNSFile := os.NewFile(uintptr(netNSFd), "netns")
+		defer netNSFile.Close()
+		cmd = exec.Command("nsenter", "--net=/proc/self/fd/3", "--", "sh", "-c", command)
+		cmd.ExtraFiles = []*os.File{netNSFile}
+	}
+
+	// the stdin is read to the EOF before running the command, so a command which doesn't read its
+	// stdin doesn't block the client
+	var stdin bytes.Buffer
+	stdin.ReadFrom(channel)
+	cmd.Stdin = &stdin
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+
+	err := cmd.Run()
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if waitStatus, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return uint32(waitStatus.ExitStatus())
+		}
+	}
+	fmt.Fprintf(channel.Stderr(), "%v\n", err)
+	return 255
+}
@@ -0,0 +1,120 @@
+package sshStandIn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netns"
+	"github.com/xaionaro-go/networkControl/hosts/linux"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestServer(t *testing.T) *Server {
+	server, err := New(netns.None())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestSSHExecutorRun(t *testing.T) {
+	server := newTestServer(t)
+	executor := linuxHost.NewSSHExecutor(server.AccessDetails())
+
+	out, err := executor.Run(nil, "echo", "it's", "$HOME")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "it's $HOME\n" {
+		t.Errorf("the arguments are not quoted: %q", out)
+	}
+
+	out, err = executor.Run([]byte("the input"), "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "the input" {
+		t.Errorf("unexpected output: %q", out)
+	}
+
+	_, err = executor.Run(nil, "sh", "-c", "echo the error >&2; exit 3")
+	if err == nil || !strings.Contains(err.Error(), "the error") {
+		t.Errorf("an error with the stderr is expected, got: %v", err)
+	}
+
+	// the next call reconnects
+
+	err = executor.(io.Closer).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = executor.Run(nil, "true")
+	if err != nil {
+		t.Errorf("cannot reconnect: %v", err)
+	}
+}
+
+func TestSSHExecutorAuth(t *testing.T) {
+	server := newTestServer(t)
+
+	accessDetails := server.AccessDetails()
+	accessDetails.Password = "wrong"
+	_, err := linuxHost.NewSSHExecutor(accessDetails).Run(nil, "true")
+	if err == nil {
+		t.Errorf("a wrong password is accepted")
+	}
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, err := ssh.NewPublicKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessDetails = server.AccessDetails()
+	accessDetails.HostKeyCallback = ssh.FixedHostKey(otherPublicKey)
+	_, err = linuxHost.NewSSHExecutor(accessDetails).Run(nil, "true")
+	if err == nil {
+		t.Errorf("a wrong host key is accepted")
+	}
+}
+
+func TestSSHExecutorKnownHosts(t *testing.T) {
+	server := newTestServer(t)
+	homeDir := t.TempDir()
+	t.Setenv("HOME", homeDir)
+
+	accessDetails := server.AccessDetails()
+	accessDetails.HostKeyCallback = nil
+	_, err := linuxHost.NewSSHExecutor(accessDetails).Run(nil, "true")
+	if err == nil || !strings.Contains(err.Error(), "HostKeyCallback") {
+		t.Errorf("an error is expected without known hosts, got: %v", err)
+	}
+
+	// the host key is taken from ~/.ssh/known_hosts if there's no HostKeyCallback
+
+	err = os.Mkdir(filepath.Join(homeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := knownhosts.Normalize(net.JoinHostPort(accessDetails.Host, strconv.Itoa(accessDetails.Post)))
+	knownHosts := knownhosts.Line([]string{address}, server.hostKey) + "\n"
+	err = os.WriteFile(filepath.Join(homeDir, ".ssh", "known_hosts"), []byte(knownHosts), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = linuxHost.NewSSHExecutor(accessDetails).Run(nil, "true")
+	if err != nil {
+		t.Errorf("the known host is not accepted: %v", err)
+	}
+}
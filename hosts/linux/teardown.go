@@ -0,0 +1,233 @@
+package linuxHost
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/xaionaro-go/iscDhcp/cfg"
+	"github.com/xaionaro-go/netTree"
+	"github.com/xaionaro-go/networkControl"
+)
+
+// persistedPaths are files written by SaveToDisk() and ApplyDiff()
+var persistedPaths = []string{
+	NETCONTOL_CONFIG_PATH,
+	IPTABLES_RULES_PATH,
+	NFTABLES_RULES_PATH,
+	DHCP_CONFIG_PATH,
+	"/etc/iproute.rules",
+	"/etc/iproute.routes",
+	"/etc/ipset-fwsm.dump",
+}
+
+// Teardown removes the firewall rules, the VLAN links "trunk.N" and their bridges, the routes of table
+// "fwsm", the "ip rule" to the table and the files written by the library (dhcpd is stopped before its
+// config is removed). Ignored VLANs and VLAN links of other parents are never touched. With KeepForeign
+// the objects the library doesn't manage are kept, as well as the "ip rule" (if there're such routes)
+// and the subnets of dhcpd.conf which are not networks of managed VLANs (dhcpd is restarted without the others).
+func (host *linuxHost) Teardown(options networkControl.TeardownOptions) (result networkControl.TeardownItems, err error) {
+	host.Infof("linuxHost.Teardown(%+v)", options)
+
+	err = host.RescanState()
+	if err != nil {
+		host.LogError(err)
+		return
+	}
+
+	// vlans (before the firewall: RemoveVLAN() unsets the security levels)
+
+	vlans, err := host.getLibraryVLANs()
+	if err != nil {
+		host.LogError(err)
+		return
+	}
+	for vlanId, vlan := range vlans {
+		curVLAN := host.States.Cur.BridgedVLANs[vlanId]
+		if curVLAN != nil && (curVLAN.IsIgnored || (options.KeepForeign && curVLAN.GetOwnership() != networkControl.OWNERSHIP_MANAGED)) {
+			continue
+		}
+		result = append(result,
+			networkControl.TeardownItem{Kind: "link", Name: "trunk." + strconv.Itoa(vlanId)},
+			networkControl.TeardownItem{Kind: "bridge", Name: host.IfNameToLinuxIfName(vlan.Name)},
+		)
+		if options.DryRun {
+			continue
+		}
+		err = host.RemoveVLAN(*vlan)
+		if err != nil {
+			host.LogError(err, *vlan)
+			return
+		}
+	}
+
+	// firewall
+
+	if firewall, ok := host.GetFirewall().(networkControl.TeardownFirewallI); ok {
+		var items networkControl.TeardownItems
+		items, err = firewall.Teardown(options)
+		result = append(result, items...)
+		if err != nil {
+			host.LogError(err)
+			return
+		}
+	} else {
+		host.Warningf("the firewall doesn't support teardown, skipping it")
+	}
+
+	// routes (with KeepForeign only the managed ones are removed, the table is used while there're others)
+
+	isForeignRouteFound := false
+	for _, route := range host.States.Cur.Routes {
+		if options.KeepForeign && route.GetOwnership() != networkControl.OWNERSHIP_MANAGED {
+			isForeignRouteFound = true
+			continue
+		}
+		result = append(result, networkControl.TeardownItem{Kind: "route", Name: route.Destination.String() + " via " + route.Gateway.String() + " table fwsm"})
+		if options.DryRun || !options.KeepForeign {
+			continue
+		}
+		err = host.RemoveRoute(*route)
+		if err != nil {
+			host.LogError(err, *route)
+			return
+		}
+	}
+	if !isForeignRouteFound {
+		result = append(result, networkControl.TeardownItem{Kind: "ip rule", Name: "from all lookup fwsm"})
+		if !options.DryRun {
+			_, err = host.runCommand(nil, "ip", "route", "flush", "table", "fwsm")
+			if err != nil {
+				host.LogError(err)
+				return
+			}
+			_, err = host.runCommand(nil, "ip", "rule", "del", "from", "any", "lookup", "fwsm")
+			if err != nil && strings.Index(err.Error(), "No such file or directory") == -1 {
+				host.LogError(err)
+				return
+			}
+			err = nil
+		}
+	}
+
+	// files
+
+	for _, path := range persistedPaths {
+		if !host.isFileExist(path) {
+			continue
+		}
+		if path == DHCP_CONFIG_PATH {
+			if host.isDHCPDisabled { // not written by the library
+				continue
+			}
+			if options.KeepForeign && host.isForeignDHCPSubnetFound() {
+				var items networkControl.TeardownItems
+				items, err = host.teardownManagedDHCPSubnets(options.DryRun)
+				result = append(result, items...)
+				if err != nil {
+					host.LogError(err)
+					return
+				}
+				continue
+			}
+			result = append(result, networkControl.TeardownItem{Kind: "service", Name: "isc-dhcp-server"})
+			if !options.DryRun {
+				err = host.stopDHCP()
+				if err != nil {
+					host.LogError(err)
+					return
+				}
+			}
+		}
+		result = append(result, networkControl.TeardownItem{Kind: "file", Name: host.path(path)})
+		if options.DryRun {
+			continue
+		}
+		err = host.removeFile(path)
+		if err != nil {
+			host.LogError(err, path)
+			return
+		}
+	}
+
+	if options.DryRun {
+		return
+	}
+
+	if !options.KeepForeign { // the unmanaged objects are removed as well (except the ignored ones)
+		ignoredState := networkControl.State{}
+		ignoredState.CopyIgnoredFrom(host.States.Cur)
+		host.States.Cur = ignoredState
+	}
+	err = host.RescanState()
+	return
+}
+
+// getLibraryVLANs returns the VLANs of links "trunk.N" enslaved to bridges (the links AddVLAN() creates),
+// VLAN links of other parents are not returned
+func (host *linuxHost) getLibraryVLANs() (networkControl.VLANs, error) {
+	ifaces, err := host.getLinkTree()
+	if err != nil {
+		return nil, err
+	}
+	trunkIfaces := netTree.Nodes{}
+	for _, iface := range ifaces {
+		link, ok := iface.Link.(*netlink.Vlan)
+		if !ok || link.Name != "trunk."+strconv.Itoa(link.VlanId) {
+			continue
+		}
+		trunkIfaces = append(trunkIfaces, iface)
+	}
+	return host.inquireBridgedVLANs(trunkIfaces), nil
+}
+
+// isManagedDHCPSubnet returns true if the subnet is a network of a managed VLAN
+func (host *linuxHost) isManagedDHCPSubnet(subnet *cfg.Subnet) bool {
+	for _, vlan := range host.States.Cur.BridgedVLANs {
+		if vlan == nil || vlan.GetOwnership() != networkControl.OWNERSHIP_MANAGED {
+			continue
+		}
+		for _, ip := range vlan.IPs {
+			if subnet.Network.Contains(ip.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isForeignDHCPSubnetFound returns true if dhcpd.conf has a subnet which is not a network of a managed VLAN
+func (host *linuxHost) isForeignDHCPSubnetFound() bool {
+	for _, subnet := range host.States.Cur.DHCP.Subnets {
+		if subnet != nil && !host.isManagedDHCPSubnet(subnet) {
+			return true
+		}
+	}
+	return false
+}
+
+// teardownManagedDHCPSubnets removes the subnets of managed VLANs from dhcpd.conf and restarts dhcpd
+func (host *linuxHost) teardownManagedDHCPSubnets(isDryRun bool) (result networkControl.TeardownItems, err error) {
+	dhcp := host.States.Cur.DHCP
+	dhcp.Subnets = cfg.Subnets{}
+	for key, subnet := range host.States.Cur.DHCP.Subnets {
+		if subnet == nil || !host.isManagedDHCPSubnet(subnet) {
+			dhcp.Subnets[key] = subnet
+			continue
+		}
+		result = append(result, networkControl.TeardownItem{Kind: "dhcp subnet", Name: subnet.Network.String()})
+	}
+	if len(result) == 0 || isDryRun {
+		return
+	}
+	err = host.SetDHCPState(dhcp)
+	if err != nil {
+		return
+	}
+	err = host.saveDHCPConfig()
+	if err != nil {
+		return
+	}
+	err = host.restartDHCP()
+	return
+}
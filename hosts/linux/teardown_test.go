@@ -0,0 +1,83 @@
+package linuxHost
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xaionaro-go/networkControl"
+	"github.com/xaionaro-go/networkControl/firewalls/iptables"
+)
+
+// teardownLinksJSON has the VLAN 10 created by the library ("trunk.10" in the bridge "inside") and
+// the VLAN 20 of another parent ("eth1.20" in the bridge "other")
+const teardownLinksJSON = `[{"ifindex":1,"ifname":"lo","mtu":65536,"address":"00:00:00:00:00:00","linkinfo":{}},` +
+	`{"ifindex":2,"ifname":"trunk","mtu":1500,"address":"02:00:00:00:00:01","linkinfo":{}},` +
+	`{"ifindex":3,"ifname":"eth1","mtu":1500,"address":"02:00:00:00:00:02","linkinfo":{}},` +
+	`{"ifindex":4,"ifname":"inside","mtu":1500,"address":"02:00:00:00:00:03","linkinfo":{"info_kind":"bridge"}},` +
+	`{"ifindex":5,"ifname":"trunk.10","mtu":1500,"address":"02:00:00:00:00:01","master":"inside","linkinfo":{"info_kind":"vlan","info_data":{"protocol":"802.1Q","id":10}}},` +
+	`{"ifindex":6,"ifname":"other","mtu":1500,"address":"02:00:00:00:00:04","linkinfo":{"info_kind":"bridge"}},` +
+	`{"ifindex":7,"ifname":"eth1.20","mtu":1500,"address":"02:00:00:00:00:02","master":"other","linkinfo":{"info_kind":"vlan","info_data":{"protocol":"802.1Q","id":20}}}]`
+
+func newTeardownTestHost(t *testing.T, failedCommand string) (*linuxHost, *RecordingExecutor) {
+	recorder := NewRecordingExecutor(&stubExecutor{
+		ipt:           iptables.NewMemoryIPTables(),
+		linksJSON:     teardownLinksJSON,
+		failedCommand: failedCommand,
+	})
+	return newExecutorTestHost(t, recorder), recorder
+}
+
+// teardownChanges returns the commands of the transcript which change the host
+func teardownChanges(transcript Transcript) (result []string) {
+	for _, line := range strings.Split(transcript.String(), "\n") {
+		if strings.HasPrefix(line, "netlink: ") || strings.HasPrefix(line, "ip route flush ") || strings.HasPrefix(line, "ip rule ") {
+			result = append(result, line)
+		}
+	}
+	return
+}
+
+func TestTeardownTranscript(t *testing.T) {
+	host, recorder := newTeardownTestHost(t, "")
+	constructionLen := len(recorder.Transcript())
+
+	items, err := host.Teardown(networkControl.TeardownOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.TrimSpace(`
+netlink: ip link del trunk.10
+netlink: ip link set inside down
+netlink: ip link del inside
+ip route flush table fwsm
+ip rule del from any lookup fwsm
+`)
+	if got := strings.Join(teardownChanges(recorder.Transcript()[constructionLen:]), "\n"); got != expected {
+		t.Errorf("unexpected changes:\n%v\nexpected:\n%v", got, expected)
+	}
+	for _, item := range items {
+		if item.Name == "eth1.20" || item.Name == "other" || item.Name == "trunk.20" {
+			t.Errorf("a VLAN of another parent is removed: %v", item)
+		}
+	}
+}
+
+func TestTeardownCommandError(t *testing.T) {
+	for _, failedCommand := range []string{
+		"ip route flush table fwsm",
+		"ip rule del from any lookup fwsm",
+	} {
+		host, recorder := newTeardownTestHost(t, failedCommand)
+		constructionLen := len(recorder.Transcript())
+
+		_, err := host.Teardown(networkControl.TeardownOptions{})
+		if err == nil || !strings.Contains(err.Error(), failedCommand) {
+			t.Errorf("%v: unexpected error: %v", failedCommand, err)
+		}
+		changes := teardownChanges(recorder.Transcript()[constructionLen:])
+		if len(changes) == 0 || changes[len(changes)-1] != failedCommand {
+			t.Errorf("%v: the teardown is continued after the error:\n%v", failedCommand, strings.Join(changes, "\n"))
+		}
+	}
+}
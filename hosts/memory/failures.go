@@ -0,0 +1,104 @@
+package memoryHost
+
+import (
+	"errors"
+)
+
+var (
+	errInjected = errors.New("injected failure")
+)
+
+// Operation is an operation of the host a failure could be injected into
+type Operation int
+
+const (
+	OPERATION_ADD     = Operation(1)
+	OPERATION_UPDATE  = Operation(2)
+	OPERATION_REMOVE  = Operation(3)
+	OPERATION_RESCAN  = Operation(4)
+	OPERATION_SAVE    = Operation(5)
+	OPERATION_RESTORE = Operation(6)
+	OPERATION_COMMIT  = Operation(7) // the commit of a batch of the firewall
+)
+
+func (operation Operation) String() string {
+	switch operation {
+	case OPERATION_ADD:
+		return "add"
+	case OPERATION_UPDATE:
+		return "update"
+	case OPERATION_REMOVE:
+		return "remove"
+	case OPERATION_RESCAN:
+		return "rescan"
+	case OPERATION_SAVE:
+		return "save"
+	case OPERATION_RESTORE:
+		return "restore"
+	case OPERATION_COMMIT:
+		return "commit"
+	}
+	return "unknown"
+}
+
+// Failure makes an operation of the host fail
+type Failure struct {
+	Operation Operation
+
+	// Kind is the name of the field of State ("BridgedVLANs", "ACLs", "SNATs", "DNATs", "Routes") or
+	// "SecurityLevels" (SetSecurityLevel()/UnsetSecurityLevel() of the firewall). "" matches any kind.
+	Kind string
+
+	// Key is KeyStringValue() of the object (the name of the interface for "SecurityLevels"). "" matches any object.
+	Key string
+
+	// Err is the returned error (errInjected if nil)
+	Err error
+
+	// Times is how many times the failure happens (0 means always)
+	Times int
+}
+
+func (failure Failure) isMatched(operation Operation, kind, key string) bool {
+	return failure.Operation == operation &&
+		(failure.Kind == "" || failure.Kind == kind) &&
+		(failure.Key == "" || failure.Key == key)
+}
+
+// InjectFailure makes the matching operations fail
+func (host *Host) InjectFailure(failure Failure) {
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	host.failures = append(host.failures, &failure)
+}
+
+// ClearFailures removes all the injected failures
+func (host *Host) ClearFailures() {
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	host.failures = nil
+}
+
+// checkFailure returns the error of the first matching injected failure (if any)
+func (host *Host) checkFailure(operation Operation, kind, key string) error {
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	for idx, failure := range host.failures {
+		if !failure.isMatched(operation, kind, key) {
+			continue
+		}
+		if failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				host.failures = append(host.failures[:idx], host.failures[idx+1:]...)
+			}
+		}
+		err := failure.Err
+		if err == nil {
+			err = errInjected
+		}
+		host.LogError(err, operation, kind, key)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+package memoryHost
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/xaionaro-go/networkControl"
+)
+
+var (
+	errNoBatch         = errors.New("there's no batch in progress")
+	errBatchInProgress = errors.New("a batch is in progress")
+)
+
+// firewallState is the "kernel" state of the firewall
+type firewallState struct {
+	securityLevels       map[string]int // the name of interface in the host -> security level
+	acls                 networkControl.ACLs
+	snats                networkControl.SNATs
+	dnats                networkControl.DNATs
+	permitInterInterface bool
+	permitIntraInterface bool
+}
+
+func (state firewallState) Copy() firewallState {
+	result := state
+	result.securityLevels = map[string]int{}
+	for ifName, securityLevel := range state.securityLevels {
+		result.securityLevels[ifName] = securityLevel
+	}
+	result.acls = nil
+	for _, acl := range state.acls {
+		result.acls = append(result.acls, copyACL(*acl))
+	}
+	result.snats = nil
+	for _, snat := range state.snats {
+		result.snats = append(result.snats, copySNAT(*snat))
+	}
+	result.dnats = nil
+	for _, dnat := range state.dnats {
+		result.dnats = append(result.dnats, copyDNAT(*dnat))
+	}
+	return result
+}
+
+// Firewall is an in-memory firewall with batches (see networkControl.BatchFirewallI). Failures of its
+// operations are injected by Host.InjectFailure().
+type Firewall struct {
+	networkControl.FirewallBase
+	host *Host
+
+	locker sync.Mutex
+	state  firewallState
+
+	// snapshot is the state at BeginBatch() to roll back to (nil if there's no batch in progress)
+	snapshot *firewallState
+}
+
+var _ networkControl.FirewallI = &Firewall{}
+var _ networkControl.BatchFirewallI = &Firewall{}
+
+func newFirewall(host *Host) *Firewall {
+	fw := &Firewall{
+		host: host,
+		state: firewallState{
+			securityLevels:       map[string]int{},
+			permitInterInterface: true,
+			permitIntraInterface: true,
+		},
+	}
+	fw.SetHost(host)
+	return fw
+}
+
+// setState replaces the objects of the firewall by the ones of the state (see Host.SetKernel())
+func (fw *Firewall) setState(state networkControl.State) {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	fw.state = firewallState{
+		securityLevels:       map[string]int{},
+		acls:                 state.ACLs,
+		snats:                state.SNATs,
+		dnats:                state.DNATs,
+		permitInterInterface: state.PermitInterInterface,
+		permitIntraInterface: state.PermitIntraInterface,
+	}
+	for _, vlan := range state.BridgedVLANs {
+		fw.state.securityLevels[fw.GetHost().IfNameToHostIfName(vlan.Name)] = vlan.SecurityLevel
+	}
+	for _, acl := range fw.state.acls {
+		acl.SetOwnership(networkControl.OWNERSHIP_MANAGED)
+	}
+	for _, snat := range fw.state.snats {
+		snat.SetOwnership(networkControl.OWNERSHIP_MANAGED)
+	}
+	for _, dnat := range fw.state.dnats {
+		dnat.SetOwnership(networkControl.OWNERSHIP_MANAGED)
+	}
+}
+
+// modify changes the state by "fn" if the operation is not failed by an injected failure
+func (fw *Firewall) modify(operation Operation, kind, key string, fn func(state *firewallState) error) error {
+	err := fw.host.checkFailure(operation, kind, key)
+	if err != nil {
+		return err
+	}
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	err = fn(&fw.state)
+	if err != nil {
+		fw.LogError(err, operation, kind, key)
+	}
+	return err
+}
+
+func (fw *Firewall) InquireSecurityLevel(ifName string) int {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	return fw.state.securityLevels[fw.GetHost().IfNameToHostIfName(ifName)]
+}
+
+// GetSecurityLevels returns the security levels of the interfaces (names in the host)
+func (fw *Firewall) GetSecurityLevels() map[string]int {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	return fw.state.Copy().securityLevels
+}
+
+func (fw *Firewall) InquireACLs() networkControl.ACLs {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	return fw.state.Copy().acls
+}
+func (fw *Firewall) InquireSNATs() networkControl.SNATs {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	return fw.state.Copy().snats
+}
+func (fw *Firewall) InquireDNATs() networkControl.DNATs {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	return fw.state.Copy().dnats
+}
+func (fw *Firewall) InquirePermitInterInterface() bool {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	return fw.state.permitInterInterface
+}
+func (fw *Firewall) InquirePermitIntraInterface() bool {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	return fw.state.permitIntraInterface
+}
+
+func findACL(acls networkControl.ACLs, acl networkControl.ACL) int {
+	for idx, curACL := range acls {
+		if curACL.KeyStringValue() == acl.KeyStringValue() {
+			return idx
+		}
+	}
+	return -1
+}
+func findSNAT(snats networkControl.SNATs, snat networkControl.SNAT) int {
+	for idx, curSNAT := range snats {
+		if curSNAT.KeyStringValue() == snat.KeyStringValue() {
+			return idx
+		}
+	}
+	return -1
+}
+func findDNAT(dnats networkControl.DNATs, dnat networkControl.DNAT) int {
+	for idx, curDNAT := range dnats {
+		if curDNAT.KeyStringValue() == dnat.KeyStringValue() {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (fw *Firewall) AddACL(acl networkControl.ACL) error {
+	return fw.modify(OPERATION_ADD, "ACLs", acl.KeyStringValue(), func(state *firewallState) error {
+		if findACL(state.acls, acl) >= 0 {
+			return errAlreadyExists
+		}
+		acl.Ownership = networkControl.OWNERSHIP_MANAGED
+		state.acls = append(state.acls, copyACL(acl))
+		return nil
+	})
+}
+func (fw *Firewall) AddSNAT(snat networkControl.SNAT) error {
+	return fw.modify(OPERATION_ADD, "SNATs", snat.KeyStringValue(), func(state *firewallState) error {
+		if findSNAT(state.snats, snat) >= 0 {
+			return errAlreadyExists
+		}
+		snat.Ownership = networkControl.OWNERSHIP_MANAGED
+		state.snats = append(state.snats, copySNAT(snat))
+		return nil
+	})
+}
+func (fw *Firewall) AddDNAT(dnat networkControl.DNAT) error {
+	return fw.modify(OPERATION_ADD, "DNATs", dnat.KeyStringValue(), func(state *firewallState) error {
+		if findDNAT(state.dnats, dnat) >= 0 {
+			return errAlreadyExists
+		}
+		dnat.Ownership = networkControl.OWNERSHIP_MANAGED
+		state.dnats = append(state.dnats, copyDNAT(dnat))
+		return nil
+	})
+}
+
+func (fw *Firewall) UpdateACL(acl networkControl.ACL) error {
+	return fw.modify(OPERATION_UPDATE, "ACLs", acl.KeyStringValue(), func(state *firewallState) error {
+		idx := findACL(state.acls, acl)
+		if idx < 0 {
+			return errNotFound
+		}
+		acl.Ownership = networkControl.OWNERSHIP_MANAGED
+		state.acls[idx] = copyACL(acl)
+		return nil
+	})
+}
+func (fw *Firewall) UpdateSNAT(snat networkControl.SNAT) error {
+	return fw.modify(OPERATION_UPDATE, "SNATs", snat.KeyStringValue(), func(state *firewallState) error {
+		idx := findSNAT(state.snats, snat)
+		if idx < 0 {
+			return errNotFound
+		}
+		snat.Ownership = networkControl.OWNERSHIP_MANAGED
+		state.snats[idx] = copySNAT(snat)
+		return nil
+	})
+}
+func (fw *Firewall) UpdateDNAT(dnat networkControl.DNAT) error {
+	return fw.modify(OPERATION_UPDATE, "DNATs", dnat.KeyStringValue(), func(state *firewallState) error {
+		idx := findDNAT(state.dnats, dnat)
+		if idx < 0 {
+			return errNotFound
+		}
+		dnat.Ownership = networkControl.OWNERSHIP_MANAGED
+		state.dnats[idx] = copyDNAT(dnat)
+		return nil
+	})
+}
+
+func (fw *Firewall) RemoveACL(acl networkControl.ACL) error {
+	return fw.modify(OPERATION_REMOVE, "ACLs", acl.KeyStringValue(), func(state *firewallState) error {
+		idx := findACL(state.acls, acl)
+		if idx < 0 { // like the other firewalls, the removal is idempotent
+			return nil
+		}
+		state.acls = append(state.acls[:idx], state.acls[idx+1:]...)
+		return nil
+	})
+}
+func (fw *Firewall) RemoveSNAT(snat networkControl.SNAT) error {
+	return fw.modify(OPERATION_REMOVE, "SNATs", snat.KeyStringValue(), func(state *firewallState) error {
+		idx := findSNAT(state.snats, snat)
+		if idx < 0 {
+			return errNotFound
+		}
+		state.snats = append(state.snats[:idx], state.snats[idx+1:]...)
+		return nil
+	})
+}
+func (fw *Firewall) RemoveDNAT(dnat networkControl.DNAT) error {
+	return fw.modify(OPERATION_REMOVE, "DNATs", dnat.KeyStringValue(), func(state *firewallState) error {
+		idx := findDNAT(state.dnats, dnat)
+		if idx < 0 {
+			return errNotFound
+		}
+		state.dnats = append(state.dnats[:idx], state.dnats[idx+1:]...)
+		return nil
+	})
+}
+
+func (fw *Firewall) SetSecurityLevel(ifName string, securityLevel int) error {
+	hostIfName := fw.GetHost().IfNameToHostIfName(ifName)
+	return fw.modify(OPERATION_UPDATE, "SecurityLevels", hostIfName, func(state *firewallState) error {
+		state.securityLevels[hostIfName] = securityLevel
+		return nil
+	})
+}
+func (fw *Firewall) UnsetSecurityLevel(ifName string) error {
+	hostIfName := fw.GetHost().IfNameToHostIfName(ifName)
+	return fw.modify(OPERATION_REMOVE, "SecurityLevels", hostIfName, func(state *firewallState) error {
+		delete(state.securityLevels, hostIfName)
+		return nil
+	})
+}
+
+func (fw *Firewall) SetEnablePermitInterInterface(enable bool) error {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	fw.state.permitInterInterface = enable
+	return nil
+}
+func (fw *Firewall) SetEnablePermitIntraInterface(enable bool) error {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	fw.state.permitIntraInterface = enable
+	return nil
+}
+
+// BeginBatch remembers the state to roll back to
+func (fw *Firewall) BeginBatch() error {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	if fw.snapshot != nil {
+		return errBatchInProgress
+	}
+	snapshot := fw.state.Copy()
+	fw.snapshot = &snapshot
+	return nil
+}
+
+// CommitBatch finishes the batch. If the commit fails (see OPERATION_COMMIT) then the changes of the batch are dropped.
+func (fw *Firewall) CommitBatch() error {
+	err := fw.host.checkFailure(OPERATION_COMMIT, "", "")
+	if err != nil {
+		rollbackErr := fw.RollbackBatch()
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	if fw.snapshot == nil {
+		return errNoBatch
+	}
+	fw.snapshot = nil
+	return nil
+}
+
+// RollbackBatch restores the state at BeginBatch()
+func (fw *Firewall) RollbackBatch() error {
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	if fw.snapshot == nil {
+		return errNoBatch
+	}
+	fw.state = *fw.snapshot
+	fw.snapshot = nil
+	return nil
+}
+
+// Teardown removes all the objects of the firewall (only the managed ACLs and NATs if
+// there're foreign ones and KeepForeign is set)
+func (fw *Firewall) Teardown(options networkControl.TeardownOptions) (result networkControl.TeardownItems, err error) {
+	if options.KeepForeign {
+		var isForeignFound bool
+		result, isForeignFound, err = networkControl.TeardownManagedFirewallObjects(fw, fw.GetHost().GetCurState(), options.DryRun)
+		if err != nil || isForeignFound {
+			return
+		}
+	}
+
+	fw.locker.Lock()
+	defer fw.locker.Unlock()
+	if fw.snapshot != nil {
+		return nil, errBatchInProgress
+	}
+	ifNames := []string{}
+	for ifName := range fw.state.securityLevels {
+		ifNames = append(ifNames, ifName)
+	}
+	sort.Strings(ifNames)
+	for _, ifName := range ifNames {
+		result = append(result, networkControl.TeardownItem{Kind: "security level", Name: ifName})
+	}
+	for _, acl := range fw.state.acls {
+		result = append(result, networkControl.TeardownItem{Kind: "acl", Name: acl.Name})
+	}
+	for _, snat := range fw.state.snats {
+		result = append(result, networkControl.TeardownItem{Kind: "snat", Name: snat.KeyStringValue()})
+	}
+	for _, dnat := range fw.state.dnats {
+		result = append(result, networkControl.TeardownItem{Kind: "dnat", Name: dnat.KeyStringValue()})
+	}
+	if options.DryRun {
+		return
+	}
+	fw.state = firewallState{
+		securityLevels:       map[string]int{},
+		permitInterInterface: fw.state.permitInterInterface,
+		permitIntraInterface: fw.state.permitIntraInterface,
+	}
+	return
+}
@@ -0,0 +1,554 @@
+package memoryHost
+
+// A host which keeps everything in memory to test business logic on top of HostI without root. The
+// "kernel" of the host is a State which is changed by ApplyDiff() (VLANs and routes) and by the
+// firewall (ACLs, NATs, security levels), RescanState() reads it back, SaveToDisk() and
+// RestoreFromDisk() use an in-memory "disk". Any operation could be made to fail by InjectFailure().
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/xaionaro-go/networkControl"
+)
+
+var (
+	errNotFound      = errors.New("not found")
+	errAlreadyExists = errors.New("already exists")
+)
+
+type Host struct {
+	networkControl.HostBase
+
+	locker   sync.Mutex
+	kernel   networkControl.State
+	disk     *networkControl.State
+	failures []*Failure
+
+	// diskManaged is the registry of managed objects saved with the "disk"
+	diskManaged networkControl.ManagedObjects
+}
+
+var _ networkControl.HostI = &Host{}
+
+func NewHost() *Host {
+	host := &Host{}
+	err := host.HostBase.SetParent(host)
+	if err != nil {
+		panic(err)
+	}
+	host.kernel = newState()
+	host.HostBase.SetFirewall(newFirewall(host))
+	return host
+}
+
+func newState() networkControl.State {
+	return networkControl.State{
+		BridgedVLANs: networkControl.VLANs{},
+	}
+}
+
+// The "kernel" keeps copies of the objects (the ownership is not known to it, so it's reset)
+
+func copyVLAN(vlan networkControl.VLAN) *networkControl.VLAN {
+	vlan.IPs = append(networkControl.IPNets(nil), vlan.IPs...)
+	return &vlan
+}
+func copyACL(acl networkControl.ACL) *networkControl.ACL {
+	acl.Rules = append(networkControl.ACLRules(nil), acl.Rules...)
+	acl.VLANNames = append([]string(nil), acl.VLANNames...)
+	acl.OutVLANNames = append([]string(nil), acl.OutVLANNames...)
+	return &acl
+}
+func copySNAT(snat networkControl.SNAT) *networkControl.SNAT {
+	snat.Sources = append(networkControl.SNATSources(nil), snat.Sources...)
+	return &snat
+}
+func copyDNAT(dnat networkControl.DNAT) *networkControl.DNAT {
+	dnat.Destinations = append(networkControl.IPPorts(nil), dnat.Destinations...)
+	return &dnat
+}
+func copyRoute(route networkControl.Route) *networkControl.Route {
+	route.Sources = append(networkControl.IPNets(nil), route.Sources...)
+	return &route
+}
+
+// copyObjects returns a deep copy of the objects of the state
+func copyObjects(state networkControl.State) networkControl.State {
+	result := state
+	result.BridgedVLANs = networkControl.VLANs{}
+	for vlanId, vlan := range state.BridgedVLANs {
+		if vlan == nil {
+			continue
+		}
+		result.BridgedVLANs[vlanId] = copyVLAN(*vlan)
+	}
+	result.ACLs = nil
+	for _, acl := range state.ACLs {
+		result.ACLs = append(result.ACLs, copyACL(*acl))
+	}
+	result.SNATs = nil
+	for _, snat := range state.SNATs {
+		result.SNATs = append(result.SNATs, copySNAT(*snat))
+	}
+	result.DNATs = nil
+	for _, dnat := range state.DNATs {
+		result.DNATs = append(result.DNATs, copyDNAT(*dnat))
+	}
+	result.Routes = nil
+	for _, route := range state.Routes {
+		result.Routes = append(result.Routes, copyRoute(*route))
+	}
+	return result
+}
+
+// Kernel returns a copy of the "kernel" state of the host
+func (host *Host) Kernel() networkControl.State {
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	return copyObjects(host.kernel)
+}
+
+// SetKernel replaces the "kernel" state of the host (for example to put objects not created by the
+// library). The firewall objects and the security levels of the VLANs are passed to the in-memory firewall.
+func (host *Host) SetKernel(state networkControl.State) {
+	state = copyObjects(state)
+	host.locker.Lock()
+	host.kernel = newState()
+	host.kernel.DHCP = state.DHCP
+	host.kernel.Routes = state.Routes
+	for _, route := range host.kernel.Routes {
+		route.SetOwnership(networkControl.OWNERSHIP_MANAGED)
+	}
+	for vlanId, vlan := range state.BridgedVLANs {
+		vlan.SetOwnership(networkControl.OWNERSHIP_MANAGED)
+		host.kernel.BridgedVLANs[vlanId] = vlan
+	}
+	host.locker.Unlock()
+
+	if fw, ok := host.GetFirewall().(*Firewall); ok {
+		fw.setState(state)
+	}
+}
+
+// Disk returns a copy of the state saved by SaveToDisk() (false if nothing was saved)
+func (host *Host) Disk() (networkControl.State, bool) {
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	if host.disk == nil {
+		return networkControl.State{}, false
+	}
+	return copyObjects(*host.disk), true
+}
+
+// SetFirewall replaces the firewall (for example by the iptables firewall on top of iptables.MemoryIPTables)
+func (host *Host) SetFirewall(newFirewall networkControl.FirewallI) error {
+	return host.HostBase.SetFirewall(newFirewall)
+}
+
+func (host *Host) IfNameToHostIfName(ifName string) string {
+	return ifName
+}
+func (host *Host) HostIfNameToIfName(hostIfName string) string {
+	return hostIfName
+}
+
+func (host *Host) addVLAN(vlan networkControl.VLAN) error {
+	if vlan.IsIgnored {
+		return nil
+	}
+	err := host.checkFailure(OPERATION_ADD, "BridgedVLANs", vlan.KeyStringValue())
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	if host.kernel.BridgedVLANs[vlan.VlanId] != nil {
+		host.locker.Unlock()
+		host.LogError(errAlreadyExists, vlan)
+		return errAlreadyExists
+	}
+	vlan.Ownership = networkControl.OWNERSHIP_MANAGED
+	host.kernel.BridgedVLANs[vlan.VlanId] = copyVLAN(vlan)
+	host.locker.Unlock()
+
+	return host.GetFirewall().SetSecurityLevel(host.IfNameToHostIfName(vlan.Name), vlan.SecurityLevel)
+}
+
+func (host *Host) updateVLAN(vlan networkControl.VLAN) error {
+	if vlan.IsIgnored {
+		return nil
+	}
+	err := host.checkFailure(OPERATION_UPDATE, "BridgedVLANs", vlan.KeyStringValue())
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	if host.kernel.BridgedVLANs[vlan.VlanId] == nil {
+		host.locker.Unlock()
+		host.LogError(errNotFound, vlan)
+		return errNotFound
+	}
+	vlan.Ownership = networkControl.OWNERSHIP_MANAGED
+	host.kernel.BridgedVLANs[vlan.VlanId] = copyVLAN(vlan)
+	host.locker.Unlock()
+
+	return host.GetFirewall().SetSecurityLevel(host.IfNameToHostIfName(vlan.Name), vlan.SecurityLevel)
+}
+
+func (host *Host) removeVLAN(vlan networkControl.VLAN) error {
+	if vlan.IsIgnored {
+		return nil
+	}
+	err := host.checkFailure(OPERATION_REMOVE, "BridgedVLANs", vlan.KeyStringValue())
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	if host.kernel.BridgedVLANs[vlan.VlanId] == nil {
+		host.locker.Unlock()
+		host.LogError(errNotFound, vlan)
+		return errNotFound
+	}
+	delete(host.kernel.BridgedVLANs, vlan.VlanId)
+	host.locker.Unlock()
+
+	return host.GetFirewall().UnsetSecurityLevel(host.IfNameToHostIfName(vlan.Name))
+}
+
+// findRoute returns the index of the route in the "kernel" (-1 if there's no such route)
+func (host *Host) findRoute(route networkControl.Route) int {
+	for idx, curRoute := range host.kernel.Routes {
+		if curRoute.KeyStringValue() == route.KeyStringValue() {
+			return idx
+		}
+	}
+	return -1
+}
+
+func (host *Host) addRoute(route networkControl.Route) error {
+	err := host.checkFailure(OPERATION_ADD, "Routes", route.KeyStringValue())
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	if host.findRoute(route) >= 0 {
+		host.LogError(errAlreadyExists, route)
+		return errAlreadyExists
+	}
+	route.Ownership = networkControl.OWNERSHIP_MANAGED
+	host.kernel.Routes = append(host.kernel.Routes, copyRoute(route))
+	return nil
+}
+
+func (host *Host) updateRoute(route networkControl.Route) error {
+	err := host.checkFailure(OPERATION_UPDATE, "Routes", route.KeyStringValue())
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	idx := host.findRoute(route)
+	if idx < 0 {
+		host.LogError(errNotFound, route)
+		return errNotFound
+	}
+	route.Ownership = networkControl.OWNERSHIP_MANAGED
+	host.kernel.Routes[idx] = copyRoute(route)
+	return nil
+}
+
+func (host *Host) removeRoute(route networkControl.Route) error {
+	err := host.checkFailure(OPERATION_REMOVE, "Routes", route.KeyStringValue())
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	idx := host.findRoute(route)
+	if idx < 0 {
+		host.LogError(errNotFound, route)
+		return errNotFound
+	}
+	host.kernel.Routes = append(host.kernel.Routes[:idx], host.kernel.Routes[idx+1:]...)
+	return nil
+}
+
+// ApplyDiff applies the diff in the order of linuxHost; on an error the "kernel" is restored and, if
+// the firewall supports batches, its changes are rolled back
+func (host *Host) ApplyDiff(stateDiff networkControl.StateDiff) error {
+	host.locker.Lock()
+	snapshot := copyObjects(host.kernel)
+	host.locker.Unlock()
+	restoreKernel := func() {
+		host.locker.Lock()
+		host.kernel = snapshot
+		host.locker.Unlock()
+	}
+
+	batchFirewall, ok := host.GetFirewall().(networkControl.BatchFirewallI)
+	if !ok {
+		err := host.applyDiff(stateDiff)
+		if err != nil {
+			restoreKernel()
+		}
+		return err
+	}
+
+	if err := batchFirewall.BeginBatch(); err != nil {
+		host.LogError(err)
+		return err
+	}
+	if err := host.applyDiff(stateDiff); err != nil {
+		restoreKernel()
+		if rollbackErr := batchFirewall.RollbackBatch(); rollbackErr != nil {
+			host.LogError(rollbackErr)
+		}
+		return err
+	}
+	if err := batchFirewall.CommitBatch(); err != nil {
+		host.LogError(err)
+		restoreKernel()
+		return err
+	}
+	return nil
+}
+
+func (host *Host) applyDiff(stateDiff networkControl.StateDiff) error {
+	firewall := host.GetFirewall()
+
+	if err := firewall.SetEnablePermitInterInterface(stateDiff.Updated.PermitInterInterface); err != nil {
+		return err
+	}
+	if err := firewall.SetEnablePermitIntraInterface(stateDiff.Updated.PermitIntraInterface); err != nil {
+		return err
+	}
+
+	// Adding
+
+	for _, vlan := range stateDiff.Added.BridgedVLANs {
+		if err := host.addVLAN(*vlan); err != nil {
+			return err
+		}
+	}
+	for _, acl := range stateDiff.Added.ACLs {
+		if err := firewall.AddACL(*acl); err != nil {
+			return err
+		}
+	}
+	for _, snat := range stateDiff.Added.SNATs {
+		if err := firewall.AddSNAT(*snat); err != nil {
+			return err
+		}
+	}
+	for _, dnat := range stateDiff.Added.DNATs {
+		if err := firewall.AddDNAT(*dnat); err != nil {
+			return err
+		}
+	}
+	for _, route := range stateDiff.Added.Routes {
+		if err := host.addRoute(*route); err != nil {
+			return err
+		}
+	}
+
+	// Updating
+
+	for _, vlan := range stateDiff.Updated.BridgedVLANs {
+		if err := host.updateVLAN(*vlan); err != nil {
+			return err
+		}
+	}
+	for _, acl := range stateDiff.Updated.ACLs {
+		if err := firewall.UpdateACL(*acl); err != nil {
+			return err
+		}
+	}
+	for _, snat := range stateDiff.Updated.SNATs {
+		if err := firewall.UpdateSNAT(*snat); err != nil {
+			return err
+		}
+	}
+	for _, dnat := range stateDiff.Updated.DNATs {
+		if err := firewall.UpdateDNAT(*dnat); err != nil {
+			return err
+		}
+	}
+	for _, route := range stateDiff.Updated.Routes {
+		if err := host.updateRoute(*route); err != nil {
+			return err
+		}
+	}
+
+	host.locker.Lock()
+	host.kernel.DHCP = stateDiff.Updated.DHCP
+	host.locker.Unlock()
+
+	// Removing
+
+	for _, vlan := range stateDiff.Removed.BridgedVLANs {
+		if err := host.removeVLAN(*vlan); err != nil {
+			return err
+		}
+	}
+	for _, acl := range stateDiff.Removed.ACLs {
+		if err := firewall.RemoveACL(*acl); err != nil {
+			return err
+		}
+	}
+	for _, snat := range stateDiff.Removed.SNATs {
+		if err := firewall.RemoveSNAT(*snat); err != nil {
+			return err
+		}
+	}
+	for _, dnat := range stateDiff.Removed.DNATs {
+		if err := firewall.RemoveDNAT(*dnat); err != nil {
+			return err
+		}
+	}
+	for _, route := range stateDiff.Removed.Routes {
+		if err := host.removeRoute(*route); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (host *Host) RescanState() error {
+	err := host.checkFailure(OPERATION_RESCAN, "", "")
+	if err != nil {
+		return err
+	}
+
+	oldIgnoredState := networkControl.State{}
+	oldIgnoredState.CopyIgnoredFrom(host.States.Cur)
+
+	kernel := host.Kernel()
+	firewall := host.GetFirewall()
+	for _, vlan := range kernel.BridgedVLANs {
+		vlan.SecurityLevel = firewall.InquireSecurityLevel(host.IfNameToHostIfName(vlan.Name))
+	}
+	host.States.Cur = networkControl.State{
+		PermitInterInterface: firewall.InquirePermitInterInterface(),
+		PermitIntraInterface: firewall.InquirePermitIntraInterface(),
+		DHCP:                 kernel.DHCP,
+		BridgedVLANs:         kernel.BridgedVLANs,
+		ACLs:                 firewall.InquireACLs(),
+		SNATs:                firewall.InquireSNATs(),
+		DNATs:                firewall.InquireDNATs(),
+		Routes:               kernel.Routes,
+	}
+
+	host.States.Cur.CopyIgnoredFrom(oldIgnoredState)
+	host.TagOwnership()
+	return nil
+}
+
+// SaveToDisk saves the current state and the registry of managed objects to the in-memory "disk"
+func (host *Host) SaveToDisk() error {
+	err := host.checkFailure(OPERATION_SAVE, "", "")
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	disk := copyObjects(host.States.Cur)
+	host.disk = &disk
+	host.diskManaged = copyManagedObjects(host.Managed)
+	return nil
+}
+
+// SaveManagedObjects saves the registry of managed objects to the in-memory "disk"
+func (host *Host) SaveManagedObjects() error {
+	err := host.checkFailure(OPERATION_SAVE, "", "")
+	if err != nil {
+		return err
+	}
+	host.locker.Lock()
+	defer host.locker.Unlock()
+	host.diskManaged = copyManagedObjects(host.Managed)
+	return nil
+}
+
+func copyManagedObjects(managed networkControl.ManagedObjects) networkControl.ManagedObjects {
+	result := networkControl.ManagedObjects{}
+	for kind, keys := range managed {
+		for key := range keys {
+			result.Add(kind, key)
+		}
+	}
+	return result
+}
+
+// RestoreFromDisk applies the state saved by SaveToDisk() (if any)
+func (host *Host) RestoreFromDisk() error {
+	err := host.checkFailure(OPERATION_RESTORE, "", "")
+	if err != nil {
+		return err
+	}
+	err = host.RescanState()
+	if err != nil {
+		return err
+	}
+	disk, ok := host.Disk()
+	if !ok {
+		return nil
+	}
+	host.locker.Lock()
+	if host.diskManaged != nil {
+		host.Managed = copyManagedObjects(host.diskManaged)
+	}
+	host.locker.Unlock()
+	host.States.New = disk
+	return host.Apply()
+}
+
+// Teardown removes the objects of the "kernel" (and clears the "disk")
+func (host *Host) Teardown(options networkControl.TeardownOptions) (networkControl.TeardownItems, error) {
+	err := host.RescanState()
+	if err != nil {
+		return nil, err
+	}
+
+	emptyState := newState()
+	if options.KeepForeign {
+		emptyState.CopyUnmanagedFrom(host.States.Cur)
+	}
+	stateDiff := emptyState.Diff(host.States.Cur)
+	var result networkControl.TeardownItems
+	for _, vlan := range stateDiff.Removed.BridgedVLANs {
+		result = append(result, networkControl.TeardownItem{Kind: "vlan", Name: vlan.Name})
+	}
+	for _, acl := range stateDiff.Removed.ACLs {
+		result = append(result, networkControl.TeardownItem{Kind: "acl", Name: acl.Name})
+	}
+	for _, snat := range stateDiff.Removed.SNATs {
+		result = append(result, networkControl.TeardownItem{Kind: "snat", Name: snat.KeyStringValue()})
+	}
+	for _, dnat := range stateDiff.Removed.DNATs {
+		result = append(result, networkControl.TeardownItem{Kind: "dnat", Name: dnat.KeyStringValue()})
+	}
+	for _, route := range stateDiff.Removed.Routes {
+		result = append(result, networkControl.TeardownItem{Kind: "route", Name: route.KeyStringValue()})
+	}
+	if options.DryRun {
+		return result, nil
+	}
+
+	// not by Apply(): it would keep ignored VLANs
+	stateDiff.Updated.PermitInterInterface = host.States.Cur.PermitInterInterface
+	stateDiff.Updated.PermitIntraInterface = host.States.Cur.PermitIntraInterface
+	err = host.ApplyDiff(stateDiff)
+	if err != nil {
+		return result, err
+	}
+	host.locker.Lock()
+	host.disk = nil
+	host.diskManaged = nil
+	host.locker.Unlock()
+	if !options.KeepForeign {
+		host.States.Cur = networkControl.State{}
+	}
+	return result, host.RescanState()
+}
@@ -0,0 +1,332 @@
+package memoryHost
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/xaionaro-go/networkControl"
+)
+
+func newTestACL(name string, vlanNames ...string) *networkControl.ACL {
+	return &networkControl.ACL{Name: name, VLANNames: vlanNames}
+}
+
+func newTestRoute(t *testing.T, destination string) *networkControl.Route {
+	ipnet, err := networkControl.IPNetFromCIDRString(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &networkControl.Route{Destination: ipnet, IfName: "outside"}
+}
+
+func newTestVLAN(name string, vlanId int, securityLevel int) *networkControl.VLAN {
+	return &networkControl.VLAN{Interface: net.Interface{Name: name}, VlanId: vlanId, SecurityLevel: securityLevel}
+}
+
+func newTestState(t *testing.T) networkControl.State {
+	return networkControl.State{
+		BridgedVLANs: networkControl.VLANs{10: newTestVLAN("inside", 10, 100)},
+		ACLs:         networkControl.ACLs{newTestACL("inside_in", "inside")},
+		Routes:       networkControl.Routes{newTestRoute(t, "198.51.100.0/24")},
+	}
+}
+
+func newTestHost(t *testing.T) *Host {
+	host := NewHost()
+	err := host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host
+}
+
+// checkKernel compares the numbers of VLANs, ACLs and routes of the host with the expected ones
+func checkKernel(t *testing.T, host *Host, vlans, acls, routes int) {
+	t.Helper()
+	kernel := host.Kernel()
+	if len(kernel.BridgedVLANs) != vlans || len(host.GetFirewall().InquireACLs()) != acls || len(kernel.Routes) != routes {
+		t.Errorf("VLANs: %v, ACLs: %v, routes: %v; expected: %v, %v, %v",
+			len(kernel.BridgedVLANs), len(host.GetFirewall().InquireACLs()), len(kernel.Routes), vlans, acls, routes)
+	}
+}
+
+func TestManagedObjectsWithoutRegistry(t *testing.T) {
+	// the host is restarted: the objects are in the "kernel", but there's no saved registry
+
+	host := NewHost()
+	host.SetKernel(networkControl.State{
+		ACLs:   networkControl.ACLs{newTestACL("outside_in", "outside")},
+		Routes: networkControl.Routes{newTestRoute(t, "198.51.100.0/24")},
+	})
+	err := host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !host.Managed.Has("ACLs", "outside_in") || !host.Managed.Has("Routes", "198.51.100.0/24") {
+		t.Fatalf("the registry is not created from the current state: %v", host.Managed)
+	}
+
+	err = host.SetNewState(networkControl.State{ACLs: networkControl.ACLs{newTestACL("outside_in", "inside")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel := host.Kernel()
+	if len(kernel.Routes) != 0 {
+		t.Errorf("the route is not removed: %v", kernel.Routes)
+	}
+	acls := host.GetFirewall().InquireACLs()
+	if len(acls) != 1 || acls[0].VLANNames[0] != "inside" {
+		t.Errorf("the ACL is not updated: %v", acls)
+	}
+	if !host.diskManaged.Has("ACLs", "outside_in") || host.diskManaged.Has("Routes", "198.51.100.0/24") {
+		t.Errorf("the registry is not saved on Apply(): %v", host.diskManaged)
+	}
+}
+
+func TestApplyUnadopted(t *testing.T) {
+	host := NewHost()
+	err := host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.SetKernel(networkControl.State{ACLs: networkControl.ACLs{newTestACL("outside_in", "outside")}})
+	err = host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host.GetCurState().ACLs[0].Ownership != networkControl.OWNERSHIP_ADOPTABLE {
+		t.Fatalf("the foreign ACL is not adoptable: %v", host.GetCurState().ACLs[0])
+	}
+
+	// an unchanged foreign object is kept
+
+	err = host.SetNewState(networkControl.State{ACLs: networkControl.ACLs{newTestACL("outside_in", "outside")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a changed one is refused until it's adopted
+
+	newState := networkControl.State{ACLs: networkControl.ACLs{newTestACL("outside_in", "inside")}}
+	err = host.SetNewState(newState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Apply()
+	if err == nil || !strings.Contains(err.Error(), "adopted") {
+		t.Fatalf("an error is expected, got: %v", err)
+	}
+	if acls := host.GetFirewall().InquireACLs(); acls[0].VLANNames[0] != "outside" {
+		t.Errorf("the foreign ACL is changed: %v", acls)
+	}
+
+	err = host.Adopt(networkControl.State{ACLs: networkControl.ACLs{newTestACL("outside_in")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.SetNewState(newState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acls := host.GetFirewall().InquireACLs(); acls[0].VLANNames[0] != "inside" {
+		t.Errorf("the adopted ACL is not changed: %v", acls)
+	}
+}
+
+func TestApplyFailureRegistry(t *testing.T) {
+	host := NewHost()
+	err := host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host.InjectFailure(Failure{Operation: OPERATION_ADD, Kind: "Routes"})
+	err = host.SetNewState(networkControl.State{
+		ACLs:   networkControl.ACLs{newTestACL("outside_in", "outside")},
+		Routes: networkControl.Routes{newTestRoute(t, "198.51.100.0/24")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Apply()
+	if err == nil {
+		t.Fatalf("an error is expected")
+	}
+	if host.Managed.Has("ACLs", "outside_in") || host.diskManaged.Has("ACLs", "outside_in") {
+		t.Errorf("the registry is changed by a failed Apply(): %v %v", host.Managed, host.diskManaged)
+	}
+}
+
+func TestApplyFailureRollback(t *testing.T) {
+	for _, failure := range []Failure{
+		{Operation: OPERATION_ADD, Kind: "Routes", Times: 1},
+		{Operation: OPERATION_ADD, Kind: "ACLs", Times: 1},
+		{Operation: OPERATION_COMMIT, Times: 1},
+	} {
+		host := newTestHost(t)
+		host.InjectFailure(failure)
+		err := host.SetNewState(newTestState(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = host.Apply()
+		if err == nil {
+			t.Fatalf("%v %v: an error is expected", failure.Operation, failure.Kind)
+		}
+
+		// the VLAN is added before the failure, it's removed together with the changes of the firewall
+		checkKernel(t, host, 0, 0, 0)
+		if securityLevel := host.GetFirewall().InquireSecurityLevel("inside"); securityLevel != 0 {
+			t.Errorf("%v %v: the security level is left: %v", failure.Operation, failure.Kind, securityLevel)
+		}
+
+		// the failure happens once
+		err = host.SetNewState(newTestState(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = host.Apply()
+		if err != nil {
+			t.Fatalf("%v %v: %v", failure.Operation, failure.Kind, err)
+		}
+		checkKernel(t, host, 1, 1, 1)
+	}
+}
+
+func TestSaveRestoreDisk(t *testing.T) {
+	host := newTestHost(t)
+	err := host.SetNewState(newTestState(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host.InjectFailure(Failure{Operation: OPERATION_SAVE, Times: 1})
+	err = host.SaveToDisk()
+	if err == nil {
+		t.Fatalf("an error is expected")
+	}
+	if _, ok := host.Disk(); ok {
+		t.Errorf("the state is saved by a failed SaveToDisk()")
+	}
+	err = host.SaveToDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk, ok := host.Disk()
+	if !ok || len(disk.BridgedVLANs) != 1 || len(disk.ACLs) != 1 || len(disk.Routes) != 1 {
+		t.Fatalf("disk: %v %v", ok, disk)
+	}
+
+	// a reboot: the "kernel" is empty, the "disk" is kept
+
+	host.SetKernel(networkControl.State{})
+	err = host.RescanState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKernel(t, host, 0, 0, 0)
+
+	host.InjectFailure(Failure{Operation: OPERATION_RESTORE, Times: 1})
+	err = host.RestoreFromDisk()
+	if err == nil {
+		t.Fatalf("an error is expected")
+	}
+	checkKernel(t, host, 0, 0, 0)
+
+	err = host.RestoreFromDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKernel(t, host, 1, 1, 1)
+	if securityLevel := host.GetFirewall().InquireSecurityLevel("inside"); securityLevel != 100 {
+		t.Errorf("security level: %v", securityLevel)
+	}
+	if !host.Managed.Has("ACLs", "inside_in") {
+		t.Errorf("the registry is not restored: %v", host.Managed)
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	host := newTestHost(t)
+	err := host.SetNewState(newTestState(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.SaveToDisk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an ACL of other software
+	err = host.GetFirewall().AddACL(*newTestACL("foreign", "outside"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := host.Teardown(networkControl.TeardownOptions{DryRun: true, KeepForeign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedItems := networkControl.TeardownItems{
+		{Kind: "vlan", Name: "inside"},
+		{Kind: "acl", Name: "inside_in"},
+		{Kind: "route", Name: "198.51.100.0/24"},
+	}
+	if len(items) != len(expectedItems) {
+		t.Fatalf("items: %v", items)
+	}
+	for idx, item := range items {
+		if item.Kind != expectedItems[idx].Kind || item.Name != expectedItems[idx].Name {
+			t.Errorf("item #%v: %v, expected: %v", idx, item, expectedItems[idx])
+		}
+	}
+	checkKernel(t, host, 1, 2, 1)
+
+	host.InjectFailure(Failure{Operation: OPERATION_REMOVE, Kind: "Routes", Times: 1})
+	_, err = host.Teardown(networkControl.TeardownOptions{KeepForeign: true})
+	if err == nil {
+		t.Fatalf("an error is expected")
+	}
+	checkKernel(t, host, 1, 2, 1)
+	if _, ok := host.Disk(); !ok {
+		t.Errorf("the disk is cleared by a failed teardown")
+	}
+
+	_, err = host.Teardown(networkControl.TeardownOptions{KeepForeign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKernel(t, host, 0, 1, 0)
+	if acls := host.GetFirewall().InquireACLs(); acls[0].Name != "foreign" {
+		t.Errorf("ACLs: %v", acls)
+	}
+	if _, ok := host.Disk(); ok {
+		t.Errorf("the disk is not cleared")
+	}
+
+	_, err = host.Teardown(networkControl.TeardownOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKernel(t, host, 0, 0, 0)
+}
@@ -23,6 +23,8 @@ type SNAT struct {
 
 	// for FWSM config only:
 	FWSMGlobalId int
+
+	Ownership Ownership
 }
 
 type DNAT struct {
@@ -31,6 +33,8 @@ type DNAT struct {
 
 	// for FWSM config only?
 	IfName string
+
+	Ownership Ownership
 }
 
 type SNATs []*SNAT
@@ -108,3 +112,15 @@ func (snat SNAT) KeyStringValue() string {
 func (dnat DNAT) KeyStringValue() string {
 	return fmt.Sprintf("%v", dnat.Destinations.Sort())
 }
+func (snat SNAT) GetOwnership() Ownership {
+	return snat.Ownership
+}
+func (snat *SNAT) SetOwnership(ownership Ownership) {
+	snat.Ownership = ownership
+}
+func (dnat DNAT) GetOwnership() Ownership {
+	return dnat.Ownership
+}
+func (dnat *DNAT) SetOwnership(ownership Ownership) {
+	dnat.Ownership = ownership
+}
@@ -63,6 +63,115 @@ func (ipnet IPNet) Contains(ip net.IP) bool {
 	return (*net.IPNet)(&ipnet).Contains(ip)
 }
 
+// normalized returns the same network with IPv4 address and mask in 4-byte form (if it's an IPv4 network)
+func (ipnet IPNet) normalized() IPNet {
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		ipnet.IP = ip4
+		if len(ipnet.Mask) == net.IPv6len {
+			ipnet.Mask = ipnet.Mask[12:]
+		}
+	}
+	if len(ipnet.IP) == 0 {
+		ipnet.IP = net.IPv4zero.To4()
+		ipnet.Mask = net.IPv4Mask(0, 0, 0, 0)
+	}
+	return ipnet
+}
+
+// PrefixLen returns the amount of leading ones in the mask; an empty IPNet is considered as "0.0.0.0/0"
+func (ipnet IPNet) PrefixLen() int {
+	ones, _ := ipnet.normalized().Mask.Size()
+	return ones
+}
+
+// IsAny returns true if the network covers all addresses ("0.0.0.0/0")
+func (ipnet IPNet) IsAny() bool {
+	return ipnet.PrefixLen() == 0
+}
+
+// ContainsIPNet returns true if all addresses of "subnet" are in the network
+func (ipnet IPNet) ContainsIPNet(subnet IPNet) bool {
+	ipnet = ipnet.normalized()
+	subnet = subnet.normalized()
+	if len(ipnet.IP) != len(subnet.IP) {
+		return false
+	}
+	if ipnet.PrefixLen() > subnet.PrefixLen() {
+		return false
+	}
+	return ipnet.Contains(subnet.IP)
+}
+
+// Overlaps returns true if the networks have common addresses
+func (ipnet IPNet) Overlaps(compareTo IPNet) bool {
+	return ipnet.ContainsIPNet(compareTo) || compareTo.ContainsIPNet(ipnet)
+}
+
+func (portRange PortRange) ContainsPortRange(subRange PortRange) bool {
+	return portRange.Start <= subRange.Start && subRange.End <= portRange.End
+}
+
+func (portRange PortRange) Overlaps(compareTo PortRange) bool {
+	return portRange.Start <= compareTo.End && compareTo.Start <= portRange.End
+}
+
+// normalized returns sorted non-overlapping ranges covering the same ports; empty PortRanges are considered as "any port"
+func (portRanges PortRanges) normalized() (result PortRanges) {
+	if len(portRanges) == 0 {
+		return PortRanges{{Start: 0, End: 65535}}
+	}
+
+	sorted := append(PortRanges{}, portRanges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	for _, portRange := range sorted {
+		last := len(result) - 1
+		if last >= 0 && int(portRange.Start) <= int(result[last].End)+1 {
+			if portRange.End > result[last].End {
+				result[last].End = portRange.End
+			}
+			continue
+		}
+		result = append(result, portRange)
+	}
+	return
+}
+
+// IsAny returns true if the ranges cover all ports
+func (portRanges PortRanges) IsAny() bool {
+	normalized := portRanges.normalized()
+	return len(normalized) == 1 && normalized[0].Start == 0 && normalized[0].End == 65535
+}
+
+// ContainsPortRanges returns true if all ports of "subRanges" are in the ranges
+func (portRanges PortRanges) ContainsPortRanges(subRanges PortRanges) bool {
+	normalized := portRanges.normalized()
+	for _, subRange := range subRanges.normalized() {
+		isContained := false
+		for _, portRange := range normalized {
+			if portRange.ContainsPortRange(subRange) {
+				isContained = true
+				break
+			}
+		}
+		if !isContained {
+			return false
+		}
+	}
+	return true
+}
+
+// Overlaps returns true if the ranges have common ports
+func (portRanges PortRanges) Overlaps(compareTo PortRanges) bool {
+	for _, portRangeA := range portRanges.normalized() {
+		for _, portRangeB := range compareTo.normalized() {
+			if portRangeA.Overlaps(portRangeB) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (ips IPs) IsEqualTo(compareTo IPs) bool {
 	return handySlices.IsEqualCollections(ips, compareTo)
 }
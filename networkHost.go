@@ -58,6 +58,9 @@ type HostBase struct {
 	firewall FirewallI
 	States   States
 
+	// Managed is the registry of objects created (or adopted) by the library
+	Managed ManagedObjects
+
 	loggerDebug   *log.Logger
 	loggerInfo    *log.Logger
 	loggerWarning *log.Logger
@@ -151,9 +154,21 @@ func (host HostBase) GetVLAN(vlanId int) VLAN {
 }
 func (host *HostBase) Apply() error {
 	handySlices.Debugf = host.Debugf
-	host.States.New.CopyIgnoredFrom(host.States.Cur)
+	err := host.States.New.checkUnadoptedChanges(host.States.Cur)
+	if err != nil {
+		host.LogError(err)
+		return err
+	}
+	host.States.New.CopyUnmanagedFrom(host.States.Cur)
 	stateDiff := host.States.New.Diff(host.States.Cur)
 	err1 := host.parent.ApplyDiff(stateDiff)
+	if err1 == nil {
+		if host.Managed == nil {
+			host.Managed = ManagedObjects{}
+		}
+		host.Managed.ApplyDiff(stateDiff)
+		err1 = host.parent.SaveManagedObjects()
+	}
 	host.States.Cur = host.States.New
 	err2 := host.RescanState()
 	if err1 != nil {
@@ -190,6 +205,43 @@ func (host HostBase) GetCurState() State {
 	return host.States.Cur
 }
 
+// Adopt brings existing (ignored or adoptable) objects under management without recreating them.
+// The objects are looked up in the current state by their keys.
+func (host *HostBase) Adopt(objects State) error {
+	if host.Managed == nil {
+		host.Managed = ManagedObjects{}
+	}
+	for _, kind := range ownedObjectKinds {
+		for _, object := range objects.ownedObjects(kind) {
+			var curObject ownedObject
+			for _, candidate := range host.States.Cur.ownedObjects(kind) {
+				if candidate.KeyStringValue() == object.KeyStringValue() {
+					curObject = candidate
+					break
+				}
+			}
+			if curObject == nil {
+				host.LogError(errNotFound, kind, object.KeyStringValue())
+				return errNotFound
+			}
+			curObject.SetOwnership(OWNERSHIP_MANAGED)
+			host.Managed.Add(kind, curObject.KeyStringValue())
+		}
+	}
+	return host.parent.SaveManagedObjects()
+}
+
+// TagOwnership tags the objects of the current state by the registry of managed objects. If there's
+// no registry (it was never saved, e.g. on the first start after an upgrade) then it's created from
+// the current state: the objects found on the host are considered created by the library.
+func (host *HostBase) TagOwnership() {
+	if host.Managed == nil {
+		host.Managed = ManagedObjects{}
+		host.Managed.AddState(host.States.Cur)
+	}
+	host.States.Cur.TagOwnership(host.Managed)
+}
+
 type HostI interface {
 	AddBridgedVLAN(VLAN) error
 	RemoveBridgedVLAN(vlanId int) error
@@ -215,8 +267,17 @@ type HostI interface {
 	ApplyDiff(StateDiff) error
 	RescanState() error
 
+	// Teardown removes everything the library created on the host
+	Teardown(TeardownOptions) (TeardownItems, error)
+
 	GetCurState() State
 
+	// Adopt brings existing objects (found by their keys in the current state) under management
+	Adopt(objects State) error
+
+	// SaveManagedObjects saves the registry of managed objects (it's called on every successful Apply())
+	SaveManagedObjects() error
+
 	SetLoggerDebug(*log.Logger)
 	SetLoggerInfo(*log.Logger)
 	SetLoggerWarning(*log.Logger)
@@ -238,6 +299,8 @@ type FirewallI interface {
 	InquireACLs() ACLs
 	InquireSNATs() SNATs
 	InquireDNATs() DNATs
+	InquirePermitInterInterface() bool
+	InquirePermitIntraInterface() bool
 
 	AddACL(ACL) error
 	AddSNAT(SNAT) error
@@ -250,11 +313,26 @@ type FirewallI interface {
 	RemoveDNAT(DNAT) error
 
 	SetSecurityLevel(ifName string, securityLevel int) error
+	UnsetSecurityLevel(ifName string) error
 
 	SetEnablePermitInterInterface(bool) error
 	SetEnablePermitIntraInterface(bool) error
 }
 
+// BatchFirewallI is implemented by firewalls which can apply many changes at once: the changes made
+// after BeginBatch() are not visible to the traffic until CommitBatch() and are dropped by RollbackBatch()
+type BatchFirewallI interface {
+	BeginBatch() error
+	CommitBatch() error
+	RollbackBatch() error
+}
+
+// RescanFirewallI is implemented by firewalls which read their state from the kernel on every Inquire*()
+// call: Rescan() reads it once and returns the error the Inquire* methods cannot return
+type RescanFirewallI interface {
+	Rescan() error
+}
+
 type Hosts []HostI
 
 func (hosts Hosts) SetFirewall(newFirewall FirewallI) error {
@@ -481,6 +559,14 @@ func (firewalls Firewalls) InquireDNATs() DNATs {
 	panic(errNotImplemented)
 	return DNATs{}
 }
+func (firewalls Firewalls) InquirePermitInterInterface() bool {
+	panic(errNotImplemented)
+	return false
+}
+func (firewalls Firewalls) InquirePermitIntraInterface() bool {
+	panic(errNotImplemented)
+	return false
+}
 func (firewalls Firewalls) AddACL(acl ACL) error {
 	panic(errNotImplemented)
 	return nil
@@ -521,6 +607,10 @@ func (firewalls Firewalls) SetSecurityLevel(ifName string, securityLevel int) er
 	panic(errNotImplemented)
 	return nil
 }
+func (firewalls Firewalls) UnsetSecurityLevel(ifName string) error {
+	panic(errNotImplemented)
+	return nil
+}
 func (firewalls Firewalls) SetEnablePermitInterInterface(enable bool) error {
 	panic(errNotImplemented)
 	return nil
@@ -0,0 +1,204 @@
+package networkControl
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/xaionaro-go/handySlices"
+)
+
+// Ownership is the relation of an object of a State to the library
+type Ownership int
+
+const (
+	// OWNERSHIP_MANAGED objects are created and maintained by the library
+	OWNERSHIP_MANAGED = Ownership(0)
+
+	// OWNERSHIP_IGNORED objects are never changed by the library
+	OWNERSHIP_IGNORED = Ownership(1)
+
+	// OWNERSHIP_ADOPTABLE objects exist on the host but were not created by the library. They're
+	// not changed by the library until they're adopted (see HostI.Adopt()).
+	OWNERSHIP_ADOPTABLE = Ownership(2)
+)
+
+func (ownership Ownership) String() string {
+	switch ownership {
+	case OWNERSHIP_MANAGED:
+		return "managed"
+	case OWNERSHIP_IGNORED:
+		return "ignored"
+	case OWNERSHIP_ADOPTABLE:
+		return "adoptable"
+	}
+	return "unknown"
+}
+
+// ownedObject is implemented by (pointers to) objects of a State
+type ownedObject interface {
+	KeyStringValue() string
+	GetOwnership() Ownership
+	SetOwnership(Ownership)
+}
+
+// ownedObjectKinds are the names of the fields of State with owned objects
+var ownedObjectKinds = []string{"BridgedVLANs", "ACLs", "SNATs", "DNATs", "Routes"}
+
+// ownedObjects returns the objects of the field "kind" of the state
+func (state State) ownedObjects(kind string) (result []ownedObject) {
+	field := reflect.ValueOf(state).FieldByName(kind)
+	var values []reflect.Value
+	switch field.Kind() {
+	case reflect.Map:
+		for _, key := range field.MapKeys() {
+			values = append(values, field.MapIndex(key))
+		}
+	case reflect.Slice:
+		for i := 0; i < field.Len(); i++ {
+			values = append(values, field.Index(i))
+		}
+	}
+	for _, value := range values {
+		if value.IsNil() {
+			continue
+		}
+		result = append(result, value.Interface().(ownedObject))
+	}
+	return
+}
+
+// ManagedObjects is the registry of objects managed by the library:
+// kind (the name of the field of State: "BridgedVLANs", "ACLs", ...) -> KeyStringValue() of the object.
+//
+// A nil registry means that nothing is managed: the objects found on the host are adoptable until they're
+// adopted (see HostI.Adopt()) or created by the library. A host without a saved registry creates it from
+// its current state (see HostBase.TagOwnership()).
+type ManagedObjects map[string]map[string]bool
+
+func (managed ManagedObjects) Add(kind, key string) {
+	if managed[kind] == nil {
+		managed[kind] = map[string]bool{}
+	}
+	managed[kind][key] = true
+}
+func (managed ManagedObjects) Remove(kind, key string) {
+	delete(managed[kind], key)
+}
+func (managed ManagedObjects) Has(kind, key string) bool {
+	return managed[kind][key]
+}
+
+// AddState adds the managed objects of the state to the registry
+func (managed ManagedObjects) AddState(state State) {
+	for _, kind := range ownedObjectKinds {
+		for _, object := range state.ownedObjects(kind) {
+			if object.GetOwnership() != OWNERSHIP_MANAGED {
+				continue
+			}
+			managed.Add(kind, object.KeyStringValue())
+		}
+	}
+}
+
+// ApplyDiff registers objects added by the diff and unregisters removed ones (updated objects are
+// managed already: objects the library doesn't manage are not changed)
+func (managed ManagedObjects) ApplyDiff(diff StateDiff) {
+	managed.AddState(diff.Added)
+	for _, kind := range ownedObjectKinds {
+		for _, object := range diff.Removed.ownedObjects(kind) {
+			managed.Remove(kind, object.KeyStringValue())
+		}
+	}
+}
+
+// TagOwnership marks managed objects of the state which are not in the registry as adoptable
+func (state *State) TagOwnership(managed ManagedObjects) {
+	for _, kind := range ownedObjectKinds {
+		for _, object := range state.ownedObjects(kind) {
+			if object.GetOwnership() != OWNERSHIP_MANAGED || managed.Has(kind, object.KeyStringValue()) {
+				continue
+			}
+			object.SetOwnership(OWNERSHIP_ADOPTABLE)
+		}
+	}
+}
+
+// copyOwnedFrom copies objects with ownership "isCopied" from "source" (objects with the same keys are replaced)
+func (state *State) copyOwnedFrom(source State, isCopied func(Ownership) bool) {
+	if state.BridgedVLANs == nil {
+		state.BridgedVLANs = VLANs{}
+	}
+	for k, v := range source.BridgedVLANs {
+		if v == nil || !isCopied(v.GetOwnership()) {
+			continue
+		}
+		state.BridgedVLANs[k] = v
+	}
+
+	stateV := reflect.ValueOf(state).Elem()
+	for _, kind := range ownedObjectKinds {
+		field := stateV.FieldByName(kind)
+		if field.Kind() != reflect.Slice {
+			continue
+		}
+		for _, object := range source.ownedObjects(kind) {
+			if !isCopied(object.GetOwnership()) {
+				continue
+			}
+			result := reflect.MakeSlice(field.Type(), 0, field.Len()+1)
+			for i := 0; i < field.Len(); i++ {
+				if !field.Index(i).IsNil() && field.Index(i).Interface().(ownedObject).KeyStringValue() == object.KeyStringValue() {
+					continue
+				}
+				result = reflect.Append(result, field.Index(i))
+			}
+			field.Set(reflect.Append(result, reflect.ValueOf(object)))
+		}
+	}
+}
+
+// isSameObject returns true if the objects are equal (the ownership is not compared)
+func isSameObject(object, compareTo ownedObject) bool {
+	ownership := object.GetOwnership()
+	object.SetOwnership(compareTo.GetOwnership())
+	defer object.SetOwnership(ownership)
+	if equaler, ok := object.(handySlices.IsEqualToIer); ok {
+		return equaler.IsEqualToI(compareTo.(handySlices.IsEqualToIer))
+	}
+	return reflect.DeepEqual(object, compareTo)
+}
+
+// checkUnadoptedChanges returns an error if the state changes an adoptable object of "cur" (such
+// changes would be dropped by CopyUnmanagedFrom())
+func (state State) checkUnadoptedChanges(cur State) error {
+	for _, kind := range ownedObjectKinds {
+		adoptable := map[string]ownedObject{}
+		for _, object := range cur.ownedObjects(kind) {
+			if object.GetOwnership() == OWNERSHIP_ADOPTABLE {
+				adoptable[object.KeyStringValue()] = object
+			}
+		}
+		for _, object := range state.ownedObjects(kind) {
+			curObject := adoptable[object.KeyStringValue()]
+			if curObject == nil || object.GetOwnership() == OWNERSHIP_IGNORED || isSameObject(object, curObject) {
+				continue
+			}
+			return fmt.Errorf("%v: %v %v", errNotAdopted, kind, object.KeyStringValue())
+		}
+	}
+	return nil
+}
+
+// CopyIgnoredFrom copies ignored objects from "source" (objects with the same keys are replaced)
+func (state *State) CopyIgnoredFrom(source State) {
+	state.copyOwnedFrom(source, func(ownership Ownership) bool {
+		return ownership == OWNERSHIP_IGNORED
+	})
+}
+
+// CopyUnmanagedFrom copies ignored and adoptable objects from "source" (objects with the same keys are replaced)
+func (state *State) CopyUnmanagedFrom(source State) {
+	state.copyOwnedFrom(source, func(ownership Ownership) bool {
+		return ownership != OWNERSHIP_MANAGED
+	})
+}
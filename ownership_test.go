@@ -0,0 +1,51 @@
+package networkControl
+
+import (
+	"testing"
+)
+
+func TestTagOwnership(t *testing.T) {
+	newState := func() State {
+		return State{
+			BridgedVLANs: VLANs{10: &VLAN{VlanId: 10}, 20: &VLAN{VlanId: 20, IsIgnored: true, Ownership: OWNERSHIP_IGNORED}},
+			ACLs:         ACLs{{Name: "inside_in"}, {Name: "outside_in"}},
+		}
+	}
+
+	// nothing is managed without a registry
+
+	state := newState()
+	state.TagOwnership(nil)
+	if state.BridgedVLANs[10].Ownership != OWNERSHIP_ADOPTABLE || state.ACLs[0].Ownership != OWNERSHIP_ADOPTABLE || state.ACLs[1].Ownership != OWNERSHIP_ADOPTABLE {
+		t.Errorf("objects are not adoptable: %v %v", state.BridgedVLANs[10], state.ACLs)
+	}
+	if state.BridgedVLANs[20].Ownership != OWNERSHIP_IGNORED {
+		t.Errorf("the ignored VLAN is retagged: %v", state.BridgedVLANs[20].Ownership)
+	}
+
+	managed := ManagedObjects{}
+	managed.Add("ACLs", "inside_in")
+	state = newState()
+	state.TagOwnership(managed)
+	if state.ACLs[0].Ownership != OWNERSHIP_MANAGED || state.ACLs[1].Ownership != OWNERSHIP_ADOPTABLE || state.BridgedVLANs[10].Ownership != OWNERSHIP_ADOPTABLE {
+		t.Errorf("ownership: %v %v", state.BridgedVLANs[10], state.ACLs)
+	}
+}
+
+func TestManagedObjectsApplyDiff(t *testing.T) {
+	managed := ManagedObjects{}
+	managed.Add("ACLs", "removed")
+	managed.ApplyDiff(StateDiff{
+		Added:   State{ACLs: ACLs{{Name: "added"}, {Name: "adoptable", Ownership: OWNERSHIP_ADOPTABLE}}},
+		Updated: State{ACLs: ACLs{{Name: "updated"}}},
+		Removed: State{ACLs: ACLs{{Name: "removed"}}},
+	})
+	for key, isManaged := range map[string]bool{"added": true, "adoptable": false, "updated": false, "removed": false} {
+		if managed.Has("ACLs", key) != isManaged {
+			t.Errorf("ACL %v: managed == %v", key, !isManaged)
+		}
+	}
+	if (ManagedObjects(nil)).Has("ACLs", "added") {
+		t.Errorf("an object is managed by a nil registry")
+	}
+}
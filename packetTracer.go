@@ -0,0 +1,326 @@
+package networkControl
+
+// A simulation of a packet passing through a State (like "packet-tracer" of Cisco ASA/FWSM). It works
+// on the model only, so it could be used to check a new State before applying it.
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+type TraceVerdict int
+
+const (
+	TRACE_ALLOW = TraceVerdict(1)
+	TRACE_DROP  = TraceVerdict(2)
+)
+
+func (verdict TraceVerdict) String() string {
+	switch verdict {
+	case TRACE_ALLOW:
+		return "ALLOW"
+	case TRACE_DROP:
+		return "DROP"
+	}
+	return "-"
+}
+
+type TracePhase int
+
+const (
+	TRACEPHASE_INPUT_INTERFACE = TracePhase(1)
+	TRACEPHASE_DNAT            = TracePhase(2)
+	TRACEPHASE_ROUTE           = TracePhase(3)
+	TRACEPHASE_ACL             = TracePhase(4)
+	TRACEPHASE_SECURITY_LEVEL  = TracePhase(5)
+	TRACEPHASE_SNAT            = TracePhase(6)
+)
+
+func (phase TracePhase) String() string {
+	switch phase {
+	case TRACEPHASE_INPUT_INTERFACE:
+		return "INPUT-INTERFACE"
+	case TRACEPHASE_DNAT:
+		return "DNAT"
+	case TRACEPHASE_ROUTE:
+		return "ROUTE-LOOKUP"
+	case TRACEPHASE_ACL:
+		return "ACCESS-LIST"
+	case TRACEPHASE_SECURITY_LEVEL:
+		return "SECURITY-LEVEL"
+	case TRACEPHASE_SNAT:
+		return "SNAT"
+	}
+	return "UNKNOWN"
+}
+
+// TracePacket is the first packet of a flow (rules with ACLFL_ESTABLISHED never match it)
+type TracePacket struct {
+	IfName          string
+	Protocol        Protocol
+	Source          net.IP
+	SourcePort      uint16
+	Destination     net.IP
+	DestinationPort uint16
+}
+
+func (packet TracePacket) String() string {
+	return fmt.Sprintf("%v %v:%v -> %v:%v (via %v)", packet.Protocol, packet.Source, packet.SourcePort, packet.Destination, packet.DestinationPort, packet.IfName)
+}
+
+// TraceStep is a check the packet passed through. Verdict is zero if the step didn't decide the packet's fate.
+type TraceStep struct {
+	Phase   TracePhase
+	Verdict TraceVerdict
+	Info    string
+}
+
+type TraceResult struct {
+	Verdict      TraceVerdict
+	EgressIfName string
+	Packet       TracePacket // the packet after NAT-ing
+	Steps        []TraceStep
+}
+
+func (result TraceResult) String() string {
+	var lines []string
+	for idx, step := range result.Steps {
+		lines = append(lines, fmt.Sprintf("Phase: %v\nType: %v\nResult: %v\nInfo: %v\n", idx+1, step.Phase, step.Verdict, step.Info))
+	}
+	lines = append(lines, fmt.Sprintf("Result:\noutput-interface: %v\npacket: %v\nAction: %v", result.EgressIfName, result.Packet, result.Verdict))
+	return strings.Join(lines, "\n")
+}
+
+func (result *TraceResult) addStep(phase TracePhase, verdict TraceVerdict, infoFmt string, args ...interface{}) {
+	result.Steps = append(result.Steps, TraceStep{Phase: phase, Verdict: verdict, Info: fmt.Sprintf(infoFmt, args...)})
+	if verdict != 0 {
+		result.Verdict = verdict
+	}
+}
+
+func isPortInRanges(port uint16, portRanges PortRanges) bool {
+	for _, portRange := range portRanges.normalized() {
+		if portRange.Start <= port && port <= portRange.End {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMatching returns true if the rule matches the packet
+func (rule ACLRule) IsMatching(packet TracePacket) bool {
+	if rule.Protocol != PROTO_IP && rule.Protocol != packet.Protocol {
+		return false
+	}
+	if rule.Flags&ACLFL_ESTABLISHED != 0 {
+		return false
+	}
+	if !rule.FromNet.normalized().Contains(packet.Source) || !rule.ToNet.normalized().Contains(packet.Destination) {
+		return false
+	}
+	if !isPortInRanges(packet.SourcePort, rule.FromPortRanges) || !isPortInRanges(packet.DestinationPort, rule.ToPortRanges) {
+		return false
+	}
+	return true
+}
+
+func (ipport IPPort) isMatching(protocol Protocol, ip net.IP, port uint16) bool {
+	if !ipport.IP.Equal(ip) {
+		return false
+	}
+	if ipport.Protocol != nil && *ipport.Protocol != PROTO_IP && *ipport.Protocol != protocol {
+		return false
+	}
+	if ipport.Port != nil && *ipport.Port != port {
+		return false
+	}
+	return true
+}
+
+func (state State) getVLANByName(ifName string) *VLAN {
+	for _, vlan := range state.BridgedVLANs {
+		if vlan != nil && vlan.Name == ifName {
+			return vlan
+		}
+	}
+	return nil
+}
+
+// traceRoute returns the egress interface for the destination: the longest prefix wins, directly connected networks win over routes with the same prefix
+func (state State) traceRoute(destination net.IP) (ifName string, info string) {
+	bestPrefixLen := -1
+	for _, vlan := range state.BridgedVLANs {
+		if vlan == nil {
+			continue
+		}
+		for _, ip := range vlan.IPs {
+			subnet := IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask}.normalized()
+			if !subnet.Contains(destination) || subnet.PrefixLen() <= bestPrefixLen {
+				continue
+			}
+			bestPrefixLen = subnet.PrefixLen()
+			ifName = vlan.Name
+			info = fmt.Sprintf("%v is directly connected to %v", subnet, vlan.Name)
+		}
+	}
+	var bestRoute *Route
+	for _, route := range state.Routes {
+		destinationNet := route.Destination.normalized()
+		if !destinationNet.Contains(destination) || destinationNet.PrefixLen() < bestPrefixLen {
+			continue
+		}
+		if destinationNet.PrefixLen() == bestPrefixLen && (bestRoute == nil || route.Metric >= bestRoute.Metric) {
+			continue
+		}
+		bestPrefixLen = destinationNet.PrefixLen()
+		bestRoute = route
+	}
+	if bestRoute != nil {
+		ifName = bestRoute.IfName
+		info = fmt.Sprintf("route to %v via %v (metric %v) on %v", bestRoute.Destination, bestRoute.Gateway, bestRoute.Metric, bestRoute.IfName)
+	}
+	return
+}
+
+// GetRouteIfName returns the name of the interface the packets to the IP are routed through (or "" if there's no route)
+func (state State) GetRouteIfName(ip net.IP) string {
+	ifName, _ := state.traceRoute(ip)
+	return ifName
+}
+
+// traceACLs checks the packet against ACLs bound to the interface as one first-match list (the same
+// way the firewalls do, see ACL.Priority); verdict is zero if no rule matched. An "allow" of an
+// outgoing ACL doesn't decide the packet's fate: it only skips the rest of outgoing ACLs.
+func (state State) traceACLs(result *TraceResult, packet TracePacket, ifName string, direction ACLDirection) TraceVerdict {
+	for _, acl := range state.ACLs.GetBoundTo(ifName, direction) {
+		for idx, rule := range acl.Rules {
+			if !rule.IsMatching(packet) {
+				continue
+			}
+			if rule.Action == ACL_ALLOW && direction == ACLDIR_OUT {
+				result.addStep(TRACEPHASE_ACL, 0, "access-group %v %v interface %v: rule #%v matched: %v (the rest of outgoing ACLs are skipped)", acl.Name, direction, ifName, idx, rule.Action)
+				return TRACE_ALLOW
+			}
+			verdict := TRACE_DROP
+			if rule.Action == ACL_ALLOW {
+				verdict = TRACE_ALLOW
+			}
+			result.addStep(TRACEPHASE_ACL, verdict, "access-group %v %v interface %v: rule #%v matched: %v", acl.Name, direction, ifName, idx, rule.Action)
+			return verdict
+		}
+		result.addStep(TRACEPHASE_ACL, 0, "access-group %v %v interface %v: no rule matched", acl.Name, direction, ifName)
+	}
+	return 0
+}
+
+// Trace simulates passing of the packet through the State:
+// DNAT, route lookup, ACLs (outgoing ones first, see ACL.Priority), security levels and SNAT.
+func (state State) Trace(packet TracePacket) (result TraceResult) {
+	result.Packet = packet
+
+	ingressVLAN := state.getVLANByName(packet.IfName)
+	if ingressVLAN == nil {
+		result.addStep(TRACEPHASE_INPUT_INTERFACE, TRACE_DROP, "unknown interface %v", packet.IfName)
+		return
+	}
+	result.addStep(TRACEPHASE_INPUT_INTERFACE, 0, "interface %v (vlan %v), security-level %v", ingressVLAN.Name, ingressVLAN.VlanId, ingressVLAN.SecurityLevel)
+
+	// DNAT
+
+	isDNATed := false
+	for _, dnat := range state.DNATs {
+		for _, destination := range dnat.Destinations {
+			if !destination.isMatching(packet.Protocol, packet.Destination, packet.DestinationPort) {
+				continue
+			}
+			result.Packet.Destination = dnat.NATTo.IP
+			if dnat.NATTo.Port != nil {
+				result.Packet.DestinationPort = *dnat.NATTo.Port
+			}
+			isDNATed = true
+			result.addStep(TRACEPHASE_DNAT, 0, "%v is translated to %v", destination, dnat.NATTo)
+			break
+		}
+		if isDNATed {
+			break
+		}
+	}
+	if !isDNATed {
+		result.addStep(TRACEPHASE_DNAT, 0, "no translation")
+	}
+
+	// Route lookup
+
+	egressIfName, routeInfo := state.traceRoute(result.Packet.Destination)
+	if egressIfName == "" {
+		result.addStep(TRACEPHASE_ROUTE, TRACE_DROP, "no route to %v", result.Packet.Destination)
+		return
+	}
+	result.EgressIfName = egressIfName
+	result.addStep(TRACEPHASE_ROUTE, 0, "%v", routeInfo)
+
+	// ACLs
+
+	switch state.traceACLs(&result, result.Packet, egressIfName, ACLDIR_OUT) {
+	case TRACE_DROP:
+		return
+	}
+
+	isAllowed := false
+	if isDNATed {
+		result.addStep(TRACEPHASE_ACL, TRACE_ALLOW, "the destination is a target of a static (DNAT)")
+		isAllowed = true
+	}
+
+	if !isAllowed {
+		switch state.traceACLs(&result, result.Packet, ingressVLAN.Name, ACLDIR_IN) {
+		case TRACE_DROP:
+			return
+		case TRACE_ALLOW:
+			isAllowed = true
+		}
+	}
+
+	// Security levels
+
+	if !isAllowed {
+		egressVLAN := state.getVLANByName(egressIfName)
+		switch {
+		case egressVLAN == nil:
+			result.addStep(TRACEPHASE_SECURITY_LEVEL, TRACE_DROP, "unknown egress interface %v", egressIfName)
+		case ingressVLAN.Name == egressVLAN.Name && !state.PermitIntraInterface:
+			result.addStep(TRACEPHASE_SECURITY_LEVEL, TRACE_DROP, "intra-interface traffic on %v is not permitted", egressVLAN.Name)
+		case ingressVLAN.Name == egressVLAN.Name:
+			result.addStep(TRACEPHASE_SECURITY_LEVEL, TRACE_ALLOW, "intra-interface traffic on %v is permitted", egressVLAN.Name)
+		case ingressVLAN.SecurityLevel > egressVLAN.SecurityLevel:
+			result.addStep(TRACEPHASE_SECURITY_LEVEL, TRACE_ALLOW, "security-level %v (%v) > %v (%v)", ingressVLAN.SecurityLevel, ingressVLAN.Name, egressVLAN.SecurityLevel, egressVLAN.Name)
+		case ingressVLAN.SecurityLevel == egressVLAN.SecurityLevel && state.PermitInterInterface:
+			result.addStep(TRACEPHASE_SECURITY_LEVEL, TRACE_ALLOW, "security-level %v (%v) == %v (%v) and inter-interface traffic is permitted", ingressVLAN.SecurityLevel, ingressVLAN.Name, egressVLAN.SecurityLevel, egressVLAN.Name)
+		default:
+			result.addStep(TRACEPHASE_SECURITY_LEVEL, TRACE_DROP, "security-level %v (%v) -> %v (%v) is not permitted", ingressVLAN.SecurityLevel, ingressVLAN.Name, egressVLAN.SecurityLevel, egressVLAN.Name)
+		}
+		if result.Verdict == TRACE_DROP {
+			return
+		}
+	}
+
+	// SNAT
+
+	for _, snat := range state.SNATs {
+		for _, source := range snat.Sources {
+			if source.IfName != "" && source.IfName != ingressVLAN.Name {
+				continue
+			}
+			if !source.IPNet.normalized().Contains(result.Packet.Source) {
+				continue
+			}
+			result.Packet.Source = snat.NATTo
+			result.addStep(TRACEPHASE_SNAT, 0, "%v is translated to %v", source, snat.NATTo)
+			return
+		}
+	}
+	result.addStep(TRACEPHASE_SNAT, 0, "no translation")
+
+	return
+}
@@ -0,0 +1,159 @@
+package networkControl
+
+import (
+	"net"
+	"testing"
+)
+
+func mustParseIPNet(t *testing.T, s string) IPNet {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipnet.IP = ip
+	return IPNet(*ipnet)
+}
+
+func newTraceTestState(t *testing.T) State {
+	proto := PROTO_TCP
+	port := uint16(25)
+
+	newVLAN := func(name string, vlanId int, securityLevel int, ip string) *VLAN {
+		return &VLAN{Interface: net.Interface{Name: name}, VlanId: vlanId, SecurityLevel: securityLevel, IPs: IPNets{mustParseIPNet(t, ip)}}
+	}
+	subnet := func(s string) IPNet {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return IPNet(*ipnet)
+	}
+
+	return State{
+		BridgedVLANs: VLANs{
+			10: newVLAN("inside", 10, 100, "10.0.0.1/24"),
+			20: newVLAN("dmz", 20, 50, "10.0.1.1/24"),
+			30: newVLAN("outside", 30, 0, "192.0.2.1/24"),
+		},
+		ACLs: ACLs{
+			{
+				Name:         "dmz-web",
+				Priority:     1,
+				OutVLANNames: []string{"dmz"},
+				Rules: ACLRules{
+					{Action: ACL_ALLOW, Protocol: PROTO_TCP, ToNet: subnet("10.0.1.10/32"), ToPortRanges: PortRanges{{80, 80}}},
+				},
+			},
+			{
+				Name:         "dmz-ssh",
+				Priority:     2,
+				OutVLANNames: []string{"dmz"},
+				Rules: ACLRules{
+					{Action: ACL_DENY, Protocol: PROTO_TCP, ToNet: subnet("10.0.1.0/24"), ToPortRanges: PortRanges{{22, 22}}},
+					{Action: ACL_DENY, Protocol: PROTO_TCP, ToNet: subnet("10.0.1.10/32"), ToPortRanges: PortRanges{{80, 80}}},
+				},
+			},
+			{
+				Name:      "outside-allow",
+				Priority:  2,
+				VLANNames: []string{"outside"},
+				Rules: ACLRules{
+					{Action: ACL_ALLOW, Protocol: PROTO_TCP, ToNet: subnet("10.0.1.10/32"), ToPortRanges: PortRanges{{443, 443}}},
+				},
+			},
+			{
+				Name:      "outside-block",
+				Priority:  1,
+				VLANNames: []string{"outside"},
+				Rules: ACLRules{
+					{Action: ACL_DENY, Protocol: PROTO_IP, FromNet: subnet("198.51.100.0/24")},
+				},
+			},
+		},
+		SNATs: SNATs{
+			{Sources: SNATSources{{IPNet: subnet("10.0.0.0/24")}}, NATTo: net.ParseIP("192.0.2.1")},
+		},
+		DNATs: DNATs{
+			{Destinations: IPPorts{{Protocol: &proto, IP: net.ParseIP("192.0.2.10"), Port: &port}}, NATTo: IPPort{IP: net.ParseIP("10.0.1.25")}},
+		},
+		Routes: Routes{
+			{Destination: subnet("0.0.0.0/0"), Gateway: net.ParseIP("192.0.2.254"), IfName: "outside"},
+		},
+	}
+}
+
+func TestStateTrace(t *testing.T) {
+	state := newTraceTestState(t)
+
+	tcp := func(ifName, source string, destination string, destinationPort uint16) TracePacket {
+		return TracePacket{IfName: ifName, Protocol: PROTO_TCP, Source: net.ParseIP(source), SourcePort: 40000, Destination: net.ParseIP(destination), DestinationPort: destinationPort}
+	}
+
+	for _, testCase := range []struct {
+		name          string
+		packet        TracePacket
+		verdict       TraceVerdict
+		egressIfName  string
+		source        string
+		destination   string
+		decidingPhase TracePhase
+		permitIntra   bool
+	}{
+		{"unknown interface", tcp("lan", "10.0.0.5", "10.0.1.10", 80), TRACE_DROP, "", "10.0.0.5", "10.0.1.10", TRACEPHASE_INPUT_INTERFACE, false},
+		{"higher to lower security level", tcp("inside", "10.0.0.5", "10.0.1.20", 8080), TRACE_ALLOW, "dmz", "192.0.2.1", "10.0.1.20", TRACEPHASE_SECURITY_LEVEL, false},
+		{"outgoing deny", tcp("inside", "10.0.0.5", "10.0.1.20", 22), TRACE_DROP, "dmz", "10.0.0.5", "10.0.1.20", TRACEPHASE_ACL, false},
+		{"outgoing allow skips the rest of outgoing ACLs", tcp("inside", "10.0.0.5", "10.0.1.10", 80), TRACE_ALLOW, "dmz", "192.0.2.1", "10.0.1.10", TRACEPHASE_SECURITY_LEVEL, false},
+		{"outgoing allow doesn't accept the packet", tcp("outside", "203.0.113.5", "10.0.1.10", 80), TRACE_DROP, "dmz", "203.0.113.5", "10.0.1.10", TRACEPHASE_SECURITY_LEVEL, false},
+		{"incoming allow overrides security levels", tcp("outside", "203.0.113.5", "10.0.1.10", 443), TRACE_ALLOW, "dmz", "203.0.113.5", "10.0.1.10", TRACEPHASE_ACL, false},
+		{"incoming ACLs are checked by priority", tcp("outside", "198.51.100.5", "10.0.1.10", 443), TRACE_DROP, "dmz", "198.51.100.5", "10.0.1.10", TRACEPHASE_ACL, false},
+		{"lower to higher security level", tcp("outside", "203.0.113.5", "10.0.0.5", 443), TRACE_DROP, "inside", "203.0.113.5", "10.0.0.5", TRACEPHASE_SECURITY_LEVEL, false},
+		{"DNAT", tcp("outside", "203.0.113.5", "192.0.2.10", 25), TRACE_ALLOW, "dmz", "203.0.113.5", "10.0.1.25", TRACEPHASE_ACL, false},
+		{"SNAT and default route", tcp("inside", "10.0.0.5", "8.8.8.8", 443), TRACE_ALLOW, "outside", "192.0.2.1", "8.8.8.8", TRACEPHASE_SECURITY_LEVEL, false},
+		{"intra-interface is not permitted", tcp("inside", "10.0.0.5", "10.0.0.6", 443), TRACE_DROP, "inside", "10.0.0.5", "10.0.0.6", TRACEPHASE_SECURITY_LEVEL, false},
+		{"intra-interface is permitted", tcp("inside", "10.0.0.5", "10.0.0.6", 443), TRACE_ALLOW, "inside", "192.0.2.1", "10.0.0.6", TRACEPHASE_SECURITY_LEVEL, true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			state.PermitIntraInterface = testCase.permitIntra
+			result := state.Trace(testCase.packet)
+			if result.Verdict != testCase.verdict {
+				t.Errorf("verdict: %v != %v\n%v", result.Verdict, testCase.verdict, result)
+			}
+			if result.EgressIfName != testCase.egressIfName {
+				t.Errorf("egress interface: %v != %v", result.EgressIfName, testCase.egressIfName)
+			}
+			if !result.Packet.Source.Equal(net.ParseIP(testCase.source)) || !result.Packet.Destination.Equal(net.ParseIP(testCase.destination)) {
+				t.Errorf("packet after NAT-ing: %v", result.Packet)
+			}
+			var decidingSteps []TraceStep
+			for _, step := range result.Steps {
+				if step.Verdict != 0 {
+					decidingSteps = append(decidingSteps, step)
+				}
+			}
+			if len(decidingSteps) != 1 || decidingSteps[0].Phase != testCase.decidingPhase {
+				t.Errorf("expected exactly one deciding step of phase %v, got: %v", testCase.decidingPhase, decidingSteps)
+			}
+		})
+	}
+}
+
+func TestStateTraceACLsFirstMatch(t *testing.T) {
+	state := newTraceTestState(t)
+	packet := TracePacket{IfName: "inside", Protocol: PROTO_TCP, Source: net.ParseIP("10.0.0.5"), Destination: net.ParseIP("10.0.1.10"), DestinationPort: 80}
+
+	var result TraceResult
+	verdict := state.traceACLs(&result, packet, "dmz", ACLDIR_OUT)
+	if verdict != TRACE_ALLOW {
+		t.Errorf("verdict: %v != %v", verdict, TRACE_ALLOW)
+	}
+	// "dmz-ssh" denies the packet too, but it's not reached
+	if len(result.Steps) != 1 || result.Steps[0].Verdict != 0 {
+		t.Errorf("expected one non-deciding step, got: %v", result.Steps)
+	}
+
+	result = TraceResult{}
+	verdict = state.traceACLs(&result, packet, "outside", ACLDIR_IN)
+	if verdict != 0 || len(result.Steps) != 2 {
+		t.Errorf("expected no match in two ACLs, got %v: %v", verdict, result.Steps)
+	}
+}
@@ -12,6 +12,7 @@ type Route struct {
 	Gateway     net.IP
 	Metric      int
 	IfName      string
+	Ownership   Ownership
 }
 
 type Routes []*Route
@@ -27,6 +28,12 @@ func (route Route) GetPos() string {
 func (route Route) KeyStringValue() string {
 	return route.Destination.String()
 }
+func (route Route) GetOwnership() Ownership {
+	return route.Ownership
+}
+func (route *Route) SetOwnership(ownership Ownership) {
+	route.Ownership = ownership
+}
 func (route Route) IsEqualToI(compareToI handySlices.IsEqualToIer) bool {
 	compareTo, ok := compareToI.(Route)
 	if !ok {
@@ -75,6 +75,72 @@ func (newState State) Diff(oldState State) (diff StateDiff) {
 	return
 }
 
+type keyStringValuer interface {
+	KeyStringValue() string
+}
+
+// patchSlice returns "slice" without "removed" elements, with "updated" elements replaced and "added" elements appended.
+// Elements are matched by KeyStringValue().
+func patchSlice(slice, added, updated, removed reflect.Value) reflect.Value {
+	getKey := func(value reflect.Value) string {
+		return value.Interface().(keyStringValuer).KeyStringValue()
+	}
+
+	isRemoved := map[string]bool{}
+	for i := 0; i < removed.Len(); i++ {
+		isRemoved[getKey(removed.Index(i))] = true
+	}
+	updatedMap := map[string]reflect.Value{}
+	for i := 0; i < updated.Len(); i++ {
+		updatedMap[getKey(updated.Index(i))] = updated.Index(i)
+	}
+
+	result := reflect.MakeSlice(slice.Type(), 0, slice.Len()+added.Len())
+	for i := 0; i < slice.Len(); i++ {
+		key := getKey(slice.Index(i))
+		if isRemoved[key] {
+			continue
+		}
+		if updatedItem, ok := updatedMap[key]; ok {
+			result = reflect.Append(result, updatedItem)
+			continue
+		}
+		result = reflect.Append(result, slice.Index(i))
+	}
+	for i := 0; i < added.Len(); i++ {
+		result = reflect.Append(result, added.Index(i))
+	}
+	return result
+}
+
+// Patch returns the state with the diff applied, so "newState.Diff(oldState)" could be converted back to "newState" by "oldState.Patch(diff)"
+func (oldState State) Patch(diff StateDiff) (newState State) {
+	oldStateV := reflect.ValueOf(oldState)
+	newStateV := reflect.ValueOf(&newState).Elem()
+	addedV := reflect.ValueOf(diff.Added)
+	updatedV := reflect.ValueOf(diff.Updated)
+	removedV := reflect.ValueOf(diff.Removed)
+
+	for i := 0; i < oldStateV.NumField(); i++ { // foreach all slice fields
+		switch oldStateV.Field(i).Kind() {
+		case reflect.Map:
+			slice := reflect.ValueOf(handySlices.MapToSlice(oldStateV.Field(i).Interface()))
+			added := reflect.ValueOf(handySlices.MapToSlice(addedV.Field(i).Interface()))
+			updated := reflect.ValueOf(handySlices.MapToSlice(updatedV.Field(i).Interface()))
+			removed := reflect.ValueOf(handySlices.MapToSlice(removedV.Field(i).Interface()))
+			newStateV.Field(i).Addr().Interface().(setSlicer).SetSliceI(patchSlice(slice, added, updated, removed).Interface())
+		case reflect.Slice:
+			newStateV.Field(i).Set(patchSlice(oldStateV.Field(i), addedV.Field(i), updatedV.Field(i), removedV.Field(i)))
+		}
+	}
+
+	newState.PermitInterInterface = diff.Updated.PermitInterInterface
+	newState.PermitIntraInterface = diff.Updated.PermitIntraInterface
+	newState.DHCP = diff.Updated.DHCP
+
+	return
+}
+
 func (state *State) AddBridgedVLAN(newVLAN VLAN) error {
 	if state.BridgedVLANs[newVLAN.Index] != nil {
 		return errAlreadyExists
@@ -100,17 +166,6 @@ func (state *State) RemoveBridgedVLAN(vlanId int) error {
 func (state State) GetVLAN(vlanId int) VLAN {
 	return state.BridgedVLANs.Get(vlanId)
 }
-func (state *State) CopyIgnoredFrom(source State) {
-	if state.BridgedVLANs == nil {
-		state.BridgedVLANs = VLANs{}
-	}
-	for k, v := range source.BridgedVLANs {
-		if !v.IsIgnored {
-			continue
-		}
-		state.BridgedVLANs[k] = v
-	}
-}
 
 type StateDiff struct {
 	Added   State
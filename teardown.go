@@ -0,0 +1,107 @@
+package networkControl
+
+import (
+	"fmt"
+)
+
+// TeardownOptions are options of HostI.Teardown()
+type TeardownOptions struct {
+	// DryRun makes Teardown() only list the objects to be removed
+	DryRun bool
+
+	// KeepForeign keeps the objects the library doesn't manage (ignored and adoptable ones)
+	KeepForeign bool
+}
+
+// TeardownItem is an object removed by HostI.Teardown() (or to be removed on a dry run)
+type TeardownItem struct {
+	Kind string // "iptables chain", "link", "route", "file", ...
+	Name string
+}
+
+func (item TeardownItem) String() string {
+	return fmt.Sprintf("%v %v", item.Kind, item.Name)
+}
+
+type TeardownItems []TeardownItem
+
+// TeardownFirewallI is implemented by firewalls which can remove everything they created on the host
+type TeardownFirewallI interface {
+	Teardown(TeardownOptions) (TeardownItems, error)
+}
+
+// TeardownManagedFirewallObjects removes only the managed ACLs and NATs of the state (in one batch if
+// the firewall supports batches). It's used by firewalls on Teardown() with KeepForeign: if the state has
+// ACLs or NATs the library doesn't manage then the chains (tables) of the firewall are kept for them.
+// isForeignFound is false if there're no such objects (so the firewall may be removed completely).
+func TeardownManagedFirewallObjects(fw FirewallI, state State, dryRun bool) (result TeardownItems, isForeignFound bool, err error) {
+	var acls ACLs
+	var snats SNATs
+	var dnats DNATs
+	for _, acl := range state.ACLs {
+		if acl.GetOwnership() != OWNERSHIP_MANAGED {
+			isForeignFound = true
+			continue
+		}
+		acls = append(acls, acl)
+		result = append(result, TeardownItem{Kind: "acl", Name: acl.Name})
+	}
+	for _, snat := range state.SNATs {
+		if snat.GetOwnership() != OWNERSHIP_MANAGED {
+			isForeignFound = true
+			continue
+		}
+		snats = append(snats, snat)
+		result = append(result, TeardownItem{Kind: "snat", Name: snat.KeyStringValue()})
+	}
+	for _, dnat := range state.DNATs {
+		if dnat.GetOwnership() != OWNERSHIP_MANAGED {
+			isForeignFound = true
+			continue
+		}
+		dnats = append(dnats, dnat)
+		result = append(result, TeardownItem{Kind: "dnat", Name: dnat.KeyStringValue()})
+	}
+	if !isForeignFound {
+		return nil, false, nil
+	}
+	if dryRun {
+		return
+	}
+
+	remove := func() error {
+		for _, acl := range acls {
+			if err := fw.RemoveACL(*acl); err != nil {
+				return err
+			}
+		}
+		for _, snat := range snats {
+			if err := fw.RemoveSNAT(*snat); err != nil {
+				return err
+			}
+		}
+		for _, dnat := range dnats {
+			if err := fw.RemoveDNAT(*dnat); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	batchFirewall, isBatch := fw.(BatchFirewallI)
+	if !isBatch {
+		err = remove()
+		return
+	}
+	err = batchFirewall.BeginBatch()
+	if err != nil {
+		return
+	}
+	err = remove()
+	if err != nil {
+		batchFirewall.RollbackBatch()
+		return
+	}
+	err = batchFirewall.CommitBatch()
+	return
+}
@@ -13,6 +13,7 @@ type VLAN struct {
 	IPs           IPNets
 	SecurityLevel int
 	IsIgnored     bool
+	Ownership     Ownership
 }
 
 func NewVLAN(iface net.Interface) *VLAN {
@@ -24,6 +25,15 @@ type VLANs map[int]*VLAN
 func (vlans VLANs) Get(vlanId int) VLAN {
 	return *vlans[vlanId]
 }
+func (vlans VLANs) ToSlice() (slice []*VLAN) {
+	for _, vlan := range vlans {
+		if vlan == nil {
+			continue
+		}
+		slice = append(slice, vlan)
+	}
+	return
+}
 func (vlans *VLANs) SetSliceI(sliceI interface{}) {
 	vlans.SetSlice(sliceI.([]*VLAN))
 }
@@ -37,6 +47,16 @@ func (vlans *VLANs) SetSlice(slice []*VLAN) {
 func (vlan VLAN) KeyStringValue() string {
 	return strconv.Itoa(vlan.VlanId)
 }
+func (vlan VLAN) GetOwnership() Ownership {
+	if vlan.IsIgnored {
+		return OWNERSHIP_IGNORED
+	}
+	return vlan.Ownership
+}
+func (vlan *VLAN) SetOwnership(ownership Ownership) {
+	vlan.Ownership = ownership
+	vlan.IsIgnored = ownership == OWNERSHIP_IGNORED
+}
 func (vlan VLAN) IsEqualToI(compareToI handySlices.IsEqualToIer) bool {
 	compareTo, ok := compareToI.(VLAN)
 	if !ok {